@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/deanbregenzer/cysl/internal/logging"
+)
+
+// BackoffConfig controls how the client retries failed connection attempts
+type BackoffConfig struct {
+	Initial       time.Duration // Delay before the first retry
+	Max           time.Duration // Upper bound for any single delay
+	Multiplier    float64       // Growth factor applied after each failure
+	Jitter        float64       // Random spread as fraction of the delay (0.2 = ±20%)
+	MaxAttempts   int           // Attempts before giving up (0 = retry forever)
+	MaxRetryAfter time.Duration // Cap for server-provided Retry-After delays
+}
+
+// DefaultBackoffConfig returns a backoff schedule suitable for reconnecting
+// to a busy server without hammering it
+func DefaultBackoffConfig() BackoffConfig {
+	return BackoffConfig{
+		Initial:       500 * time.Millisecond,
+		Max:           30 * time.Second,
+		Multiplier:    2,
+		Jitter:        0.2,
+		MaxAttempts:   10,
+		MaxRetryAfter: 5 * time.Minute,
+	}
+}
+
+// Delay returns the backoff delay for the given attempt (starting at 1),
+// including jitter
+func (b BackoffConfig) Delay(attempt int) time.Duration {
+	d := float64(b.Initial)
+	for i := 1; i < attempt; i++ {
+		d *= b.Multiplier
+		if d >= float64(b.Max) {
+			d = float64(b.Max)
+			break
+		}
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (rand.Float64()*2 - 1)
+	}
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	return time.Duration(d)
+}
+
+// ReconnectMetrics collects connection retry statistics
+type ReconnectMetrics struct {
+	Attempts             atomic.Int64 // Total dial attempts
+	Failures             atomic.Int64 // Failed dial attempts
+	ServerDirectedDelays atomic.Int64 // Retries delayed by a server Retry-After hint
+	ServerDirectedWaitMs atomic.Int64 // Total time spent waiting on server hints (ms)
+}
+
+// parseRetryAfter extracts a Retry-After delay from a rejected handshake.
+// Only 429 and 503 responses carry a meaningful hint. The header may be
+// either delta-seconds or an HTTP date (RFC 9110 section 10.2.3).
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0 // Date already passed - retry immediately
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// dialWithBackoff dials the server, retrying failures with exponential backoff.
+// A Retry-After hint from the server overrides the local backoff schedule for
+// that attempt. Returns the last error once MaxAttempts is exhausted.
+func dialWithBackoff(ctx context.Context, url string, opts *websocket.DialOptions,
+	cfg BackoffConfig, metrics *ReconnectMetrics) (*websocket.Conn, *http.Response, error) {
+	var lastErr error
+	var lastStatus int // HTTP status of the last rejected attempt
+	for attempt := 1; cfg.MaxAttempts == 0 || attempt <= cfg.MaxAttempts; attempt++ {
+		metrics.Attempts.Add(1)
+
+		dialCtx, dialCancel := context.WithTimeout(ctx, dialTimeout)
+		conn, resp, err := websocket.Dial(dialCtx, url, opts)
+		dialCancel()
+		if err == nil {
+			return conn, resp, nil
+		}
+
+		metrics.Failures.Add(1)
+		lastErr, lastStatus = err, 0
+		if resp != nil {
+			lastStatus = resp.StatusCode
+		}
+		if lastStatus == http.StatusUnauthorized || lastStatus == http.StatusForbidden {
+			// Credentials or policy won't change by retrying
+			return nil, resp, fmt.Errorf("%w: server refused connection (%s): %w", ErrAuthFailed, resp.Status, err)
+		}
+		if cfg.MaxAttempts != 0 && attempt == cfg.MaxAttempts {
+			break // No point waiting after the final attempt
+		}
+
+		// Prefer the server's instructions over our own schedule
+		delay := cfg.Delay(attempt)
+		if hint, ok := parseRetryAfter(resp); ok {
+			if cfg.MaxRetryAfter > 0 && hint > cfg.MaxRetryAfter {
+				hint = cfg.MaxRetryAfter
+			}
+			delay = hint
+			metrics.ServerDirectedDelays.Add(1)
+			metrics.ServerDirectedWaitMs.Add(hint.Milliseconds())
+			logging.FromContext(ctx).Warn("Dial attempt rejected, server asks to retry later",
+				"attempt", attempt, "status", resp.Status, "retry_in", delay)
+		} else {
+			logging.FromContext(ctx).Warn("Dial attempt failed", "attempt", attempt, "error", err, "retry_in", delay)
+		}
+		emitEvent(ctx, Reconnecting{Attempt: attempt + 1, Delay: delay, Err: err})
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	if lastStatus == http.StatusTooManyRequests {
+		// Still over the server's connection limit after all attempts
+		return nil, nil, fmt.Errorf("%w: giving up after %d attempts: %w", ErrRateLimited, cfg.MaxAttempts, lastErr)
+	}
+	return nil, nil, fmt.Errorf("giving up after %d attempts: %w", cfg.MaxAttempts, lastErr)
+}
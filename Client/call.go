@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// ReplyError is returned by Call when the server answered with a
+// MessageTypeError message.
+type ReplyError struct {
+	Code    string // e.g. "unsupported_type"
+	Message string
+}
+
+// Error implements the error interface.
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("server replied with error %s: %s", e.Code, e.Message)
+}
+
+// Call sends msg and waits for the server's reply to it - the message
+// whose ReplyTo is msg's ID - while pushes keep arriving on Receive. ctx
+// bounds the whole call; without a deadline, a server that never answers
+// blocks it until the client stops. A MessageTypeError reply is returned
+// along with a *ReplyError. Replies that arrive after their Call gave up
+// show up on Receive. For the circuit breaker, a call succeeds once its
+// reply arrives: a reply that doesn't come before ctx's deadline counts as
+// a failure, like a failed write. Calls need envelopes: raw text
+// connections (see WithProtocol) return ErrRawProtocol. A msg without a
+// TraceID gets a new one, which the reply and the server's log lines
+// about the call carry. Safe for concurrent use, as many calls as needed
+// can wait at once.
+func (c *Client) Call(ctx context.Context, msg Message) (Message, error) {
+	if c.rc.Protocol == ProtocolRaw {
+		return Message{}, ErrRawProtocol
+	}
+	if msg.ID == "" {
+		msg.ID = protocol.NewID()
+	}
+	if msg.TraceID == "" {
+		msg.TraceID = protocol.NewTraceID()
+	}
+	reply := make(chan Message, 1) // The reader never waits for the caller
+	c.mu.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]chan Message)
+	}
+	c.calls[msg.ID] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, msg.ID)
+		c.mu.Unlock()
+	}()
+
+	if err := c.send(ctx, msg, true); err != nil {
+		return Message{}, err
+	}
+	select {
+	case m := <-reply:
+		c.rc.Breaker.RecordSuccess() // Even an error reply shows the connection works
+		if m.Type == MessageTypeError {
+			var e MessageError
+			m.DecodePayload(&e)
+			return m, &ReplyError{Code: e.Code, Message: e.Message}
+		}
+		return m, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			c.rc.Breaker.RecordFailure()
+		} else {
+			c.rc.Breaker.abandon() // The caller gave up - that says nothing about the connection
+		}
+		return Message{}, ctx.Err()
+	case <-c.done:
+		return Message{}, ErrClosed
+	}
+}
+
+// answer hands m to the Call waiting for it. Returns false if m answers
+// no waiting call.
+func (c *Client) answer(m Message) bool {
+	if m.ReplyTo == "" {
+		return false
+	}
+	c.mu.Lock()
+	reply, ok := c.calls[m.ReplyTo]
+	delete(c.calls, m.ReplyTo) // A second reply goes to Receive
+	c.mu.Unlock()
+	if ok {
+		reply <- m
+	}
+	return ok
+}
@@ -0,0 +1,208 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// ErrCircuitOpen is returned by Send while the circuit breaker is open,
+// i.e. recent sends kept failing and the cool-down has not elapsed yet
+var ErrCircuitOpen = errors.New("circuit breaker open: connection degraded")
+
+// BreakerState is the state of a CircuitBreaker
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // Normal operation - sends pass through
+	BreakerOpen                         // Failing fast until the cool-down elapses
+	BreakerHalfOpen                     // Allowing a probe send to test recovery
+)
+
+// String returns a readable state name for logs
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+// CircuitBreakerConfig controls when the breaker trips and recovers
+type CircuitBreakerConfig struct {
+	FailureThreshold int           // Consecutive failures that open the circuit
+	CoolDown         time.Duration // Time to fail fast before probing again
+	HalfOpenProbes   int           // Successful probes required to close the circuit
+}
+
+// DefaultCircuitBreakerConfig returns conservative breaker settings
+func DefaultCircuitBreakerConfig() CircuitBreakerConfig {
+	return CircuitBreakerConfig{
+		FailureThreshold: 3,
+		CoolDown:         10 * time.Second,
+		HalfOpenProbes:   1,
+	}
+}
+
+// CircuitBreaker tracks send outcomes and fails fast on a degraded connection.
+// Closed: all sends allowed. Open: all sends rejected with ErrCircuitOpen
+// until CoolDown elapses. Half-open: one probe at a time is allowed; success
+// closes the circuit, failure re-opens it. Safe for concurrent use. A nil
+// breaker allows every send.
+type CircuitBreaker struct {
+	cfg       CircuitBreakerConfig
+	state     BreakerState
+	failures  int       // Consecutive failures while closed
+	successes int       // Successful probes while half-open
+	openedAt  time.Time // When the circuit last opened
+	probing   bool      // Whether a half-open probe is in flight
+	mu        sync.Mutex
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(cfg CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{cfg: cfg}
+}
+
+// Allow reports whether a send may proceed. Returns ErrCircuitOpen when the
+// circuit is open or a half-open probe is already in flight.
+func (cb *CircuitBreaker) Allow() error {
+	if cb == nil {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		if time.Since(cb.openedAt) < cb.cfg.CoolDown {
+			return ErrCircuitOpen
+		}
+		// Cool-down over - let a probe through
+		cb.state = BreakerHalfOpen
+		cb.successes = 0
+		cb.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if cb.probing {
+			return ErrCircuitOpen // Only one probe at a time
+		}
+		cb.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// RecordSuccess reports a successful send (and acknowledgment, if any)
+func (cb *CircuitBreaker) RecordSuccess() {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerHalfOpen:
+		cb.probing = false
+		cb.successes++
+		if cb.successes >= cb.cfg.HalfOpenProbes {
+			cb.state = BreakerClosed
+			cb.failures = 0
+		}
+	default:
+		cb.failures = 0
+	}
+}
+
+// RecordFailure reports a failed send or acknowledgment timeout
+func (cb *CircuitBreaker) RecordFailure() {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerHalfOpen:
+		// Probe failed - connection still degraded
+		cb.probing = false
+		cb.state = BreakerOpen
+		cb.openedAt = time.Now()
+	case BreakerClosed:
+		cb.failures++
+		if cb.failures >= cb.cfg.FailureThreshold {
+			cb.state = BreakerOpen
+			cb.openedAt = time.Now()
+		}
+	}
+}
+
+// abandon forgets a send whose outcome is unknown, e.g. a call given up
+// by its caller: a half-open probe lets the next one through.
+func (cb *CircuitBreaker) abandon() {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == BreakerHalfOpen {
+		cb.probing = false
+	}
+}
+
+// State returns the current breaker state
+func (cb *CircuitBreaker) State() BreakerState {
+	if cb == nil {
+		return BreakerClosed
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Send writes a text message through the circuit breaker. It fails fast with
+// ErrCircuitOpen while the breaker is open and records the write outcome.
+func Send(ctx context.Context, conn *websocket.Conn, cb *CircuitBreaker, msg []byte) error {
+	return SendFrame(ctx, conn, cb, websocket.MessageText, msg)
+}
+
+// SendFrame is Send for any frame type, e.g. binary envelopes (see
+// MessageFrameType). Failures are reported to the session's MetricsSink.
+func SendFrame(ctx context.Context, conn *websocket.Conn, cb *CircuitBreaker, typ websocket.MessageType, msg []byte) error {
+	return sendFrame(ctx, conn, cb, typ, msg, false)
+}
+
+// sendFrame is SendFrame. For a frame that awaitsReply, a successful write
+// is not recorded: the sender records the reply or its timeout instead.
+func sendFrame(ctx context.Context, conn *websocket.Conn, cb *CircuitBreaker, typ websocket.MessageType, msg []byte, awaitsReply bool) error {
+	if err := cb.Allow(); err != nil {
+		reportSendError(ctx, err)
+		emitEvent(ctx, MessageDropped{Reason: DropSendFailed, Count: 1})
+		return err
+	}
+
+	writeCtx, cancel := context.WithTimeout(ctx, messageTimeout)
+	err := conn.Write(writeCtx, typ, msg)
+	cancel()
+
+	if err != nil {
+		cb.RecordFailure()
+		reportSendError(ctx, err)
+		emitEvent(ctx, MessageDropped{Reason: DropSendFailed, Count: 1})
+		return err
+	}
+	if !awaitsReply {
+		cb.RecordSuccess()
+	}
+	return nil
+}
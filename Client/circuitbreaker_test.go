@@ -0,0 +1,168 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// echoServer serves WebSocket connections that echo every message.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		for {
+			typ, data, err := conn.Read(r.Context())
+			if err != nil {
+				return
+			}
+			if err := conn.Write(r.Context(), typ, data); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// brokenConn dials url and drops the connection, so every write fails the
+// way it does on a connection that broke mid-session.
+func brokenConn(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.CloseNow()
+	return conn
+}
+
+func TestCircuitBreakerTripsAndRecovers(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 3, CoolDown: 50 * time.Millisecond, HalfOpenProbes: 1})
+	for i := range 3 {
+		if err := cb.Allow(); err != nil {
+			t.Fatalf("send %d refused before the threshold: %v", i+1, err)
+		}
+		cb.RecordFailure()
+	}
+	if err := cb.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow after 3 failures = %v, want ErrCircuitOpen", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := cb.Allow(); err != nil {
+		t.Fatalf("probe after the cool-down refused: %v", err)
+	}
+	if err := cb.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second probe = %v, want ErrCircuitOpen while the first is in flight", err)
+	}
+	cb.RecordSuccess()
+	if st := cb.State(); st != BreakerClosed {
+		t.Fatalf("state after a successful probe = %s, want closed", st)
+	}
+}
+
+// TestSendReturnsErrCircuitOpen fails one write on each of three
+// connections - each failed write ends its session - and checks that the
+// client's breaker counted them together: Send on the live connection then
+// fails fast with ErrCircuitOpen.
+func TestSendReturnsErrCircuitOpen(t *testing.T) {
+	url := echoServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := Connect(ctx, url, WithProtocol(ProtocolRaw),
+		WithCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 3, CoolDown: time.Minute, HalfOpenProbes: 1}))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer c.Close()
+	msg, err := NewEnvelope(MessageTypeMessage, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(msg); err != nil {
+		t.Fatalf("send on a healthy connection: %v", err)
+	}
+
+	breaker := c.Reconnecting().Breaker
+	for i := range 3 {
+		err := SendFrame(ctx, brokenConn(t, url), breaker, websocket.MessageText, []byte("lost"))
+		if err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("write %d on a broken connection = %v, want a write error", i+1, err)
+		}
+	}
+	if st := breaker.State(); st != BreakerOpen {
+		t.Fatalf("breaker after 3 failed sessions = %s, want open", st)
+	}
+	if err := c.Send(msg); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Send with an open circuit = %v, want ErrCircuitOpen", err)
+	}
+}
+
+// silentServer serves WebSocket connections that read every message and
+// never answer.
+func silentServer(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		for {
+			if _, _, err := conn.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// TestCallTimeoutsOpenCircuit checks that calls whose replies never come
+// count as failures although their writes succeeded: after three of them,
+// Call and Send fail fast with ErrCircuitOpen.
+func TestCallTimeoutsOpenCircuit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := Connect(ctx, silentServer(t),
+		WithCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 3, CoolDown: time.Minute, HalfOpenProbes: 1}))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer c.Close()
+	msg, err := NewEnvelope(MessageTypeMessage, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 3 {
+		callCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		_, err := c.Call(callCtx, msg)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("call %d = %v, want the deadline", i+1, err)
+		}
+		msg.ID = ""
+	}
+	if st := c.Reconnecting().Breaker.State(); st != BreakerOpen {
+		t.Fatalf("breaker after 3 unanswered calls = %s, want open", st)
+	}
+	if _, err := c.Call(ctx, msg); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Call with an open circuit = %v, want ErrCircuitOpen", err)
+	}
+	if err := c.Send(msg); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Send with an open circuit = %v, want ErrCircuitOpen", err)
+	}
+}
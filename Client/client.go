@@ -1,13 +1,18 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"time"
 
 	"github.com/coder/websocket"
+
+	"github.com/deanbregenzer/cysl/internal/protocol"
 )
 
 const (
@@ -16,89 +21,286 @@ const (
 	messageTimeout   = 10 * time.Second
 )
 
-// Run connects to the WebSocket server and sends test messages
+// Run connects to the WebSocket server and sends test messages. Messages
+// the server pushes meanwhile (broadcasts, topic messages, notices) are
+// logged as they arrive.
 func Run(ctx context.Context) error {
-	// Get server URL from environment or use default
-	serverURL := os.Getenv("SERVER_URL")
-	if serverURL == "" {
-		serverURL = os.Getenv("WEBSOCKET_SERVER")
-	}
-	if serverURL == "" {
-		serverURL = defaultServerURL
-	}
+	rc, serverURL := newClientFromEnv()
 
-	// Create a context with timeout for dial
-	dialCtx, dialCancel := context.WithTimeout(ctx, dialTimeout)
-	defer dialCancel()
+	next := 1 // Next message number - survives reconnects
 
-	// Establish WebSocket connection
-	log.Printf("Connecting to server: %s", serverURL)
-	conn, resp, err := websocket.Dial(dialCtx, serverURL, &websocket.DialOptions{
-		CompressionMode: websocket.CompressionDisabled,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to connect to server: %w", err)
-	}
-	defer conn.Close(websocket.StatusInternalError, "")
+	slog.Info("Connecting to server", "url", serverURL)
+	rc.Session = func(ctx context.Context, conn *websocket.Conn) error {
+		// Guard the exchanges with the client's circuit breaker so a
+		// degraded connection fails fast. It outlives the session: a
+		// failed exchange ends the session, so only failures counted
+		// across reconnects can trip it. The echo acknowledges each
+		// message, so an exchange succeeds once it arrives - not when the
+		// write did - and the pump writes without a breaker of its own
+		breaker := rc.Breaker
 
-	log.Printf("Connection established. Server response status: %s", resp.Status)
+		logger := LoggerFromContext(ctx)
 
-	// Start client-side heartbeat monitoring
-	heartbeatCtx, heartbeatCancel := context.WithCancel(ctx)
-	defer heartbeatCancel()
+		// Read on a goroutine of its own, so pushes don't wait for the
+		// next reply and the replies don't get mixed up with them
+		replies := make(chan []byte)
+		p := startPump(ctx, conn, nil, func(ctx context.Context, typ websocket.MessageType, data []byte) {
+			text := decodeText(ctx, typ, data)
+			if !isReply(ctx, typ, data) {
+				logger.Info("Received message", "message", string(text))
+				return
+			}
+			select {
+			case replies <- text:
+			case <-ctx.Done():
+			}
+		})
+		defer p.stop()
 
-	cfg := DefaultClientHeartbeatConfig()
-	go func() {
-		metrics, err := ClientHeartbeat(heartbeatCtx, conn, cfg)
-		if err != nil {
-			log.Printf("Client heartbeat failed: %v | Pings=%d Pongs=%d Failed=%d",
-				err,
-				metrics.PingsSent.Load(),
-				metrics.PongsReceived.Load(),
-				metrics.FailedPings.Load())
-		}
-	}()
-
-	// Send test messages to the server
-	for i := 1; i <= 5; i++ {
-		select {
-		case <-ctx.Done():
-			log.Println("Client shutting down...")
-			conn.Close(websocket.StatusNormalClosure, "Client shutting down")
-			return ctx.Err()
-		default:
+		// Send test messages to the server
+		for next <= 5 {
+			// Send ping message
+			message := fmt.Sprintf("Client Ping #%d", next)
+			typ, data, err := encodeText(ctx, message)
+			if err != nil {
+				return err
+			}
+			if err := breaker.Allow(); err != nil {
+				// Keep the message until the cool-down lets a probe through
+				logger.Warn("Holding message back", "message", message, "error", err)
+			} else {
+				logger.Info("Sending message", "message", message)
+				if err := p.write(ctx, typ, data); err != nil {
+					breaker.RecordFailure()
+					if ctx.Err() != nil {
+						logger.Info("Client shutting down")
+						return ctx.Err()
+					}
+					return fmt.Errorf("failed to send message: %w", err)
+				}
+
+				// Wait for response - the echo doubles as an acknowledgment
+				select {
+				case response := <-replies:
+					breaker.RecordSuccess()
+					logger.Info("Received response", "response", string(response))
+					next++
+				case <-p.done():
+					breaker.RecordFailure()
+					if ctx.Err() != nil {
+						logger.Info("Client shutting down")
+						return ctx.Err()
+					}
+					return p.err()
+				case <-time.After(messageTimeout):
+					breaker.RecordFailure() // Missing ACK counts against the connection
+					return fmt.Errorf("error reading response: %w", context.DeadlineExceeded)
+				}
+			}
+
+			// Wait between messages - pushes are still logged meanwhile
+			select {
+			case <-p.done():
+				if ctx.Err() != nil {
+					logger.Info("Client shutting down")
+					return ctx.Err()
+				}
+				return p.err()
+			case <-time.After(2 * time.Second):
+			}
 		}
+		// Close while the reader still runs, so it sees the server's answer
+		CloseWith(conn, CloseNormal, "Client finished")
+		return nil
+	}
 
-		// Send ping message
-		message := fmt.Sprintf("Client Ping #%d", i)
-		log.Printf("Sending message: %s", message)
+	if err := rc.Run(ctx); err != nil {
+		return err
+	}
+	slog.Info("WebSocket connection closed")
+	return nil
+}
 
-		writeCtx, writeCancel := context.WithTimeout(ctx, messageTimeout)
-		err := conn.Write(writeCtx, websocket.MessageText, []byte(message))
-		writeCancel()
+// isReply reports whether a message is the server's answer to one the
+// client sent: an echo or an error on sessions with envelopes, the echo
+// handler's "Server echoes: " text on raw ones, or a moderation rejection,
+// which is always text.
+func isReply(ctx context.Context, typ websocket.MessageType, data []byte) bool {
+	if bytes.HasPrefix(data, []byte("Server rejected message: ")) {
+		return true
+	}
+	if ProtocolVersionFromContext(ctx) == ProtocolRaw {
+		return bytes.HasPrefix(data, []byte("Server echoes: "))
+	}
+	if typ != MessageFrameType(ctx) {
+		return false // Flat notices
+	}
+	m, err := DecodeMessage(ctx, data)
+	return err == nil && (m.Type == MessageTypeEcho || m.Type == MessageTypeError)
+}
+
+// newClientFromEnv creates the reconnecting client both CLI modes use,
+// configured from SERVER_URL (or WEBSOCKET_SERVER), AUTH_TOKEN,
+// HEARTBEAT_MODE and CODEC, with callbacks that log connection events. Returns the
+// client and the server URL; the caller sets Session.
+func newClientFromEnv() (*ReconnectingClient, string) {
+	// Keep the connection alive across failures: the client re-dials with
+	// backoff (honoring the server's Retry-After hints) and starts a new
+	// session on each connection
+	serverURL := serverURLFromEnv()
+	opts := optionsFromEnv()
+	rc := NewClient(serverURL, nil, opts...)
+	rc.OnConnect = func(conn *websocket.Conn, resp *http.Response, hb HeartbeatConfig) {
+		rc.Logger().Info("Connection established", "attempts", rc.Metrics.Attempts.Load(),
+			"status", resp.Status, "server_directed_delays", rc.Metrics.ServerDirectedDelays.Load(),
+			"protocol", NegotiatedProtocol(resp), "codec", negotiatedCodec(conn).Name(), "session_resumed", SessionResumed(resp))
+		rc.Logger().Info("Heartbeat negotiated", "interval", hb.Interval, "timeout", hb.Timeout, "mode", hb.Mode)
+	}
+	rc.OnDisconnect = func(err error) {
+		if ce, ok := PeerClose(err); ok {
+			// Say what the server's close code means, e.g. "shutdown"
+			rc.Logger().Warn("Disconnected", "error", err, "close_code", protocol.CloseName(ce.Code), "close_reason", ce.Reason)
+			return
+		}
+		rc.Logger().Warn("Disconnected", "error", err)
+	}
+	rc.OnReconnectFailed = func(err error) {
+		rc.Logger().Error("Giving up reconnecting", "error", err)
+	}
+	return rc, serverURL
+}
+
+// serverURLFromEnv returns SERVER_URL, WEBSOCKET_SERVER or the default.
+func serverURLFromEnv() string {
+	if serverURL := os.Getenv("SERVER_URL"); serverURL != "" {
+		return serverURL
+	}
+	if serverURL := os.Getenv("WEBSOCKET_SERVER"); serverURL != "" {
+		return serverURL
+	}
+	return defaultServerURL
+}
 
+// optionsFromEnv returns the options AUTH_TOKEN, HEARTBEAT_MODE and CODEC
+// ask for.
+func optionsFromEnv() []Option {
+	var opts []Option
+	if token := os.Getenv("AUTH_TOKEN"); token != "" {
+		opts = append(opts, WithAuth(StaticToken(token)))
+	}
+	if mode := os.Getenv("HEARTBEAT_MODE"); mode != "" {
+		hb := DefaultClientHeartbeatConfig()
+		hb.Mode = mode // The server falls back to "ws" for unknown modes
+		opts = append(opts, WithHeartbeat(hb))
+	}
+	if name := os.Getenv("CODEC"); name != "" {
+		codec, err := CodecByName(name)
 		if err != nil {
-			return fmt.Errorf("failed to send message: %w", err)
+			slog.Warn("Ignoring CODEC", "error", err)
+		} else {
+			opts = append(opts, WithCodec(codec))
 		}
+	}
+	return opts
+}
 
-		// Wait for response
-		readCtx, readCancel := context.WithTimeout(ctx, messageTimeout)
-		_, response, err := conn.Read(readCtx)
-		readCancel()
+// readResponse reads the next data message (see readMessage). Envelopes
+// are unwrapped to the text they carry (see decodeText).
+func readResponse(ctx context.Context, conn *websocket.Conn) ([]byte, error) {
+	typ, data, err := readMessage(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return decodeText(ctx, typ, data), nil
+}
 
+// readMessage reads the next data message, skipping empty binary messages.
+// The server sends those as write probes to detect half-open connections;
+// they carry no payload and need no reply. JSON heartbeat messages are
+// handed to the session's AppHeartbeat, if any, rate limit and slow
+// consumer notices are logged, and envelopes whose ID was already seen are
+// dropped. A close for rate limit violations is returned as a *RateLimitError.
+func readMessage(ctx context.Context, conn *websocket.Conn) (websocket.MessageType, []byte, error) {
+	ah := appHeartbeatFrom(ctx)
+	for {
+		typ, data, err := conn.Read(ctx)
 		if err != nil {
-			return fmt.Errorf("error reading response: %w", err)
+			return 0, nil, readError(err)
+		}
+		if typ == websocket.MessageBinary && len(data) == 0 {
+			continue // Server liveness probe
+		}
+		if ah.Handle(ctx, typ, data) {
+			continue // Heartbeat traffic
+		}
+		if logRateLimitNotice(LoggerFromContext(ctx), typ, data) {
+			continue // The message was throttled - its reply still follows
+		}
+		if n, ok := parseSlowConsumerNotice(typ, data); ok {
+			logSlowConsumerNotice(LoggerFromContext(ctx), n)
+			if n.Dropped > 0 {
+				emitEvent(ctx, MessageDropped{Reason: DropServerSlowConsumer, Count: n.Dropped})
+			}
+			continue // Informational - we are reading as fast as we can
 		}
+		if duplicateMessage(ctx, typ, data) {
+			emitEvent(ctx, MessageDropped{Reason: DropDuplicate, Count: 1})
+			continue // Resent by the server - already handled
+		}
+		return typ, data, nil
+	}
+}
 
-		log.Printf("Received response: %s", string(response))
+// RateLimitNotice is sent by the server when a message arrived sooner than
+// its rate limit allows. The message is still processed, but MaxViolations
+// consecutive violations close the connection.
+type RateLimitNotice struct {
+	Type          string `json:"type"` // Always "rate_limited"
+	Limiter       string `json:"limiter"`
+	Violations    int    `json:"violations"`
+	MaxViolations int    `json:"max_violations"`
+	MinIntervalMs int64  `json:"min_interval_ms"`
+}
 
-		// Wait between messages
-		time.Sleep(2 * time.Second)
+// logRateLimitNotice logs a RateLimitNotice. Returns false for every other message.
+func logRateLimitNotice(logger *slog.Logger, typ websocket.MessageType, data []byte) bool {
+	var n RateLimitNotice
+	if typ != websocket.MessageText || len(data) == 0 || data[0] != '{' {
+		return false
+	}
+	if json.Unmarshal(data, &n) != nil || n.Type != "rate_limited" {
+		return false
 	}
+	logger.Warn("Server throttled a message", "limiter", n.Limiter, "violations", n.Violations,
+		"max_violations", n.MaxViolations, "min_interval_ms", n.MinIntervalMs)
+	return true
+}
 
-	// Gracefully close the connection
-	conn.Close(websocket.StatusNormalClosure, "Client finished")
-	log.Println("WebSocket connection closed")
+// SlowConsumerNotice is sent by the server when this client's outgoing
+// queue stayed too full for too long. Under the "drop_bulk" policy Dropped
+// broadcasts and topic messages were discarded.
+type SlowConsumerNotice struct {
+	Type    string `json:"type"` // Always "slow_consumer"
+	Queued  int    `json:"queued"`
+	Policy  string `json:"policy"`
+	Dropped int    `json:"dropped"`
+}
 
-	return nil
+// parseSlowConsumerNotice recognizes a SlowConsumerNotice. Returns false
+// for every other message.
+func parseSlowConsumerNotice(typ websocket.MessageType, data []byte) (SlowConsumerNotice, bool) {
+	var n SlowConsumerNotice
+	if typ != websocket.MessageText || len(data) == 0 || data[0] != '{' {
+		return n, false
+	}
+	if json.Unmarshal(data, &n) != nil || n.Type != "slow_consumer" {
+		return n, false
+	}
+	return n, true
+}
+
+// logSlowConsumerNotice logs a SlowConsumerNotice.
+func logSlowConsumerNotice(logger *slog.Logger, n SlowConsumerNotice) {
+	logger.Warn("Server reports this client as a slow consumer", "queued", n.Queued,
+		"policy", n.Policy, "dropped", n.Dropped)
 }
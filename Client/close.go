@@ -0,0 +1,37 @@
+package client
+
+import (
+	"github.com/coder/websocket"
+
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// Close codes and what they mean (see internal/protocol). Sessions get
+// the server's close as a websocket.CloseError in their error's chain;
+// PeerClose returns it. ClosePolicyViolation with a rate limit reason
+// becomes a *RateLimitError, CloseAuthFailed matches ErrAuthFailed and
+// CloseSuperseded ErrSuperseded.
+const (
+	CloseNormal          = protocol.CloseNormal          // 1000: done; the server drops the session
+	CloseShutdown        = protocol.CloseShutdown        // 1001: the server shuts down, or the client exits
+	ClosePolicyViolation = protocol.ClosePolicyViolation // 1008: refused by a handler, kicked, slow consumer
+	CloseRateLimited     = protocol.CloseRateLimited     // 1008 with an "error":"rate_limited" reason
+	CloseMessageTooBig   = protocol.CloseMessageTooBig   // 1009: a message exceeded the server's limit
+	CloseInternalError   = protocol.CloseInternalError   // 1011: the server ended the connection without a deliberate close
+	CloseAuthFailed      = protocol.CloseAuthFailed      // 4401: the credentials stopped being valid
+	CloseSuperseded      = protocol.CloseSuperseded      // 4409: a newer connection from the same device took over; matches ErrSuperseded
+)
+
+// CloseWith closes conn with code and reason and waits for the server's
+// answering close frame. A connection that is already closing keeps the
+// code it was first closed with, and nil is returned. Sessions close
+// while their reader still runs, so it receives the answer.
+func CloseWith(conn *websocket.Conn, code websocket.StatusCode, reason string) error {
+	return protocol.CloseWith(conn, code, reason)
+}
+
+// PeerClose returns the close frame the server ended the connection with,
+// e.g. from Run's error, a Disconnected event or Client.Err.
+func PeerClose(err error) (websocket.CloseError, bool) {
+	return protocol.PeerClose(err)
+}
@@ -0,0 +1,278 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/coder/websocket"
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// receiveBuffer is how many received messages wait for Receive's reader
+// before the client stops reading from the connection.
+const receiveBuffer = 64
+
+// Client is a connection to the server for programs embedding the client:
+// Send and Receive exchange messages while the client keeps the connection
+// alive underneath - heartbeat, reconnects with backoff and session
+// resumption work as with a ReconnectingClient. Connect creates it.
+type Client struct {
+	rc       *ReconnectingClient
+	sends    chan *outgoingMessage
+	received chan Message
+	ready    chan struct{} // Closed once the first connection is up
+	closing  chan struct{} // Closed by Close
+	done     chan struct{} // Closed once the client stopped
+	cancel   context.CancelFunc
+
+	mu     sync.Mutex
+	live   bool                    // A session is running
+	closed bool                    // Close was called
+	err    error                   // Why the client stopped, set before done is closed
+	calls  map[string]chan Message // Calls waiting for a reply, by request ID
+
+	readyOnce sync.Once
+	closeOnce sync.Once
+}
+
+// outgoingMessage is a message handed to the session, with the channel
+// its write result goes back on.
+type outgoingMessage struct {
+	msg         Message
+	awaitsReply bool // Sent by Call
+	result      chan error
+}
+
+// Connect dials url and returns once the connection is established. opts
+// are those of NewClient - WithHeartbeat, WithHeader, WithTLS, WithCodec,
+// WithAuth, ... ctx bounds only the connecting: the client then runs until
+// Close, or until reconnecting fails for good (see BackoffConfig.MaxAttempts).
+func Connect(ctx context.Context, url string, opts ...Option) (*Client, error) {
+	// Keep ctx's values (e.g. a logger) but not its deadline
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	c := &Client{
+		sends:    make(chan *outgoingMessage),
+		received: make(chan Message, receiveBuffer),
+		ready:    make(chan struct{}),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+		cancel:   cancel,
+	}
+	c.rc = NewClient(url, c.session, opts...)
+
+	go func() {
+		err := c.rc.Run(runCtx)
+		c.mu.Lock()
+		if c.closed {
+			err = nil // Stopped as asked
+		}
+		c.err = err
+		c.mu.Unlock()
+		close(c.received) // Sessions have stopped reading
+		close(c.done)
+	}()
+
+	select {
+	case <-c.ready:
+		return c, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Reconnecting returns the client running the connection, for its Metrics,
+// Events and Logger. Its fields must not be changed.
+func (c *Client) Reconnecting() *ReconnectingClient {
+	return c.rc
+}
+
+// Send sends msg, waiting until it was written to the connection. While
+// the client reconnects it waits for the new connection. Create messages
+// with NewEnvelope. Returns ErrCircuitOpen while the connection is
+// degraded and ErrClosed once the client stopped.
+func (c *Client) Send(msg Message) error {
+	return c.SendContext(context.Background(), msg)
+}
+
+// SendContext is Send, giving up when ctx is done before the message was
+// handed to the connection.
+func (c *Client) SendContext(ctx context.Context, msg Message) error {
+	return c.send(ctx, msg, false)
+}
+
+// send is SendContext; Call sends its request with awaitsReply set.
+func (c *Client) send(ctx context.Context, msg Message, awaitsReply bool) error {
+	out := &outgoingMessage{msg: msg, awaitsReply: awaitsReply, result: make(chan error, 1)}
+	select {
+	case c.sends <- out:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closing:
+		return notSentError{ErrClosed}
+	case <-c.done:
+		return notSentError{ErrClosed}
+	}
+	return <-out.result // The session always answers - writes time out
+}
+
+// Receive returns the messages the server sends, in order. Heartbeat
+// traffic, rate limit notices and messages resent after a reconnect are
+// handled by the client and don't show up. On raw text connections (see
+// WithProtocol) each message arrives as a MessageTypeMessage carrying the
+// text as a JSON string. Keep reading: once receiveBuffer messages wait,
+// the client stops reading from the connection. The channel is closed
+// when the client stops.
+func (c *Client) Receive() <-chan Message {
+	return c.received
+}
+
+// Close closes the connection with a normal closure and stops the client.
+// Returns the error that had stopped the client before, if any.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		live := c.live
+		c.mu.Unlock()
+		close(c.closing)
+		if !live {
+			c.cancel() // Dialing or waiting to - nothing to close gracefully
+		}
+	})
+	<-c.done
+	c.cancel()
+	return c.Err()
+}
+
+// Err returns why the client stopped: nil while it runs and after Close,
+// the error that ended reconnecting otherwise.
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+	default:
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// NewEnvelope creates a message of type typ with a fresh ID and timestamp.
+// payload is encoded as JSON; nil leaves the payload empty.
+func NewEnvelope(typ string, payload any) (Message, error) {
+	return protocol.New(typ, payload)
+}
+
+// session is the Client's SessionFunc: it writes what Send hands it and
+// passes what the server sends on to Receive. Returning nil after Close
+// makes the client close the connection normally.
+func (c *Client) session(ctx context.Context, conn *websocket.Conn) (err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil // Closed while the connection was being established
+	}
+	c.live = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.live = false
+		if c.closed {
+			err = nil // Don't reconnect - Close relies on it
+		}
+		c.mu.Unlock()
+	}()
+	c.readyOnce.Do(func() { close(c.ready) })
+
+	// Pushes reach Receive while sends are being written
+	p := startPump(ctx, conn, c.rc.Breaker, func(ctx context.Context, typ websocket.MessageType, data []byte) {
+		m := receivedMessage(ctx, typ, data)
+		if c.answer(m) {
+			return // A Call's reply
+		}
+		select {
+		case c.received <- m:
+		case <-ctx.Done():
+		}
+	})
+	defer p.stop() // Before the client closes received
+
+	for {
+		select {
+		case <-c.closing:
+			// Close while the reader still runs: it receives the server's
+			// answer, and stopping it afterwards would drop the connection
+			CloseWith(conn, CloseNormal, "Client closed")
+			return nil
+		case <-p.done():
+			if c.isClosed() {
+				return nil // The server answered our close
+			}
+			return p.err()
+		case out := <-c.sends:
+			typ, data, err := encodeMessage(ctx, out.msg)
+			if err != nil {
+				out.result <- err // The message is at fault, not the connection
+				continue
+			}
+			// The writer answers, in the order the sends arrived; a failure
+			// ends the session through done
+			select {
+			case p.out <- outgoingFrame{typ: typ, data: data, awaitsReply: out.awaitsReply, result: out.result}:
+			case <-p.done():
+				out.result <- notSentError{p.err()}
+			case <-c.closing:
+				out.result <- notSentError{ErrClosed}
+			}
+		}
+	}
+}
+
+// isClosed reports whether Close was called.
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// encodeMessage prepares msg for the session ctx belongs to: in its codec,
+// or on raw sessions as the payload's text - a string payload unquoted.
+func encodeMessage(ctx context.Context, msg Message) (websocket.MessageType, []byte, error) {
+	if ProtocolVersionFromContext(ctx) == ProtocolRaw {
+		var text string
+		if json.Unmarshal(msg.Payload, &text) == nil {
+			return websocket.MessageText, []byte(text), nil
+		}
+		return websocket.MessageText, msg.Payload, nil
+	}
+	if msg.ID == "" {
+		msg.ID = protocol.NewID() // The server's duplicate detection needs one
+	}
+	data, err := CodecFromContext(ctx).Encode(msg)
+	return MessageFrameType(ctx), data, err
+}
+
+// receivedMessage turns what the server sent into a Message: envelopes are
+// decoded, flat server notices (no ID) keep their JSON as payload, and raw text
+// becomes a MessageTypeMessage with the text as payload.
+func receivedMessage(ctx context.Context, typ websocket.MessageType, data []byte) Message {
+	if ProtocolVersionFromContext(ctx) != ProtocolRaw && typ == MessageFrameType(ctx) {
+		if m, err := DecodeMessage(ctx, data); err == nil && m.ID != "" {
+			return m
+		}
+	}
+	if typ == websocket.MessageText {
+		var notice struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(data, &notice) == nil && notice.Type != "" {
+			return Message{Type: notice.Type, Payload: data}
+		}
+	}
+	text, _ := json.Marshal(string(data))
+	return Message{Type: MessageTypeMessage, Payload: text}
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/coder/websocket"
+)
+
+// recentIDsSize is how many message IDs a client remembers. Resent
+// frames follow the original closely, and a resumed session replays no
+// more than the server's sessions.max_messages (256 by default).
+const recentIDsSize = 256
+
+// recentIDs remembers the IDs of the last envelopes a client received,
+// so a message the server wrote twice - or replayed with a resumed
+// session - is only handled once. Methods are
+// nil-safe: a nil set remembers nothing.
+type recentIDs struct {
+	ring []string
+	next int
+	seen map[string]struct{}
+	mu   sync.Mutex
+}
+
+// newRecentIDs creates an empty set remembering size IDs.
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{ring: make([]string, size), seen: make(map[string]struct{}, size)}
+}
+
+// add records id and reports whether it is new. Empty IDs - raw messages
+// and notices - are always new.
+func (r *recentIDs) add(id string) bool {
+	if r == nil || id == "" {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.seen[id]; dup {
+		return false
+	}
+	delete(r.seen, r.ring[r.next]) // Forget the oldest
+	r.ring[r.next] = id
+	r.next = (r.next + 1) % len(r.ring)
+	r.seen[id] = struct{}{}
+	return true
+}
+
+// recentIDsKey is the context key for the session's recentIDs.
+type recentIDsKey struct{}
+
+// withRecentIDs returns a copy of ctx carrying ids.
+func withRecentIDs(ctx context.Context, ids *recentIDs) context.Context {
+	return context.WithValue(ctx, recentIDsKey{}, ids)
+}
+
+// duplicateMessage reports whether data is an envelope whose ID the
+// session ctx belongs to already received.
+func duplicateMessage(ctx context.Context, typ websocket.MessageType, data []byte) bool {
+	ids, _ := ctx.Value(recentIDsKey{}).(*recentIDs)
+	if ids == nil || ProtocolVersionFromContext(ctx) == ProtocolRaw || typ != MessageFrameType(ctx) {
+		return false
+	}
+	m, err := DecodeMessage(ctx, data)
+	if err != nil {
+		return false
+	}
+	return !ids.add(m.ID)
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/deanbregenzer/cysl/internal/heartbeat"
+)
+
+// Errors returned by the client's APIs, for callers to branch on with
+// errors.Is - e.g. to stop retrying on ErrAuthFailed or to slow down on
+// ErrRateLimited. Run's error wraps the one that ended it.
+var (
+	// ErrRateLimited: the server refused or closed the connection for
+	// exceeding a rate limit. errors.As finds a *RateLimitError when the
+	// server said which limit.
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrAuthFailed: the server rejected the credentials (401/403) or
+	// closed the connection with CloseAuthFailed, or the TokenProvider
+	// failed.
+	ErrAuthFailed = errors.New("authentication failed")
+
+	// ErrSuperseded: the server closed the connection with CloseSuperseded
+	// because a newer one from the same device took over. The client
+	// doesn't reconnect, or the two would take turns closing each other.
+	ErrSuperseded = errors.New("superseded by a newer connection")
+
+	// ErrHeartbeatLost: the server stopped answering heartbeat pings.
+	ErrHeartbeatLost = heartbeat.ErrLost
+
+	// ErrClosed: the Client was closed, or stopped after reconnecting
+	// failed for good.
+	ErrClosed = errors.New("client closed")
+
+	// ErrRawProtocol: Call on a client that doesn't negotiate envelopes.
+	// Raw text carries no message IDs to answer.
+	ErrRawProtocol = errors.New("calls need the envelope protocol")
+)
+
+// notSentError is a send that failed before its frame was handed to the
+// connection: the server can't have seen the message, so it may be sent
+// again on another connection (see Pool).
+type notSentError struct{ err error }
+
+// Error implements the error interface.
+func (e notSentError) Error() string { return e.err.Error() }
+
+// Unwrap makes the error match the one that kept the message back.
+func (e notSentError) Unwrap() error { return e.err }
+
+// notSent reports whether err left the message unsent: the client or the
+// connection had stopped before it was written, or the circuit breaker
+// held it back.
+func notSent(err error) bool {
+	var ns notSentError
+	return errors.As(err, &ns) || errors.Is(err, ErrCircuitOpen)
+}
+
+// RateLimitError is returned when the server closed the connection for
+// rate limit violations. It carries the server's close reason.
+type RateLimitError struct {
+	Limiter       string
+	Violations    int
+	MaxViolations int
+	MinInterval   time.Duration // Required spacing of messages
+	Rate          float64       // Messages per second of a token bucket limiter
+	Burst         int           // Messages a token bucket limiter allows at once
+	Err           error         // The close error
+}
+
+// Error implements the error interface.
+func (e *RateLimitError) Error() string {
+	if e.Rate > 0 {
+		return fmt.Sprintf("rate limited by server (%s, %g messages/s, burst %d)", e.Limiter, e.Rate, e.Burst)
+	}
+	return fmt.Sprintf("rate limited by server (%s, violations: %d/%d, min interval %v)",
+		e.Limiter, e.Violations, e.MaxViolations, e.MinInterval)
+}
+
+// Unwrap makes the error match ErrRateLimited and the close error.
+func (e *RateLimitError) Unwrap() []error {
+	return []error{ErrRateLimited, e.Err}
+}
+
+// readError converts a read error: a close for rate limit violations
+// becomes a *RateLimitError, CloseAuthFailed matches ErrAuthFailed,
+// CloseSuperseded ErrSuperseded, everything else is returned as is.
+func readError(err error) error {
+	ce, ok := PeerClose(err)
+	if ok && ce.Code == CloseAuthFailed {
+		return fmt.Errorf("%w: server closed the connection: %w", ErrAuthFailed, err)
+	}
+	if ok && ce.Code == CloseSuperseded {
+		return fmt.Errorf("%w: %w", ErrSuperseded, err)
+	}
+	if !ok || ce.Code != CloseRateLimited {
+		return err
+	}
+	var info struct {
+		Error         string  `json:"error"` // "rate_limited"
+		Limiter       string  `json:"limiter"`
+		Violations    int     `json:"violations"`
+		MaxViolations int     `json:"max_violations"`
+		MinIntervalMs int64   `json:"min_interval_ms"`
+		Rate          float64 `json:"rate"`
+		Burst         int     `json:"burst"`
+	}
+	if json.Unmarshal([]byte(ce.Reason), &info) != nil || info.Error != "rate_limited" {
+		return err
+	}
+	return &RateLimitError{
+		Limiter:       info.Limiter,
+		Violations:    info.Violations,
+		MaxViolations: info.MaxViolations,
+		MinInterval:   time.Duration(info.MinIntervalMs) * time.Millisecond,
+		Rate:          info.Rate,
+		Burst:         info.Burst,
+		Err:           err,
+	}
+}
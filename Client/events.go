@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// Event is a change in the client's connection state, delivered on the
+// channel Events returns. Switch on the concrete type:
+//
+//	for ev := range rc.Events() {
+//		switch ev := ev.(type) {
+//		case client.Connected:
+//		case client.Disconnected:
+//		...
+//		}
+//	}
+type Event interface {
+	isEvent()
+}
+
+// Connected is sent when a connection is established.
+type Connected struct {
+	Heartbeat    HeartbeatConfig // As negotiated with the server
+	Protocol     int             // Negotiated message protocol version
+	Capabilities []string        // Capabilities the server agreed to (see WithCapabilities)
+	Resumed      bool            // The server restored the previous session (see SessionResumed)
+}
+
+// Disconnected is sent when an established connection is lost.
+type Disconnected struct {
+	Reason error // Why the session ended, e.g. wrapping ErrHeartbeatLost
+}
+
+// Reconnecting is sent before the client waits to dial again, after a lost
+// connection or a failed dial attempt.
+type Reconnecting struct {
+	Attempt int           // Dial attempt that follows the delay, 1 after a lost connection
+	Delay   time.Duration // Wait before that attempt
+	Err     error         // What failed
+}
+
+// HeartbeatMiss is sent when a heartbeat ping went unanswered. The
+// connection is given up once Missed reaches MaxMissed.
+type HeartbeatMiss struct {
+	Missed    int // Consecutive misses
+	MaxMissed int
+	Err       error
+}
+
+// Reasons for MessageDropped.
+const (
+	DropDuplicate          = "duplicate"            // The server resent a message already received
+	DropSendFailed         = "send_failed"          // SendFrame failed or the circuit breaker refused
+	DropServerSlowConsumer = "server_slow_consumer" // The server discarded messages queued for this client
+)
+
+// MessageDropped is sent when messages were discarded on either side.
+type MessageDropped struct {
+	Reason string // DropDuplicate, DropSendFailed or DropServerSlowConsumer
+	Count  int
+}
+
+// Stopped is the last event: Run returned with Err (nil after the session
+// finished).
+type Stopped struct {
+	Err error
+}
+
+func (Connected) isEvent()      {}
+func (Disconnected) isEvent()   {}
+func (Reconnecting) isEvent()   {}
+func (HeartbeatMiss) isEvent()  {}
+func (MessageDropped) isEvent() {}
+func (Stopped) isEvent()        {}
+
+// eventBuffer is how many events wait for a slow reader before the oldest
+// are discarded.
+const eventBuffer = 64
+
+// Events returns the client's event channel. Call it before Run; events
+// happening earlier aren't recorded. Events are never blocked on: if the
+// reader falls eventBuffer events behind, the oldest are discarded, so
+// the latest state is always delivered. The channel isn't closed - Stopped
+// is the last event of a Run.
+func (rc *ReconnectingClient) Events() <-chan Event {
+	ch := make(chan Event, eventBuffer)
+	if !rc.events.CompareAndSwap(nil, &ch) {
+		return *rc.events.Load()
+	}
+	return ch
+}
+
+// emit delivers ev to the event channel, if anyone asked for it.
+func (rc *ReconnectingClient) emit(ev Event) {
+	p := rc.events.Load()
+	if p == nil {
+		return
+	}
+	for {
+		select {
+		case *p <- ev:
+			return
+		default:
+		}
+		select {
+		case <-*p: // Make room - the newest state matters most
+		default:
+		}
+	}
+}
+
+// eventsKey is the context key for the client emitting a connection's
+// events.
+type eventsKey struct{}
+
+// withEvents returns a copy of ctx through which the connection's dial
+// attempts and session emit rc's events.
+func withEvents(ctx context.Context, rc *ReconnectingClient) context.Context {
+	return context.WithValue(ctx, eventsKey{}, rc)
+}
+
+// emitEvent emits ev on the client ctx belongs to.
+func emitEvent(ctx context.Context, ev Event) {
+	if rc, ok := ctx.Value(eventsKey{}).(*ReconnectingClient); ok {
+		rc.emit(ev)
+	}
+}
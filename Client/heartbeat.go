@@ -2,82 +2,91 @@ package client
 
 import (
 	"context"
-	"fmt"
-	"log"
-	"sync/atomic"
-	"time"
+	"net/http"
 
 	"github.com/coder/websocket"
+	"github.com/deanbregenzer/cysl/internal/heartbeat"
 )
 
-// HeartbeatConfig contains all configurable heartbeat parameters for client
-type HeartbeatConfig struct {
-	Interval       time.Duration // Time between pings
-	Timeout        time.Duration // Max wait time for pong
-	MaxMissedPings int           // Max failed pings before giving up
-	EnableMetrics  bool          // Enable metrics collection
-}
+// HeartbeatConfig contains all configurable heartbeat parameters for client;
+// shared with the server, see internal/heartbeat
+type HeartbeatConfig = heartbeat.Config
 
 // HeartbeatMetrics collects performance and health metrics
-type HeartbeatMetrics struct {
-	PingsSent     atomic.Int64 // Total pings sent
-	PongsReceived atomic.Int64 // Total pongs received
-	FailedPings   atomic.Int64 // Failed pings
-	AvgLatency    atomic.Int64 // Average latency (ms)
-}
+type HeartbeatMetrics = heartbeat.Metrics
+
+// HeartbeatSnapshot is a point-in-time copy of HeartbeatMetrics with
+// moving-average, min/max and percentile latency; see Metrics.Snapshot.
+type HeartbeatSnapshot = heartbeat.MetricsSnapshot
+
+// AppHeartbeat runs a session's heartbeat. In JSON mode the session's reads
+// must pass every message to its Handle method (readResponse does this)
+type AppHeartbeat = heartbeat.Heartbeat
+
+// Heartbeat modes - the server accepts the same names
+const (
+	HeartbeatModeFrames = heartbeat.ModeFrames // WebSocket ping/pong control frames (default)
+	HeartbeatModeJSON   = heartbeat.ModeJSON   // Application-level JSON ping/pong messages
+)
 
 // DefaultClientHeartbeatConfig returns client-side heartbeat configuration
 func DefaultClientHeartbeatConfig() HeartbeatConfig {
-	return HeartbeatConfig{
-		Interval:       5 * time.Second, // Shorter interval for testing
-		Timeout:        3 * time.Second, // Shorter timeout
-		MaxMissedPings: 2,
-		EnableMetrics:  true,
-	}
+	return heartbeat.DefaultConfig(heartbeat.RoleClient)
+}
+
+// NewAppHeartbeat creates the heartbeat for a client connection, in the mode
+// cfg selects. Every ping result is logged
+func NewAppHeartbeat(conn *websocket.Conn, cfg HeartbeatConfig) *AppHeartbeat {
+	return heartbeat.New(conn, cfg, heartbeat.RoleClient)
 }
 
 // ClientHeartbeat implements client-side heartbeat monitoring
-// The client reads pong responses automatically through the Read() loop
+// The client reads pong responses automatically through the Read() loop.
+// In JSON mode pongs only arrive through NewAppHeartbeat(...).Handle, so
+// sessions using that mode must use NewAppHeartbeat directly
 func ClientHeartbeat(ctx context.Context, conn *websocket.Conn,
 	cfg HeartbeatConfig) (*HeartbeatMetrics, error) {
-	metrics := &HeartbeatMetrics{}
-	timer := time.NewTimer(cfg.Interval)
-	defer timer.Stop()
-	missedPings := 0
-
-	for {
-		select {
-		case <-ctx.Done():
-			return metrics, ctx.Err()
-		case <-timer.C:
-		}
-
-		// Send ping with timeout
-		pingCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
-		start := time.Now()
+	return NewAppHeartbeat(conn, cfg).Run(ctx)
+}
 
-		err := conn.Ping(pingCtx)
-		cancel()
+// ProposeHeartbeat adds the client's desired heartbeat values to the
+// upgrade request headers so the server can negotiate them
+func ProposeHeartbeat(h http.Header, cfg HeartbeatConfig) {
+	heartbeat.WriteHeaders(h, cfg)
+}
 
-		metrics.PingsSent.Add(1)
+// ApplyNegotiatedHeartbeat returns cfg updated with the values the server
+// accepted in the upgrade response. Servers that don't support negotiation
+// send no headers, in which case cfg is returned unchanged - except for the
+// mode: a server without JSON heartbeat support keeps using control frames
+func ApplyNegotiatedHeartbeat(resp *http.Response, cfg HeartbeatConfig) HeartbeatConfig {
+	if resp == nil {
+		return cfg
+	}
+	if d, ok := heartbeat.ParseMillis(resp.Header.Get(heartbeat.HeaderInterval)); ok {
+		cfg.Interval = d
+	}
+	if d, ok := heartbeat.ParseMillis(resp.Header.Get(heartbeat.HeaderTimeout)); ok {
+		cfg.Timeout = d
+	}
+	if mode, ok := heartbeat.ParseMode(resp.Header.Get(heartbeat.HeaderMode)); ok {
+		cfg.Mode = mode
+	} else {
+		cfg.Mode = HeartbeatModeFrames
+	}
+	return cfg
+}
 
-		if err != nil {
-			metrics.FailedPings.Add(1)
-			missedPings++
-			log.Printf("Client ping failed: %v (missed: %d/%d)",
-				err, missedPings, cfg.MaxMissedPings)
+// appHeartbeatKey is the context key for the session's heartbeat.
+type appHeartbeatKey struct{}
 
-			if missedPings >= cfg.MaxMissedPings {
-				return metrics, fmt.Errorf("max missed pings (%d) exceeded", cfg.MaxMissedPings)
-			}
-		} else {
-			latency := time.Since(start).Milliseconds()
-			metrics.AvgLatency.Store(latency)
-			metrics.PongsReceived.Add(1)
-			missedPings = 0
-			log.Printf("Client ping successful (latency: %dms)", latency)
-		}
+// withAppHeartbeat returns ctx carrying ah for the session's read loop.
+func withAppHeartbeat(ctx context.Context, ah *AppHeartbeat) context.Context {
+	return context.WithValue(ctx, appHeartbeatKey{}, ah)
+}
 
-		timer.Reset(cfg.Interval)
-	}
+// appHeartbeatFrom returns the session's heartbeat, or nil outside a session.
+func appHeartbeatFrom(ctx context.Context) *AppHeartbeat {
+	ah, _ := ctx.Value(appHeartbeatKey{}).(*AppHeartbeat)
+	return ah
 }
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// interactiveHelp lists the REPL's slash commands.
+const interactiveHelp = `Commands:
+  /ping   measure the round trip to the server
+  /stats  show connection and heartbeat statistics
+  /help   show this list
+  /quit   close the connection and exit
+Any other line is sent to the server as a message.`
+
+// replStats counts the REPL's traffic across reconnects.
+type replStats struct {
+	sent     atomic.Int64 // Lines sent to the server
+	received atomic.Int64 // Replies and other messages printed
+	sessions atomic.Int64 // Connections established
+}
+
+// RunInteractive connects like Run, but sends the lines read from in
+// instead of the test messages. Replies are printed to out as they arrive,
+// so they can show up while the next line is being typed. Lines starting
+// with "/" are commands (see interactiveHelp); /quit or the end of in
+// closes the connection and returns nil. Lines typed while reconnecting
+// are sent once the new connection is up.
+func RunInteractive(ctx context.Context, in io.Reader, out io.Writer) error {
+	rc, serverURL := newClientFromEnv()
+	var stats replStats
+
+	// Read input on its own goroutine so a session can wait for a line,
+	// a reply and a broken connection at the same time. Reading stdin
+	// can't be interrupted, so this goroutine outlives the client
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	slog.Info("Connecting to server", "url", serverURL)
+	fmt.Fprintln(out, "Type a message and press Enter, /help lists commands.")
+	rc.Session = func(ctx context.Context, conn *websocket.Conn) error {
+		breaker := rc.Breaker // Counts failures across reconnects
+		connected := time.Now()
+		stats.sessions.Add(1)
+
+		// Print everything the server sends as it arrives; the reader
+		// already handles heartbeat traffic, probes and rate limit notices
+		p := startPump(ctx, conn, breaker, func(ctx context.Context, typ websocket.MessageType, data []byte) {
+			stats.received.Add(1)
+			fmt.Fprintf(out, "< %s\n", decodeText(ctx, typ, data))
+		})
+		defer p.stop()
+
+		for {
+			var line string
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-p.done():
+				return p.err()
+			case line, ok = <-lines:
+			}
+			if !ok {
+				CloseWith(conn, CloseNormal, "Client finished")
+				return nil // End of input - same as /quit
+			}
+
+			line = strings.TrimSpace(line)
+			switch {
+			case line == "":
+				continue
+			case line == "/quit":
+				CloseWith(conn, CloseNormal, "Client finished")
+				return nil
+			case line == "/help":
+				fmt.Fprintln(out, interactiveHelp)
+			case line == "/ping":
+				replPing(ctx, conn, out)
+			case line == "/stats":
+				replPrintStats(ctx, out, rc, &stats, breaker, connected)
+			case strings.HasPrefix(line, "/"):
+				fmt.Fprintf(out, "Unknown command %s - /help lists commands\n", line)
+			default:
+				typ, data, err := encodeText(ctx, line)
+				if err != nil {
+					return err
+				}
+				err = p.write(ctx, typ, data)
+				if errors.Is(err, ErrCircuitOpen) {
+					fmt.Fprintln(out, "Not sent: the connection is degraded, try again shortly")
+					continue
+				}
+				if err != nil {
+					return p.err() // The writer stopped the session
+				}
+				stats.sent.Add(1)
+			}
+		}
+	}
+
+	if err := rc.Run(ctx); err != nil {
+		return err
+	}
+	slog.Info("WebSocket connection closed")
+	return nil
+}
+
+// replPing sends a WebSocket ping and prints the round trip. The pong is
+// read by the session's reader goroutine.
+func replPing(ctx context.Context, conn *websocket.Conn, out io.Writer) {
+	pingCtx, cancel := context.WithTimeout(ctx, messageTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := conn.Ping(pingCtx); err != nil {
+		fmt.Fprintf(out, "Ping failed: %v\n", err)
+		return
+	}
+	fmt.Fprintf(out, "Pong in %v\n", time.Since(start).Round(time.Microsecond))
+}
+
+// replPrintStats prints the session's counters, the reconnect statistics
+// and the heartbeat's view of the connection.
+func replPrintStats(ctx context.Context, out io.Writer, rc *ReconnectingClient, stats *replStats,
+	breaker *CircuitBreaker, connected time.Time) {
+	fmt.Fprintf(out, "Connected to %s for %v (connection %d)\n",
+		rc.URL, time.Since(connected).Round(time.Second), stats.sessions.Load())
+	fmt.Fprintf(out, "Messages: %d sent, %d received\n", stats.sent.Load(), stats.received.Load())
+	fmt.Fprintf(out, "Dial attempts: %d (%d failed, %d delayed by the server)\n",
+		rc.Metrics.Attempts.Load(), rc.Metrics.Failures.Load(), rc.Metrics.ServerDirectedDelays.Load())
+	fmt.Fprintf(out, "Circuit breaker: %s\n", breaker.State())
+
+	if ah := appHeartbeatFrom(ctx); ah != nil {
+		st := ah.Health()
+		fmt.Fprintf(out, "Heartbeat: %s, latency %v, jitter %v, %d missed\n",
+			st.State, st.Latency.Round(time.Millisecond), st.Jitter.Round(time.Millisecond), st.Missed)
+		if n, ok := ah.Reported(); ok {
+			fmt.Fprintf(out, "Server reports: %s, latency %dms\n", n.State, n.LatencyMs)
+		}
+	}
+}
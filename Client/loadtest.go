@@ -0,0 +1,337 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// LoadTestConfig describes a load test: Connections clients connect at
+// once (spread over RampUp), each sending Rate messages per second to an
+// echo endpoint for Duration.
+type LoadTestConfig struct {
+	URL         string
+	Connections int           // Concurrent connections
+	Rate        float64       // Messages per second per connection (0 = connect only)
+	Duration    time.Duration // How long connections send, after the ramp-up
+	RampUp      time.Duration // Time over which connections are opened
+	Options     []Option      // Applied to every connection, e.g. WithCodec or WithAuth
+	Logger      *slog.Logger  // Where the connections log (nil = discarded)
+}
+
+// DefaultLoadTestConfig returns a 30s test with 10 connections sending a
+// message per second each, opened over one second.
+func DefaultLoadTestConfig() LoadTestConfig {
+	return LoadTestConfig{
+		URL:         defaultServerURL,
+		Connections: 10,
+		Rate:        1,
+		Duration:    30 * time.Second,
+		RampUp:      time.Second,
+	}
+}
+
+// LoadTestReport is the outcome of a load test. Latency is the time from
+// sending a message to receiving its echo.
+type LoadTestReport struct {
+	Connections int            // Connections attempted
+	Connected   int            // Connections the server accepted
+	Refused     map[string]int // Failed connection attempts by reason
+	Dropped     map[string]int // Accepted connections lost before the end, by reason
+
+	Sent       int64         // Messages written
+	Received   int64         // Echoes received
+	SendErrors int64         // Messages that could not be written
+	Elapsed    time.Duration // From the first dial to the end of sending
+	Throughput float64       // Echoes per second over Elapsed
+
+	Latency   LatencySummary // Message round trips
+	Heartbeat LatencySummary // Heartbeat ping round trips
+}
+
+// LatencySummary summarizes round-trip samples.
+type LatencySummary struct {
+	Samples            int
+	Avg, P50, P95, P99 time.Duration
+	Max                time.Duration
+}
+
+// SuccessRate returns the share of connections the server accepted.
+func (r LoadTestReport) SuccessRate() float64 {
+	if r.Connections == 0 {
+		return 0
+	}
+	return float64(r.Connected) / float64(r.Connections)
+}
+
+// Reasons a connection failed or was lost.
+const (
+	loadRateLimited   = "rate_limited"
+	loadAuthFailed    = "auth_failed"
+	loadHeartbeatLost = "heartbeat_lost"
+	loadOther         = "other"
+)
+
+// loadPayload is the payload of a load test message; the echo returns it,
+// so the round trip is measured without keeping track of messages.
+type loadPayload struct {
+	Conn int   `json:"conn"`
+	Seq  int   `json:"seq"`
+	Sent int64 `json:"sent"` // UnixNano
+}
+
+// loadTest collects the results of a running load test.
+type loadTest struct {
+	cfg  LoadTestConfig
+	stop chan struct{} // Closed when the connections should stop sending
+
+	sent, received, sendErrors atomic.Int64
+
+	mu        sync.Mutex
+	connected int
+	refused   map[string]int
+	dropped   map[string]int
+	latencies []time.Duration
+	heartbeat []time.Duration
+}
+
+// RunLoadTest runs a load test against an echo endpoint (such as /ws) and
+// reports connection success, throughput and latency percentiles. Every
+// connection runs the full client - heartbeat, protocol and codec
+// negotiation - but doesn't reconnect: a lost connection is reported as
+// dropped. Cancelling ctx ends the test early with the results so far.
+func RunLoadTest(ctx context.Context, cfg LoadTestConfig) (LoadTestReport, error) {
+	if cfg.Connections < 1 {
+		return LoadTestReport{}, errors.New("load test needs at least one connection")
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.DiscardHandler)
+	}
+	lt := &loadTest{
+		cfg:     cfg,
+		stop:    make(chan struct{}),
+		refused: make(map[string]int),
+		dropped: make(map[string]int),
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range cfg.Connections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Spread the dials evenly over the ramp-up
+			delay := time.Duration(int64(cfg.RampUp) * int64(i) / int64(cfg.Connections))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			lt.run(ctx, i)
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(cfg.RampUp + cfg.Duration):
+	}
+	elapsed := time.Since(start)
+	close(lt.stop)
+	wg.Wait()
+	return lt.report(elapsed), nil
+}
+
+// RunLoadTestFromEnv runs the load test of the CLI's loadtest mode: cfg's
+// URL and Options come from the same environment variables as the client
+// mode (SERVER_URL, AUTH_TOKEN, HEARTBEAT_MODE, CODEC). The report is
+// written to out.
+func RunLoadTestFromEnv(ctx context.Context, cfg LoadTestConfig, out io.Writer) error {
+	cfg.URL = serverURLFromEnv()
+	cfg.Options = optionsFromEnv()
+	slog.Info("Starting load test", "url", cfg.URL, "connections", cfg.Connections,
+		"rate", cfg.Rate, "duration", cfg.Duration, "ramp_up", cfg.RampUp)
+	report, err := RunLoadTest(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	report.Print(out)
+	return nil
+}
+
+// run opens connection i and sends until the test stops.
+func (lt *loadTest) run(ctx context.Context, i int) {
+	opts := append(slices.Clone(lt.cfg.Options),
+		WithBackoff(BackoffConfig{MaxAttempts: 1}), // One attempt - the test measures it
+		WithLogger(lt.cfg.Logger.With("load_conn", i)),
+		WithMetricsSink(lt))
+	rc := NewClient(lt.cfg.URL, func(ctx context.Context, conn *websocket.Conn) error {
+		lt.session(ctx, conn, i)
+		return nil // Never reconnect
+	}, opts...)
+	if err := rc.Run(ctx); err != nil && ctx.Err() == nil {
+		lt.count(lt.refused, loadReason(err))
+	}
+}
+
+// session sends on one connection at the configured rate and measures the
+// echoes, until the test stops or the connection is lost.
+func (lt *loadTest) session(ctx context.Context, conn *websocket.Conn, i int) {
+	lt.mu.Lock()
+	lt.connected++
+	lt.mu.Unlock()
+
+	p := startPump(ctx, conn, NewCircuitBreaker(DefaultCircuitBreakerConfig()), func(ctx context.Context, typ websocket.MessageType, data []byte) {
+		m, err := DecodeMessage(ctx, data)
+		var payload loadPayload
+		if err != nil || m.Type != MessageTypeEcho || m.DecodePayload(&payload) != nil || payload.Sent == 0 {
+			return // Not an echo of ours
+		}
+		lt.received.Add(1)
+		rtt := time.Since(time.Unix(0, payload.Sent))
+		lt.mu.Lock()
+		lt.latencies = append(lt.latencies, rtt)
+		lt.mu.Unlock()
+	})
+	defer p.stop()
+
+	var tick <-chan time.Time
+	if lt.cfg.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / lt.cfg.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for seq := 1; ; seq++ {
+		select {
+		case <-lt.stop:
+			CloseWith(conn, CloseNormal, "Load test finished")
+			return
+		case <-p.done():
+			if ctx.Err() == nil {
+				lt.count(lt.dropped, loadReason(p.err()))
+			}
+			return
+		case <-tick:
+		}
+		data, err := NewMessage(ctx, MessageTypeMessage, loadPayload{Conn: i, Seq: seq, Sent: time.Now().UnixNano()})
+		if err == nil {
+			err = p.write(ctx, MessageFrameType(ctx), data)
+		}
+		if err != nil {
+			lt.sendErrors.Add(1)
+			continue // A lost connection shows up through done
+		}
+		lt.sent.Add(1)
+	}
+}
+
+// count adds one to reason in m.
+func (lt *loadTest) count(m map[string]int, reason string) {
+	lt.mu.Lock()
+	m[reason]++
+	lt.mu.Unlock()
+}
+
+// loadReason classifies why a connection failed or was lost.
+func loadReason(err error) string {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return loadRateLimited
+	case errors.Is(err, ErrAuthFailed):
+		return loadAuthFailed
+	case errors.Is(err, ErrHeartbeatLost):
+		return loadHeartbeatLost
+	}
+	return loadOther
+}
+
+// OnLatencySample records a heartbeat round trip (MetricsSink).
+func (lt *loadTest) OnLatencySample(rtt time.Duration) {
+	lt.mu.Lock()
+	lt.heartbeat = append(lt.heartbeat, rtt)
+	lt.mu.Unlock()
+}
+
+// OnReconnect is never called: load test sessions don't reconnect.
+func (lt *loadTest) OnReconnect(int, time.Duration, error) {}
+
+// OnSendError is counted by session instead.
+func (lt *loadTest) OnSendError(error) {}
+
+// report summarizes the results.
+func (lt *loadTest) report(elapsed time.Duration) LoadTestReport {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	r := LoadTestReport{
+		Connections: lt.cfg.Connections,
+		Connected:   lt.connected,
+		Refused:     lt.refused,
+		Dropped:     lt.dropped,
+		Sent:        lt.sent.Load(),
+		Received:    lt.received.Load(),
+		SendErrors:  lt.sendErrors.Load(),
+		Elapsed:     elapsed,
+		Latency:     summarize(lt.latencies),
+		Heartbeat:   summarize(lt.heartbeat),
+	}
+	if elapsed > 0 {
+		r.Throughput = float64(r.Received) / elapsed.Seconds()
+	}
+	return r
+}
+
+// summarize computes the latency summary of samples, sorting them.
+func summarize(samples []time.Duration) LatencySummary {
+	if len(samples) == 0 {
+		return LatencySummary{}
+	}
+	slices.Sort(samples)
+	var sum time.Duration
+	for _, d := range samples {
+		sum += d
+	}
+	at := func(q float64) time.Duration {
+		return samples[int(q*float64(len(samples)-1))]
+	}
+	return LatencySummary{
+		Samples: len(samples),
+		Avg:     sum / time.Duration(len(samples)),
+		P50:     at(0.50),
+		P95:     at(0.95),
+		P99:     at(0.99),
+		Max:     samples[len(samples)-1],
+	}
+}
+
+// Print writes the report in a human-readable form.
+func (r LoadTestReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "Connections: %d/%d connected (%.1f%%)\n", r.Connected, r.Connections, 100*r.SuccessRate())
+	for reason, n := range r.Refused {
+		fmt.Fprintf(w, "  refused (%s): %d\n", reason, n)
+	}
+	for reason, n := range r.Dropped {
+		fmt.Fprintf(w, "  dropped (%s): %d\n", reason, n)
+	}
+	fmt.Fprintf(w, "Messages: %d sent, %d echoed, %d send errors in %v (%.1f msg/s)\n",
+		r.Sent, r.Received, r.SendErrors, r.Elapsed.Round(time.Millisecond), r.Throughput)
+	printLatency(w, "Message latency", r.Latency)
+	printLatency(w, "Heartbeat RTT", r.Heartbeat)
+}
+
+// printLatency writes one latency summary line.
+func printLatency(w io.Writer, name string, s LatencySummary) {
+	if s.Samples == 0 {
+		fmt.Fprintf(w, "%s: no samples\n", name)
+		return
+	}
+	round := func(d time.Duration) time.Duration { return d.Round(10 * time.Microsecond) }
+	fmt.Fprintf(w, "%s: avg %v, p50 %v, p95 %v, p99 %v, max %v (%d samples)\n",
+		name, round(s.Avg), round(s.P50), round(s.P95), round(s.P99), round(s.Max), s.Samples)
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// MetricsSink receives client health events as they happen, so embedding
+// applications can feed them into their own monitoring (a Prometheus
+// client, a mobile analytics SDK, ...) instead of scraping logs. Methods
+// are called from the client's goroutines and must not block.
+type MetricsSink interface {
+	// OnLatencySample reports the round trip of an answered heartbeat ping.
+	OnLatencySample(rtt time.Duration)
+
+	// OnReconnect reports a lost connection: cause is why the session
+	// ended, and the client re-dials after delay. attempt counts the
+	// consecutive short-lived sessions (1 after a stable one).
+	OnReconnect(attempt int, delay time.Duration, cause error)
+
+	// OnSendError reports a message SendFrame could not send, including
+	// ones the circuit breaker refused.
+	OnSendError(err error)
+}
+
+// WithMetricsSink reports the client's health events to sink.
+func WithMetricsSink(sink MetricsSink) Option {
+	return func(rc *ReconnectingClient) { rc.Sink = sink }
+}
+
+// metricsSinkKey is the context key for the session's MetricsSink.
+type metricsSinkKey struct{}
+
+// withMetricsSink returns a copy of ctx carrying sink, if there is one.
+func withMetricsSink(ctx context.Context, sink MetricsSink) context.Context {
+	if sink == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, metricsSinkKey{}, sink)
+}
+
+// reportSendError passes err to the sink of the session ctx belongs to.
+func reportSendError(ctx context.Context, err error) {
+	if sink, ok := ctx.Value(metricsSinkKey{}).(MetricsSink); ok {
+		sink.OnSendError(err)
+	}
+}
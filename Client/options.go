@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// Option customizes a client created by NewClient. Options are applied in
+// order over the defaults (DefaultBackoffConfig,
+// DefaultClientHeartbeatConfig, slog.Default()), so a later option
+// overrides an earlier one. Fields set on the returned client afterwards
+// override both.
+type Option func(*ReconnectingClient)
+
+// TokenProvider returns the bearer token for the next dial. It is called
+// before every connection attempt series, so tokens can expire and be
+// refreshed between reconnects.
+type TokenProvider func(ctx context.Context) (string, error)
+
+// StaticToken returns a TokenProvider that always returns token.
+func StaticToken(token string) TokenProvider {
+	return func(context.Context) (string, error) { return token, nil }
+}
+
+// NewClient creates a reconnecting client for url that runs session on
+// every connection, configured by opts.
+func NewClient(url string, session SessionFunc, opts ...Option) *ReconnectingClient {
+	rc := NewReconnectingClient(url, session)
+	for _, opt := range opts {
+		opt(rc)
+	}
+	return rc
+}
+
+// WithHeartbeat sets the heartbeat the client proposes. The server may
+// adjust it within its policy.
+func WithHeartbeat(cfg HeartbeatConfig) Option {
+	return func(rc *ReconnectingClient) { rc.Heartbeat = cfg }
+}
+
+// WithHeader adds h to the headers of every upgrade request, e.g. an API
+// key or a tracing header. Headers the client negotiates with (heartbeat,
+// protocol, session) are set over it.
+func WithHeader(h http.Header) Option {
+	return func(rc *ReconnectingClient) {
+		for k, v := range h {
+			rc.Header[k] = append(rc.Header[k], v...)
+		}
+	}
+}
+
+// WithDeviceID names the device the client runs on in every upgrade
+// request. A server that takes over duplicate connections then closes
+// the user's older connection from the same device - e.g. one that went
+// half-open - and resumes its session on the new one.
+func WithDeviceID(id string) Option {
+	return func(rc *ReconnectingClient) { rc.Header.Set(protocol.HeaderDevice, id) }
+}
+
+// WithTLS dials wss:// URLs with cfg, e.g. to trust a private CA or to
+// present a client certificate.
+func WithTLS(cfg *tls.Config) Option {
+	return func(rc *ReconnectingClient) { rc.TLS = cfg }
+}
+
+// WithAuth sends "Authorization: Bearer <token>" with every upgrade, the
+// token coming from provider. It overrides an Authorization header set
+// in Header.
+func WithAuth(provider TokenProvider) Option {
+	return func(rc *ReconnectingClient) { rc.Token = provider }
+}
+
+// WithProtocol sets the highest message protocol version the client
+// proposes. ProtocolRaw sends plain text, as clients before versioning did.
+func WithProtocol(version int) Option {
+	return func(rc *ReconnectingClient) { rc.Protocol = version }
+}
+
+// WithCodec asks the server to encode envelopes with c, e.g. CodecMsgPack
+// for smaller telemetry messages. Servers that don't support it answer
+// with JSON.
+func WithCodec(c Codec) Option {
+	return func(rc *ReconnectingClient) { rc.Codec = c }
+}
+
+// WithCapabilities proposes capabilities to the server, e.g. "rpc" for
+// JSON-RPC on the default /ws endpoint. The server agrees to those it
+// serves (see Connected.Capabilities); messages of a capability carry its
+// name in Message.Stream, in both directions. Capabilities need envelopes,
+// so raw text clients (see WithProtocol) propose none.
+func WithCapabilities(caps ...string) Option {
+	return func(rc *ReconnectingClient) { rc.Capabilities = caps }
+}
+
+// WithCircuitBreaker replaces the default circuit breaker around sends.
+func WithCircuitBreaker(cfg CircuitBreakerConfig) Option {
+	return func(rc *ReconnectingClient) { rc.Breaker = NewCircuitBreaker(cfg) }
+}
+
+// WithBackoff sets the re-dial schedule.
+func WithBackoff(cfg BackoffConfig) Option {
+	return func(rc *ReconnectingClient) { rc.Backoff = cfg }
+}
+
+// WithLogger makes the client log through l instead of slog.Default().
+// Each connection's logger derives from it, adding conn_id.
+func WithLogger(l *slog.Logger) Option {
+	return func(rc *ReconnectingClient) { rc.Log = l }
+}
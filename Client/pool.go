@@ -0,0 +1,427 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pool selection strategies.
+const (
+	PoolRoundRobin  = "round_robin"  // Take turns (the default)
+	PoolLeastLoaded = "least_loaded" // The connection with the fewest sends and calls in flight
+)
+
+// PoolConfig sizes a Pool and sets how it picks and replaces connections.
+type PoolConfig struct {
+	Size       int           // Connections kept open
+	Strategy   string        // PoolRoundRobin or PoolLeastLoaded
+	Cooldown   time.Duration // How long a connection that missed a heartbeat or failed a send is passed over
+	EvictAfter time.Duration // A connection reconnecting for longer is replaced by a new one
+}
+
+// DefaultPoolConfig returns four connections taken in turns, passing over
+// a troubled one for 30 seconds and replacing one that stays down for a
+// minute.
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{Size: 4, Strategy: PoolRoundRobin, Cooldown: 30 * time.Second, EvictAfter: time.Minute}
+}
+
+// Pool keeps several persistent connections to one server, for services
+// that push more messages into its hub than one connection carries - each
+// server connection has its own rate limit and send queue. Sends and calls
+// go to a healthy connection picked by the configured strategy; one that
+// fails before its message was written is retried on the next. Connections that lost their heartbeat or
+// failed a send are passed over for a while, and ones that stay down or
+// stop for good are replaced:
+//
+//	pool, err := client.NewPool(ctx, "wss://hub.example.com/ws", client.DefaultPoolConfig(),
+//		client.WithAuth(client.StaticToken(token)))
+//	...
+//	defer pool.Close()
+//	err = pool.Send(msg)
+//
+// Safe for concurrent use.
+type Pool struct {
+	url      string
+	cfg      PoolConfig
+	opts     []Option
+	received chan Message
+	ctx      context.Context // Bounds replacement dials; cancelled by Close
+	cancel   context.CancelFunc
+	next     atomic.Uint64 // Round-robin cursor
+	evicted  atomic.Int64
+
+	mu      sync.Mutex
+	members []*poolMember
+	closed  bool
+	wg      sync.WaitGroup // Watchers, forwarders and replacements
+}
+
+// poolMember is one connection of a pool and what the pool knows of its
+// health.
+type poolMember struct {
+	c        *Client
+	inflight atomic.Int64
+
+	mu           sync.Mutex
+	up           bool      // Connected, according to the client's events
+	downSince    time.Time // When it last went down
+	suspectUntil time.Time // Passed over until then
+}
+
+// ErrPoolExhausted is returned by a Pool's Send and Call when no
+// connection is up.
+var ErrPoolExhausted = errors.New("no connection in the pool is up")
+
+// NewPool connects cfg.Size clients to url with opts - those of Connect -
+// and returns once they are established. Connections that fail to dial
+// are retried in the background; NewPool fails only if none comes up.
+func NewPool(ctx context.Context, url string, cfg PoolConfig, opts ...Option) (*Pool, error) {
+	def := DefaultPoolConfig()
+	if cfg.Size <= 0 {
+		cfg.Size = def.Size
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = def.Cooldown
+	}
+	if cfg.EvictAfter <= 0 {
+		cfg.EvictAfter = def.EvictAfter
+	}
+	switch cfg.Strategy {
+	case "":
+		cfg.Strategy = PoolRoundRobin
+	case PoolRoundRobin, PoolLeastLoaded:
+	default:
+		return nil, fmt.Errorf("unknown pool strategy %q (want %s or %s)", cfg.Strategy, PoolRoundRobin, PoolLeastLoaded)
+	}
+	// Keep ctx's values but not its deadline, like Connect
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	p := &Pool{
+		url:      url,
+		cfg:      cfg,
+		opts:     opts,
+		received: make(chan Message, receiveBuffer),
+		ctx:      runCtx,
+		cancel:   cancel,
+	}
+
+	errs := make(chan error, cfg.Size)
+	for range cfg.Size {
+		go func() { errs <- p.add(ctx) }()
+	}
+	var firstErr error
+	failed := 0
+	for range cfg.Size {
+		if err := <-errs; err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if failed == cfg.Size {
+		p.Close()
+		return nil, fmt.Errorf("connect pool: %w", firstErr)
+	}
+	for range failed {
+		p.replace()
+	}
+	p.wg.Add(1)
+	go p.evictLoop()
+	return p, nil
+}
+
+// add connects one more client and starts watching it.
+func (p *Pool) add(ctx context.Context) error {
+	// Ask for the event channel before the client runs, so it sees the
+	// first Connected
+	opts := append(slices.Clip(p.opts), func(rc *ReconnectingClient) { rc.Events() })
+	c, err := Connect(ctx, p.url, opts...)
+	if err != nil {
+		return err
+	}
+	m := &poolMember{c: c, up: true}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		c.Close()
+		return ErrClosed
+	}
+	p.members = append(p.members, m)
+	p.wg.Add(2)
+	p.mu.Unlock()
+	go p.watch(m)
+	go p.forward(m)
+	return nil
+}
+
+// watch follows m's events: it is up between Connected and Disconnected,
+// passed over for a while after a heartbeat miss, and replaced once its
+// client stopped.
+func (p *Pool) watch(m *poolMember) {
+	defer p.wg.Done()
+	events := m.c.rc.Events()
+	for {
+		var ev Event
+		select {
+		case ev = <-events:
+		case <-m.c.done:
+			ev = Stopped{Err: m.c.Err()} // Its Stopped may have been discarded
+		}
+		m.mu.Lock()
+		switch ev := ev.(type) {
+		case Connected:
+			m.up = true
+		case Disconnected, Reconnecting:
+			if m.up {
+				m.up, m.downSince = false, time.Now()
+			}
+		case HeartbeatMiss:
+			m.suspectUntil = time.Now().Add(p.cfg.Cooldown)
+		case Stopped:
+			m.up = false
+			m.mu.Unlock()
+			if p.evict(m) {
+				m.c.rc.Logger().Warn("Pool connection stopped - replacing it", "error", ev.Err)
+			}
+			return
+		}
+		m.mu.Unlock()
+	}
+}
+
+// forward passes m's messages on to the pool's Receive.
+func (p *Pool) forward(m *poolMember) {
+	defer p.wg.Done()
+	for msg := range m.c.Receive() {
+		select {
+		case p.received <- msg:
+		case <-p.ctx.Done(): // Closing - drain, so the client can stop
+		}
+	}
+}
+
+// evictLoop replaces connections that have been reconnecting for longer
+// than EvictAfter: a fresh connection may reach a server that's up.
+func (p *Pool) evictLoop() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(min(p.cfg.EvictAfter, p.cfg.Cooldown) / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			members := slices.Clone(p.members)
+			p.mu.Unlock()
+			for _, m := range members {
+				m.mu.Lock()
+				stale := !m.up && now.Sub(m.downSince) > p.cfg.EvictAfter
+				m.mu.Unlock()
+				if stale && p.evict(m) {
+					m.c.rc.Logger().Warn("Pool connection down too long - replacing it", "evict_after", p.cfg.EvictAfter)
+					go m.c.Close() // Its watcher returns once it stopped
+				}
+			}
+		}
+	}
+}
+
+// evict removes m from the pool and dials a replacement. Returns false if
+// m was already gone or the pool is closing.
+func (p *Pool) evict(m *poolMember) bool {
+	p.mu.Lock()
+	i := slices.Index(p.members, m)
+	if i < 0 || p.closed {
+		p.mu.Unlock()
+		return false
+	}
+	p.members = slices.Delete(p.members, i, i+1)
+	p.mu.Unlock()
+	p.evicted.Add(1)
+	p.replace()
+	return true
+}
+
+// replace dials a new connection in the background, retrying every
+// Cooldown until one is up or the pool is closed.
+func (p *Pool) replace() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			err := p.add(p.ctx)
+			if err == nil || p.ctx.Err() != nil {
+				return
+			}
+			select {
+			case <-time.After(p.cfg.Cooldown):
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// pick returns the connections to try, best first: those that are up and
+// not passed over, by strategy, then those that are up but passed over.
+func (p *Pool) pick() []*poolMember {
+	p.mu.Lock()
+	members := slices.Clone(p.members)
+	p.mu.Unlock()
+
+	now := time.Now()
+	var healthy, suspect []*poolMember
+	for _, m := range members {
+		m.mu.Lock()
+		switch {
+		case !m.up:
+		case now.Before(m.suspectUntil):
+			suspect = append(suspect, m)
+		default:
+			healthy = append(healthy, m)
+		}
+		m.mu.Unlock()
+	}
+	if n := len(healthy); n > 1 {
+		start := int(p.next.Add(1) % uint64(n))
+		healthy = slices.Concat(healthy[start:], healthy[:start])
+	}
+	if p.cfg.Strategy == PoolLeastLoaded {
+		// Equally loaded connections still take turns
+		slices.SortStableFunc(healthy, func(a, b *poolMember) int {
+			return int(a.inflight.Load() - b.inflight.Load())
+		})
+	}
+	return append(healthy, suspect...)
+}
+
+// do runs op on the picked connections until one succeeds or fails for
+// another reason than the message not being sent. Once a frame may have
+// reached the server - a failed write, a reply that didn't come - trying
+// the next connection could deliver the message twice.
+func (p *Pool) do(ctx context.Context, op func(c *Client) error) error {
+	candidates := p.pick()
+	if len(candidates) == 0 {
+		return ErrPoolExhausted
+	}
+	var err error
+	for _, m := range candidates {
+		m.inflight.Add(1)
+		err = op(m.c)
+		m.inflight.Add(-1)
+		var replyErr *ReplyError
+		if err == nil || ctx.Err() != nil || errors.As(err, &replyErr) {
+			return err
+		}
+		// The connection is in trouble - give it time to recover
+		m.mu.Lock()
+		m.suspectUntil = time.Now().Add(p.cfg.Cooldown)
+		m.mu.Unlock()
+		if !notSent(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// Send sends msg on one of the pool's connections, see Client.Send.
+// Returns ErrPoolExhausted when none is up.
+func (p *Pool) Send(msg Message) error {
+	return p.SendContext(context.Background(), msg)
+}
+
+// SendContext is Send, giving up when ctx is done.
+func (p *Pool) SendContext(ctx context.Context, msg Message) error {
+	return p.do(ctx, func(c *Client) error { return c.SendContext(ctx, msg) })
+}
+
+// Call sends msg on one of the pool's connections and waits for the reply,
+// see Client.Call. A send that fails before the message was written is
+// retried on the next connection. Anything after that is final: a reply,
+// including an error reply, a failed write and a reply that never came.
+func (p *Pool) Call(ctx context.Context, msg Message) (Message, error) {
+	var reply Message
+	err := p.do(ctx, func(c *Client) error {
+		var err error
+		reply, err = c.Call(ctx, msg)
+		return err
+	})
+	return reply, err
+}
+
+// Receive returns the messages the server sends on any of the pool's
+// connections. Replies to Call don't show up. Keep reading, see
+// Client.Receive. The channel is closed by Close.
+func (p *Pool) Receive() <-chan Message {
+	return p.received
+}
+
+// PoolStats describes a pool's connections.
+type PoolStats struct {
+	Size     int   // Connections in the pool, up or not
+	Up       int   // Connections that are up
+	Healthy  int   // Up and not passed over
+	InFlight int64 // Sends and calls in progress
+	Evicted  int64 // Connections replaced since the pool started
+}
+
+// Stats returns a snapshot of the pool's connections.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	members := slices.Clone(p.members)
+	p.mu.Unlock()
+
+	now := time.Now()
+	st := PoolStats{Size: len(members), Evicted: p.evicted.Load()}
+	for _, m := range members {
+		st.InFlight += m.inflight.Load()
+		m.mu.Lock()
+		if m.up {
+			st.Up++
+			if !now.Before(m.suspectUntil) {
+				st.Healthy++
+			}
+		}
+		m.mu.Unlock()
+	}
+	return st
+}
+
+// Close closes every connection normally and stops replacing them.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	members := p.members
+	p.members = nil
+	p.mu.Unlock()
+	p.cancel() // Stops replacements; forwarders drain from here on
+
+	var wg sync.WaitGroup
+	for _, m := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.c.Close()
+		}()
+	}
+	wg.Wait()
+	p.wg.Wait()
+	close(p.received)
+	return nil
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// TestPoolRetriesOnlyUnsent checks that the pool tries the next connection
+// only when the message never reached the first one.
+func TestPoolRetriesOnlyUnsent(t *testing.T) {
+	written := errors.New("failed to write frame: broken pipe")
+	tests := []struct {
+		name  string
+		err   error
+		tries int
+	}{
+		{"client closed before the write", notSentError{ErrClosed}, 2},
+		{"connection lost before the write", notSentError{written}, 2},
+		{"circuit open", ErrCircuitOpen, 2},
+		{"write failed", written, 1},
+		{"client closed while waiting for the reply", ErrClosed, 1},
+		{"error reply", &ReplyError{Code: "unsupported_type"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Pool{cfg: DefaultPoolConfig()}
+			p.members = []*poolMember{{up: true}, {up: true}}
+			tries := 0
+			err := p.do(context.Background(), func(*Client) error {
+				tries++
+				if tries == 1 {
+					return tt.err
+				}
+				return nil
+			})
+			if tries != tt.tries {
+				t.Fatalf("tried %d connections, want %d (err %v)", tries, tt.tries, err)
+			}
+			if tt.tries == 1 && !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestPoolCallTimeoutIsFinal checks that a call whose reply didn't come in
+// time is not sent again on another connection.
+func TestPoolCallTimeoutIsFinal(t *testing.T) {
+	p := &Pool{cfg: DefaultPoolConfig()}
+	p.members = []*poolMember{{up: true}, {up: true}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	tries := 0
+	err := p.do(ctx, func(*Client) error {
+		tries++
+		<-ctx.Done() // Written; the reply never comes
+		return ctx.Err()
+	})
+	if tries != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("tried %d connections with %v, want 1 and the deadline", tries, err)
+	}
+}
+
+// TestPoolPicksHealthyFirst checks the order connections are tried in:
+// healthy ones taking turns, then those passed over; ones that are down
+// never.
+func TestPoolPicksHealthyFirst(t *testing.T) {
+	a, b, c := &poolMember{up: true}, &poolMember{up: true}, &poolMember{up: true}
+	suspect := &poolMember{up: true, suspectUntil: time.Now().Add(time.Minute)}
+	down := &poolMember{downSince: time.Now()}
+	p := &Pool{cfg: DefaultPoolConfig()}
+	p.members = []*poolMember{a, suspect, b, down, c}
+
+	first := make(map[*poolMember]int)
+	for range 6 {
+		picked := p.pick()
+		if len(picked) != 4 || picked[3] != suspect {
+			t.Fatalf("picked %d connections ending with %p, want 4 ending with the suspect one", len(picked), picked[len(picked)-1])
+		}
+		first[picked[0]]++
+	}
+	if first[a] != 2 || first[b] != 2 || first[c] != 2 {
+		t.Fatalf("healthy connections went first %d, %d and %d times in 6 picks, want 2 each", first[a], first[b], first[c])
+	}
+}
+
+// TestPoolPicksLeastLoaded checks that the least_loaded strategy tries the
+// connection with the fewest messages in flight first, and that equally
+// loaded ones take turns.
+func TestPoolPicksLeastLoaded(t *testing.T) {
+	busy, idle, alsoIdle := &poolMember{up: true}, &poolMember{up: true}, &poolMember{up: true}
+	busy.inflight.Store(3)
+	p := &Pool{cfg: PoolConfig{Strategy: PoolLeastLoaded}}
+	p.members = []*poolMember{busy, idle, alsoIdle}
+
+	first := make(map[*poolMember]int)
+	for range len(p.members) { // One round of the cursor
+		picked := p.pick()
+		if picked[2] != busy {
+			t.Fatal("the busy connection wasn't tried last")
+		}
+		first[picked[0]]++
+	}
+	if first[idle] == 0 || first[alsoIdle] == 0 {
+		t.Fatalf("idle connections went first %d and %d times in a round, want both", first[idle], first[alsoIdle])
+	}
+}
+
+// eventually fails the test unless cond holds within five seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+	}
+}
+
+// newTestPool connects a pool of two to an echo server.
+func newTestPool(t *testing.T, cfg PoolConfig) *Pool {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p, err := NewPool(ctx, echoServer(t), cfg)
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// TestPoolReplacesStoppedConnection checks that a connection that stopped
+// for good leaves the pool and a new one takes its place.
+func TestPoolReplacesStoppedConnection(t *testing.T) {
+	p := newTestPool(t, PoolConfig{Size: 2, Cooldown: 50 * time.Millisecond})
+	p.mu.Lock()
+	dead := p.members[0]
+	p.mu.Unlock()
+	dead.c.Close()
+
+	eventually(t, "the stopped connection was replaced", func() bool {
+		st := p.Stats()
+		return st.Evicted == 1 && st.Size == 2 && st.Up == 2
+	})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if slices.Contains(p.members, dead) {
+		t.Fatal("the stopped connection is still in the pool")
+	}
+}
+
+// downServer is an echo server that can drop its connections and refuse
+// new ones, like a server that went away.
+type downServer struct {
+	url    string
+	refuse atomic.Bool
+	mu     sync.Mutex
+	conns  []*websocket.Conn
+}
+
+func newDownServer(t *testing.T) *downServer {
+	t.Helper()
+	ds := &downServer{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ds.refuse.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		ds.mu.Lock()
+		ds.conns = append(ds.conns, conn)
+		ds.mu.Unlock()
+		for {
+			typ, data, err := conn.Read(r.Context())
+			if err != nil {
+				return
+			}
+			if err := conn.Write(r.Context(), typ, data); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	ds.url = "ws" + strings.TrimPrefix(srv.URL, "http")
+	return ds
+}
+
+// drop goes down and breaks the first connection it accepted.
+func (ds *downServer) drop() {
+	ds.refuse.Store(true)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.conns[0].CloseNow()
+}
+
+// TestPoolEvictsConnectionDownTooLong checks that sends avoid a connection
+// that is reconnecting, and that it is closed and replaced once it has
+// been down for longer than EvictAfter.
+func TestPoolEvictsConnectionDownTooLong(t *testing.T) {
+	ds := newDownServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p, err := NewPool(ctx, ds.url, PoolConfig{Size: 2, Cooldown: 50 * time.Millisecond, EvictAfter: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+	defer p.Close()
+
+	ds.drop()
+	eventually(t, "one connection is down", func() bool { return p.Stats().Up == 1 })
+	p.mu.Lock()
+	members := slices.Clone(p.members)
+	p.mu.Unlock()
+	picked := p.pick()
+	if len(picked) != 1 {
+		t.Fatalf("picked %d connections with one down, want 1", len(picked))
+	}
+	stale := members[0]
+	if stale == picked[0] {
+		stale = members[1]
+	}
+	msg, err := NewEnvelope(MessageTypeMessage, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Send(msg); err != nil {
+		t.Fatalf("send with one connection up: %v", err)
+	}
+
+	eventually(t, "the stale connection was evicted", func() bool { return p.Stats().Evicted == 1 })
+	select {
+	case <-stale.c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the evicted connection wasn't closed")
+	}
+	ds.refuse.Store(false) // Back up: the replacement gets through
+	eventually(t, "the replacement is up", func() bool {
+		st := p.Stats()
+		return st.Size == 2 && st.Up == 2
+	})
+}
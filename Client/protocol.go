@@ -0,0 +1,210 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/coder/websocket"
+
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// Message is the envelope of application messages once protocol version 1
+// or later was negotiated (see internal/protocol).
+type Message = protocol.Message
+
+// MessageError is the payload of a MessageTypeError message.
+type MessageError = protocol.ErrorPayload
+
+// Protocol versions and the header that negotiates them during the upgrade.
+const (
+	ProtocolRaw     = protocol.VersionRaw // Plain text messages (servers without versioning)
+	ProtocolV1      = protocol.Version1   // JSON Message envelopes
+	ProtocolCurrent = protocol.Current
+
+	HeaderProtocolVersion = protocol.HeaderVersion
+	HeaderCapabilities    = protocol.HeaderCapabilities // Capability negotiation, see WithCapabilities
+)
+
+// Built-in message types.
+const (
+	MessageTypeMessage = protocol.TypeMessage
+	MessageTypeEcho    = protocol.TypeEcho
+	MessageTypeError   = protocol.TypeError
+)
+
+// Codec encodes envelopes for the wire; it is negotiated as the WebSocket
+// subprotocol. Sessions without one use CodecJSON.
+type Codec = protocol.Codec
+
+// Built-in codecs.
+var (
+	CodecJSON     = protocol.JSON     // Text frames (the default)
+	CodecMsgPack  = protocol.MsgPack  // Binary frames
+	CodecProtobuf = protocol.Protobuf // Binary frames, smallest envelope
+)
+
+// CodecByName returns a built-in codec by short name ("json", "msgpack",
+// "protobuf") or subprotocol.
+func CodecByName(name string) (Codec, error) {
+	return protocol.CodecByName(name)
+}
+
+// NewMessage encodes a message of type typ with payload in the codec of
+// the session ctx belongs to. Send it with the frame type of
+// MessageFrameType.
+func NewMessage(ctx context.Context, typ string, payload any) ([]byte, error) {
+	m, err := protocol.New(typ, payload)
+	if err != nil {
+		return nil, err
+	}
+	return CodecFromContext(ctx).Encode(m)
+}
+
+// NewTraceID generates a random trace ID. Set it as the TraceID of the
+// messages one user action sends, so the server's log lines and the
+// messages it fans out for them can be followed back to the action.
+func NewTraceID() string {
+	return protocol.NewTraceID()
+}
+
+// DecodeMessage parses an envelope in the codec of the session ctx
+// belongs to.
+func DecodeMessage(ctx context.Context, data []byte) (Message, error) {
+	return CodecFromContext(ctx).Decode(data)
+}
+
+// MessageFrameType returns the WebSocket frame type envelopes travel in on
+// the session ctx belongs to.
+func MessageFrameType(ctx context.Context) websocket.MessageType {
+	if CodecFromContext(ctx).Binary() {
+		return websocket.MessageBinary
+	}
+	return websocket.MessageText
+}
+
+// NegotiatedProtocol returns the protocol version the server accepted in
+// its upgrade response. Servers without versioning send none: ProtocolRaw.
+func NegotiatedProtocol(resp *http.Response) int {
+	if resp == nil {
+		return ProtocolRaw
+	}
+	return protocol.Accepted(resp.Header)
+}
+
+// NegotiatedCapabilities returns the capabilities the server agreed to in
+// its upgrade response, out of those the client proposed.
+func NegotiatedCapabilities(resp *http.Response) []string {
+	if resp == nil {
+		return nil
+	}
+	return protocol.AcceptedCapabilities(resp.Header)
+}
+
+// SessionResumed reports whether the server restored the session of the
+// client's previous connection - its topic subscriptions and the messages
+// it hadn't sent yet - instead of starting a new one.
+func SessionResumed(resp *http.Response) bool {
+	return resp != nil && resp.Header.Get(protocol.HeaderSessionResumed) == "true"
+}
+
+// negotiatedCodec returns the codec the server picked as subprotocol.
+// Servers that picked none speak JSON.
+func negotiatedCodec(conn *websocket.Conn) Codec {
+	c, err := protocol.CodecByName(conn.Subprotocol())
+	if err != nil {
+		return CodecJSON
+	}
+	return c
+}
+
+// protocolKey, codecKey and capabilitiesKey are the context keys for the
+// session's protocol version, codec and capabilities.
+type (
+	protocolKey     struct{}
+	codecKey        struct{}
+	capabilitiesKey struct{}
+)
+
+// withProtocolVersion returns a copy of ctx carrying the negotiated version.
+func withProtocolVersion(ctx context.Context, version int) context.Context {
+	return context.WithValue(ctx, protocolKey{}, version)
+}
+
+// withCodec returns a copy of ctx carrying the negotiated codec.
+func withCodec(ctx context.Context, c Codec) context.Context {
+	return context.WithValue(ctx, codecKey{}, c)
+}
+
+// withCapabilities returns a copy of ctx carrying the negotiated
+// capabilities.
+func withCapabilities(ctx context.Context, caps []string) context.Context {
+	return context.WithValue(ctx, capabilitiesKey{}, caps)
+}
+
+// CapabilitiesFromContext returns the capabilities of the session ctx
+// belongs to; none outside a session or if the server agreed to none.
+// Sessions only send messages on the streams listed.
+func CapabilitiesFromContext(ctx context.Context) []string {
+	caps, _ := ctx.Value(capabilitiesKey{}).([]string)
+	return caps
+}
+
+// CodecFromContext returns the codec of the session ctx belongs to;
+// CodecJSON outside a session or if none was negotiated.
+func CodecFromContext(ctx context.Context) Codec {
+	if c, ok := ctx.Value(codecKey{}).(Codec); ok {
+		return c
+	}
+	return CodecJSON
+}
+
+// ProtocolVersionFromContext returns the protocol version of the session
+// ctx belongs to; ProtocolRaw outside a session or if none was negotiated.
+func ProtocolVersionFromContext(ctx context.Context) int {
+	v, _ := ctx.Value(protocolKey{}).(int)
+	return v
+}
+
+// encodeText prepares a line of text for sending: as is on raw sessions,
+// as a MessageTypeMessage with a string payload otherwise. Returns the
+// frame type to send it in.
+func encodeText(ctx context.Context, text string) (websocket.MessageType, []byte, error) {
+	if ProtocolVersionFromContext(ctx) == ProtocolRaw {
+		return websocket.MessageText, []byte(text), nil
+	}
+	data, err := NewMessage(ctx, MessageTypeMessage, text)
+	return MessageFrameType(ctx), data, err
+}
+
+// decodeText returns the text to show for a message the server sent: the
+// payload of echoes and messages, a summary of errors. Raw sessions, flat
+// server notices and types this client doesn't know are shown as they
+// arrived, so newer servers can add types without breaking it.
+func decodeText(ctx context.Context, typ websocket.MessageType, data []byte) []byte {
+	if ProtocolVersionFromContext(ctx) == ProtocolRaw || typ != MessageFrameType(ctx) {
+		return data // Notices are always JSON text
+	}
+	m, err := DecodeMessage(ctx, data)
+	if err != nil {
+		return data
+	}
+	switch m.Type {
+	case MessageTypeEcho, MessageTypeMessage:
+		var text string
+		if m.DecodePayload(&text) == nil {
+			return []byte(text)
+		}
+		return m.Payload // Structured payload - show the JSON
+	case MessageTypeError:
+		var e MessageError
+		if m.DecodePayload(&e) == nil {
+			return []byte(fmt.Sprintf("error %s: %s", e.Code, e.Message))
+		}
+	}
+	if CodecFromContext(ctx).Binary() {
+		return []byte(fmt.Sprintf("%s message", m.Type)) // Unknown type - don't print binary
+	}
+	return data
+}
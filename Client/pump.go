@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/coder/websocket"
+)
+
+// pump runs a session's reads and writes on two goroutines, so messages
+// the server pushes on its own - broadcasts, topic messages, notices, JSON
+// heartbeats - are read while the session sends or waits, instead of
+// piling up until it reads the next reply. The reader hands each message
+// to the session's deliver function; the writer takes frames from write,
+// one at a time, in the order they were handed over. When the session's
+// context is cancelled, the pump closes the connection with CloseShutdown
+// and the reader receives the server's answer, so the server sees a proper
+// close handshake instead of a dropped connection.
+type pump struct {
+	conn       *websocket.Conn
+	breaker    *CircuitBreaker
+	out        chan outgoingFrame
+	ctx        context.Context // Cancelled with the reader's or writer's error
+	cancel     context.CancelCauseFunc
+	readCtx    context.Context // Outlives ctx until the close handshake is done
+	cancelRead context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// outgoingFrame is a frame handed to the writer, with the channel its
+// result goes back on.
+type outgoingFrame struct {
+	typ         websocket.MessageType
+	data        []byte
+	awaitsReply bool       // A Call's request - the breaker counts the reply, not the write
+	result      chan error // Buffered - the writer never waits for the sender
+}
+
+// startPump starts the reader and writer of the session ctx belongs to.
+// deliver gets every data message (see readMessage), in order; reading
+// waits while it blocks, so it must give up once its ctx - the pump's -
+// is done. Writes go through breaker. Call stop when the session ends.
+func startPump(ctx context.Context, conn *websocket.Conn, breaker *CircuitBreaker,
+	deliver func(ctx context.Context, typ websocket.MessageType, data []byte)) *pump {
+	p := &pump{conn: conn, breaker: breaker, out: make(chan outgoingFrame)}
+	p.ctx, p.cancel = context.WithCancelCause(ctx)
+	// Cancelling a read drops the connection, so reads don't end with ctx
+	p.readCtx, p.cancelRead = context.WithCancel(context.WithoutCancel(ctx))
+	p.wg.Add(3)
+	go p.read(deliver)
+	go p.writeLoop()
+	go p.closeOnCancel(ctx)
+	return p
+}
+
+// closeOnCancel ends the reader once the pump stops. If the session's ctx
+// was cancelled, it closes the connection first - the reader still runs,
+// so it receives the server's close frame and the handshake completes.
+func (p *pump) closeOnCancel(ctx context.Context) {
+	defer p.wg.Done()
+	<-p.ctx.Done()
+	if ctx.Err() != nil {
+		CloseWith(p.conn, CloseShutdown, "Client exiting")
+	}
+	p.cancelRead()
+}
+
+// read reads until the connection fails.
+func (p *pump) read(deliver func(ctx context.Context, typ websocket.MessageType, data []byte)) {
+	defer p.wg.Done()
+	for {
+		typ, data, err := readMessage(p.readCtx, p.conn)
+		if err != nil {
+			p.cancel(fmt.Errorf("error reading response: %w", err))
+			return
+		}
+		deliver(p.ctx, typ, data)
+	}
+}
+
+// writeLoop writes the frames handed to write until a write fails. A
+// refusal of the circuit breaker fails only its frame.
+func (p *pump) writeLoop() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case f := <-p.out:
+			err := sendFrame(p.ctx, p.conn, p.breaker, f.typ, f.data, f.awaitsReply)
+			if err != nil && !errors.Is(err, ErrCircuitOpen) {
+				p.cancel(fmt.Errorf("failed to send message: %w", err)) // Before the sender learns it
+				f.result <- err
+				return
+			}
+			f.result <- err
+		}
+	}
+}
+
+// write hands a frame to the writer and waits until it was written.
+// Safe for concurrent use.
+func (p *pump) write(ctx context.Context, typ websocket.MessageType, data []byte) error {
+	f := outgoingFrame{typ: typ, data: data, result: make(chan error, 1)}
+	select {
+	case p.out <- f:
+		return <-f.result
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.ctx.Done():
+		return p.err()
+	}
+}
+
+// done is closed once the reader or the writer failed, or the session's
+// context was cancelled.
+func (p *pump) done() <-chan struct{} {
+	return p.ctx.Done()
+}
+
+// err returns why the pump stopped: the read or write error, or the cause
+// the session's context was cancelled with.
+func (p *pump) err() error {
+	return context.Cause(p.ctx)
+}
+
+// stop stops both goroutines and waits for them. Stopping a reader in the
+// middle of a read closes the connection, so sessions that want to close
+// it gracefully call conn.Close first.
+func (p *pump) stop() {
+	p.cancel(nil)
+	p.wg.Wait()
+}
@@ -0,0 +1,265 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/deanbregenzer/cysl/internal/logging"
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// SessionFunc does the work on one established connection. It should
+// return when ctx is cancelled (shutdown or heartbeat failure) or the
+// connection breaks. Returning nil ends the client; returning an error
+// triggers a reconnect.
+type SessionFunc func(ctx context.Context, conn *websocket.Conn) error
+
+// ReconnectingClient keeps a connection to the server alive: whenever the
+// connection or its heartbeat fails it re-dials with exponential backoff
+// and jitter (honoring Retry-After), renegotiates the heartbeat and starts
+// a new session.
+type ReconnectingClient struct {
+	URL          string
+	Header       http.Header     // Extra upgrade headers (e.g. Authorization)
+	TLS          *tls.Config     // TLS settings for wss:// URLs (nil = system defaults)
+	Backoff      BackoffConfig   // Re-dial schedule; MaxAttempts bounds each reconnect
+	Heartbeat    HeartbeatConfig // Proposed heartbeat - the server may adjust it
+	Protocol     int             // Highest message protocol version to propose (ProtocolRaw = plain text)
+	Codec        Codec           // Envelope codec to ask for (nil = JSON); the server may decline
+	Capabilities []string        // Capabilities to propose, e.g. "rpc" (see WithCapabilities)
+	Session      SessionFunc     // Work to do per connection
+	Token        TokenProvider   // Bearer token per dial (optional, see WithAuth)
+	Log          *slog.Logger    // Base logger (nil = slog.Default())
+	Sink         MetricsSink     // Receives latency, reconnect and send error events (optional, see WithMetricsSink)
+	Breaker      *CircuitBreaker // Guards the sessions' sends; shared by all of them, so failures count across reconnects (nil = none)
+
+	// Event callbacks - all optional, called from the Run goroutine.
+	OnConnect         func(conn *websocket.Conn, resp *http.Response, hb HeartbeatConfig)
+	OnDisconnect      func(err error)
+	OnReconnectFailed func(err error) // Backoff exhausted; Run returns afterwards
+
+	Metrics ReconnectMetrics // Dial statistics across all reconnects
+
+	logger  atomic.Pointer[slog.Logger] // Logger of the current connection, tagged with its ID
+	session string                      // Session token the server issued, presented on reconnect
+	recent  *recentIDs                  // Envelope IDs received, kept across reconnects
+	events  atomic.Pointer[chan Event]  // Created by Events
+}
+
+// NewReconnectingClient creates a client with the default backoff and
+// heartbeat. NewClient does the same and applies options.
+func NewReconnectingClient(url string, session SessionFunc) *ReconnectingClient {
+	return &ReconnectingClient{
+		URL:       url,
+		Header:    http.Header{},
+		Backoff:   DefaultBackoffConfig(),
+		Heartbeat: DefaultClientHeartbeatConfig(),
+		Protocol:  ProtocolCurrent,
+		Breaker:   NewCircuitBreaker(DefaultCircuitBreakerConfig()),
+		Session:   session,
+	}
+}
+
+// newConnID generates a random ID for one connection (its dial attempts
+// and session), so its lines can be told apart in aggregated logs.
+func newConnID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Logger returns the logger of the current or last connection: the base
+// logger with a conn_id attribute. Use it in the event callbacks; sessions
+// get the same logger from LoggerFromContext.
+func (rc *ReconnectingClient) Logger() *slog.Logger {
+	if l := rc.logger.Load(); l != nil {
+		return l
+	}
+	if rc.Log != nil {
+		return rc.Log
+	}
+	return slog.Default()
+}
+
+// LoggerFromContext returns the logger of the session ctx belongs to, or
+// the default logger outside a session.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	return logging.FromContext(ctx)
+}
+
+// stableSession is how long a session must last before a disconnect counts
+// as a fresh failure again. Shorter sessions keep growing the backoff, so a
+// server that accepts and immediately drops us is not re-dialed in a tight loop.
+const stableSession = 30 * time.Second
+
+// Run connects and runs sessions until a session returns nil, ctx is
+// cancelled or reconnecting fails for good.
+func (rc *ReconnectingClient) Run(ctx context.Context) error {
+	err := rc.run(ctx)
+	rc.emit(Stopped{Err: err})
+	return err
+}
+
+// run implements Run.
+func (rc *ReconnectingClient) run(ctx context.Context) error {
+	flaps := 0                  // Consecutive sessions shorter than stableSession
+	var httpClient *http.Client // nil = http.DefaultClient
+	if rc.TLS != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = rc.TLS
+		httpClient = &http.Client{Transport: transport}
+	}
+	for {
+		header := rc.Header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		ProposeHeartbeat(header, rc.Heartbeat)
+		protocol.Propose(header, rc.Protocol)
+		if rc.Protocol > ProtocolRaw {
+			protocol.ProposeCapabilities(header, rc.Capabilities) // Stream messages need envelopes
+		}
+		if rc.session != "" {
+			header.Set(protocol.HeaderSession, rc.session) // Get our subscriptions and unsent messages back
+		}
+		if rc.Token != nil {
+			token, err := rc.Token(ctx)
+			if err != nil {
+				return fmt.Errorf("%w: get auth token: %w", ErrAuthFailed, err)
+			}
+			header.Set("Authorization", "Bearer "+token)
+		}
+
+		// Every connection logs with its own ID, from the first dial attempt on
+		base := rc.Log
+		if base == nil {
+			base = slog.Default()
+		}
+		logger := base.With("conn_id", newConnID())
+		rc.logger.Store(logger)
+		connCtx := withEvents(logging.WithLogger(ctx, logger), rc)
+
+		dialOpts := &websocket.DialOptions{
+			CompressionMode: websocket.CompressionDisabled,
+			HTTPHeader:      header,
+			HTTPClient:      httpClient,
+		}
+		if rc.Protocol > ProtocolRaw && rc.Codec != nil {
+			dialOpts.Subprotocols = []string{rc.Codec.Name()}
+		}
+		conn, resp, err := dialWithBackoff(connCtx, rc.URL, dialOpts, rc.Backoff, &rc.Metrics)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if rc.OnReconnectFailed != nil {
+				rc.OnReconnectFailed(err)
+			}
+			return fmt.Errorf("failed to connect to server: %w", err)
+		}
+
+		if token := resp.Header.Get(protocol.HeaderSession); token != "" {
+			rc.session = token
+		}
+		hb := ApplyNegotiatedHeartbeat(resp, rc.Heartbeat)
+		caps := NegotiatedCapabilities(resp)
+		rc.emit(Connected{Heartbeat: hb, Protocol: NegotiatedProtocol(resp), Capabilities: caps, Resumed: SessionResumed(resp)})
+		if rc.OnConnect != nil {
+			rc.OnConnect(conn, resp, hb)
+		}
+
+		// Sessions encode and decode messages for the version, codec and
+		// capabilities the server picked, see ProtocolVersionFromContext,
+		// CodecFromContext and CapabilitiesFromContext
+		started := time.Now()
+		sessionCtx := withCodec(withProtocolVersion(connCtx, NegotiatedProtocol(resp)), negotiatedCodec(conn))
+		sessionCtx = withCapabilities(sessionCtx, caps)
+		sessionCtx = withMetricsSink(sessionCtx, rc.Sink)
+		err = rc.runSession(sessionCtx, conn, hb)
+		if err == nil {
+			CloseWith(conn, CloseNormal, "Client finished")
+			return nil
+		}
+		conn.CloseNow() // Already closed, unless the session failed on its own
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rc.emit(Disconnected{Reason: err})
+		if rc.OnDisconnect != nil {
+			rc.OnDisconnect(err)
+		}
+		if errors.Is(err, ErrSuperseded) {
+			return err // The connection that replaced ours is the client now
+		}
+
+		if time.Since(started) >= stableSession {
+			flaps = 0
+		}
+		flaps++
+		delay := rc.Backoff.Delay(flaps)
+		logger.Info("Reconnecting", "delay", delay)
+		if rc.Sink != nil {
+			rc.Sink.OnReconnect(flaps, delay, err)
+		}
+		rc.emit(Reconnecting{Attempt: 1, Delay: delay, Err: err})
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// runSession runs one session with its own heartbeat. A heartbeat failure
+// cancels the session's context so it can't hang on a dead connection.
+// The session's context carries the AppHeartbeat for JSON mode.
+func (rc *ReconnectingClient) runSession(ctx context.Context, conn *websocket.Conn, hb HeartbeatConfig) error {
+	sessionCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// In JSON mode the session's reads carry the heartbeat, see readResponse
+	ah := NewAppHeartbeat(conn, hb)
+	ah.Logger = logging.FromContext(ctx)
+	if rc.Sink != nil {
+		ah.OnPong = rc.Sink.OnLatencySample
+	}
+	ah.OnMiss = func(missed int, err error) {
+		rc.emit(HeartbeatMiss{Missed: missed, MaxMissed: hb.MaxMissedPings, Err: err})
+	}
+	sessionCtx = withAppHeartbeat(sessionCtx, ah)
+	// Drops messages the server resent - also those a resumed session
+	// replays after they already arrived on the previous connection
+	if rc.recent == nil {
+		rc.recent = newRecentIDs(recentIDsSize)
+	}
+	sessionCtx = withRecentIDs(sessionCtx, rc.recent)
+
+	go func() {
+		metrics, err := ah.Run(sessionCtx)
+		if err != nil && sessionCtx.Err() == nil {
+			snap := metrics.Snapshot()
+			ah.Logger.Error("Client heartbeat failed", "error", err,
+				"pings", snap.PingsSent,
+				"pongs", snap.PongsReceived,
+				"failed", snap.FailedPings,
+				"latency_avg", snap.AvgLatency.Round(time.Millisecond),
+				"latency_p95", snap.P95Latency.Round(time.Millisecond))
+			cancel(err) // Wraps ErrHeartbeatLost
+		}
+	}()
+
+	err := rc.Session(sessionCtx, conn)
+	if cause := context.Cause(sessionCtx); errors.Is(cause, ErrHeartbeatLost) {
+		return cause // Report the root cause, not the resulting read error
+	}
+	return err
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/deanbregenzer/cysl/internal/logging"
+)
+
+// AccessSettings restricts which client addresses may open WebSocket
+// connections. Entries are addresses ("192.0.2.7") or CIDRs
+// ("10.0.0.0/8"). A denied address is refused even if it is allowed; with
+// an allow list, every address not on it is refused. The client address is
+// the one derived from trusted proxies (see ProxySettings).
+type AccessSettings struct {
+	Allow []string `yaml:"allow"` // Only these may connect, if set (env ACCESS_ALLOW, comma-separated)
+	Deny  []string `yaml:"deny"`  // These may never connect (env ACCESS_DENY, comma-separated)
+
+	// File names a YAML file with more allow and deny entries, in the
+	// same form as the settings above. It is re-read on reload (SIGHUP or
+	// POST /admin/access/reload), so lists can change without a restart
+	// (env ACCESS_LIST_FILE).
+	File string `yaml:"file"`
+}
+
+// validate checks the inline entries. The file is checked when loaded.
+func (as AccessSettings) validate() []ValidationError {
+	var errs []ValidationError
+	if _, err := parseCIDRs(as.Allow); err != nil {
+		errs = append(errs, ValidationError{"access.allow", err.Error()})
+	}
+	if _, err := parseCIDRs(as.Deny); err != nil {
+		errs = append(errs, ValidationError{"access.deny", err.Error()})
+	}
+	return errs
+}
+
+// parseCIDRs parses addresses and CIDRs. Addresses become single-host
+// networks.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// netsContain reports whether ip is in any of nets.
+func netsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessList is one loaded version of the lists.
+type accessList struct {
+	allow, deny []*net.IPNet
+	entries     AccessSettings // The entries as configured, for the admin API
+	loadedAt    time.Time
+}
+
+// AccessControl enforces the allow and deny lists. The lists are replaced
+// whole on reload, so checks never see a half-loaded version.
+type AccessControl struct {
+	settings atomic.Pointer[AccessSettings] // What reloads read
+	list     atomic.Pointer[accessList]
+	denied   atomic.Int64 // Connections refused
+	reload   sync.Mutex   // One reload at a time
+}
+
+// NewAccessControl loads the lists settings describe.
+func NewAccessControl(settings AccessSettings) (*AccessControl, error) {
+	ac := &AccessControl{}
+	if err := ac.configure(settings); err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
+
+// configure switches to new settings and loads them. On error the
+// previous lists stay in force.
+func (ac *AccessControl) configure(settings AccessSettings) error {
+	ac.reload.Lock()
+	defer ac.reload.Unlock()
+	list, err := loadAccessList(settings)
+	if err != nil {
+		return err
+	}
+	ac.settings.Store(&settings)
+	ac.list.Store(list)
+	return nil
+}
+
+// Reload re-reads the list file. On error the previous lists stay in force.
+func (ac *AccessControl) Reload() error {
+	return ac.configure(*ac.settings.Load())
+}
+
+// loadAccessList combines the inline entries with the file's.
+func loadAccessList(settings AccessSettings) (*accessList, error) {
+	entries := AccessSettings{
+		Allow: append([]string(nil), settings.Allow...),
+		Deny:  append([]string(nil), settings.Deny...),
+	}
+	if settings.File != "" {
+		data, err := os.ReadFile(settings.File)
+		if err != nil {
+			return nil, fmt.Errorf("read access list: %w", err)
+		}
+		var file struct {
+			Allow []string `yaml:"allow"`
+			Deny  []string `yaml:"deny"`
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parse access list %s: %w", settings.File, err)
+		}
+		entries.Allow = append(entries.Allow, file.Allow...)
+		entries.Deny = append(entries.Deny, file.Deny...)
+	}
+
+	list := &accessList{entries: entries, loadedAt: time.Now()}
+	var err error
+	if list.allow, err = parseCIDRs(entries.Allow); err != nil {
+		return nil, fmt.Errorf("access list allow: %w", err)
+	}
+	if list.deny, err = parseCIDRs(entries.Deny); err != nil {
+		return nil, fmt.Errorf("access list deny: %w", err)
+	}
+	return list, nil
+}
+
+// Check decides whether a client IP may connect. reason says why not.
+// Addresses that aren't IPs pass only when there is no allow list.
+func (ac *AccessControl) Check(clientIP string) (allowed bool, reason string) {
+	list := ac.list.Load()
+	ip := net.ParseIP(clientIP)
+	switch {
+	case ip != nil && netsContain(list.deny, ip):
+		reason = "address is on the deny list"
+	case len(list.allow) > 0 && (ip == nil || !netsContain(list.allow, ip)):
+		reason = "address is not on the allow list"
+	default:
+		return true, ""
+	}
+	ac.denied.Add(1)
+	return false, reason
+}
+
+// Denied returns how many connections the lists refused.
+func (ac *AccessControl) Denied() int64 {
+	return ac.denied.Load()
+}
+
+// registerAdminRoutes mounts the access list admin API:
+//
+//	GET  /admin/access         the lists in force and when they were loaded
+//	POST /admin/access/reload  re-read the list file
+func (ac *AccessControl) registerAdminRoutes(mux *http.ServeMux, as AdminSettings) {
+	mux.Handle("GET /admin/access", requireAdmin(as, http.HandlerFunc(ac.handleGet)))
+	mux.Handle("POST /admin/access/reload", requireAdmin(as, http.HandlerFunc(ac.handleReload)))
+}
+
+// accessView is the admin API's view of the lists.
+type accessView struct {
+	Allow    []string  `json:"allow"`
+	Deny     []string  `json:"deny"`
+	File     string    `json:"file,omitempty"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Denied   int64     `json:"denied"`
+}
+
+// handleGet serves the lists in force.
+func (ac *AccessControl) handleGet(w http.ResponseWriter, r *http.Request) {
+	list := ac.list.Load()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accessView{
+		Allow:    append([]string{}, list.entries.Allow...),
+		Deny:     append([]string{}, list.entries.Deny...),
+		File:     ac.settings.Load().File,
+		LoadedAt: list.loadedAt,
+		Denied:   ac.Denied(),
+	})
+}
+
+// handleReload re-reads the list file and serves the result.
+func (ac *AccessControl) handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := ac.Reload(); err != nil {
+		logging.FromContext(r.Context()).Error("Access list reload failed - keeping previous lists", "error", err)
+		httpError(w, r, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	logging.FromContext(r.Context()).Info("Access list reloaded", "via", "admin", "remote_addr", r.RemoteAddr)
+	ac.handleGet(w, r)
+}
+
+// ReloadAccessList re-reads the default server's access list file, e.g. on
+// SIGHUP. On error the previous lists stay in force.
+func ReloadAccessList() error {
+	return defaultServer.Load().access.Reload()
+}
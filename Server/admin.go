@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AdminSettings protects the admin API. Without a token the admin routes
+// are not mounted at all.
+type AdminSettings struct {
+	Token string `yaml:"token"` // Bearer token for /admin/ (env ADMIN_TOKEN)
+}
+
+// Enabled reports whether the admin API should be served.
+func (as AdminSettings) Enabled() bool {
+	return as.Token != ""
+}
+
+// requireAdmin wraps an admin handler with a bearer token check.
+func requireAdmin(as AdminSettings, next http.Handler) http.Handler {
+	return requireToken("admin", as.Token, next)
+}
+
+// requireToken wraps a handler with a check for the bearer token token.
+// Rejections are audited with realm as their type. The comparison is
+// constant-time so the token can't be guessed byte by byte.
+func requireToken(realm, token string, next http.Handler) http.Handler {
+	want := []byte(token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), want) != 1 {
+			auditLog.Record(AuditEvent{
+				Type:       realm,
+				RemoteAddr: r.RemoteAddr,
+				Decision:   "reject",
+				Reason:     "missing or invalid " + realm + " token",
+				Fields:     map[string]string{"path": r.URL.Path, "request_id": RequestIDFromContext(r.Context())},
+			})
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`"`)
+			httpError(w, r, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
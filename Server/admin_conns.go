@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ConnInfo describes a live connection for the admin API.
+type ConnInfo struct {
+	ID          ConnID     `json:"id"`
+	User        UserID     `json:"user,omitempty"`
+	RemoteAddr  string     `json:"remote_addr"`
+	Country     string     `json:"country,omitempty"` // From GeoIP, when enabled
+	ASN         uint       `json:"asn,omitempty"`
+	ConnectedAt time.Time  `json:"connected_at"`
+	UptimeS     float64    `json:"uptime_s"`
+	Health      ConnHealth `json:"health"`
+	HealthSince time.Time  `json:"health_since"` // When it entered that state
+	LatencyMs   float64    `json:"latency_ms"`   // Smoothed heartbeat RTT (0 before the first pong)
+	JitterMs    float64    `json:"jitter_ms"`
+	IntervalMs  float64    `json:"heartbeat_interval_ms"` // Current ping interval, which adaptive heartbeats move
+	MessagesIn  int64      `json:"messages_in"`
+	MessagesOut int64      `json:"messages_out"`
+	Queued      int        `json:"queued"` // Messages waiting in the send queue
+	Topics      []string   `json:"topics,omitempty"`
+}
+
+// Info returns a snapshot of the connection.
+func (hc *HubConn) Info() ConnInfo {
+	now := time.Now()
+	info := ConnInfo{
+		ID:          hc.ID,
+		User:        hc.User,
+		RemoteAddr:  hc.RemoteAddr,
+		Country:     hc.Geo.Country,
+		ASN:         hc.Geo.ASN,
+		ConnectedAt: hc.ConnectedAt,
+		UptimeS:     now.Sub(hc.ConnectedAt).Seconds(),
+		Health:      hc.Health(),
+		HealthSince: hc.HealthSince(),
+		MessagesIn:  hc.received.Load(),
+		MessagesOut: hc.sent.Load(),
+		Queued:      len(hc.send),
+	}
+	if hb := hc.heartbeat.Load(); hb != nil {
+		st := hb.Health()
+		info.LatencyMs = float64(st.Latency) / float64(time.Millisecond)
+		info.JitterMs = float64(st.Jitter) / float64(time.Millisecond)
+		info.IntervalMs = float64(hb.Interval()) / float64(time.Millisecond)
+	}
+	hc.hub.mu.RLock()
+	for topic := range hc.topics {
+		info.Topics = append(info.Topics, topic)
+	}
+	hc.hub.mu.RUnlock()
+	sort.Strings(info.Topics)
+	return info
+}
+
+// registerAdminRoutes mounts the connection admin API:
+//
+//	GET  /admin/connections            every live connection, oldest first
+//	GET  /admin/connections/{id}       one connection
+//	POST /admin/connections/{id}/close {"reason":"..."} force-closes it
+//	GET  /admin/stats                  aggregate counters
+func (s *Server) registerAdminRoutes(mux *http.ServeMux, as AdminSettings) {
+	mux.Handle("GET /admin/connections", requireAdmin(as, http.HandlerFunc(s.handleConnections)))
+	mux.Handle("GET /admin/connections/{id}", requireAdmin(as, http.HandlerFunc(s.handleConnection)))
+	mux.Handle("POST /admin/connections/{id}/close", requireAdmin(as, http.HandlerFunc(s.handleCloseConnection)))
+	mux.Handle("GET /admin/stats", requireAdmin(as, http.HandlerFunc(s.handleStats)))
+}
+
+// handleConnections lists the live connections.
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	conns := s.hub.Conns()
+	infos := make([]ConnInfo, len(conns))
+	for i, hc := range conns {
+		infos[i] = hc.Info()
+	}
+	writeAdminJSON(w, http.StatusOK, infos)
+}
+
+// handleConnection serves one connection.
+func (s *Server) handleConnection(w http.ResponseWriter, r *http.Request) {
+	hc, ok := s.hub.Get(ConnID(r.PathValue("id")))
+	if !ok {
+		httpError(w, r, ErrUnknownConn.Error(), http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, hc.Info())
+}
+
+// handleCloseConnection force-closes a connection with 1008 (policy
+// violation) and the given reason.
+func (s *Server) handleCloseConnection(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil {
+			httpError(w, r, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	}
+	if body.Reason == "" {
+		body.Reason = "closed by administrator"
+	}
+	id := ConnID(r.PathValue("id"))
+	hc, ok := s.hub.Get(id)
+	if err := s.hub.Disconnect(id, body.Reason); errors.Is(err, ErrUnknownConn) {
+		httpError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	auditLog.Record(AuditEvent{
+		Type:       "admin",
+		RemoteAddr: r.RemoteAddr,
+		Decision:   "close",
+		Reason:     body.Reason,
+		Fields:     map[string]string{"conn_id": string(id), "path": r.URL.Path, "request_id": RequestIDFromContext(r.Context())},
+	})
+	if !ok {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	writeAdminJSON(w, http.StatusAccepted, hc.Info())
+}
+
+// ServerStats are the aggregate counters the admin API dumps.
+type ServerStats struct {
+	ActiveConnections int64              `json:"active_connections"`
+	ConnectionsTotal  int64              `json:"connections_total"`
+	ConnectionsPerIP  map[string]int     `json:"connections_per_ip"`
+	Health            map[ConnHealth]int `json:"health"`
+	MessagesReceived  int64              `json:"messages_received"`
+	MessagesSent      int64              `json:"messages_sent"`
+	OversizedMessages int64              `json:"oversized_messages"`
+	HandlerPanics     int64              `json:"handler_panics"`
+	RateLimited       map[string]int64   `json:"rate_limit_rejections"` // By limiter
+	AccessDenied      int64              `json:"access_denied"`
+	HubDropped        int64              `json:"hub_dropped"`
+	HubExpired        int64              `json:"hub_expired"`
+	HubWriteRetries   int64              `json:"hub_write_retries"`
+	SlowConsumers     int64              `json:"slow_consumers"`
+	SessionsParked    int                `json:"sessions_parked"`
+	SessionsResumed   int64              `json:"sessions_resumed"`
+	Memory            MemoryStats        `json:"memory"`
+}
+
+// Stats returns the server's aggregate counters.
+func (s *Server) Stats() ServerStats {
+	st := ServerStats{
+		ActiveConnections: s.active.Load(),
+		ConnectionsTotal:  s.metrics.ConnectionsTotal.Load(),
+		ConnectionsPerIP:  s.conns.Snapshot(),
+		Health:            s.hub.HealthCounts(),
+		MessagesReceived:  s.metrics.MessagesReceived.Load(),
+		MessagesSent:      s.metrics.MessagesSent.Load(),
+		OversizedMessages: s.metrics.OversizedMessages.Load(),
+		HandlerPanics:     s.metrics.HandlerPanics.Load(),
+		RateLimited:       make(map[string]int64, len(s.metrics.Limiters)),
+		AccessDenied:      s.access.Denied(),
+		HubDropped:        s.hub.Dropped(),
+		HubExpired:        s.hub.Expired(),
+		HubWriteRetries:   s.hub.WriteRetries(),
+		SlowConsumers:     s.hub.SlowConsumers(),
+		SessionsParked:    s.hub.Sessions().Parked(),
+		SessionsResumed:   s.hub.Sessions().Resumed(),
+		Memory:            s.hub.Memory().Stats(),
+	}
+	for name, ls := range s.metrics.Limiters {
+		st.RateLimited[name] = ls.Rejections.Load()
+	}
+	return st
+}
+
+// handleStats dumps the aggregate counters.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, s.Stats())
+}
+
+// writeAdminJSON writes v as an indented JSON response.
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRingSize is the number of recent audit events kept in memory.
+const auditRingSize = 256
+
+// AuditEvent records a security-relevant server decision, such as a rejected
+// connection or a policy match. Events are written as JSON lines so they can
+// be shipped to log aggregation and replayed later.
+type AuditEvent struct {
+	Time       time.Time         `json:"time"`             // When the decision was made
+	Type       string            `json:"type"`             // Event category (e.g. "geo_policy")
+	RemoteAddr string            `json:"remote_addr"`      // Client address the decision applies to
+	Decision   string            `json:"decision"`         // Outcome (e.g. "allow", "deny")
+	Reason     string            `json:"reason,omitempty"` // Human-readable explanation
+	Fields     map[string]string `json:"fields,omitempty"` // Additional context (country, ASN, limits)
+}
+
+// AuditLogger writes audit events to an optional JSON-lines file and the
+// standard logger, and keeps the most recent events in a ring buffer for
+// diagnostics. Safe for concurrent use.
+type AuditLogger struct {
+	file   *os.File     // Optional JSONL sink (nil = log only)
+	path   string       // Path of file, for Scan
+	recent []AuditEvent // Ring buffer of recent events
+	next   int          // Next write position in recent
+	full   bool         // Whether the ring buffer has wrapped
+	mu     sync.Mutex   // Protects file writes and the ring buffer
+}
+
+// NewAuditLogger creates an audit logger. If path is non-empty, events are
+// appended to that file as JSON lines in addition to the standard logger.
+func NewAuditLogger(path string) (*AuditLogger, error) {
+	al := &AuditLogger{recent: make([]AuditEvent, auditRingSize)}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		al.file = f
+		al.path = path
+	}
+	return al, nil
+}
+
+// Record stores an audit event. A zero Time is filled in with the current time.
+func (al *AuditLogger) Record(ev AuditEvent) {
+	if al == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Audit event encoding failed", "error", err)
+		return
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	al.recent[al.next] = ev
+	al.next = (al.next + 1) % len(al.recent)
+	if al.next == 0 {
+		al.full = true
+	}
+
+	slog.Info("AUDIT", "event", json.RawMessage(line)) // Nested as an object in JSON output
+	if al.file != nil {
+		if _, err := al.file.Write(append(line, '\n')); err != nil {
+			slog.Error("Audit file write failed", "error", err)
+		}
+	}
+}
+
+// Recent returns the buffered audit events, oldest first.
+func (al *AuditLogger) Recent() []AuditEvent {
+	if al == nil {
+		return nil
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if !al.full {
+		return append([]AuditEvent(nil), al.recent[:al.next]...)
+	}
+	out := make([]AuditEvent, 0, len(al.recent))
+	out = append(out, al.recent[al.next:]...)
+	return append(out, al.recent[:al.next]...)
+}
+
+// Scan calls fn for every event of type typ (all types if empty) recorded
+// within [from, to], oldest first. Events come from the audit file when one
+// is configured - so exports reach back as far as the file does - and from
+// the in-memory ring otherwise. Stops at the first error from fn.
+func (al *AuditLogger) Scan(typ string, from, to time.Time, fn func(AuditEvent) error) error {
+	if al == nil {
+		return nil
+	}
+	match := func(ev AuditEvent) bool {
+		return (typ == "" || ev.Type == typ) && !ev.Time.Before(from) && !ev.Time.After(to)
+	}
+	if al.path == "" {
+		for _, ev := range al.Recent() {
+			if match(ev) {
+				if err := fn(ev); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	// A separate read handle - the writer keeps appending meanwhile, and a
+	// half-written last line is skipped like any other malformed line
+	f, err := os.Open(al.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var ev AuditEvent
+		if json.Unmarshal(scanner.Bytes(), &ev) != nil || !match(ev) {
+			continue
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Close closes the audit file, if any.
+func (al *AuditLogger) Close() error {
+	if al == nil {
+		return nil
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.file == nil {
+		return nil
+	}
+	err := al.file.Close()
+	al.file = nil
+	return err
+}
+
+// auditLoggerFromConfig creates the audit logger, writing to path when set.
+// Falls back to log-only auditing if the file can't be opened.
+func auditLoggerFromConfig(path string) *AuditLogger {
+	al, err := NewAuditLogger(path)
+	if err != nil {
+		slog.Error("Audit file disabled", "error", err)
+		al, _ = NewAuditLogger("")
+	}
+	return al
+}
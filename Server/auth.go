@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UserID identifies an authenticated user.
+type UserID string
+
+// AuthFunc authenticates an upgrade request. Returning an error rejects the
+// connection with 401 Unauthorized; the returned UserID is attached to the
+// connection context (see UserFromContext).
+type AuthFunc func(r *http.Request) (UserID, error)
+
+// AuthSettings configures connection authentication. Without a JWT secret
+// or Func, connections are accepted anonymously as before.
+type AuthSettings struct {
+	JWTSecret   string `yaml:"jwt_secret"`   // HS256 signing key (env AUTH_JWT_SECRET)
+	JWTIssuer   string `yaml:"jwt_issuer"`   // Required "iss" claim (optional)
+	JWTAudience string `yaml:"jwt_audience"` // Required "aud" claim (optional)
+
+	// Func, when set from code, replaces the built-in JWT check.
+	Func AuthFunc `yaml:"-"`
+}
+
+// ErrUnauthenticated is returned when a request carries no credentials.
+// It is an ErrAuthFailed.
+var ErrUnauthenticated = fmt.Errorf("%w: missing bearer token", ErrAuthFailed)
+
+// jwtLeeway tolerates small clock differences in exp/nbf checks.
+const jwtLeeway = 30 * time.Second
+
+// userKey is the context key for the authenticated UserID.
+type userKey struct{}
+
+// withUser returns a context carrying the user identity.
+func withUser(ctx context.Context, user UserID) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFromContext returns the authenticated user of the connection the
+// context belongs to. ok is false for anonymous connections.
+func UserFromContext(ctx context.Context) (UserID, bool) {
+	user, ok := ctx.Value(userKey{}).(UserID)
+	return user, ok && user != ""
+}
+
+// authFromConfig returns the configured authenticator, or nil when
+// authentication is disabled.
+func authFromConfig(as AuthSettings) AuthFunc {
+	if as.Func != nil {
+		return as.Func
+	}
+	if as.JWTSecret == "" {
+		return nil
+	}
+	return JWTAuth([]byte(as.JWTSecret), as.JWTIssuer, as.JWTAudience)
+}
+
+// JWTAuth returns an AuthFunc accepting HS256 bearer tokens signed with
+// secret. The "sub" claim becomes the UserID; "exp" is required. issuer and
+// audience are checked when non-empty. Browsers can't set headers on
+// WebSocket upgrades, so the token may also be passed as ?access_token=.
+// All errors are ErrAuthFailed.
+func JWTAuth(secret []byte, issuer, audience string) AuthFunc {
+	return func(r *http.Request) (UserID, error) {
+		token := bearerToken(r)
+		if token == "" {
+			return "", ErrUnauthenticated
+		}
+		claims, err := verifyHS256(token, secret)
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", ErrAuthFailed, err)
+		}
+		if err := claims.validate(time.Now(), issuer, audience); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrAuthFailed, err)
+		}
+		return UserID(claims.Subject), nil
+	}
+}
+
+// bearerToken extracts the token from the Authorization header or the
+// access_token query parameter.
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if scheme, token, ok := strings.Cut(h, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// jwtClaims is the subset of registered claims we check.
+type jwtClaims struct {
+	Subject   string       `json:"sub"`
+	Issuer    string       `json:"iss"`
+	Audience  jwtAudience  `json:"aud"`
+	ExpiresAt *json.Number `json:"exp"`
+	NotBefore *json.Number `json:"nbf"`
+}
+
+// jwtAudience accepts "aud" as a single string or an array.
+type jwtAudience []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("invalid aud claim")
+	}
+	*a = list
+	return nil
+}
+
+// verifyHS256 checks the token signature and decodes its claims. Only
+// HS256 is accepted - in particular never "none".
+func verifyHS256(token string, secret []byte) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// decodeSegment decodes one base64url JSON segment of a token.
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// validate checks the time-based claims, the subject and the optional
+// issuer/audience requirements.
+func (c *jwtClaims) validate(now time.Time, issuer, audience string) error {
+	if c.Subject == "" {
+		return errors.New("token has no subject")
+	}
+	if c.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+	exp, err := c.ExpiresAt.Int64()
+	if err != nil {
+		return errors.New("invalid exp claim")
+	}
+	if now.After(time.Unix(exp, 0).Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if c.NotBefore != nil {
+		nbf, err := c.NotBefore.Int64()
+		if err != nil {
+			return errors.New("invalid nbf claim")
+		}
+		if now.Add(jwtLeeway).Before(time.Unix(nbf, 0)) {
+			return errors.New("token not yet valid")
+		}
+	}
+	if issuer != "" && c.Issuer != issuer {
+		return errors.New("unexpected token issuer")
+	}
+	if audience != "" {
+		for _, a := range c.Audience {
+			if a == audience {
+				return nil
+			}
+		}
+		return errors.New("token not intended for this audience")
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxBeaconSize bounds a beacon datagram; real beacons are ~150 bytes.
+const maxBeaconSize = 1024
+
+// Beacon is a signed heartbeat datagram sent by a device over UDP:
+//
+//	{"id":"sensor-17","seq":42,"ts":1700000000000,"sig":"<hex hmac>"}
+//
+// sig is HMAC-SHA256 over "id|seq|ts" with the shared beacon key, ts is the
+// device's send time in Unix milliseconds.
+type Beacon struct {
+	ID        string `json:"id"`  // Device identity
+	Seq       uint64 `json:"seq"` // Monotonic sequence number - rejects replays
+	Timestamp int64  `json:"ts"`  // Device send time (Unix ms)
+	Signature string `json:"sig"` // Hex HMAC-SHA256 signature
+}
+
+// signingPayload returns the bytes covered by the signature.
+func (b Beacon) signingPayload() []byte {
+	return []byte(fmt.Sprintf("%s|%d|%d", b.ID, b.Seq, b.Timestamp))
+}
+
+// SignBeacon computes the signature for a beacon. Devices written in Go can
+// use it directly; others must reproduce the same HMAC.
+func SignBeacon(key []byte, b Beacon) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b.signingPayload())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeviceStatus is the last known state of a device.
+type DeviceStatus struct {
+	ID        string    `json:"id"`
+	LastSeen  time.Time `json:"last_seen"`  // When the last valid beacon arrived
+	LastSeq   uint64    `json:"last_seq"`   // Sequence number of the last valid beacon
+	LatencyMs int64     `json:"latency_ms"` // One-way latency of the last beacon (clock skew included)
+	Beacons   int64     `json:"beacons"`    // Valid beacons received
+	Addr      string    `json:"addr"`       // Source address of the last beacon
+
+	Probe *ProbeResult `json:"probe,omitempty"` // Last active probe, if the device is probed
+}
+
+// DeviceRegistry tracks device liveness from beacons. Safe for concurrent use.
+type DeviceRegistry struct {
+	devices map[string]*DeviceStatus
+	mu      sync.RWMutex
+}
+
+// NewDeviceRegistry creates an empty registry.
+func NewDeviceRegistry() *DeviceRegistry {
+	return &DeviceRegistry{devices: make(map[string]*DeviceStatus)}
+}
+
+// errStaleBeacon is returned for replayed or out-of-order beacons.
+var errStaleBeacon = errors.New("stale beacon sequence")
+
+// Observe records a verified beacon. Beacons whose sequence number is not
+// greater than the last one seen are rejected, so captured datagrams can't
+// be replayed to fake liveness.
+func (dr *DeviceRegistry) Observe(b Beacon, addr string, now time.Time) error {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	status := dr.device(b.ID)
+	if status.Beacons > 0 && b.Seq <= status.LastSeq {
+		return errStaleBeacon
+	}
+
+	status.LastSeen = now
+	status.LastSeq = b.Seq
+	status.LatencyMs = now.UnixMilli() - b.Timestamp
+	status.Beacons++
+	status.Addr = addr
+	return nil
+}
+
+// RecordProbe stores an active probe result for a device. Returns the
+// previous result and whether reachability changed (true for the first probe).
+func (dr *DeviceRegistry) RecordProbe(id string, result ProbeResult) (*ProbeResult, bool) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	status := dr.device(id)
+	prev := status.Probe
+	if prev != nil && !result.Reachable {
+		result.Failures = prev.Failures + 1
+	} else if !result.Reachable {
+		result.Failures = 1
+	}
+	status.Probe = &result
+	return prev, prev == nil || prev.Reachable != result.Reachable
+}
+
+// device returns the status entry for id, creating it if needed.
+// Callers must hold dr.mu.
+func (dr *DeviceRegistry) device(id string) *DeviceStatus {
+	status, ok := dr.devices[id]
+	if !ok {
+		status = &DeviceStatus{ID: id}
+		dr.devices[id] = status
+	}
+	return status
+}
+
+// List returns a snapshot of all devices sorted by ID.
+func (dr *DeviceRegistry) List() []DeviceStatus {
+	dr.mu.RLock()
+	defer dr.mu.RUnlock()
+
+	out := make([]DeviceStatus, 0, len(dr.devices))
+	for _, s := range dr.devices {
+		snapshot := *s
+		if s.Probe != nil {
+			probe := *s.Probe // Don't share the pointer with later updates
+			snapshot.Probe = &probe
+		}
+		out = append(out, snapshot)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Online reports whether the device counts as up at now: a beacon arrived
+// within offlineAfter, or the last active probe succeeded.
+func (ds DeviceStatus) Online(now time.Time, offlineAfter time.Duration) bool {
+	if ds.Beacons > 0 && now.Sub(ds.LastSeen) <= offlineAfter {
+		return true
+	}
+	return ds.Probe != nil && ds.Probe.Reachable
+}
+
+// BeaconMetrics counts beacon outcomes.
+type BeaconMetrics struct {
+	Received atomic.Int64 // Datagrams received
+	Accepted atomic.Int64 // Valid beacons applied to the registry
+	Rejected atomic.Int64 // Malformed, unsigned, badly signed or stale datagrams
+}
+
+// BeaconListener receives UDP heartbeat beacons and updates a DeviceRegistry.
+// Lets very large fleets report liveness without holding a TCP connection.
+type BeaconListener struct {
+	addr     string
+	key      []byte
+	maxSkew  time.Duration // Reject beacons whose timestamp is further off than this
+	registry *DeviceRegistry
+	metrics  BeaconMetrics
+}
+
+// NewBeaconListener creates a listener for addr (e.g. ":8081") verifying
+// beacons with key.
+func NewBeaconListener(addr string, key []byte, registry *DeviceRegistry) *BeaconListener {
+	return &BeaconListener{
+		addr:     addr,
+		key:      key,
+		maxSkew:  5 * time.Minute,
+		registry: registry,
+	}
+}
+
+// Metrics returns the listener's beacon counters.
+func (bl *BeaconListener) Metrics() *BeaconMetrics {
+	return &bl.metrics
+}
+
+// Run listens until ctx is cancelled. Returns an error if the socket can't be opened.
+func (bl *BeaconListener) Run(ctx context.Context) error {
+	pc, err := net.ListenPacket("udp", bl.addr)
+	if err != nil {
+		return fmt.Errorf("beacon listen: %w", err)
+	}
+	slog.Info("Beacon listener started", "addr", bl.addr)
+
+	// Unblock ReadFrom on shutdown
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	buf := make([]byte, maxBeaconSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil // Normal shutdown
+			}
+			return fmt.Errorf("beacon read: %w", err)
+		}
+		bl.metrics.Received.Add(1)
+
+		if err := bl.handle(buf[:n], addr.String()); err != nil {
+			bl.metrics.Rejected.Add(1)
+			slog.Warn("Rejected beacon", "remote_addr", addr.String(), "error", err)
+			continue
+		}
+		bl.metrics.Accepted.Add(1)
+	}
+}
+
+// handle decodes, verifies and records one datagram.
+func (bl *BeaconListener) handle(data []byte, addr string) error {
+	var b Beacon
+	if err := json.Unmarshal(data, &b); err != nil {
+		return fmt.Errorf("malformed beacon: %w", err)
+	}
+	if b.ID == "" {
+		return errors.New("missing device id")
+	}
+
+	sig, err := hex.DecodeString(b.Signature)
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	expected, _ := hex.DecodeString(SignBeacon(bl.key, b))
+	if !hmac.Equal(sig, expected) {
+		return errors.New("invalid signature")
+	}
+
+	now := time.Now()
+	skew := now.Sub(time.UnixMilli(b.Timestamp))
+	if skew > bl.maxSkew || skew < -bl.maxSkew {
+		return fmt.Errorf("timestamp skew %v exceeds %v", skew.Round(time.Second), bl.maxSkew)
+	}
+	return bl.registry.Observe(b, addr, now)
+}
+
+// beaconListenerFromConfig creates the beacon listener when both an address
+// and a key are configured. Unsigned beacons are never accepted, so a
+// missing key disables the listener rather than running it open.
+func beaconListenerFromConfig(bs BeaconSettings, registry *DeviceRegistry) *BeaconListener {
+	if bs.Addr == "" {
+		return nil
+	}
+	if bs.Key == "" {
+		slog.Warn("Beacon address set without a key - beacon listener disabled")
+		return nil
+	}
+	return NewBeaconListener(bs.Addr, []byte(bs.Key), registry)
+}
+
+// handleDevices lists the device registry as JSON.
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deviceRegistry.List())
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/coder/websocket"
+
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// HeaderCapabilities negotiates the capabilities of an envelope connection
+// during the upgrade: the client lists those it understands, the server
+// answers with those the endpoint's handler serves (see CapabilityMux).
+const HeaderCapabilities = protocol.HeaderCapabilities
+
+// ErrorCodeUnsupportedStream answers a message on a stream the connection
+// didn't negotiate.
+const ErrorCodeUnsupportedStream = protocol.CodeUnsupportedStream
+
+// CapabilityRPC is the built-in capability of /ws: JSON-RPC 2.0 requests
+// in the payload of envelopes on stream "rpc", answered like on /rpc.
+const CapabilityRPC = "rpc"
+
+// CapabilityHandler is a Handler that serves capabilities besides its own
+// messages. The server negotiates them with clients that propose
+// envelopes and lists the agreed ones in the connection's context (see
+// CapabilitiesFromContext).
+type CapabilityHandler interface {
+	Handler
+
+	// Capabilities lists the capability names the handler serves.
+	Capabilities() []string
+}
+
+// CapabilityMux lets one connection speak several sub-protocols - say
+// rooms, RPC and a telemetry stream - next to the endpoint's own messages.
+// Envelopes whose Stream names a negotiated capability go to that
+// capability's handler; everything else, raw text included, goes to the
+// fallback handler. Each handler sees the connection's events as if it
+// were alone on it, and the messages it creates with NewMessage travel on
+// its stream:
+//
+//	mux := server.NewCapabilityMux(server.EchoHandler{})
+//	mux.Handle("rooms", roomsHandler{})
+//	mux.Handle("telemetry", telemetryHandler{})
+//	server.RegisterHandler("/ws", mux)
+//
+// Clients that negotiate no capabilities are served by the fallback only
+// and never receive a stream message. Register capabilities before the
+// mux serves connections.
+type CapabilityMux struct {
+	fallback Handler
+	names    []string // In registration order, which is the order of OnConnect
+	handlers map[string]Handler
+}
+
+// NewCapabilityMux creates a mux serving fallback and no capabilities.
+func NewCapabilityMux(fallback Handler) *CapabilityMux {
+	return &CapabilityMux{fallback: fallback, handlers: make(map[string]Handler)}
+}
+
+// Handle serves capability with h, replacing an earlier handler of that
+// name.
+func (m *CapabilityMux) Handle(capability string, h Handler) {
+	if _, ok := m.handlers[capability]; !ok {
+		m.names = append(m.names, capability)
+	}
+	m.handlers[capability] = h
+}
+
+// Capabilities lists the registered capabilities.
+func (m *CapabilityMux) Capabilities() []string {
+	return slices.Clone(m.names)
+}
+
+// OnConnect connects the fallback, then the handlers of the negotiated
+// capabilities. The first error closes the connection.
+func (m *CapabilityMux) OnConnect(ctx context.Context, hc *HubConn) error {
+	if err := m.fallback.OnConnect(ctx, hc); err != nil {
+		return err
+	}
+	for _, c := range CapabilitiesFromContext(ctx) {
+		if err := m.handlers[c].OnConnect(WithStream(ctx, c), hc); err != nil {
+			return fmt.Errorf("capability %s: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// OnMessage routes the message by its stream. Stream messages are decoded
+// twice, here and by their handler; messages of connections without
+// capabilities go to the fallback untouched.
+func (m *CapabilityMux) OnMessage(ctx context.Context, hc *HubConn, msgType websocket.MessageType, msg []byte) ([]byte, error) {
+	if len(CapabilitiesFromContext(ctx)) == 0 {
+		return m.fallback.OnMessage(ctx, hc, msgType, msg)
+	}
+	env, err := DecodeMessage(ctx, msg)
+	if err != nil || env.Stream == "" {
+		return m.fallback.OnMessage(ctx, hc, msgType, msg) // It answers invalid envelopes itself
+	}
+	if stream := env.Stream; !HasCapability(ctx, stream) {
+		env.Stream = "" // Answer outside the stream the client may not know
+		return errorReply(ctx, env, ErrorCodeUnsupportedStream, fmt.Sprintf("stream %q was not negotiated", stream)), nil
+	}
+	return m.handlers[env.Stream].OnMessage(WithStream(ctx, env.Stream), hc, msgType, msg)
+}
+
+// OnClose tells every handler OnConnect may have reached.
+func (m *CapabilityMux) OnClose(ctx context.Context, hc *HubConn, err error) {
+	m.fallback.OnClose(ctx, hc, err)
+	for _, c := range CapabilitiesFromContext(ctx) {
+		m.handlers[c].OnClose(WithStream(ctx, c), hc, err)
+	}
+}
+
+// rpcStream serves CapabilityRPC: the payload of each envelope is a
+// JSON-RPC request or batch for the /rpc methods, answered in a reply of
+// the same type.
+type rpcStream struct {
+	BaseHandler
+}
+
+// OnMessage dispatches the request; notifications produce no reply.
+func (rpcStream) OnMessage(ctx context.Context, hc *HubConn, msgType websocket.MessageType, msg []byte) ([]byte, error) {
+	m, err := DecodeMessage(ctx, msg)
+	if err != nil {
+		return errorMessage(ctx, ErrorCodeInvalidMessage, err.Error()), nil
+	}
+	resp := rpcMethods.Handle(ctx, m.Payload)
+	if resp == nil {
+		return nil, nil
+	}
+	return NewReply(ctx, m, m.Type, json.RawMessage(resp))
+}
+
+// defaultWSHandler is the /ws handler until an application replaces it:
+// the echo handler, with CapabilityRPC for clients that ask for it.
+func defaultWSHandler() Handler {
+	mux := NewCapabilityMux(EchoHandler{})
+	mux.Handle(CapabilityRPC, rpcStream{})
+	return mux
+}
+
+// capabilitiesKey and streamKey are the context keys for the connection's
+// negotiated capabilities and the stream a handler serves.
+type (
+	capabilitiesKey struct{}
+	streamKey       struct{}
+)
+
+// withCapabilities returns a copy of ctx carrying the negotiated
+// capabilities.
+func withCapabilities(ctx context.Context, caps []string) context.Context {
+	return context.WithValue(ctx, capabilitiesKey{}, caps)
+}
+
+// CapabilitiesFromContext returns the capabilities the connection
+// negotiated during the upgrade, in the client's order; none for raw
+// connections and clients that proposed none.
+func CapabilitiesFromContext(ctx context.Context) []string {
+	caps, _ := ctx.Value(capabilitiesKey{}).([]string)
+	return caps
+}
+
+// HasCapability reports whether the connection negotiated capability.
+// Handlers that push stream messages from other goroutines, with the
+// context OnConnect got, check it first so clients that don't know the
+// stream aren't sent it.
+func HasCapability(ctx context.Context, capability string) bool {
+	return slices.Contains(CapabilitiesFromContext(ctx), capability)
+}
+
+// WithStream returns a copy of ctx whose messages travel on stream: the
+// messages NewMessage creates carry it in their Stream. CapabilityMux
+// hands its capability handlers such a context.
+func WithStream(ctx context.Context, stream string) context.Context {
+	return context.WithValue(ctx, streamKey{}, stream)
+}
+
+// StreamFromContext returns the stream set by WithStream; "" for the
+// endpoint's own messages.
+func StreamFromContext(ctx context.Context) string {
+	s, _ := ctx.Value(streamKey{}).(string)
+	return s
+}
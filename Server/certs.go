@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the monitor looks for certificates about
+// to expire.
+const certCheckInterval = time.Hour
+
+// CertInfo describes a certificate the server serves.
+type CertInfo struct {
+	Subject  string    `json:"subject"` // Common name, or the first DNS name
+	DNSNames []string  `json:"dns_names,omitempty"`
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+	Instance string    `json:"instance,omitempty"` // Cluster instance serving it (admin API only)
+}
+
+// CertMonitor keeps track of the certificates the TLS listener serves -
+// those loaded at startup and those autocert obtains or renews later - so
+// their expiry shows up in /metrics, /admin/certs and, within the
+// warning threshold, the log. Methods are nil-safe: a nil monitor (TLS
+// disabled) has no certificates.
+type CertMonitor struct {
+	warning time.Duration
+	logger  *slog.Logger
+
+	certs map[string]CertInfo // By subject - a renewal replaces its predecessor
+	mu    sync.RWMutex        // Protects certs
+}
+
+// NewCertMonitor creates a monitor that warns about certificates expiring
+// within warning. Call Watch to add a listener's certificates and Run to
+// check them periodically.
+func NewCertMonitor(warning time.Duration, logger *slog.Logger) *CertMonitor {
+	return &CertMonitor{warning: warning, logger: logger, certs: make(map[string]CertInfo)}
+}
+
+// certMonitorFromConfig returns nil when TLS is disabled.
+func certMonitorFromConfig(ts TLSSettings, logger *slog.Logger) *CertMonitor {
+	if !ts.Enabled() {
+		return nil
+	}
+	return NewCertMonitor(ts.ExpiryWarning, logger)
+}
+
+// Watch records cfg's certificates and wraps its GetCertificate, so the
+// certificates it returns during handshakes are recorded too.
+func (cm *CertMonitor) Watch(cfg *tls.Config) {
+	if cm == nil || cfg == nil {
+		return
+	}
+	for _, cert := range cfg.Certificates {
+		cm.observe(&cert)
+	}
+	if get := cfg.GetCertificate; get != nil {
+		cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := get(hello)
+			if err == nil {
+				cm.observe(cert)
+			}
+			return cert, err
+		}
+	}
+}
+
+// observe records cert, replacing an older certificate for its subject.
+func (cm *CertMonitor) observe(cert *tls.Certificate) {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return
+		}
+	}
+	info := CertInfo{
+		Subject:  leaf.Subject.CommonName,
+		DNSNames: leaf.DNSNames,
+		Serial:   leaf.SerialNumber.Text(16),
+		NotAfter: leaf.NotAfter,
+	}
+	if info.Subject == "" && len(leaf.DNSNames) > 0 {
+		info.Subject = leaf.DNSNames[0]
+	}
+
+	// Handshakes mostly see the certificate already recorded
+	cm.mu.RLock()
+	known, ok := cm.certs[info.Subject]
+	cm.mu.RUnlock()
+	if ok && known.Serial == info.Serial {
+		return
+	}
+	cm.mu.Lock()
+	cm.certs[info.Subject] = info
+	cm.mu.Unlock()
+	if ok {
+		cm.logger.Info("TLS certificate replaced", "subject", info.Subject, "not_after", info.NotAfter)
+	}
+	cm.check(info, time.Now())
+}
+
+// Certs returns the recorded certificates, the one expiring first first.
+func (cm *CertMonitor) Certs() []CertInfo {
+	if cm == nil {
+		return nil
+	}
+	cm.mu.RLock()
+	certs := make([]CertInfo, 0, len(cm.certs))
+	for _, c := range cm.certs {
+		certs = append(certs, c)
+	}
+	cm.mu.RUnlock()
+	slices.SortFunc(certs, func(a, b CertInfo) int { return a.NotAfter.Compare(b.NotAfter) })
+	return certs
+}
+
+// Soonest returns the certificate expiring first; false if there is none.
+func (cm *CertMonitor) Soonest() (CertInfo, bool) {
+	certs := cm.Certs()
+	if len(certs) == 0 {
+		return CertInfo{}, false
+	}
+	return certs[0], true
+}
+
+// Run checks the certificates every hour until ctx is cancelled, logging
+// a warning for each one within the threshold and an error for each one
+// that expired.
+func (cm *CertMonitor) Run(ctx context.Context) {
+	if cm == nil {
+		return
+	}
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, c := range cm.Certs() {
+				cm.check(c, now)
+			}
+		}
+	}
+}
+
+// check logs c if it expired or expires within the warning threshold.
+func (cm *CertMonitor) check(c CertInfo, now time.Time) {
+	left := c.NotAfter.Sub(now)
+	switch {
+	case left <= 0:
+		cm.logger.Error("TLS certificate expired", "subject", c.Subject, "not_after", c.NotAfter)
+	case left < cm.warning:
+		cm.logger.Warn("TLS certificate expires soon", "subject", c.Subject, "not_after", c.NotAfter,
+			"remaining", left.Round(time.Minute))
+	}
+}
+
+// collectMetrics exports the expiry of each certificate.
+func (cm *CertMonitor) collectMetrics(mw *MetricsWriter) {
+	if cm == nil {
+		return
+	}
+	expiry := make(map[string]float64)
+	for _, c := range cm.Certs() {
+		expiry[c.Subject] = float64(c.NotAfter.Unix())
+	}
+	mw.GaugeVec("cysl_tls_cert_expiry_timestamp_seconds", "Expiry of the TLS certificates served, as a Unix timestamp.", "subject", expiry)
+}
+
+// registerCertRoutes mounts the certificate overview on the admin API.
+func (s *Server) registerCertRoutes(mux *http.ServeMux, as AdminSettings) {
+	mux.Handle("GET /admin/certs", requireAdmin(as, http.HandlerFunc(s.handleCerts)))
+}
+
+// handleCerts lists this instance's certificates and the one expiring
+// first. In a cluster, soonest covers every instance: each reports its
+// soonest-expiring certificate to Redis, and instances lists them.
+func (s *Server) handleCerts(w http.ResponseWriter, r *http.Request) {
+	mon := s.certs.Load()
+	body := struct {
+		Certs     []CertInfo `json:"certs"`
+		Soonest   *CertInfo  `json:"soonest,omitempty"`
+		Instances []CertInfo `json:"instances,omitempty"` // Soonest of each cluster instance
+		Error     string     `json:"error,omitempty"`     // Why the cluster's certificates are missing
+	}{Certs: mon.Certs()}
+	if body.Certs == nil {
+		body.Certs = []CertInfo{}
+	}
+	if c, ok := mon.Soonest(); ok {
+		body.Soonest = &c
+	}
+	if relay := s.hub.Cluster(); relay != nil {
+		certs, err := relay.Certs()
+		if err != nil {
+			body.Error = err.Error()
+		}
+		body.Instances = certs
+		if len(certs) > 0 && (body.Soonest == nil || certs[0].NotAfter.Before(body.Soonest.NotAfter)) {
+			body.Soonest = &certs[0]
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, body)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/coder/websocket"
+
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// Close codes and what they mean (see internal/protocol). The server closes
+// connections only with these; the reason of a policy violation says which
+// policy, often as JSON such as {"error":"rate_limited",...}.
+const (
+	CloseNormal          = protocol.CloseNormal          // 1000: the connection's work is done
+	CloseShutdown        = protocol.CloseShutdown        // 1001: Shutdown or Drain
+	ClosePolicyViolation = protocol.ClosePolicyViolation // 1008: a handler refused, Hub.Disconnect, slow consumer
+	CloseRateLimited     = protocol.CloseRateLimited     // 1008 with an "error":"rate_limited" reason
+	CloseMessageTooBig   = protocol.CloseMessageTooBig   // 1009: a message exceeded max_message_size
+	CloseInternalError   = protocol.CloseInternalError   // 1011: the connection ended without a deliberate close
+	CloseAuthFailed      = protocol.CloseAuthFailed      // 4401: the credentials stopped being valid
+	CloseSuperseded      = protocol.CloseSuperseded      // 4409: a newer connection of the same user and device took over
+)
+
+// CloseError is a close code with its reason. Handlers return one (or an
+// error wrapping one) from OnConnect or OnMessage to close the connection
+// with that code instead of ClosePolicyViolation and the error's text:
+//
+//	return nil, server.CloseError{Code: server.CloseAuthFailed, Reason: "token revoked"}
+type CloseError = websocket.CloseError
+
+// CloseWith closes conn with code and reason and waits for the client's
+// answering close frame. A connection that is already closing keeps the
+// code it was first closed with, and nil is returned, so cleanup paths can
+// close unconditionally. The reason is truncated to fit the frame.
+func CloseWith(conn *websocket.Conn, code websocket.StatusCode, reason string) error {
+	return protocol.CloseWith(conn, code, reason)
+}
+
+// closeHandlerError closes conn after its handler returned err: with the
+// code of a CloseError in err's chain, or ClosePolicyViolation and err's
+// text.
+func closeHandlerError(conn *websocket.Conn, err error) error {
+	var ce CloseError
+	if errors.As(err, &ce) {
+		return CloseWith(conn, ce.Code, ce.Reason)
+	}
+	return CloseWith(conn, ClosePolicyViolation, err.Error())
+}
+
+// peerCloseDetail describes the close frame err ended with for
+// DisconnectError.Detail, e.g. "shutdown: Client exiting".
+func peerCloseDetail(err error) string {
+	ce, ok := protocol.PeerClose(err)
+	if !ok {
+		return ""
+	}
+	detail := protocol.CloseName(ce.Code)
+	if ce.Reason != "" {
+		detail += ": " + ce.Reason
+	}
+	return detail
+}
@@ -0,0 +1,381 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds all tunable server settings. Values are resolved in three
+// layers: DefaultConfig, then an optional YAML or JSON file, then
+// environment variables, so a deployment can ship a file and still override
+// single values per container. Durations are written as strings ("10s").
+type Config struct {
+	Addr                string        `yaml:"addr"`                   // Listen address (env SERVER_ADDR)
+	MaxMessageSize      int64         `yaml:"max_message_size"`       // Max bytes per message (env MAX_MESSAGE_SIZE)
+	MaxConnectionsPerIP int           `yaml:"max_connections_per_ip"` // Concurrent connections per IP (env MAX_CONNECTIONS_PER_IP)
+	ReadTimeout         time.Duration `yaml:"read_timeout"`           // Max wait for the next message (env READ_TIMEOUT)
+	WriteTimeout        time.Duration `yaml:"write_timeout"`          // Max time for a single write (env WRITE_TIMEOUT)
+	RetryAfterConnLimit time.Duration `yaml:"retry_after_conn_limit"` // Retry-After hint when the per-IP limit is hit
+	ShutdownTimeout     time.Duration `yaml:"shutdown_timeout"`       // Grace period for HTTP shutdown
+	DrainTimeout        time.Duration `yaml:"drain_timeout"`          // Grace period for WebSocket close handshakes on shutdown (env DRAIN_TIMEOUT)
+
+	HTTP       HTTPConfig        `yaml:"http"`      // net/http server timeouts
+	Heartbeat  HeartbeatConfig   `yaml:"heartbeat"` // Default heartbeat profile
+	Policy     HeartbeatPolicy   `yaml:"heartbeat_policy"`
+	Sweeper    SweeperConfig     `yaml:"sweeper"`
+	ConnStates ConnStateSettings `yaml:"conn_states"` // Janitor of per-connection rate limit states
+	Hub        HubSettings       `yaml:"hub"`         // Per-connection send queues
+	Lifetime   LifetimeSettings  `yaml:"lifetime"`    // Max age and idle time of connections
+
+	RateLimit MessageRateSettings `yaml:"rate_limit"` // Per-IP and global message token buckets
+	Memory    MemorySettings      `yaml:"memory"`     // Budget for queued and stored messages
+	Sessions  SessionSettings     `yaml:"sessions"`   // Resumption of dropped connections' state
+	Takeover  TakeoverSettings    `yaml:"takeover"`   // Duplicate connections of a user's device
+	PubSub    PubSubSettings      `yaml:"pubsub"`     // Topic subscriptions by clients
+	Cluster   ClusterSettings     `yaml:"cluster"`    // Redis relay to other server instances
+
+	Moderation  ModerationSettings  `yaml:"moderation"`
+	GeoIP       GeoIPSettings       `yaml:"geoip"`
+	Beacon      BeaconSettings      `yaml:"beacon"`
+	Probes      ProbeSettings       `yaml:"probes"`
+	Uptime      UptimeSettings      `yaml:"uptime"`
+	Downtime    DowntimeSettings    `yaml:"downtime"`
+	Escalation  EscalationSettings  `yaml:"escalation"`
+	Monitors    MonitorSettings     `yaml:"monitors"`
+	Incidents   IncidentSettings    `yaml:"incidents"`
+	Maintenance MaintenanceSettings `yaml:"maintenance"`
+	Status      StatusSettings      `yaml:"status"`
+	History     HistorySettings     `yaml:"history"`
+	Watch       WatchSettings       `yaml:"watch"`
+	Admin       AdminSettings       `yaml:"admin"`
+	Publish     PublishSettings     `yaml:"publish"` // POST /publish for systems without a WebSocket
+	TLS         TLSSettings         `yaml:"tls"`
+	Auth        AuthSettings        `yaml:"auth"`
+	Proxy       ProxySettings       `yaml:"proxy"`      // Reverse proxies in front of the server
+	Access      AccessSettings      `yaml:"access"`     // IP allow and deny lists
+	Origins     OriginSettings      `yaml:"origins"`    // Browser origins allowed to connect
+	Preflight   PreflightSettings   `yaml:"preflight"`  // Startup self-test
+	CrashDump   CrashDumpSettings   `yaml:"crash_dump"` // Diagnostic bundle on SIGQUIT or a panic
+
+	AuditLogFile string      `yaml:"audit_log_file"` // JSONL audit sink (env AUDIT_LOG_FILE)
+	Log          LogSettings `yaml:"log"`            // Level and format (env LOG_LEVEL, LOG_FORMAT)
+}
+
+// HTTPConfig holds the timeouts of the underlying http.Server.
+type HTTPConfig struct {
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+}
+
+// ModerationSettings configures the content moderation hook.
+type ModerationSettings struct {
+	URL      string        `yaml:"url"`       // HTTP moderation endpoint - empty disables moderation (env MODERATION_URL)
+	Timeout  time.Duration `yaml:"timeout"`   // Max hold time per message (env MODERATION_TIMEOUT)
+	FailOpen bool          `yaml:"fail_open"` // Allow messages when the service fails (env MODERATION_FAIL_OPEN)
+	Rooms    []string      `yaml:"rooms"`     // Chat rooms moderated, as patterns like "support-*" (empty = every connection)
+}
+
+// GeoIPSettings configures GeoIP enrichment and country/ASN policies.
+type GeoIPSettings struct {
+	CountryDB        string `yaml:"country_db"`         // MaxMind country database (env GEOIP_COUNTRY_DB)
+	ASNDB            string `yaml:"asn_db"`             // MaxMind ASN database (env GEOIP_ASN_DB)
+	PolicyFile       string `yaml:"policy_file"`        // Enforced geo policy (env GEO_POLICY_FILE)
+	ShadowPolicyFile string `yaml:"shadow_policy_file"` // Dry-run geo policy (env GEO_POLICY_SHADOW_FILE)
+}
+
+// BeaconSettings configures the UDP beacon listener.
+type BeaconSettings struct {
+	Addr string `yaml:"addr"` // UDP listen address - empty disables beacons (env BEACON_ADDR)
+	Key  string `yaml:"key"`  // Shared HMAC key (env BEACON_KEY)
+}
+
+// DefaultConfig returns the built-in defaults, matching the values the
+// server has always used.
+func DefaultConfig() Config {
+	modDefaults := DefaultModerationConfig()
+	return Config{
+		Addr:                ServerAddr,
+		MaxMessageSize:      1024 * 1024, // 1 MB
+		MaxConnectionsPerIP: 50,
+		ReadTimeout:         10 * time.Second,
+		WriteTimeout:        10 * time.Second,
+		RetryAfterConnLimit: 10 * time.Second,
+		ShutdownTimeout:     10 * time.Second,
+		DrainTimeout:        5 * time.Second,
+		HTTP: HTTPConfig{
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 15 * time.Second,
+			IdleTimeout:  60 * time.Second,
+		},
+		Heartbeat:  DefaultHeartbeatConfig(),
+		Policy:     DefaultHeartbeatPolicy(),
+		Sweeper:    DefaultSweeperConfig(),
+		ConnStates: DefaultConnStateSettings(),
+		Hub:        DefaultHubSettings(),
+		Lifetime:   DefaultLifetimeSettings(),
+		RateLimit:  DefaultMessageRateSettings(),
+		Memory:     DefaultMemorySettings(),
+		Origins:    DefaultOriginSettings(),
+		Preflight:  DefaultPreflightSettings(),
+		CrashDump:  DefaultCrashDumpSettings(),
+		TLS:        TLSSettings{ExpiryWarning: 14 * 24 * time.Hour},
+		Sessions:   DefaultSessionSettings(),
+		Takeover:   DefaultTakeoverSettings(),
+		Publish:    DefaultPublishSettings(),
+		PubSub:     DefaultPubSubSettings(),
+		Cluster:    DefaultClusterSettings(),
+		Moderation: ModerationSettings{
+			Timeout:  modDefaults.Timeout,
+			FailOpen: modDefaults.FailOpen,
+		},
+		Probes: ProbeSettings{
+			Interval: 60 * time.Second,
+			Timeout:  5 * time.Second,
+		},
+		Uptime: UptimeSettings{
+			SampleInterval: time.Minute,
+			OfflineAfter:   5 * time.Minute,
+		},
+		Downtime: DowntimeSettings{
+			CheckInterval: 15 * time.Second,
+			OfflineAfter:  5 * time.Minute,
+			OnlineAfter:   3,
+		},
+		Escalation: EscalationSettings{
+			CheckInterval: 30 * time.Second,
+		},
+		Monitors: MonitorSettings{
+			CheckInterval: 10 * time.Second,
+		},
+		Incidents: IncidentSettings{
+			Retain: 500,
+		},
+		Maintenance: MaintenanceSettings{
+			CheckInterval: 30 * time.Second,
+		},
+		Status: StatusSettings{
+			Title:   "Service Status",
+			History: 20,
+		},
+		Log: LogSettings{Level: "info", Format: LogFormatText},
+	}
+}
+
+// LoadConfig builds a Config from defaults, the file at path (YAML or JSON -
+// JSON is valid YAML; empty path skips the file) and environment variables.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("read config: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true) // Typos in setting names are errors, not silent no-ops
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return cfg, fmt.Errorf("parse config %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides settings from environment variables. All malformed
+// values are reported together.
+func (c *Config) applyEnv() error {
+	var errs []error
+	envString("SERVER_ADDR", &c.Addr)
+	errs = append(errs,
+		envInt64("MAX_MESSAGE_SIZE", &c.MaxMessageSize),
+		envInt("MAX_CONNECTIONS_PER_IP", &c.MaxConnectionsPerIP),
+		envDuration("READ_TIMEOUT", &c.ReadTimeout),
+		envDuration("WRITE_TIMEOUT", &c.WriteTimeout),
+		envDuration("DRAIN_TIMEOUT", &c.DrainTimeout),
+		envDuration("CONN_STATE_MAX_IDLE", &c.ConnStates.MaxIdle),
+		envDuration("CONN_STATE_SWEEP_INTERVAL", &c.ConnStates.SweepInterval),
+		envInt("HUB_QUEUE_DEPTH", &c.Hub.QueueDepth),
+		envDuration("HUB_MESSAGE_TTL", &c.Hub.MessageTTL),
+		envInt("HUB_DEAD_LETTERS", &c.Hub.DeadLetters),
+		envInt("HUB_WRITE_RETRIES", &c.Hub.WriteRetries),
+		envDuration("SESSION_TTL", &c.Sessions.TTL),
+		envInt("SESSION_MAX_MESSAGES", &c.Sessions.MaxMessages),
+		envInt64("SESSION_MAX_BYTES", &c.Sessions.MaxBytes),
+		envBool("PUBSUB_ENABLED", &c.PubSub.Enabled),
+		envInt("PUBSUB_MAX_SUBSCRIPTIONS", &c.PubSub.MaxSubscriptions),
+	)
+	envString("HUB_OVERFLOW", &c.Hub.Overflow)
+	errs = append(errs,
+		envInt("HUB_SLOW_THRESHOLD", &c.Hub.SlowConsumer.Threshold),
+		envDuration("HUB_SLOW_FOR", &c.Hub.SlowConsumer.For),
+	)
+	envString("HUB_SLOW_POLICY", &c.Hub.SlowConsumer.Policy)
+	errs = append(errs,
+		envFloat("RATE_LIMIT_PER_IP", &c.RateLimit.PerIP.Rate),
+		envInt("RATE_LIMIT_PER_IP_BURST", &c.RateLimit.PerIP.Burst),
+		envFloat("RATE_LIMIT_GLOBAL", &c.RateLimit.Global.Rate),
+		envInt("RATE_LIMIT_GLOBAL_BURST", &c.RateLimit.Global.Burst),
+		envDuration("RATE_LIMIT_MIN_INTERVAL", &c.RateLimit.MinInterval),
+		envInt("RATE_LIMIT_MAX_VIOLATIONS", &c.RateLimit.MaxViolations),
+		envInt64("MEMORY_BUDGET", &c.Memory.Budget),
+		envFloat("MEMORY_HIGH_WATER", &c.Memory.HighWater),
+	)
+
+	envString("MODERATION_URL", &c.Moderation.URL)
+	errs = append(errs,
+		envDuration("MODERATION_TIMEOUT", &c.Moderation.Timeout),
+		envBool("MODERATION_FAIL_OPEN", &c.Moderation.FailOpen),
+	)
+
+	envString("GEOIP_COUNTRY_DB", &c.GeoIP.CountryDB)
+	envString("GEOIP_ASN_DB", &c.GeoIP.ASNDB)
+	envString("GEO_POLICY_FILE", &c.GeoIP.PolicyFile)
+	envString("GEO_POLICY_SHADOW_FILE", &c.GeoIP.ShadowPolicyFile)
+	envString("AUDIT_LOG_FILE", &c.AuditLogFile)
+	envString("LOG_LEVEL", &c.Log.Level)
+	envString("LOG_FORMAT", &c.Log.Format)
+	envString("UPTIME_STATE_FILE", &c.Uptime.StateFile)
+	envString("INCIDENT_STATE_FILE", &c.Incidents.StateFile)
+	errs = append(errs, envBool("STATUS_PAGE_ENABLED", &c.Status.Enabled))
+	envString("METRICS_HISTORY_FILE", &c.History.StateFile)
+	errs = append(errs, envBool("METRICS_HISTORY_ENABLED", &c.History.Enabled))
+	if v, ok := os.LookupEnv("HEALTH_WATCH_USERS"); ok {
+		c.Watch.AllowedUsers = splitList(v)
+	}
+	envString("ADMIN_TOKEN", &c.Admin.Token)
+	envString("PUBLISH_TOKEN", &c.Publish.Token)
+	errs = append(errs,
+		envFloat("PUBLISH_RATE", &c.Publish.Rate.Rate),
+		envInt("PUBLISH_BURST", &c.Publish.Rate.Burst),
+	)
+	envString("CLUSTER_REDIS_ADDR", &c.Cluster.RedisAddr)
+	envString("CLUSTER_REDIS_PASSWORD", &c.Cluster.RedisPassword)
+	envString("CLUSTER_PREFIX", &c.Cluster.Prefix)
+	envString("CLUSTER_INSTANCE", &c.Cluster.Instance)
+	errs = append(errs, envDuration("CLUSTER_REPORT_INTERVAL", &c.Cluster.ReportInterval))
+	envString("DOWNTIME_WEBHOOK_URL", &c.Downtime.WebhookURL)
+	envString("AUTH_JWT_SECRET", &c.Auth.JWTSecret)
+	envString("SMTP_PASSWORD", &c.Escalation.SMTP.Password)
+	envString("BEACON_ADDR", &c.Beacon.Addr)
+	envString("BEACON_KEY", &c.Beacon.Key)
+	envString("TLS_CERT_FILE", &c.TLS.CertFile)
+	envString("TLS_KEY_FILE", &c.TLS.KeyFile)
+	errs = append(errs, envDuration("TLS_EXPIRY_WARNING", &c.TLS.ExpiryWarning))
+	if v, ok := os.LookupEnv("TLS_AUTOCERT_DOMAINS"); ok {
+		c.TLS.Autocert.Domains = splitList(v)
+	}
+	if v, ok := os.LookupEnv("TRUSTED_PROXIES"); ok {
+		c.Proxy.TrustedProxies = splitList(v)
+	}
+	errs = append(errs, envBool("PROXY_PROTOCOL", &c.Proxy.ProxyProtocol))
+	if v, ok := os.LookupEnv("ACCESS_ALLOW"); ok {
+		c.Access.Allow = splitList(v)
+	}
+	if v, ok := os.LookupEnv("ACCESS_DENY"); ok {
+		c.Access.Deny = splitList(v)
+	}
+	envString("ACCESS_LIST_FILE", &c.Access.File)
+	if v, ok := os.LookupEnv("ORIGIN_PATTERNS"); ok {
+		c.Origins.Patterns = splitList(v)
+	}
+	errs = append(errs, envBool("ORIGIN_ALLOW_ALL", &c.Origins.AllowAll))
+	if v, ok := os.LookupEnv("PREFLIGHT_FAIL_ON"); ok {
+		c.Preflight.FailOn = splitList(v)
+	}
+	envString("CRASH_DUMP_DIR", &c.CrashDump.Dir)
+	errs = append(errs,
+		envDuration("CONN_MAX_LIFETIME", &c.Lifetime.MaxLifetime),
+		envDuration("CONN_IDLE_TIMEOUT", &c.Lifetime.IdleTimeout),
+		envBool("CONN_TAKEOVER", &c.Takeover.Enabled),
+	)
+
+	return errors.Join(errs...)
+}
+
+// envString overrides dst with the variable's value if it is set.
+func envString(name string, dst *string) {
+	if v, ok := os.LookupEnv(name); ok {
+		*dst = v
+	}
+}
+
+// envInt overrides dst with the variable parsed as an int.
+func envInt(name string, dst *int) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%s: invalid integer %q", name, v)
+	}
+	*dst = n
+	return nil
+}
+
+// envInt64 overrides dst with the variable parsed as an int64.
+func envInt64(name string, dst *int64) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s: invalid integer %q", name, v)
+	}
+	*dst = n
+	return nil
+}
+
+// envFloat overrides dst with the variable parsed as a float.
+func envFloat(name string, dst *float64) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("%s: invalid number %q", name, v)
+	}
+	*dst = f
+	return nil
+}
+
+// envDuration overrides dst with the variable parsed as a duration ("10s").
+func envDuration(name string, dst *time.Duration) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%s: invalid duration %q", name, v)
+	}
+	*dst = d
+	return nil
+}
+
+// envBool overrides dst with the variable parsed as a bool.
+func envBool(name string, dst *bool) error {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%s: invalid boolean %q", name, v)
+	}
+	*dst = b
+	return nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// conformanceReadLimit is large enough for the biggest Autobahn test
+// messages (case 9.x sends up to 16 MiB).
+const conformanceReadLimit = 32 * 1024 * 1024
+
+// StartConformance runs the server as a strict RFC 6455 echo endpoint for
+// the Autobahn test suite. Every message is echoed back unchanged with its
+// original type, and everything that is not part of the protocol is turned
+// off: no per-IP limits, rate limiting, moderation, origin checks or
+// server-initiated pings, so test results reflect only our WebSocket stack.
+// Only cfg.Addr is used. Never expose this mode publicly.
+func StartConformance(ctx context.Context, cfg Config) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleConformance)
+
+	server := &http.Server{
+		Addr:    cfg.Addr,
+		Handler: mux,
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		slog.Info("Starting conformance echo server", "addr", cfg.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errChan <- err
+		}
+	}()
+
+	select {
+	case err := <-errChan:
+		return fmt.Errorf("conformance server failed to start: %w", err)
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			return fmt.Errorf("conformance server shutdown error: %w", err)
+		}
+	}
+	return nil
+}
+
+// handleConformance echoes messages by streaming each frame straight back,
+// so fragmented and very large messages are handled without buffering.
+func handleConformance(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		InsecureSkipVerify: true,                                   // Test clients send arbitrary origins
+		CompressionMode:    websocket.CompressionNoContextTakeover, // Exercise permessage-deflate cases
+	})
+	if err != nil {
+		slog.Warn("Conformance accept failed", "error", err)
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(conformanceReadLimit)
+
+	ctx := r.Context()
+	for {
+		if err := echoFrame(ctx, conn); err != nil {
+			// Peer closes and protocol errors end the test case normally
+			if websocket.CloseStatus(err) == -1 {
+				slog.Info("Conformance echo ended", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// echoFrame copies one message from the reader to a writer of the same type.
+func echoFrame(ctx context.Context, conn *websocket.Conn) error {
+	typ, reader, err := conn.Reader(ctx)
+	if err != nil {
+		return err
+	}
+
+	writer, err := conn.Writer(ctx, typ)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		return fmt.Errorf("echo copy: %w", err)
+	}
+	return writer.Close()
+}
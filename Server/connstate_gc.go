@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// ConnStateSettings configures the janitor of the per-connection rate
+// limit states. The server removes a connection's state when the
+// connection closes; the janitor catches the states a cleanup path missed,
+// so they can't pile up over the life of the process.
+type ConnStateSettings struct {
+	MaxIdle       time.Duration `yaml:"max_idle"`       // States without a message this long are dropped; 0 = never (env CONN_STATE_MAX_IDLE)
+	SweepInterval time.Duration `yaml:"sweep_interval"` // How often the janitor looks (env CONN_STATE_SWEEP_INTERVAL)
+}
+
+// DefaultConnStateSettings returns a janitor that drops states idle for
+// 10 minutes, checking every minute. Open connections are never idle that
+// long: they are closed after read_timeout without a message.
+func DefaultConnStateSettings() ConnStateSettings {
+	return ConnStateSettings{MaxIdle: 10 * time.Minute, SweepInterval: time.Minute}
+}
+
+// validate checks the settings. MaxIdle is compared with the read timeout
+// in validateTimeouts.
+func (cs ConnStateSettings) validate() []ValidationError {
+	var errs []ValidationError
+	if cs.MaxIdle < 0 {
+		errs = append(errs, ValidationError{"conn_states.max_idle", "must not be negative"})
+	}
+	if cs.MaxIdle > 0 && cs.SweepInterval <= 0 {
+		errs = append(errs, ValidationError{"conn_states.sweep_interval", "must be positive"})
+	}
+	return errs
+}
+
+// Len returns the number of tracked states.
+func (csm *ConnectionStateManager) Len() int {
+	csm.mu.RLock()
+	defer csm.mu.RUnlock()
+	return len(csm.states)
+}
+
+// Expired returns how many states Expire dropped.
+func (csm *ConnectionStateManager) Expired() int64 {
+	return csm.expired.Load()
+}
+
+// Expire drops the states that saw no message or ping for maxIdle and
+// returns how many. A connection still holding its state keeps using it;
+// only the manager forgets it.
+func (csm *ConnectionStateManager) Expire(maxIdle time.Duration) int {
+	cutoff := time.Now().Add(-maxIdle).UnixNano()
+	csm.mu.Lock()
+	defer csm.mu.Unlock()
+	n := 0
+	for id, state := range csm.states {
+		if state.touched.Load() < cutoff {
+			delete(csm.states, id)
+			n++
+		}
+	}
+	csm.expired.Add(int64(n))
+	return n
+}
+
+// Run expires idle states every cfg.SweepInterval until ctx is cancelled.
+// It returns right away if cfg.MaxIdle is 0.
+func (csm *ConnectionStateManager) Run(ctx context.Context, cfg ConnStateSettings, logger *slog.Logger) {
+	if cfg.MaxIdle <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n := csm.Expire(cfg.MaxIdle); n > 0 {
+				// Each one is a connection whose cleanup didn't run
+				logger.Warn("Expired stale connection states", "count", n, "max_idle", cfg.MaxIdle, "remaining", csm.Len())
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CrashDumpSettings configures the diagnostic bundle written on SIGQUIT,
+// when a connection's handler panics (at most once a minute) or when a
+// goroutine guarded by DumpOnPanic panics.
+type CrashDumpSettings struct {
+	Dir         string `yaml:"dir"`          // Where dumps are written; empty = the system temp directory (env CRASH_DUMP_DIR)
+	AuditEvents int    `yaml:"audit_events"` // Recent audit events included (at most 256 are kept)
+}
+
+// DefaultCrashDumpSettings returns dumps in the temp directory with the
+// last 100 audit events.
+func DefaultCrashDumpSettings() CrashDumpSettings {
+	return CrashDumpSettings{AuditEvents: 100}
+}
+
+// validate checks the settings.
+func (cs CrashDumpSettings) validate() []ValidationError {
+	if cs.AuditEvents < 0 {
+		return []ValidationError{{"crash_dump.audit_events", "must not be negative"}}
+	}
+	return nil
+}
+
+// redacted replaces secrets in a dump's config snapshot.
+const redacted = "REDACTED"
+
+// WriteCrashDump writes a crash dump of the default server, see
+// Server.WriteCrashDump.
+func WriteCrashDump(reason string) (string, error) {
+	return defaultServer.Load().WriteCrashDump(reason)
+}
+
+// WriteCrashDump writes a diagnostic bundle for postmortems and returns
+// its path: the goroutine dump, the connection table, the config with its
+// secrets redacted and the most recent audit events. The file is named
+// after the time, e.g. cysl-crash-20240501T120000Z-4711.txt. The server
+// keeps running; main calls it on SIGQUIT and exits afterwards.
+func (s *Server) WriteCrashDump(reason string) (string, error) {
+	return s.writeCrashDump(reason, nil)
+}
+
+// DumpOnPanic writes a crash dump of the default server if the goroutine
+// it is deferred in panics, then lets the panic continue:
+//
+//	defer server.DumpOnPanic()
+func DumpOnPanic() {
+	if v := recover(); v != nil {
+		stack := debug.Stack() // Still the panicking stack - nothing has unwound yet
+		reason := fmt.Sprintf("panic: %v", v)
+		if path, err := defaultServer.Load().writeCrashDump(reason, stack); err != nil {
+			slog.Error("Crash dump failed", "reason", reason, "error", err)
+		} else {
+			slog.Error("Crash dump written", "reason", reason, "path", path)
+		}
+		panic(v)
+	}
+}
+
+// writeCrashDump writes the dump, with the panicking goroutine's stack
+// first if there is one.
+func (s *Server) writeCrashDump(reason string, stack []byte) (string, error) {
+	cfg := s.Config()
+	dir := cfg.CrashDump.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	now := time.Now().UTC()
+	path := filepath.Join(dir, fmt.Sprintf("cysl-crash-%s-%d.txt", now.Format("20060102T150405Z"), os.Getpid()))
+	// Connection addresses and audit events aren't for everyone
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("create crash dump: %w", err)
+	}
+	w := bufio.NewWriter(f)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(w, "cysl crash dump\nreason: %s\ntime: %s\npid: %d\ngo: %s\ngoroutines: %d\n",
+		reason, now.Format(time.RFC3339Nano), os.Getpid(), runtime.Version(), runtime.NumGoroutine())
+	fmt.Fprintf(w, "heap: %d bytes in use, %d GCs\nactive connections: %d\n", mem.HeapInuse, mem.NumGC, s.active.Load())
+	if stack != nil {
+		fmt.Fprintf(w, "\n== Panicking goroutine ==\n%s", stack)
+	}
+
+	conns := s.hub.Conns()
+	infos := make([]ConnInfo, len(conns))
+	for i, hc := range conns {
+		infos[i] = hc.Info()
+	}
+	fmt.Fprintf(w, "\n== Connections (%d) ==\n", len(infos))
+	writeDumpJSON(w, infos)
+
+	fmt.Fprintf(w, "\n== Config ==\n")
+	writeDumpConfig(w, cfg)
+
+	events := auditLog.Recent()
+	events = events[max(0, len(events)-cfg.CrashDump.AuditEvents):]
+	fmt.Fprintf(w, "\n== Recent audit events (%d) ==\n", len(events))
+	for _, ev := range events {
+		line, _ := json.Marshal(ev)
+		fmt.Fprintf(w, "%s\n", line)
+	}
+
+	// The same format as the runtime's own SIGQUIT dump
+	fmt.Fprintf(w, "\n== Goroutines ==\n")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return path, fmt.Errorf("write crash dump: %w", err)
+	}
+	return path, nil
+}
+
+// writeDumpJSON writes v as indented JSON.
+func writeDumpJSON(w io.Writer, v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintf(w, "(%v)\n", err)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", data)
+}
+
+// writeDumpConfig writes cfg as YAML, as it would appear in the config
+// file, with the values of secret keys replaced.
+func writeDumpConfig(w io.Writer, cfg *Config) {
+	var node yaml.Node
+	if err := node.Encode(cfg); err != nil {
+		fmt.Fprintf(w, "(%v)\n", err)
+		return
+	}
+	redactSecrets(&node)
+	data, err := yaml.Marshal(&node)
+	if err != nil {
+		fmt.Fprintf(w, "(%v)\n", err)
+		return
+	}
+	w.Write(data)
+}
+
+// redactSecrets replaces the non-empty values of secret keys in n and
+// everything below it. Keys are matched by name, so secrets added to the
+// config later are covered too.
+func redactSecrets(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, val := n.Content[i], n.Content[i+1]
+			if secretKey(key.Value) && val.Kind == yaml.ScalarNode && val.Value != "" {
+				val.Value, val.Tag, val.Style = redacted, "!!str", 0
+			}
+		}
+	}
+	for _, c := range n.Content {
+		redactSecrets(c)
+	}
+}
+
+// secretKey reports whether a config key holds a secret: tokens,
+// passwords, keys (but not key files) and webhook URLs, which often carry
+// a token.
+func secretKey(key string) bool {
+	switch key {
+	case "token", "key", "password", "webhook_url":
+		return true
+	}
+	return strings.HasSuffix(key, "_secret") || strings.HasSuffix(key, "_password") ||
+		strings.HasSuffix(key, "_key") || strings.HasSuffix(key, "_token")
+}
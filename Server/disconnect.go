@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/coder/websocket"
+)
+
+// DisconnectReason says why a connection ended.
+type DisconnectReason string
+
+// Disconnect reasons. The server decided the first group, the peer or the
+// network the rest.
+const (
+	DisconnectDrain         DisconnectReason = "drain"           // The server shut down (Shutdown, Drain)
+	DisconnectKicked        DisconnectReason = "kicked"          // Hub.Disconnect, e.g. through the admin API
+	DisconnectSlowConsumer  DisconnectReason = "slow_consumer"   // The client fell too far behind its queue
+	DisconnectRateLimited   DisconnectReason = "rate_limited"    // Too many rate limit violations
+	DisconnectMessageTooBig DisconnectReason = "message_too_big" // A message exceeded max_message_size
+	DisconnectHandler       DisconnectReason = "handler"         // The handler refused the connection or a message
+	DisconnectHeartbeat     DisconnectReason = "heartbeat_lost"  // The client stopped answering pings
+	DisconnectHalfOpen      DisconnectReason = "half_open"       // The sweeper's probe write stalled
+	DisconnectPanic         DisconnectReason = "panic"           // A handler or middleware panicked; the connection was closed with 1011
+	DisconnectLifetime      DisconnectReason = "max_lifetime"    // The connection reached lifetime.max_lifetime
+	DisconnectIdle          DisconnectReason = "idle_timeout"    // No message arrived within lifetime.idle_timeout
+	DisconnectSuperseded    DisconnectReason = "superseded"      // A newer connection of the same user and device took over, see TakeoverSettings
+
+	DisconnectPeerClosed  DisconnectReason = "peer_closed"  // The client sent a close frame
+	DisconnectReadTimeout DisconnectReason = "read_timeout" // Nothing arrived within read_timeout
+	DisconnectReadError   DisconnectReason = "read_error"   // The network connection failed
+	DisconnectWriteError  DisconnectReason = "write_error"  // Writing a reply failed
+)
+
+// DisconnectError is why a connection ended. Handlers get it as OnClose's
+// error, and it is the cause of the connection's context once the read loop
+// stopped, so goroutines a handler started learn it from context.Cause:
+//
+//	var de *server.DisconnectError
+//	if errors.As(context.Cause(ctx), &de) && de.Reason == server.DisconnectHeartbeat {
+//		...
+//	}
+type DisconnectError struct {
+	Reason DisconnectReason
+	Detail string // The close reason the server gave (e.g. to Hub.Disconnect) or the peer's close code and reason
+	Err    error  // What ended the read loop, or the handler's error
+}
+
+// Error implements the error interface.
+func (e *DisconnectError) Error() string {
+	msg := "disconnected: " + string(e.Reason)
+	if e.Detail != "" {
+		msg += " (" + e.Detail + ")"
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the error that ended the read loop, so errors.Is finds
+// e.g. ErrHeartbeatLost and websocket.CloseStatus the peer's status.
+func (e *DisconnectError) Unwrap() error {
+	return e.Err
+}
+
+// closing records why the server is about to close hc. The first reason
+// wins: a connection drained while being kicked was kicked.
+func (hc *HubConn) closing(reason DisconnectReason, detail string) {
+	hc.closeCause.CompareAndSwap(nil, &DisconnectError{Reason: reason, Detail: detail})
+}
+
+// disconnectCause explains err, the error that ended hc's read loop: a
+// reason the server recorded before closing comes first, then the cause
+// ctx was cancelled with, then what err itself says.
+func disconnectCause(ctx context.Context, hc *HubConn, t *SweepTarget, err error) *DisconnectError {
+	if de := hc.closeCause.Load(); de != nil {
+		return &DisconnectError{Reason: de.Reason, Detail: de.Detail, Err: err}
+	}
+	if t.closed.Load() {
+		return &DisconnectError{Reason: DisconnectHalfOpen, Err: err}
+	}
+	var de *DisconnectError
+	if errors.As(context.Cause(ctx), &de) {
+		return de // The heartbeat gave up - err is just the cancelled read
+	}
+	switch {
+	case websocket.CloseStatus(err) != -1:
+		return &DisconnectError{Reason: DisconnectPeerClosed, Detail: peerCloseDetail(err), Err: err}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &DisconnectError{Reason: DisconnectReadTimeout, Err: err}
+	}
+	return &DisconnectError{Reason: DisconnectReadError, Err: err}
+}
+
+// disconnectReason returns the reason of a DisconnectError in err's chain,
+// "" if there is none.
+func disconnectReason(err error) DisconnectReason {
+	var de *DisconnectError
+	if errors.As(err, &de) {
+		return de.Reason
+	}
+	return ""
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DowntimeSettings configures debounced downtime detection.
+type DowntimeSettings struct {
+	CheckInterval time.Duration `yaml:"check_interval"` // How often device state is evaluated
+	OfflineAfter  time.Duration `yaml:"offline_after"`  // Silence before a device is declared offline
+	OnlineAfter   int           `yaml:"online_after"`   // Consecutive good heartbeats before it is back online
+	WebhookURL    string        `yaml:"webhook_url"`    // Receives DowntimeEvent JSON (env DOWNTIME_WEBHOOK_URL)
+}
+
+// DowntimeEvent is emitted when a device changes between online and offline.
+type DowntimeEvent struct {
+	Device   string    `json:"device"`
+	State    string    `json:"state"`              // "offline" or "online"
+	At       time.Time `json:"at"`                 // When the transition was detected
+	Since    time.Time `json:"since"`              // Last good heartbeat (offline) or when it went down (online)
+	Duration string    `json:"downtime,omitempty"` // Length of the outage, on "online" events
+
+	// Maintenance marks outages inside a maintenance window. They are
+	// audited but not sent to webhooks, escalation or incidents.
+	Maintenance bool `json:"maintenance,omitempty"`
+}
+
+// deviceHealth is the detector's view of one device.
+type deviceHealth struct {
+	offline     bool
+	downSince   time.Time // When the device was declared offline
+	lastGood    time.Time // Last beacon or successful probe
+	streak      int       // Consecutive good heartbeats while offline
+	beacons     int64     // Beacon count at the last check
+	probeAt     time.Time // CheckedAt of the last probe seen
+	maintenance bool      // Went offline inside a maintenance window
+	initialized bool
+}
+
+// DowntimeDetector turns raw beacon and probe churn into debounced
+// offline/online events. A device goes offline only after OfflineAfter of
+// silence and comes back only after OnlineAfter consecutive good
+// heartbeats, so a flapping link produces one outage instead of dozens of
+// alerts.
+type DowntimeDetector struct {
+	cfg      DowntimeSettings
+	registry *DeviceRegistry
+	webhook  *WebhookNotifier
+	devices  map[string]*deviceHealth
+	mu       sync.Mutex // Protects devices
+
+	// OnEvent, if set, is called for every event in addition to the
+	// audit log and webhook (e.g. to drive escalation).
+	OnEvent func(DowntimeEvent)
+}
+
+// NewDowntimeDetector creates a detector. Call Run to start evaluating.
+func NewDowntimeDetector(cfg DowntimeSettings, registry *DeviceRegistry) *DowntimeDetector {
+	return &DowntimeDetector{
+		cfg:      cfg,
+		registry: registry,
+		webhook:  NewWebhookNotifier(cfg.WebhookURL),
+		devices:  make(map[string]*deviceHealth),
+	}
+}
+
+// Run evaluates all devices every CheckInterval until ctx is cancelled.
+func (dd *DowntimeDetector) Run(ctx context.Context) {
+	ticker := time.NewTicker(dd.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, ev := range dd.Check(time.Now()) {
+			dd.emit(ev)
+		}
+	}
+}
+
+// Check updates every device from the registry and returns the transitions.
+func (dd *DowntimeDetector) Check(now time.Time) []DowntimeEvent {
+	var events []DowntimeEvent
+
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	for _, d := range dd.registry.List() {
+		h, ok := dd.devices[d.ID]
+		if !ok {
+			h = &deviceHealth{}
+			dd.devices[d.ID] = h
+		}
+
+		// Count the good and bad heartbeats since the last check
+		good := d.Beacons - h.beacons
+		h.beacons = d.Beacons
+		if good > 0 && d.LastSeen.After(h.lastGood) {
+			h.lastGood = d.LastSeen
+		}
+		failed := false
+		if p := d.Probe; p != nil && p.CheckedAt.After(h.probeAt) {
+			h.probeAt = p.CheckedAt
+			if p.Reachable {
+				good++
+				h.lastGood = p.CheckedAt
+			} else {
+				failed = true
+			}
+		}
+
+		if !h.initialized {
+			// A device seen for the first time starts online, counted from
+			// its latest report - the first check is not a transition
+			h.initialized = true
+			if h.lastGood.IsZero() {
+				h.lastGood = now
+			}
+			continue
+		}
+
+		if !h.offline {
+			if now.Sub(h.lastGood) >= dd.cfg.OfflineAfter {
+				h.offline = true
+				h.downSince = now
+				h.streak = 0
+				h.maintenance = maintenanceSchedule.Covers("device", d.ID, now)
+				events = append(events, DowntimeEvent{Device: d.ID, State: "offline", At: now, Since: h.lastGood, Maintenance: h.maintenance})
+			}
+			continue
+		}
+
+		// Still down when its maintenance window ends: from here on it is
+		// a real outage
+		if h.maintenance && !maintenanceSchedule.Covers("device", d.ID, now) {
+			h.maintenance = false
+			h.downSince = now
+			events = append(events, DowntimeEvent{Device: d.ID, State: "offline", At: now, Since: now})
+		}
+
+		// Offline: require a run of good heartbeats without a failure
+		if failed {
+			h.streak = 0
+		}
+		h.streak += int(good)
+		if h.streak >= dd.cfg.OnlineAfter {
+			h.offline = false
+			h.streak = 0
+			events = append(events, DowntimeEvent{
+				Device:      d.ID,
+				State:       "online",
+				At:          now,
+				Since:       h.downSince,
+				Duration:    now.Sub(h.downSince).Round(time.Second).String(),
+				Maintenance: h.maintenance,
+			})
+			h.maintenance = false
+		}
+	}
+	return events
+}
+
+// emit records an event in the audit log and sends it to the webhook.
+// Events inside a maintenance window stop at the audit log.
+func (dd *DowntimeDetector) emit(ev DowntimeEvent) {
+	slog.Info("Device state changed", "device", ev.Device, "state", ev.State, "since", ev.Since.Format(time.RFC3339))
+	fields := map[string]string{"device": ev.Device}
+	if ev.Duration != "" {
+		fields["downtime"] = ev.Duration
+	}
+	if ev.Maintenance {
+		fields["maintenance"] = "true"
+	}
+	auditLog.Record(AuditEvent{
+		Type:       "downtime",
+		RemoteAddr: ev.Device,
+		Decision:   ev.State,
+		Reason:     fmt.Sprintf("since %s", ev.Since.Format(time.RFC3339)),
+		Fields:     fields,
+	})
+	if ev.Maintenance {
+		return
+	}
+	dd.webhook.Notify(ev)
+	if dd.OnEvent != nil {
+		dd.OnEvent(ev)
+	}
+}
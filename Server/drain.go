@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// drainReason is the close reason sent to clients on shutdown.
+const drainReason = "server shutting down"
+
+// Drain closes every registered connection with StatusGoingAway, telling
+// clients to reconnect elsewhere (or later) instead of waiting for a
+// heartbeat to time out, and waits until their handlers have unregistered
+// them. Close handshakes run concurrently; Drain gives up waiting for
+// them when ctx expires. Returns how many
+// connections were open when draining started.
+//
+// http.Server.Shutdown doesn't track hijacked connections, so without
+// draining WebSocket clients only notice the shutdown when the process exits.
+func (h *Hub) Drain(ctx context.Context) int {
+	h.mu.RLock()
+	conns := h.conns.snapshot()
+	h.mu.RUnlock()
+	if len(conns) == 0 {
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	for _, hc := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Close writes the close frame and waits for the client's answer;
+			// the read loop then sees the closure and unregisters hc
+			hc.closing(DisconnectDrain, drainReason)
+			CloseWith(hc.conn, CloseShutdown, drainReason)
+			select {
+			case <-hc.done:
+			case <-ctx.Done():
+			}
+		}()
+	}
+	closed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		// Clients that haven't answered are left to the pending handshakes,
+		// which the websocket library bounds itself, or to the process exit
+	}
+	return len(conns)
+}
+
+// drainConnections shuts the server down within timeout, logging why
+// connections were left open.
+func (s *Server) drainConnections(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		s.logger().Warn("Drain incomplete", "error", err)
+	}
+}
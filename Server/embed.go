@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Handler returns the server's WebSocket stack as an http.Handler: the
+// registered handlers (/ws echoes unless replaced), /rpc, /chat, /health,
+// /readyz and /metrics. Applications mount it on their own mux or router, behind
+// their own middleware and TLS, instead of letting Run listen:
+//
+//	s, err := server.NewServer(cfg)
+//	...
+//	mux.Handle("/realtime/", http.StripPrefix("/realtime", s.Handler()))
+//
+// Addr, HTTP, TLS and the shutdown timeouts of the config only matter to
+// Run; everything else applies to connections served through the handler
+// too. The process-wide services Run starts (audit log, beacons, monitors,
+// status page, ...) are not part of it. Every call returns a new mux, with the handlers
+// registered at that time, behind the X-Request-ID middleware. Call
+// Shutdown when stopping the http.Server.
+func (s *Server) Handler() http.Handler {
+	s.start()
+	return s.withRequestID(s.newMux())
+}
+
+// newMux routes the WebSocket stack.
+func (s *Server) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	s.mountHandlers(mux)                                 // /ws (echo unless replaced) and application handlers
+	mux.Handle("/rpc", s.WebSocketHandler(rpcHandler{})) // JSON-RPC 2.0 over WebSocket
+	mux.HandleFunc("/chat/{room}", s.handleChat)
+	mux.HandleFunc("/chat", handleChatRooms)
+	mux.HandleFunc("/health", s.healthCheck)
+	mux.HandleFunc("/readyz", s.handleReadyz)  // Preflight results of Run
+	mux.Handle("/metrics", s.metricsHandler()) // Prometheus text format
+	if ps := s.Config().Publish; ps.Enabled() {
+		s.registerPublishRoute(mux, ps) // POST /publish
+	}
+	return mux
+}
+
+// start runs the server's background loops once: the sweeper detects
+// half-open connections that heartbeats alone may miss, the janitor drops
+// connection states left behind, and the cluster relay, if configured,
+// links the hub to those of the other instances.
+func (s *Server) start() {
+	s.startOnce.Do(func() {
+		go s.sweeper.Run(s.background)
+		go s.states.Run(s.background, s.Config().ConnStates, s.logger())
+		if relay := clusterRelayFromConfig(s.Config().Cluster, s.hub, s.logger()); relay != nil {
+			s.hub.cluster.Store(relay)
+			go relay.Run(s.background)
+		}
+	})
+}
+
+// Shutdown closes the server's WebSocket connections with StatusGoingAway
+// and waits until their handlers have finished or ctx expires, then stops
+// the background loops. Call it after http.Server.Shutdown, which doesn't
+// track hijacked connections and so leaves WebSocket clients connected.
+// Returns an error if connections were still open when ctx expired.
+func (s *Server) Shutdown(ctx context.Context) error {
+	defer s.stopBackground()
+	start := time.Now()
+	n := s.hub.Drain(ctx)
+	open := s.hub.Count()
+	if n > 0 {
+		s.logger().Info("Drained WebSocket connections", "count", n,
+			"duration", time.Since(start).Round(time.Millisecond), "still_registered", open)
+	}
+	if open > 0 && ctx.Err() != nil {
+		return fmt.Errorf("%d WebSocket connections still open: %w", open, ctx.Err())
+	}
+	return nil
+}
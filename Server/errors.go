@@ -0,0 +1,26 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/deanbregenzer/cysl/internal/heartbeat"
+)
+
+// Errors returned by the server's APIs, for callers to branch on with
+// errors.Is. The concrete errors carry details: a *RateLimitError is
+// ErrRateLimited, authentication errors name the failed check. The hub's
+// errors (ErrQueueFull, ErrSlowConsumer, ErrUnknownConn) are in hub.go.
+var (
+	// ErrRateLimited: a client exceeded a rate limit. errors.As finds
+	// the *RateLimitError with the limiter and violation counts.
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrAuthFailed: a request's credentials were missing or invalid.
+	ErrAuthFailed = errors.New("authentication failed")
+
+	// ErrHeartbeatLost: the peer stopped answering heartbeat pings.
+	ErrHeartbeatLost = heartbeat.ErrLost
+
+	// ErrRoomNotFound: no chat room with that name has members.
+	ErrRoomNotFound = errors.New("room not found")
+)
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint.
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// EscalationSettings configures escalation of device outages.
+type EscalationSettings struct {
+	CheckInterval time.Duration       `yaml:"check_interval"` // How often open outages are re-evaluated
+	Policies      []EscalationPolicy  `yaml:"policies"`       // First matching policy wins
+	Maintenance   []MaintenanceWindow `yaml:"maintenance"`    // Planned outages - no notifications (see also the top-level maintenance schedule)
+	SMTP          SMTPSettings        `yaml:"smtp"`           // Mail server for email steps
+}
+
+// EscalationPolicy is the escalation chain for one tenant's devices.
+type EscalationPolicy struct {
+	Tenant     string           `yaml:"tenant"`      // Name used in notifications
+	Devices    []string         `yaml:"devices"`     // Device ID patterns ("sensor-*"); empty matches all
+	Steps      []EscalationStep `yaml:"steps"`       // Ordered by After
+	QuietHours *QuietHours      `yaml:"quiet_hours"` // Daily window in which steps are held back
+}
+
+// EscalationStep notifies one or more channels once an outage lasts After.
+type EscalationStep struct {
+	After        time.Duration `yaml:"after"`         // Outage length that triggers the step
+	Webhook      string        `yaml:"webhook"`       // POST the event as JSON
+	Email        []string      `yaml:"email"`         // Mail recipients (needs smtp settings)
+	PagerDutyKey string        `yaml:"pagerduty_key"` // Events API v2 routing key
+}
+
+// QuietHours is a daily window ("22:00"-"07:00") in a time zone. Steps due
+// inside it are held back until it ends, then sent if the outage persists.
+type QuietHours struct {
+	Start    string `yaml:"start"`    // HH:MM
+	End      string `yaml:"end"`      // HH:MM, may be earlier than Start (spans midnight)
+	Timezone string `yaml:"timezone"` // IANA name, default UTC
+}
+
+// SMTPSettings configures outgoing mail.
+type SMTPSettings struct {
+	Addr     string `yaml:"addr"`     // host:port of the mail server
+	From     string `yaml:"from"`     // Sender address
+	Username string `yaml:"username"` // PLAIN auth user (optional)
+	Password string `yaml:"password"` // PLAIN auth password (env SMTP_PASSWORD)
+}
+
+// matchDevice reports whether id matches any of the patterns (or there are none).
+func matchDevice(patterns []string, id string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q (want HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Active reports whether now falls inside the quiet hours.
+func (q *QuietHours) Active(now time.Time) bool {
+	if q == nil {
+		return false
+	}
+	start, err1 := parseClock(q.Start)
+	end, err2 := parseClock(q.End)
+	if err1 != nil || err2 != nil {
+		return false // Rejected by validation; never silence alerts by accident
+	}
+	loc := time.UTC
+	if q.Timezone != "" {
+		if l, err := time.LoadLocation(q.Timezone); err == nil {
+			loc = l
+		}
+	}
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end // Spans midnight
+}
+
+// outage is an open device outage and the steps already sent for it.
+type outage struct {
+	device string
+	since  time.Time
+	policy *EscalationPolicy
+	fired  []bool // Per step
+}
+
+// Escalator escalates device outages from the DowntimeDetector through the
+// steps of the matching policy, e.g. webhook after 5m, email after 30m and
+// a PagerDuty incident after 2h. Recovery resolves the PagerDuty incident.
+type Escalator struct {
+	cfg     EscalationSettings
+	outages map[string]*outage // Device ID -> open outage
+	mu      sync.Mutex         // Protects outages
+}
+
+// NewEscalator creates an escalator. Feed it events via Handle and call Run.
+func NewEscalator(cfg EscalationSettings) *Escalator {
+	return &Escalator{
+		cfg:     cfg,
+		outages: make(map[string]*outage),
+	}
+}
+
+// policyFor returns the first policy matching the device, or nil.
+func (e *Escalator) policyFor(device string) *EscalationPolicy {
+	for i := range e.cfg.Policies {
+		if matchDevice(e.cfg.Policies[i].Devices, device) {
+			return &e.cfg.Policies[i]
+		}
+	}
+	return nil
+}
+
+// Handle opens or closes an outage. Use it as DowntimeDetector.OnEvent.
+func (e *Escalator) Handle(ev DowntimeEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch ev.State {
+	case "offline":
+		p := e.policyFor(ev.Device)
+		if p == nil {
+			return // Nobody to escalate to
+		}
+		e.outages[ev.Device] = &outage{device: ev.Device, since: ev.Since, policy: p, fired: make([]bool, len(p.Steps))}
+	case "online":
+		o, ok := e.outages[ev.Device]
+		if !ok {
+			return
+		}
+		delete(e.outages, ev.Device)
+		// Close any incident we opened so on-call isn't paged for a recovered device
+		for i, step := range o.policy.Steps {
+			if o.fired[i] && step.PagerDutyKey != "" {
+				go e.sendPagerDuty(step.PagerDutyKey, "resolve", o, ev.At)
+			}
+		}
+	}
+}
+
+// Run re-evaluates open outages every CheckInterval until ctx is cancelled.
+func (e *Escalator) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		e.escalate(time.Now())
+	}
+}
+
+// escalate fires every due step that isn't suppressed.
+func (e *Escalator) escalate(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, o := range e.outages {
+		if e.suppressed(o, now) {
+			continue // Held back; re-checked on the next tick
+		}
+		down := now.Sub(o.since)
+		for i, step := range o.policy.Steps {
+			if o.fired[i] || down < step.After {
+				continue
+			}
+			o.fired[i] = true
+			e.fire(step, o, now)
+		}
+	}
+}
+
+// suppressed reports whether quiet hours or a maintenance window hold
+// back notifications for the outage.
+func (e *Escalator) suppressed(o *outage, now time.Time) bool {
+	if o.policy.QuietHours.Active(now) {
+		return true
+	}
+	for _, w := range e.cfg.Maintenance {
+		if w.activeAt(now) && matchDevice(w.Devices, o.device) {
+			return true
+		}
+	}
+	return maintenanceSchedule.Covers("device", o.device, now)
+}
+
+// fire sends one escalation step on all of its channels.
+func (e *Escalator) fire(step EscalationStep, o *outage, now time.Time) {
+	summary := fmt.Sprintf("[%s] device %s offline for %v", o.policy.Tenant, o.device, now.Sub(o.since).Round(time.Second))
+	slog.Warn("Escalating", "summary", summary)
+	auditLog.Record(AuditEvent{
+		Type:       "escalation",
+		RemoteAddr: o.device,
+		Decision:   "notify",
+		Reason:     summary,
+		Fields:     map[string]string{"device": o.device, "tenant": o.policy.Tenant, "after": step.After.String()},
+	})
+
+	if step.Webhook != "" {
+		NewWebhookNotifier(step.Webhook).Notify(map[string]any{
+			"tenant":  o.policy.Tenant,
+			"device":  o.device,
+			"since":   o.since,
+			"summary": summary,
+		})
+	}
+	if len(step.Email) > 0 {
+		go e.sendEmail(step.Email, summary)
+	}
+	if step.PagerDutyKey != "" {
+		go e.sendPagerDuty(step.PagerDutyKey, "trigger", o, now)
+	}
+}
+
+// sendEmail mails the summary to recipients via the configured SMTP server.
+func (e *Escalator) sendEmail(to []string, summary string) {
+	s := e.cfg.SMTP
+	if s.Addr == "" {
+		slog.Warn("Escalation email skipped: no smtp.addr configured")
+		return
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := hostFromAddr(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n",
+		s.From, strings.Join(to, ", "), summary, summary)
+	if err := smtp.SendMail(s.Addr, auth, s.From, to, []byte(msg)); err != nil {
+		slog.Error("Escalation email failed", "error", err)
+	}
+}
+
+// sendPagerDuty triggers or resolves a PagerDuty incident for the outage.
+// The dedup key ties both actions to the same incident.
+func (e *Escalator) sendPagerDuty(routingKey, action string, o *outage, now time.Time) {
+	event := map[string]any{
+		"routing_key":  routingKey,
+		"event_action": action,
+		"dedup_key":    fmt.Sprintf("cysl-%s-%d", o.device, o.since.Unix()),
+	}
+	if action == "trigger" {
+		event["payload"] = map[string]any{
+			"summary":   fmt.Sprintf("[%s] device %s offline since %s", o.policy.Tenant, o.device, o.since.Format(time.RFC3339)),
+			"source":    o.device,
+			"severity":  "critical",
+			"timestamp": now.Format(time.RFC3339),
+		}
+	}
+	wn := NewWebhookNotifier(pagerDutyEventsURL)
+	if err := wn.post(context.Background(), event); err != nil {
+		slog.Error("PagerDuty event failed", "action", action, "device", o.device, "error", err)
+	}
+}
+
+// escalatorFromConfig creates the escalator when policies are configured.
+func escalatorFromConfig(es EscalationSettings) *Escalator {
+	if len(es.Policies) == 0 {
+		return nil
+	}
+	return NewEscalator(es)
+}
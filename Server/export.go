@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exportFlushEvery is how many rows are buffered before an export is
+// flushed to the client, so large exports stream instead of piling up.
+const exportFlushEvery = 500
+
+// exportWriter streams rows as CSV or as a JSON array. The JSON array is
+// written element by element, so neither format holds the export in memory.
+type exportWriter struct {
+	w       http.ResponseWriter
+	csv     *csv.Writer // nil for JSON
+	flusher http.Flusher
+	rows    int
+}
+
+// newExportWriter picks the format from ?format= (json by default, or csv)
+// and writes the response headers. name is the download's base file name.
+func newExportWriter(w http.ResponseWriter, r *http.Request, name string, header []string) (*exportWriter, error) {
+	ew := &exportWriter{w: w}
+	ew.flusher, _ = w.(http.Flusher)
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, name))
+		w.Write([]byte("["))
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, name))
+		ew.csv = csv.NewWriter(w)
+		ew.csv.Write(header)
+	default:
+		return nil, fmt.Errorf("unknown format %q (want json or csv)", format)
+	}
+	return ew, nil
+}
+
+// Row writes one row: v as JSON, or record as CSV.
+func (ew *exportWriter) Row(v any, record []string) error {
+	if ew.csv != nil {
+		if err := ew.csv.Write(record); err != nil {
+			return err
+		}
+	} else {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if ew.rows > 0 {
+			ew.w.Write([]byte(","))
+		}
+		if _, err := ew.w.Write(data); err != nil {
+			return err // Client went away - stop producing rows
+		}
+	}
+
+	ew.rows++
+	if ew.rows%exportFlushEvery == 0 {
+		ew.flush()
+	}
+	return nil
+}
+
+// Close finishes the document.
+func (ew *exportWriter) Close() {
+	if ew.csv == nil {
+		ew.w.Write([]byte("]\n"))
+	}
+	ew.flush()
+}
+
+// flush pushes buffered rows to the client.
+func (ew *exportWriter) flush() {
+	if ew.csv != nil {
+		ew.csv.Flush()
+	}
+	if ew.flusher != nil {
+		ew.flusher.Flush()
+	}
+}
+
+// Exporter serves admin downloads of the metrics history, connection log
+// and uptime history for offline analysis. Sources that aren't running
+// (history disabled, no device sources) answer 404.
+type Exporter struct {
+	history *MetricsHistory
+	uptime  *UptimeTracker
+	audit   *AuditLogger
+}
+
+// NewExporter creates an exporter over the given sources; any may be nil.
+func NewExporter(history *MetricsHistory, uptime *UptimeTracker, audit *AuditLogger) *Exporter {
+	return &Exporter{history: history, uptime: uptime, audit: audit}
+}
+
+// registerAdminRoutes mounts the export endpoints behind the admin token.
+// All take ?from=&to= (RFC 3339 or Unix seconds) and ?format=json|csv.
+func (ex *Exporter) registerAdminRoutes(mux *http.ServeMux, as AdminSettings) {
+	mux.Handle("GET /admin/export/history", requireAdmin(as, http.HandlerFunc(ex.handleHistory)))
+	mux.Handle("GET /admin/export/connections", requireAdmin(as, http.HandlerFunc(ex.handleConnections)))
+	mux.Handle("GET /admin/export/uptime", requireAdmin(as, http.HandlerFunc(ex.handleUptime)))
+}
+
+// handleHistory exports one history series (heartbeat latency by default)
+// over the last 24 hours unless a range is given.
+func (ex *Exporter) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if ex.history == nil {
+		httpError(w, r, "metrics history is disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	series := q.Get("series")
+	if series == "" {
+		series = SeriesHeartbeatLatency
+	}
+	now := time.Now()
+	from, to, err := parseTimeRange(q.Get("from"), q.Get("to"), now.Add(-24*time.Hour), now)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	points, resolution, err := ex.history.Query(series, from, to, q.Get("resolution"), now)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ew, err := newExportWriter(w, r, series+"-"+resolution,
+		[]string{"time", "series", "resolution", "avg", "min", "max", "samples"})
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer ew.Close()
+	for _, p := range points {
+		avg := p.Sum / float64(p.Count)
+		t := time.Unix(p.T, 0).UTC()
+		row := struct {
+			Time       time.Time `json:"time"`
+			Series     string    `json:"series"`
+			Resolution string    `json:"resolution"`
+			Avg        float64   `json:"avg"`
+			Min        float64   `json:"min"`
+			Max        float64   `json:"max"`
+			Samples    int64     `json:"samples"`
+		}{t, series, resolution, avg, p.Min, p.Max, p.Count}
+		if ew.Row(row, []string{t.Format(time.RFC3339), series, resolution,
+			formatExportFloat(avg), formatExportFloat(p.Min), formatExportFloat(p.Max),
+			strconv.FormatInt(p.Count, 10)}) != nil {
+			return
+		}
+	}
+}
+
+// handleConnections exports connection open/close events from the audit
+// log. Without an audit file only the recent in-memory events are available.
+func (ex *Exporter) handleConnections(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, to, err := parseTimeRange(q.Get("from"), q.Get("to"), time.Time{}, time.Now())
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ew, err := newExportWriter(w, r, "connections",
+		[]string{"time", "remote_addr", "event", "user", "country", "asn", "peak_violations"})
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer ew.Close()
+
+	// Headers are already sent, so a failing scan can only cut the export short
+	ex.audit.Scan("connection", from, to, func(ev AuditEvent) error {
+		row := struct {
+			Time           time.Time `json:"time"`
+			RemoteAddr     string    `json:"remote_addr"`
+			Event          string    `json:"event"` // "open" or "close"
+			User           string    `json:"user,omitempty"`
+			Country        string    `json:"country,omitempty"`
+			ASN            string    `json:"asn,omitempty"`
+			PeakViolations string    `json:"peak_violations,omitempty"`
+		}{ev.Time, ev.RemoteAddr, ev.Decision, ev.Fields["user"], ev.Fields["country"],
+			ev.Fields["asn"], ev.Fields["peak_violations"]}
+		return ew.Row(row, []string{ev.Time.Format(time.RFC3339Nano), row.RemoteAddr, row.Event,
+			row.User, row.Country, row.ASN, row.PeakViolations})
+	})
+}
+
+// handleUptime exports the hourly uptime history of all devices.
+func (ex *Exporter) handleUptime(w http.ResponseWriter, r *http.Request) {
+	if ex.uptime == nil {
+		httpError(w, r, "uptime tracking is disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	now := time.Now()
+	from, to, err := parseTimeRange(q.Get("from"), q.Get("to"), now.Add(-uptimeRetention), now)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ew, err := newExportWriter(w, r, "uptime",
+		[]string{"id", "hour", "up_seconds", "observed_seconds", "uptime"})
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer ew.Close()
+	for _, row := range ex.uptime.Rows(from, to) {
+		if ew.Row(row, []string{row.ID, row.Hour.Format(time.RFC3339),
+			strconv.FormatInt(row.Up, 10), strconv.FormatInt(row.Total, 10),
+			fmt.Sprintf("%.3f", row.Uptime)}) != nil {
+			return
+		}
+	}
+}
+
+// formatExportFloat formats a value for CSV without exponent noise.
+func formatExportFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoInfo holds the geographic and network origin of a connection.
+// Empty fields mean the lookup was disabled or found no record.
+type GeoInfo struct {
+	Country string // ISO 3166-1 alpha-2 country code (e.g. "DE")
+	ASN     uint   // Autonomous system number (e.g. 3320)
+	ASOrg   string // Autonomous system organization name
+}
+
+// String formats GeoInfo for log lines, e.g. "DE/AS3320".
+func (g GeoInfo) String() string {
+	country := g.Country
+	if country == "" {
+		country = "??"
+	}
+	if g.ASN == 0 {
+		return country
+	}
+	return fmt.Sprintf("%s/AS%d", country, g.ASN)
+}
+
+// GeoResolver looks up GeoInfo for IP addresses using MaxMind DB files.
+// MaxMind ships country and ASN data as separate databases, so both are
+// optional; a resolver with neither database open returns empty GeoInfo.
+// Readers are memory-mapped and safe for concurrent lookups.
+type GeoResolver struct {
+	countryDB *maxminddb.Reader // GeoLite2-Country / GeoIP2-Country (optional)
+	asnDB     *maxminddb.Reader // GeoLite2-ASN (optional)
+}
+
+// countryRecord maps the subset of the MaxMind country schema we need.
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// asnRecord maps the MaxMind ASN schema.
+type asnRecord struct {
+	Number uint   `maxminddb:"autonomous_system_number"`
+	Org    string `maxminddb:"autonomous_system_organization"`
+}
+
+// NewGeoResolver opens the given MaxMind database files. Either path may be
+// empty to skip that database. Returns an error if a configured file can't be opened.
+func NewGeoResolver(countryPath, asnPath string) (*GeoResolver, error) {
+	gr := &GeoResolver{}
+	if countryPath != "" {
+		db, err := maxminddb.Open(countryPath)
+		if err != nil {
+			return nil, fmt.Errorf("open GeoIP country database: %w", err)
+		}
+		gr.countryDB = db
+	}
+	if asnPath != "" {
+		db, err := maxminddb.Open(asnPath)
+		if err != nil {
+			gr.Close()
+			return nil, fmt.Errorf("open GeoIP ASN database: %w", err)
+		}
+		gr.asnDB = db
+	}
+	return gr, nil
+}
+
+// Lookup resolves an address (with or without port) to GeoInfo.
+// Lookup errors are not fatal - the connection simply gets no geo data.
+func (gr *GeoResolver) Lookup(addr string) GeoInfo {
+	var info GeoInfo
+	if gr == nil {
+		return info
+	}
+
+	ip := net.ParseIP(hostFromAddr(addr))
+	if ip == nil {
+		return info
+	}
+
+	if gr.countryDB != nil {
+		var rec countryRecord
+		if err := gr.countryDB.Lookup(ip, &rec); err == nil {
+			info.Country = rec.Country.ISOCode
+		}
+	}
+	if gr.asnDB != nil {
+		var rec asnRecord
+		if err := gr.asnDB.Lookup(ip, &rec); err == nil {
+			info.ASN = rec.Number
+			info.ASOrg = rec.Org
+		}
+	}
+	return info
+}
+
+// Close releases the memory-mapped database files.
+func (gr *GeoResolver) Close() {
+	if gr == nil {
+		return
+	}
+	if gr.countryDB != nil {
+		gr.countryDB.Close()
+	}
+	if gr.asnDB != nil {
+		gr.asnDB.Close()
+	}
+}
+
+// GeoStats counts active connections per country and ASN for monitoring.
+// Mirrors ConnectionManager's mutex-protected map approach.
+type GeoStats struct {
+	countries map[string]int // Country code -> active connections
+	asns      map[uint]int   // ASN -> active connections
+	mu        sync.Mutex     // Protects both maps
+}
+
+// NewGeoStats creates an empty GeoStats collector.
+func NewGeoStats() *GeoStats {
+	return &GeoStats{
+		countries: make(map[string]int),
+		asns:      make(map[uint]int),
+	}
+}
+
+// Add records a new connection from the given origin.
+func (gs *GeoStats) Add(info GeoInfo) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if info.Country != "" {
+		gs.countries[info.Country]++
+	}
+	if info.ASN != 0 {
+		gs.asns[info.ASN]++
+	}
+}
+
+// Remove records that a connection from the given origin has closed.
+// Entries that drop to zero are deleted to keep the maps bounded.
+func (gs *GeoStats) Remove(info GeoInfo) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if info.Country != "" {
+		if gs.countries[info.Country]--; gs.countries[info.Country] <= 0 {
+			delete(gs.countries, info.Country)
+		}
+	}
+	if info.ASN != 0 {
+		if gs.asns[info.ASN]--; gs.asns[info.ASN] <= 0 {
+			delete(gs.asns, info.ASN)
+		}
+	}
+}
+
+// Countries returns a copy of the per-country connection counts.
+func (gs *GeoStats) Countries() map[string]int {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	out := make(map[string]int, len(gs.countries))
+	for k, v := range gs.countries {
+		out[k] = v
+	}
+	return out
+}
+
+// ASNs returns a copy of the per-ASN connection counts.
+func (gs *GeoStats) ASNs() map[uint]int {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	out := make(map[uint]int, len(gs.asns))
+	for k, v := range gs.asns {
+		out[k] = v
+	}
+	return out
+}
+
+// geoResolverFromConfig opens the configured GeoIP databases. Returns nil
+// (lookups disabled) when none is set or a database fails to open - GeoIP
+// is an enrichment, never a startup blocker. Unless a geo policy depends
+// on it: without lookups every connection would pass the policy, and a
+// shadow policy would report that nothing changes, so then a missing
+// database is an error.
+func geoResolverFromConfig(gs GeoIPSettings) (*GeoResolver, error) {
+	policy := ""
+	switch {
+	case gs.PolicyFile != "":
+		policy = "geo policy"
+	case gs.ShadowPolicyFile != "":
+		policy = "shadow geo policy"
+	}
+	if gs.CountryDB == "" && gs.ASNDB == "" {
+		if policy != "" {
+			return nil, fmt.Errorf("the %s needs a GeoIP database (geoip.country_db or geoip.asn_db)", policy)
+		}
+		return nil, nil
+	}
+
+	gr, err := NewGeoResolver(gs.CountryDB, gs.ASNDB)
+	if err != nil {
+		if policy != "" {
+			return nil, fmt.Errorf("GeoIP database for the %s: %w", policy, err)
+		}
+		slog.Error("GeoIP lookups disabled", "error", err)
+		return nil, nil
+	}
+	return gr, nil
+}
+
+// hostFromAddr strips the port from a "host:port" address.
+// Returns the input unchanged if it has no port.
+func hostFromAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestGeoPoliciesNeedDatabase checks that a server with an enforced or a
+// shadow geo policy but no GeoIP database refuses to start.
+func TestGeoPoliciesNeedDatabase(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(policy, []byte(`{"countries": {"KP": {"deny": true}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		set  func(*GeoIPSettings)
+		want string
+	}{
+		{"policy", func(gs *GeoIPSettings) { gs.PolicyFile = policy }, "the geo policy needs a GeoIP database"},
+		{"shadow policy", func(gs *GeoIPSettings) { gs.ShadowPolicyFile = policy }, "the shadow geo policy needs a GeoIP database"},
+		{"shadow policy with a missing database", func(gs *GeoIPSettings) {
+			gs.ShadowPolicyFile = policy
+			gs.CountryDB = filepath.Join(t.TempDir(), "missing.mmdb")
+		}, "GeoIP database for the shadow geo policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.set(&cfg.GeoIP)
+			if _, err := NewServer(cfg); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("NewServer = %v, want %q", err, tt.want)
+			}
+			errs := cfg.Validate()
+			if len(errs) == 0 {
+				t.Fatal("Validate found no problem")
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GeoRule describes the policy applied to connections from one country or ASN.
+type GeoRule struct {
+	Deny           bool          `json:"deny"`                      // Reject all connections from this origin
+	MaxConnections int           `json:"max_connections,omitempty"` // Cap on concurrent connections (0 = unlimited)
+	MinInterval    string        `json:"min_interval,omitempty"`    // Stricter message interval, e.g. "30s" (empty = default)
+	minInterval    time.Duration // Parsed MinInterval
+}
+
+// GeoPolicy holds per-country and per-ASN rules loaded from a JSON file:
+//
+//	{
+//	  "countries": {"KP": {"deny": true}, "CN": {"max_connections": 100}},
+//	  "asns":      {"64496": {"min_interval": "30s"}}
+//	}
+//
+// A connection is evaluated against both its country and its ASN rule; a deny
+// from either wins, every matching cap must have room, and the strictest
+// message interval applies.
+type GeoPolicy struct {
+	Countries map[string]GeoRule `json:"countries"` // ISO country code -> rule
+	ASNs      map[uint]GeoRule   `json:"asns"`      // AS number -> rule
+
+	counts map[string]int // Policy key ("country:DE", "asn:3320") -> active connections
+	mu     sync.Mutex     // Protects counts
+}
+
+// GeoDecision is the result of evaluating a connection against a GeoPolicy.
+type GeoDecision struct {
+	Allowed     bool          // Whether the connection may proceed
+	Reason      string        // Why it was denied (empty when allowed)
+	MinInterval time.Duration // Stricter message interval to apply (0 = default)
+	keys        []string      // Policy keys whose caps were charged - needed for Release
+}
+
+// LoadGeoPolicy reads and validates a GeoPolicy from a JSON file.
+func LoadGeoPolicy(path string) (*GeoPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read geo policy: %w", err)
+	}
+
+	gp := &GeoPolicy{}
+	if err := json.Unmarshal(data, gp); err != nil {
+		return nil, fmt.Errorf("parse geo policy: %w", err)
+	}
+	if err := gp.init(); err != nil {
+		return nil, err
+	}
+	return gp, nil
+}
+
+// init normalizes country codes, parses intervals and prepares counters.
+func (gp *GeoPolicy) init() error {
+	countries := make(map[string]GeoRule, len(gp.Countries))
+	for code, rule := range gp.Countries {
+		if err := rule.parse(); err != nil {
+			return fmt.Errorf("country %s: %w", code, err)
+		}
+		countries[strings.ToUpper(code)] = rule
+	}
+	gp.Countries = countries
+
+	for asn, rule := range gp.ASNs {
+		if err := rule.parse(); err != nil {
+			return fmt.Errorf("asn %d: %w", asn, err)
+		}
+		gp.ASNs[asn] = rule
+	}
+
+	gp.counts = make(map[string]int)
+	return nil
+}
+
+// parse validates the rule and converts MinInterval into a duration.
+func (r *GeoRule) parse() error {
+	if r.MaxConnections < 0 {
+		return fmt.Errorf("max_connections must not be negative")
+	}
+	if r.MinInterval == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(r.MinInterval)
+	if err != nil {
+		return fmt.Errorf("invalid min_interval %q: %w", r.MinInterval, err)
+	}
+	r.minInterval = d
+	return nil
+}
+
+// Admit evaluates the connection origin and, if allowed, atomically charges
+// every matching connection cap. Callers must pass an allowed decision to
+// Release when the connection closes.
+func (gp *GeoPolicy) Admit(info GeoInfo) GeoDecision {
+	if gp == nil {
+		return GeoDecision{Allowed: true}
+	}
+
+	type match struct {
+		key  string
+		rule GeoRule
+	}
+	var matches []match
+	if rule, ok := gp.Countries[info.Country]; ok && info.Country != "" {
+		matches = append(matches, match{"country:" + info.Country, rule})
+	}
+	if rule, ok := gp.ASNs[info.ASN]; ok && info.ASN != 0 {
+		matches = append(matches, match{"asn:" + strconv.FormatUint(uint64(info.ASN), 10), rule})
+	}
+
+	gp.mu.Lock()
+	defer gp.mu.Unlock()
+
+	decision := GeoDecision{Allowed: true}
+	for _, m := range matches {
+		if m.rule.Deny {
+			return GeoDecision{Reason: m.key + " is denied"}
+		}
+		if m.rule.MaxConnections > 0 && gp.counts[m.key] >= m.rule.MaxConnections {
+			return GeoDecision{Reason: fmt.Sprintf("%s connection cap (%d) reached", m.key, m.rule.MaxConnections)}
+		}
+		// Strictest interval wins when both country and ASN set one
+		if m.rule.minInterval > decision.MinInterval {
+			decision.MinInterval = m.rule.minInterval
+		}
+	}
+
+	// All checks passed - charge capped keys while still holding the lock
+	for _, m := range matches {
+		if m.rule.MaxConnections > 0 {
+			gp.counts[m.key]++
+			decision.keys = append(decision.keys, m.key)
+		}
+	}
+	return decision
+}
+
+// Release returns the connection slots charged by Admit.
+func (gp *GeoPolicy) Release(d GeoDecision) {
+	if gp == nil || len(d.keys) == 0 {
+		return
+	}
+	gp.mu.Lock()
+	defer gp.mu.Unlock()
+	for _, key := range d.keys {
+		if gp.counts[key]--; gp.counts[key] <= 0 {
+			delete(gp.counts, key)
+		}
+	}
+}
+
+// loadOptionalGeoPolicy loads a geo policy file, returning nil without
+// error when path is empty. A configured but invalid policy is an error:
+// silently running without the operator's deny list would be worse than
+// refusing to start.
+func loadOptionalGeoPolicy(path string) (*GeoPolicy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return LoadGeoPolicy(path)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/coder/websocket"
+)
+
+// Handler receives the events of a WebSocket connection. The server does
+// everything around it - authentication, limits, geo policy, heartbeats,
+// moderation, hub membership - and calls the handler only for connections
+// and messages that passed all checks. Calls for one connection never
+// overlap; different connections are handled concurrently.
+type Handler interface {
+	// OnConnect runs once the connection has joined the hub, before its
+	// first message is read. Returning an error closes the connection.
+	OnConnect(ctx context.Context, hc *HubConn) error
+
+	// OnMessage handles one message. A non-nil reply is written back with
+	// the same message type; returning an error closes the connection.
+	OnMessage(ctx context.Context, hc *HubConn, msgType websocket.MessageType, msg []byte) (reply []byte, err error)
+
+	// OnClose runs when the connection ends, also after a failed OnConnect.
+	// err is a *DisconnectError saying why.
+	OnClose(ctx context.Context, hc *HubConn, err error)
+}
+
+// BaseHandler implements Handler with no-ops. Embed it to implement only
+// the events you need.
+type BaseHandler struct{}
+
+// OnConnect accepts the connection.
+func (BaseHandler) OnConnect(ctx context.Context, hc *HubConn) error { return nil }
+
+// OnMessage ignores the message.
+func (BaseHandler) OnMessage(ctx context.Context, hc *HubConn, msgType websocket.MessageType, msg []byte) ([]byte, error) {
+	return nil, nil
+}
+
+// OnClose does nothing.
+func (BaseHandler) OnClose(ctx context.Context, hc *HubConn, err error) {}
+
+// EchoHandler is the default /ws behavior: every message is echoed back.
+// Raw connections get it with a "Server echoes: " prefix; connections that
+// negotiated envelopes get a MessageTypeEcho message carrying the payload
+// of each MessageTypeMessage, and a MessageTypeError for anything else.
+// Envelopes use the connection's codec (see CodecFromContext) and answer
+// the message they echo (see NewReply).
+type EchoHandler struct {
+	BaseHandler
+}
+
+// OnMessage echoes the message.
+func (EchoHandler) OnMessage(ctx context.Context, hc *HubConn, msgType websocket.MessageType, msg []byte) ([]byte, error) {
+	if ProtocolVersionFromContext(ctx) == ProtocolRaw {
+		return []byte(fmt.Sprintf("Server echoes: %s", msg)), nil
+	}
+	if msgType == websocket.MessageText && CodecFromContext(ctx).Binary() {
+		// The reply goes out as a text frame too, so it can't use the
+		// binary codec
+		ctx = withCodec(ctx, CodecJSON)
+		return errorMessage(ctx, ErrorCodeInvalidMessage, "text frame on a binary codec connection"), nil
+	}
+
+	m, err := DecodeMessage(ctx, msg)
+	if err != nil {
+		return errorMessage(ctx, ErrorCodeInvalidMessage, err.Error()), nil
+	}
+	if m.Type != MessageTypeMessage {
+		// Newer clients may send types this server doesn't know; telling
+		// them keeps the connection usable
+		return errorReply(ctx, m, ErrorCodeUnsupportedType, fmt.Sprintf("message type %q is not supported", m.Type)), nil
+	}
+	return NewReply(ctx, m, MessageTypeEcho, m.Payload)
+}
+
+// wsHandlers maps URL patterns to the handlers Start mounts. /ws echoes,
+// and serves CapabilityRPC, unless an application replaces it.
+var (
+	wsHandlers   = map[string]Handler{"/ws": defaultWSHandler()}
+	wsHandlersMu sync.Mutex
+)
+
+// RegisterHandler serves WebSocket connections on pattern (an http.ServeMux
+// pattern such as "/ws" or "/devices/{id}/ws") with h. Registering "/ws"
+// replaces the echo handler. Call before Start.
+func RegisterHandler(pattern string, h Handler) {
+	wsHandlersMu.Lock()
+	wsHandlers[pattern] = h
+	wsHandlersMu.Unlock()
+}
+
+// WebSocketHandler wraps h in an http.Handler with the default server's
+// full connection handling, for applications that mount endpoints on their
+// own mux. The default server is looked up per request, so the handler
+// follows Start.
+func WebSocketHandler(h Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defaultServer.Load().serveWebSocket(w, r, h)
+	})
+}
+
+// mountHandlers adds every registered handler to mux, served by s.
+func (s *Server) mountHandlers(mux *http.ServeMux) {
+	wsHandlersMu.Lock()
+	defer wsHandlersMu.Unlock()
+	for pattern, h := range wsHandlers {
+		mux.Handle(pattern, s.WebSocketHandler(h))
+	}
+}
@@ -2,113 +2,95 @@ package server
 
 import (
 	"context"
-	"fmt"
-	"sync/atomic"
+	"net/http"
 	"time"
 
 	"github.com/coder/websocket"
+	"github.com/deanbregenzer/cysl/internal/heartbeat"
 )
 
-// HeartbeatConfig contains all configurable heartbeat parameters.
-// This allows fine-tuning of heartbeat behavior for different network conditions
-// and application requirements without code changes.
-type HeartbeatConfig struct {
-	Interval       time.Duration // Time between pings (e.g. 30s) - lower for faster detection
-	Timeout        time.Duration // Max wait time for pong (e.g. 20s) - should be < Interval
-	MaxMissedPings int           // Max failed pings before giving up (e.g. 2) - prevents false positives
-	EnableMetrics  bool          // Enable metrics collection - overhead negligible with atomics
-}
+// HeartbeatConfig contains all configurable heartbeat parameters; shared
+// with the client, see internal/heartbeat.
+type HeartbeatConfig = heartbeat.Config
 
 // HeartbeatMetrics collects performance and health metrics for monitoring.
-// Uses atomic.Int64 for thread-safety without locks, allowing concurrent reads
-// from multiple goroutines without performance degradation.
-type HeartbeatMetrics struct {
-	PingsSent     atomic.Int64 // Total pings sent - incremented before each ping
-	PongsReceived atomic.Int64 // Total pongs received - incremented on successful pong
-	FailedPings   atomic.Int64 // Failed pings - incremented on timeout or error
-	AvgLatency    atomic.Int64 // Average latency in milliseconds - updated after each pong
+type HeartbeatMetrics = heartbeat.Metrics
+
+// HeartbeatSnapshot is a point-in-time copy of HeartbeatMetrics with
+// moving-average, min/max and percentile latency; see Metrics.Snapshot.
+type HeartbeatSnapshot = heartbeat.MetricsSnapshot
+
+// AppHeartbeat runs a connection's heartbeat. In JSON mode the read loop
+// must hand incoming messages to its Handle method.
+type AppHeartbeat = heartbeat.Heartbeat
+
+// Heartbeat modes selectable via HeartbeatConfig.Mode.
+const (
+	HeartbeatModeFrames = heartbeat.ModeFrames // RFC 6455 ping/pong control frames (default)
+	HeartbeatModeJSON   = heartbeat.ModeJSON   // Application-level JSON ping/pong messages
+)
+
+// ConnHealth is a connection's derived health, classified from heartbeat
+// latency, jitter and missed pings with hysteresis (see HealthThresholds).
+type ConnHealth = heartbeat.Health
+
+// HealthThresholds configures how heartbeat results map to a ConnHealth.
+type HealthThresholds = heartbeat.HealthThresholds
+
+// Connection health states, from best to worst.
+const (
+	HealthHealthy  = heartbeat.HealthHealthy
+	HealthDegraded = heartbeat.HealthDegraded
+	HealthUnstable = heartbeat.HealthUnstable
+	HealthLost     = heartbeat.HealthLost
+)
+
+// HealthChange is a transition of a connection's health, as passed to the
+// callbacks registered with WithStateChange.
+type HealthChange struct {
+	From    ConnHealth
+	To      ConnHealth
+	Latency time.Duration // Smoothed RTT at the time of the change
+	Jitter  time.Duration // Smoothed RTT variation
+	Missed  int           // Consecutive missed pings
+	At      time.Time
 }
 
-// DefaultHeartbeatConfig returns a production-ready configuration with
-// conservative values suitable for most internet connections.
+// StateChangeFunc is called on every health change of a connection. It
+// runs on the connection's heartbeat goroutine, concurrently with the
+// connection's Handler, and must not block.
+type StateChangeFunc func(hc *HubConn, change HealthChange)
+
+// DefaultHeartbeatConfig returns the server's heartbeat defaults.
 // Interval: 5s - shorter for testing/demo purposes (use 30s in production)
 // Timeout: 3s - allows for network jitter and processing delays
 // MaxMissedPings: 2 - prevents false positives from transient issues
 func DefaultHeartbeatConfig() HeartbeatConfig {
-	return HeartbeatConfig{
-		Interval:       5 * time.Second, // Shorter interval for testing
-		Timeout:        3 * time.Second, // Shorter timeout
-		MaxMissedPings: 2,
-		EnableMetrics:  true,
-	}
+	return heartbeat.DefaultConfig(heartbeat.RoleServer)
+}
+
+// NewAppHeartbeat creates the heartbeat for a server connection, in the mode
+// cfg selects. Its metrics are aggregated into /metrics while it runs.
+func NewAppHeartbeat(conn *websocket.Conn, cfg HeartbeatConfig) *AppHeartbeat {
+	hb := heartbeat.New(conn, cfg, heartbeat.RoleServer)
+	hb.OnStart = heartbeatStats.track
+	hb.OnStop = heartbeatStats.retire
+	hb.OnPong = heartbeatStats.Latency.Observe
+	return hb
 }
 
 // EnhancedHeartbeat implements a production-ready heartbeat solution with:
-// - Automatic ping/pong frame handling per RFC 6455
+// - Automatic ping/pong frame handling per RFC 6455 (or JSON messages, see Mode)
 // - Configurable timeout and failure threshold
 // - Real-time latency measurement
 // - Thread-safe metrics collection
 // - Graceful context cancellation support
 // Returns metrics and error on failure or context cancellation.
-// Note: Rate-limiting for incoming client pings should be implemented at the
-// WebSocket frame level, not in the server's outgoing ping loop.
+// In JSON mode pongs only arrive through NewAppHeartbeat(...).Handle, so
+// connections using that mode must use NewAppHeartbeat directly.
 func EnhancedHeartbeat(ctx context.Context, conn *websocket.Conn,
 	cfg HeartbeatConfig) (*HeartbeatMetrics, error) {
-	// Initialize metrics collector
-	metrics := &HeartbeatMetrics{}
-	timer := time.NewTimer(cfg.Interval)
-	defer timer.Stop()
-	missedPings := 0 // Counter for consecutive failures - resets on successful pong
-
-	for {
-		select {
-		case <-ctx.Done():
-			// Context cancelled (e.g., connection closed) - exit gracefully with metrics
-			return metrics, ctx.Err()
-		case <-timer.C:
-			// Timer expired - time to send next ping
-		}
-
-		// Note: Rate-limiting is not applied here because the server controls
-		// its own ping frequency through cfg.Interval configuration.
-		// Rate-limiting should instead be applied to incoming pings from clients,
-		// which would require WebSocket ping frame interception (not implemented).
-
-		// Create timeout context for this specific ping attempt
-		// This ensures we don't wait forever for a response
-		pingCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
-		start := time.Now() // Start latency measurement
-
-		// Send WebSocket ping frame (opcode 0x9) per RFC 6455
-		// Server expects pong frame (opcode 0xA) in response
-		err := conn.Ping(pingCtx)
-		cancel() // Always clean up context resources (prevents memory leak)
-
-		metrics.PingsSent.Add(1) // Atomic increment - thread-safe
-
-		if err != nil {
-			// Ping failed - could be network issue, client crashed, or timeout
-			metrics.FailedPings.Add(1)
-			missedPings++
-
-			// Check if we've exceeded the failure threshold
-			// Multiple failures indicate persistent connection problem
-			if missedPings >= cfg.MaxMissedPings {
-				return metrics, fmt.Errorf("max missed pings (%d) exceeded", cfg.MaxMissedPings)
-			}
-		} else {
-			// Ping successful - pong received within timeout
-			// Calculate round-trip latency and reset failure counter
-			latency := time.Since(start).Milliseconds()
-			metrics.AvgLatency.Store(latency) // Store current latency (atomic operation)
-			metrics.PongsReceived.Add(1)      // Increment successful pongs
-			missedPings = 0                   // Reset failure counter - connection is healthy
-		}
-
-		// Reset timer for next ping interval
-		// This creates consistent ping intervals regardless of processing time
-		timer.Reset(cfg.Interval)
-	}
+	return NewAppHeartbeat(conn, cfg).Run(ctx)
 }
 
 // HeartBeat sends periodic pings to keep the connection alive.
@@ -138,3 +120,79 @@ func HeartBeat(ctx context.Context, c *websocket.Conn, d time.Duration) {
 		t.Reset(time.Minute)
 	}
 }
+
+// Heartbeat negotiation headers exchanged during the WebSocket upgrade.
+// The client proposes values in the request; the server answers with the
+// values it accepted (bounded by HeartbeatPolicy) in the 101 response.
+// Values are integer milliseconds so non-Go clients can parse them easily.
+const (
+	HeaderHeartbeatInterval = heartbeat.HeaderInterval
+	HeaderHeartbeatTimeout  = heartbeat.HeaderTimeout
+	HeaderHeartbeatMode     = heartbeat.HeaderMode
+	HeaderHeartbeatHealth   = heartbeat.HeaderHealth // "notify" - client wants health notifications
+)
+
+// HeartbeatPolicy bounds the heartbeat values a client may negotiate.
+// Keeps clients from asking for intervals so short they become a flood
+// or so long that dead connections are never detected.
+type HeartbeatPolicy struct {
+	MinInterval time.Duration `yaml:"min_interval"` // Shortest interval the server will accept
+	MaxInterval time.Duration `yaml:"max_interval"` // Longest interval the server will accept
+	MinTimeout  time.Duration `yaml:"min_timeout"`  // Shortest pong timeout the server will accept
+	MaxTimeout  time.Duration `yaml:"max_timeout"`  // Longest pong timeout the server will accept
+}
+
+// DefaultHeartbeatPolicy returns bounds suitable for internet clients.
+func DefaultHeartbeatPolicy() HeartbeatPolicy {
+	return HeartbeatPolicy{
+		MinInterval: 2 * time.Second,
+		MaxInterval: 60 * time.Second,
+		MinTimeout:  1 * time.Second,
+		MaxTimeout:  30 * time.Second,
+	}
+}
+
+// NegotiateHeartbeat derives the heartbeat configuration for a connection
+// from the client's proposal headers, clamped to policy. Missing or invalid
+// proposals fall back to base. The timeout is always kept below the interval.
+func NegotiateHeartbeat(r *http.Request, base HeartbeatConfig, policy HeartbeatPolicy) HeartbeatConfig {
+	cfg := base
+	if d, ok := heartbeat.ParseMillis(r.Header.Get(HeaderHeartbeatInterval)); ok {
+		cfg.Interval = clampDuration(d, policy.MinInterval, policy.MaxInterval)
+	}
+	if d, ok := heartbeat.ParseMillis(r.Header.Get(HeaderHeartbeatTimeout)); ok {
+		cfg.Timeout = clampDuration(d, policy.MinTimeout, policy.MaxTimeout)
+	}
+	if mode, ok := heartbeat.ParseMode(r.Header.Get(HeaderHeartbeatMode)); ok {
+		cfg.Mode = mode // Unknown modes keep the server default
+	}
+	if r.Header.Get(HeaderHeartbeatHealth) == "notify" {
+		cfg.NotifyHealth = true
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = HeartbeatModeFrames
+	}
+
+	// A timeout >= interval would overlap consecutive pings
+	if cfg.Timeout >= cfg.Interval {
+		cfg.Timeout = cfg.Interval / 2
+	}
+	return cfg
+}
+
+// SetHeartbeatHeaders writes the accepted heartbeat values to the response
+// headers. Must be called before websocket.Accept writes the 101 response.
+func SetHeartbeatHeaders(h http.Header, cfg HeartbeatConfig) {
+	heartbeat.WriteHeaders(h, cfg)
+}
+
+// clampDuration limits d to the range [lo, hi].
+func clampDuration(d, lo, hi time.Duration) time.Duration {
+	if d < lo {
+		return lo
+	}
+	if d > hi {
+		return hi
+	}
+	return d
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// historyTiers are the resolutions kept by MetricsHistory, finest first.
+// Every sample lands in all tiers at once, so coarser tiers are rolled up
+// continuously instead of by a separate job; each tier drops points older
+// than its retention.
+var historyTiers = []struct {
+	Name   string
+	Step   time.Duration
+	Retain time.Duration
+}{
+	{"10s", 10 * time.Second, 24 * time.Hour},
+	{"1m", time.Minute, 7 * 24 * time.Hour},
+	{"1h", time.Hour, 90 * 24 * time.Hour},
+}
+
+// historySaveEvery is how often the history is written to its state file.
+// The 10s tier alone is ~8640 points per series, so it isn't saved per sample.
+const historySaveEvery = time.Minute
+
+// History series recorded by MetricsHistory.
+const (
+	SeriesConnections      = "connections"          // Open WebSocket connections
+	SeriesHeartbeatLatency = "heartbeat_latency_ms" // Mean ping RTT over the step
+	SeriesFailedPings      = "failed_pings"         // Failed pings during the step
+)
+
+// HistorySettings configures the embedded metrics history.
+type HistorySettings struct {
+	Enabled   bool   `yaml:"enabled"`    // Record history (env METRICS_HISTORY_ENABLED)
+	StateFile string `yaml:"state_file"` // Where history is persisted across restarts (optional, env METRICS_HISTORY_FILE)
+}
+
+// HistoryPoint aggregates all samples of one series within one step.
+type HistoryPoint struct {
+	T     int64   `json:"t"`   // Unix time of the step start
+	Count int64   `json:"n"`   // Samples aggregated
+	Sum   float64 `json:"sum"` // Sum of samples - avg is Sum/Count
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// add merges one sample into the point.
+func (p *HistoryPoint) add(v float64) {
+	if p.Count == 0 || v < p.Min {
+		p.Min = v
+	}
+	if p.Count == 0 || v > p.Max {
+		p.Max = v
+	}
+	p.Count++
+	p.Sum += v
+}
+
+// historyTier holds the points of all series at one resolution.
+type historyTier map[string][]HistoryPoint // Series -> points, oldest first
+
+// MetricsHistory keeps weeks of heartbeat latency and connection counts in
+// memory at decreasing resolution (10s for a day, 1m for a week, 1h for 90
+// days) so they can be charted without external monitoring. About 63k small
+// points at most, persisted as JSON like the uptime history.
+type MetricsHistory struct {
+	cfg   HistorySettings
+	tiers []historyTier // Indexed like historyTiers
+	mu    sync.Mutex    // Protects tiers
+
+	// Previous cumulative values, to turn counters into per-step deltas
+	lastLatencySum   int64
+	lastLatencyCount int64
+	lastFailed       int64
+
+	connections *atomic.Int64 // Open connections of the server being recorded (nil = not recorded)
+}
+
+// NewMetricsHistory creates a history and loads persisted points if a
+// state file is configured. A missing state file is not an error.
+func NewMetricsHistory(cfg HistorySettings) (*MetricsHistory, error) {
+	mh := &MetricsHistory{cfg: cfg, tiers: make([]historyTier, len(historyTiers))}
+	for i := range mh.tiers {
+		mh.tiers[i] = make(historyTier)
+	}
+	if cfg.StateFile == "" {
+		return mh, nil
+	}
+
+	data, err := os.ReadFile(cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return mh, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read history state: %w", err)
+	}
+	var saved map[string]historyTier // Tier name -> series
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("parse history state %s: %w", cfg.StateFile, err)
+	}
+	for i, tier := range historyTiers {
+		if series, ok := saved[tier.Name]; ok {
+			mh.tiers[i] = series
+		}
+	}
+	return mh, nil
+}
+
+// Run samples every finest step until ctx is cancelled, persisting the
+// history every historySaveEvery and once more on shutdown.
+func (mh *MetricsHistory) Run(ctx context.Context) {
+	mh.lastLatencySum, mh.lastLatencyCount = heartbeatStats.Latency.sumNs.Load(), heartbeatStats.Latency.count.Load()
+	_, _, mh.lastFailed = heartbeatStats.totals()
+
+	ticker := time.NewTicker(historyTiers[0].Step)
+	defer ticker.Stop()
+	lastSave := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			mh.save()
+			return
+		case now := <-ticker.C:
+			mh.Sample(now)
+			if now.Sub(lastSave) >= historySaveEvery {
+				mh.save()
+				lastSave = now
+			}
+		}
+	}
+}
+
+// Sample records the current connection count, and the latency and ping
+// failures since the previous sample. Latency is skipped when no pong
+// arrived in between - an idle server has no latency, not zero latency.
+func (mh *MetricsHistory) Sample(now time.Time) {
+	latencySum, latencyCount := heartbeatStats.Latency.sumNs.Load(), heartbeatStats.Latency.count.Load()
+	_, _, failed := heartbeatStats.totals()
+
+	if mh.connections != nil {
+		mh.Record(SeriesConnections, float64(mh.connections.Load()), now)
+	}
+	if n := latencyCount - mh.lastLatencyCount; n > 0 {
+		meanNs := float64(latencySum-mh.lastLatencySum) / float64(n)
+		mh.Record(SeriesHeartbeatLatency, meanNs/float64(time.Millisecond), now)
+	}
+	mh.Record(SeriesFailedPings, float64(failed-mh.lastFailed), now)
+
+	mh.lastLatencySum, mh.lastLatencyCount, mh.lastFailed = latencySum, latencyCount, failed
+}
+
+// Record adds one sample to every tier and drops expired points.
+func (mh *MetricsHistory) Record(series string, v float64, now time.Time) {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	for i, tier := range historyTiers {
+		start := now.Truncate(tier.Step).Unix()
+		points := mh.tiers[i][series]
+		if n := len(points); n == 0 || points[n-1].T != start {
+			points = append(points, HistoryPoint{T: start})
+		}
+		points[len(points)-1].add(v)
+
+		cutoff := now.Add(-tier.Retain).Unix()
+		drop := sort.Search(len(points), func(j int) bool { return points[j].T >= cutoff })
+		mh.tiers[i][series] = points[drop:]
+	}
+}
+
+// Query returns the points of series in [from, to] at the finest tier whose
+// retention still reaches back to from, or at the named resolution if
+// resolution is not empty. Returns the resolution used.
+func (mh *MetricsHistory) Query(series string, from, to time.Time, resolution string, now time.Time) ([]HistoryPoint, string, error) {
+	tierIdx := -1
+	for i, tier := range historyTiers {
+		if resolution == tier.Name || (resolution == "" && !from.Before(now.Add(-tier.Retain))) {
+			tierIdx = i
+			break
+		}
+	}
+	if tierIdx < 0 && resolution != "" {
+		return nil, "", fmt.Errorf("unknown resolution %q", resolution)
+	}
+	if tierIdx < 0 {
+		tierIdx = len(historyTiers) - 1 // Older than all retention - serve what's left
+	}
+
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	points := mh.tiers[tierIdx][series]
+	step := int64(historyTiers[tierIdx].Step / time.Second)
+	lo := sort.Search(len(points), func(j int) bool { return points[j].T+step > from.Unix() })
+	hi := sort.Search(len(points), func(j int) bool { return points[j].T > to.Unix() })
+	if lo >= hi {
+		return []HistoryPoint{}, historyTiers[tierIdx].Name, nil
+	}
+	return append([]HistoryPoint(nil), points[lo:hi]...), historyTiers[tierIdx].Name, nil
+}
+
+// save writes all tiers to the state file. The file is replaced atomically
+// so a crash mid-write never loses the previous state.
+func (mh *MetricsHistory) save() {
+	if mh.cfg.StateFile == "" {
+		return
+	}
+
+	mh.mu.Lock()
+	saved := make(map[string]historyTier, len(historyTiers))
+	for i, tier := range historyTiers {
+		saved[tier.Name] = mh.tiers[i]
+	}
+	data, err := json.Marshal(saved)
+	mh.mu.Unlock()
+	if err != nil {
+		slog.Error("Failed to encode history state", "error", err)
+		return
+	}
+
+	tmp := mh.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		slog.Error("Failed to write history state", "error", err)
+		return
+	}
+	if err := os.Rename(tmp, mh.cfg.StateFile); err != nil {
+		slog.Error("Failed to replace history state", "error", err)
+	}
+}
+
+// historyResponse is the JSON answer of /metrics/history.
+type historyResponse struct {
+	Series     string          `json:"series"`
+	Resolution string          `json:"resolution"`
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	Points     []historyOutput `json:"points"`
+}
+
+// historyOutput is a HistoryPoint as served to charts.
+type historyOutput struct {
+	T     int64   `json:"t"`
+	Avg   float64 `json:"avg"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int64   `json:"n"`
+}
+
+// ServeHTTP serves one series as JSON:
+//
+//	GET /metrics/history?series=connections&from=2024-05-01T00:00:00Z&to=now&resolution=1m
+//
+// from and to are RFC 3339 or Unix seconds (default: the last hour);
+// resolution is optional and picked from the range when omitted.
+func (mh *MetricsHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	series := q.Get("series")
+	if series == "" {
+		series = SeriesConnections
+	}
+	now := time.Now()
+	from, to, err := parseTimeRange(q.Get("from"), q.Get("to"), now.Add(-time.Hour), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	points, resolution, err := mh.Query(series, from, to, q.Get("resolution"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := historyResponse{Series: series, Resolution: resolution, From: from, To: to,
+		Points: make([]historyOutput, len(points))}
+	for i, p := range points {
+		resp.Points[i] = historyOutput{T: p.T, Avg: math.Round(p.Sum/float64(p.Count)*1000) / 1000,
+			Min: p.Min, Max: p.Max, Count: p.Count}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseTimeRange parses optional from/to query values (RFC 3339, Unix
+// seconds or "now"), falling back to the given defaults.
+func parseTimeRange(fromStr, toStr string, defFrom, defTo time.Time) (time.Time, time.Time, error) {
+	from, err := parseTimeParam(fromStr, defFrom)
+	if err != nil {
+		return from, defTo, fmt.Errorf("from: %w", err)
+	}
+	to, err := parseTimeParam(toStr, defTo)
+	if err != nil {
+		return from, to, fmt.Errorf("to: %w", err)
+	}
+	if to.Before(from) {
+		return from, to, errors.New("to is before from")
+	}
+	return from, to, nil
+}
+
+// parseTimeParam parses one time query value.
+func parseTimeParam(s string, def time.Time) (time.Time, error) {
+	switch s {
+	case "":
+		return def, nil
+	case "now":
+		return time.Now(), nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("want RFC 3339 or Unix seconds, got %q", s)
+	}
+	return t, nil
+}
+
+// historyFromConfig creates the metrics history when enabled or when a
+// state file is configured.
+func historyFromConfig(hs HistorySettings) (*MetricsHistory, error) {
+	if !hs.Enabled && hs.StateFile == "" {
+		return nil, nil
+	}
+	return NewMetricsHistory(hs)
+}
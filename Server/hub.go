@@ -0,0 +1,760 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/deanbregenzer/cysl/internal/logging"
+)
+
+// Overflow policies for a connection's full send queue.
+const (
+	OverflowDisconnect = "disconnect"  // Close the connection as a slow consumer (default)
+	OverflowDropOldest = "drop_oldest" // Discard the oldest queued message to make room
+	OverflowDropNewest = "drop_newest" // Discard the message being sent
+)
+
+// HubSettings configures the per-connection send queues. Each connection's
+// writer goroutine drains its queue, so a slow client only ever fills its
+// own queue; the policy decides what happens once it is full.
+type HubSettings struct {
+	QueueDepth   int           `yaml:"queue_depth"`   // Outgoing messages that may queue per connection (env HUB_QUEUE_DEPTH)
+	Overflow     string        `yaml:"overflow"`      // OverflowDisconnect, OverflowDropOldest or OverflowDropNewest (env HUB_OVERFLOW)
+	MessageTTL   time.Duration `yaml:"message_ttl"`   // Deadline for messages sent without one; 0 = none (env HUB_MESSAGE_TTL)
+	DeadLetters  int           `yaml:"dead_letters"`  // Expired messages kept for inspection; 0 = none (env HUB_DEAD_LETTERS)
+	WriteRetries int           `yaml:"write_retries"` // Retries of a write that timed out on a live connection (env HUB_WRITE_RETRIES)
+
+	SlowConsumer SlowConsumerSettings `yaml:"slow_consumer"` // Detection of clients lagging behind
+}
+
+// DefaultHubSettings returns a 64-message queue that disconnects clients
+// which can't keep up, drops the bulk backlog of those lagging behind and
+// retries a timed-out write twice.
+func DefaultHubSettings() HubSettings {
+	return HubSettings{QueueDepth: 64, Overflow: OverflowDisconnect, WriteRetries: 2, SlowConsumer: DefaultSlowConsumerSettings()}
+}
+
+// Hub errors.
+var (
+	ErrUnknownConn  = errors.New("unknown connection")
+	ErrSlowConsumer = errors.New("connection too slow - disconnected")
+	ErrQueueFull    = errors.New("send queue full - message dropped")
+)
+
+// hubOptions are the queue settings a Hub gives new connections.
+type hubOptions struct {
+	HubSettings
+	writeTimeout time.Duration // Max time for writing one queued message
+}
+
+// ConnID identifies a connection registered with the Hub. IDs are random,
+// so knowing one connection's ID doesn't reveal others.
+type ConnID string
+
+// newConnID generates a random connection ID.
+func newConnID() ConnID {
+	var b [8]byte
+	rand.Read(b[:])
+	return ConnID(hex.EncodeToString(b[:]))
+}
+
+// HubConn is a connection registered with the Hub. Messages sent through
+// the hub are queued and written by the connection's own writer goroutine,
+// so one stalled client never blocks delivery to the others.
+type HubConn struct {
+	ID          ConnID
+	User        UserID // Authenticated user ("" for anonymous connections)
+	RemoteAddr  string
+	Geo         GeoInfo // Country and ASN of RemoteAddr (empty without GeoIP)
+	ConnectedAt time.Time
+
+	conn         *websocket.Conn
+	hub          *Hub
+	logger       *slog.Logger  // Tagged with the connection's ID and address
+	send         chan outgoing // Outgoing message queue
+	pushMu       sync.Mutex    // Serializes enqueues, so none overtakes messages being requeued
+	overflow     string        // What to do when send is full
+	writeTimeout time.Duration // Max time for writing one queued message
+	writeRetries int           // Retries of a write that timed out
+	ttl          time.Duration // Deadline for messages sent without one (0 = none)
+	slow         SlowConsumerSettings
+	slowSince    atomic.Int64  // UnixNano the queue reached the threshold (0 = below, -1 = handled)
+	done         chan struct{} // Closed on unregister
+	stopped      chan struct{} // Closed when the writer returned
+	unacked      *offlineQueue // Written messages no heartbeat confirmed yet (nil without a session)
+	topics       map[string]struct{}
+	once         sync.Once
+	health       atomic.Int32                    // ConnHealth, updated by the heartbeat
+	healthSince  atomic.Int64                    // UnixNano of the last health change (0 = none yet)
+	heartbeat    atomic.Pointer[AppHeartbeat]    // Source of the latency the admin API shows
+	received     atomic.Int64                    // Messages read from the client
+	sent         atomic.Int64                    // Messages written to the client
+	closeCause   atomic.Pointer[DisconnectError] // Why the server closes the connection, see closing
+
+	queued   int64      // Bytes of queued messages reserved from the hub's memory budget
+	released bool       // Unregistered: queued was returned and charge refuses
+	accMu    sync.Mutex // Protects queued and released
+}
+
+// Health returns the connection's health as classified by its heartbeat.
+func (hc *HubConn) Health() ConnHealth {
+	return ConnHealth(hc.health.Load())
+}
+
+// Logger returns the connection's logger, which adds its ID and address
+// to every line.
+func (hc *HubConn) Logger() *slog.Logger {
+	return hc.logger
+}
+
+// setHealth records a health change and returns the previous state.
+func (hc *HubConn) setHealth(h ConnHealth) ConnHealth {
+	hc.healthSince.Store(time.Now().UnixNano())
+	return ConnHealth(hc.health.Swap(int32(h)))
+}
+
+// HealthSince returns when the connection entered its current health
+// state.
+func (hc *HubConn) HealthSince() time.Time {
+	if since := hc.healthSince.Load(); since != 0 {
+		return time.Unix(0, since)
+	}
+	return hc.ConnectedAt
+}
+
+// Hub tracks all active connections and delivers messages to all of them,
+// to a single connection, or to the subscribers of a topic. Messages one
+// goroutine sends reach each recipient in the order it sent them, no
+// matter how many goroutines send concurrently: delivery runs in the
+// sender's goroutine and each connection's queue is FIFO. Fan-out iterates
+// a snapshot of the recipients (see connSet), so the hub's lock is held
+// only to pick the snapshot, however many recipients there are.
+type Hub struct {
+	conns     *connSet
+	topics    map[string]*connSet // Topic or pattern -> subscribers
+	wildcards map[string]struct{} // Keys of topics that are patterns, see topicMatch
+	mu        sync.RWMutex        // Protects conns, topics, wildcards and HubConn.topics
+
+	opts          atomic.Pointer[hubOptions]      // Queue settings for new connections
+	dropped       atomic.Int64                    // Messages discarded by the drop overflow policies
+	expired       atomic.Int64                    // Messages discarded because their deadline passed
+	slowConsumers atomic.Int64                    // Slow consumers detected
+	writeRetries  atomic.Int64                    // Timed-out writes retried
+	dlq           atomic.Pointer[DeadLetterQueue] // Keeps expired messages (nil = disabled)
+	memory        *MemoryBudget                   // Caps the bytes queued and kept as dead letters
+	sessions      *SessionStore                   // Sessions of dropped connections, see SessionSettings
+	cluster       atomic.Pointer[ClusterRelay]    // Relays broadcasts and topic messages to other instances (nil = single instance)
+}
+
+// NewHub creates an empty hub.
+func NewHub() *Hub {
+	h := &Hub{
+		conns:     newConnSet(),
+		topics:    make(map[string]*connSet),
+		wildcards: make(map[string]struct{}),
+	}
+	defaults := DefaultConfig()
+	h.memory = NewMemoryBudget(defaults.Memory)
+	h.sessions = newSessionStore(h)
+	// Under memory pressure dead letters go first, then the messages kept
+	// for dropped connections, then the oldest messages of the longest queues
+	h.memory.AddEvictor(func(need int64) int64 { return h.dlq.Load().evict(need) })
+	h.memory.AddEvictor(h.sessions.evict)
+	h.memory.AddEvictor(h.evictQueued)
+	h.configure(defaults.Hub, defaults.WriteTimeout)
+	return h
+}
+
+// configure sets the queue settings of connections registered from now on.
+func (h *Hub) configure(settings HubSettings, writeTimeout time.Duration) {
+	h.opts.Store(&hubOptions{HubSettings: settings, writeTimeout: writeTimeout})
+	if h.dlq.Load().Cap() != settings.DeadLetters {
+		dlq := NewDeadLetterQueue(settings.DeadLetters) // Resizing starts empty
+		if dlq != nil {
+			dlq.budget = h.memory
+		}
+		h.dlq.Swap(dlq).clear()
+	}
+}
+
+// Memory returns the budget the hub's queues and dead letters are
+// accounted against. Other message stores may share it.
+func (h *Hub) Memory() *MemoryBudget {
+	return h.memory
+}
+
+// Sessions returns the store keeping the sessions of dropped connections.
+func (h *Hub) Sessions() *SessionStore {
+	return h.sessions
+}
+
+// Cluster returns the relay to the other server instances, or nil if the
+// hub is on its own.
+func (h *Hub) Cluster() *ClusterRelay {
+	return h.cluster.Load()
+}
+
+// Dropped returns how many messages the drop overflow policies or memory
+// pressure discarded.
+func (h *Hub) Dropped() int64 {
+	return h.dropped.Load()
+}
+
+// hub holds every connection of the default server.
+var hub = NewHub()
+
+// DefaultHub returns the hub that all /ws and /rpc connections of the
+// default server (the one Start runs) join.
+func DefaultHub() *Hub {
+	return hub
+}
+
+// Register adds a connection and starts its writer. Call Unregister when
+// the connection closes.
+func (h *Hub) Register(ctx context.Context, conn *websocket.Conn, user UserID, remoteAddr string) *HubConn {
+	id := newConnID()
+	ctx = logging.WithLogger(ctx, slog.Default().With("conn_id", id, "remote_addr", remoteAddr))
+	return h.register(ctx, id, conn, user, remoteAddr, GeoInfo{}, nil)
+}
+
+// register adds a connection under an ID the caller generated - the server
+// does so before the upgrade, so its log lines carry the ID from the start.
+// The connection logs with ctx's logger. Connections with a session pass
+// the queue their written messages wait in until acknowledged.
+func (h *Hub) register(ctx context.Context, id ConnID, conn *websocket.Conn, user UserID, remoteAddr string, geo GeoInfo, unacked *offlineQueue) *HubConn {
+	opts := h.opts.Load()
+	hc := &HubConn{
+		ID:           id,
+		User:         user,
+		RemoteAddr:   remoteAddr,
+		Geo:          geo,
+		ConnectedAt:  time.Now(),
+		hub:          h,
+		logger:       logging.FromContext(ctx),
+		conn:         conn,
+		send:         make(chan outgoing, opts.QueueDepth),
+		ttl:          opts.MessageTTL,
+		slow:         opts.SlowConsumer,
+		overflow:     opts.Overflow,
+		writeTimeout: opts.writeTimeout,
+		writeRetries: opts.WriteRetries,
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+		unacked:      unacked,
+		topics:       make(map[string]struct{}),
+	}
+	h.mu.Lock()
+	h.conns.add(hc)
+	h.mu.Unlock()
+
+	go hc.writeLoop(ctx)
+	return hc
+}
+
+// Unregister removes a connection and all of its subscriptions.
+func (h *Hub) Unregister(hc *HubConn) {
+	h.mu.Lock()
+	h.unregister(hc)
+	h.mu.Unlock()
+	hc.close()
+}
+
+// unregister removes hc from the hub's maps. Callers must hold h.mu.
+func (h *Hub) unregister(hc *HubConn) {
+	h.conns.remove(hc.ID)
+	for topic := range hc.topics {
+		h.removeSubscriber(topic, hc.ID)
+	}
+}
+
+// close stops the connection's queue: once it returns, no message is
+// added anymore and the writer is on its way out.
+func (hc *HubConn) close() {
+	hc.pushMu.Lock()
+	defer hc.pushMu.Unlock()
+	hc.once.Do(func() {
+		close(hc.done)
+		hc.releaseQueued() // Whatever is still queued is never written
+	})
+}
+
+// Get returns the connection registered under id.
+func (h *Hub) Get(id ConnID) (*HubConn, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.conns.get(id)
+}
+
+// Conns returns the registered connections, oldest first.
+func (h *Hub) Conns() []*HubConn {
+	h.mu.RLock()
+	conns := slices.Clone(h.conns.snapshot())
+	h.mu.RUnlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ConnectedAt.Before(conns[j].ConnectedAt) })
+	return conns
+}
+
+// Disconnect closes the connection registered under id with
+// ClosePolicyViolation and reason. The connection unregisters itself
+// once its read loop notices.
+func (h *Hub) Disconnect(id ConnID, reason string) error {
+	hc, ok := h.Get(id)
+	if !ok {
+		return ErrUnknownConn
+	}
+	hc.logger.Warn("Hub: disconnecting", "reason", reason)
+	hc.closing(DisconnectKicked, reason)
+	go CloseWith(hc.conn, ClosePolicyViolation, reason)
+	return nil
+}
+
+// Count returns the number of registered connections.
+func (h *Hub) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.conns.len()
+}
+
+// HealthCounts returns how many registered connections are in each health
+// state. Every state is present, so absent states read as zero.
+func (h *Hub) HealthCounts() map[ConnHealth]int {
+	counts := map[ConnHealth]int{HealthHealthy: 0, HealthDegraded: 0, HealthUnstable: 0, HealthLost: 0}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, hc := range h.conns.snapshot() {
+		counts[hc.Health()]++
+	}
+	return counts
+}
+
+// Broadcast queues msg for every connection, and relays it to the other
+// instances of a cluster. Returns how many local connections accepted it.
+func (h *Hub) Broadcast(msg []byte) int {
+	return h.BroadcastContext(context.Background(), msg)
+}
+
+// BroadcastContext is Broadcast with a deadline: connections that haven't
+// written msg by ctx's deadline drop it (see Expired and DeadLetters). A
+// ctx that is already done queues nothing.
+func (h *Hub) BroadcastContext(ctx context.Context, msg []byte) int {
+	if ctx.Err() != nil {
+		return 0
+	}
+	n := h.broadcastLocal(ctx, msg)
+	h.cluster.Load().broadcast(ctx, msg)
+	return n
+}
+
+// broadcastLocal is Broadcast for this instance's connections only.
+func (h *Hub) broadcastLocal(ctx context.Context, msg []byte) int {
+	h.mu.RLock()
+	targets := h.conns.snapshot()
+	h.mu.RUnlock()
+	return deliver(ctx, targets, msg)
+}
+
+// SendTo queues msg for a single connection.
+func (h *Hub) SendTo(id ConnID, msg []byte) error {
+	return h.SendToContext(context.Background(), id, msg)
+}
+
+// SendToContext is SendTo with a deadline, see BroadcastContext.
+func (h *Hub) SendToContext(ctx context.Context, id ConnID, msg []byte) error {
+	h.mu.RLock()
+	hc, ok := h.conns.get(id)
+	h.mu.RUnlock()
+	if !ok {
+		// A dropped connection's session keeps the message for its return
+		return h.sessions.forward(ctx, id, msg, false)
+	}
+	return hc.Push(ctx, msg)
+}
+
+// Subscribe adds a connection to a topic. topic may be a pattern with
+// wildcards (see topicMatch); the connection then receives what is
+// published to every matching topic.
+func (h *Hub) Subscribe(id ConnID, topic string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hc, ok := h.conns.get(id)
+	if !ok {
+		return ErrUnknownConn
+	}
+	h.subscribe(hc, topic)
+	return nil
+}
+
+// subscribeLimited is Subscribe for client requests: it refuses a new
+// topic once the connection is subscribed to max topics.
+func (h *Hub) subscribeLimited(id ConnID, topic string, max int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hc, ok := h.conns.get(id)
+	if !ok {
+		return ErrUnknownConn
+	}
+	if _, dup := hc.topics[topic]; !dup && len(hc.topics) >= max {
+		return ErrTooManySubscriptions
+	}
+	h.subscribe(hc, topic)
+	return nil
+}
+
+// subscribe adds hc to a topic. Callers must hold h.mu.
+func (h *Hub) subscribe(hc *HubConn, topic string) {
+	subs, ok := h.topics[topic]
+	if !ok {
+		subs = newConnSet()
+		h.topics[topic] = subs
+		if isTopicPattern(topic) {
+			h.wildcards[topic] = struct{}{}
+		}
+	}
+	subs.add(hc)
+	hc.topics[topic] = struct{}{}
+}
+
+// Unsubscribe removes a connection from a topic.
+func (h *Hub) Unsubscribe(id ConnID, topic string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hc, ok := h.conns.get(id); ok {
+		delete(hc.topics, topic)
+	}
+	h.removeSubscriber(topic, id)
+}
+
+// removeSubscriber drops id from a topic, deleting empty topics.
+// Callers must hold h.mu.
+func (h *Hub) removeSubscriber(topic string, id ConnID) {
+	if subs, ok := h.topics[topic]; ok && subs.remove(id) {
+		delete(h.topics, topic)
+		delete(h.wildcards, topic)
+	}
+}
+
+// Publish queues msg for every subscriber of topic - including those of
+// matching patterns, once each - and for the sessions of dropped
+// subscribers that wait to be resumed. In a cluster, it is relayed to the
+// other instances' subscribers too. Returns how many local subscribers
+// accepted it.
+func (h *Hub) Publish(topic string, msg []byte) int {
+	return h.PublishContext(context.Background(), topic, msg)
+}
+
+// PublishContext is Publish with a deadline, see BroadcastContext.
+func (h *Hub) PublishContext(ctx context.Context, topic string, msg []byte) int {
+	if ctx.Err() != nil {
+		return 0
+	}
+	n := h.publishLocal(ctx, topic, msg)
+	h.cluster.Load().publishTopic(ctx, topic, msg)
+	return n
+}
+
+// publishLocal is Publish for this instance's subscribers only.
+func (h *Hub) publishLocal(ctx context.Context, topic string, msg []byte) int {
+	// Only the snapshots are picked under the lock - together with the
+	// waiting sessions, so a connection handing over to its session is
+	// found on exactly one side
+	h.mu.RLock()
+	sets := [][]*HubConn{h.topics[topic].snapshot()}
+	for pattern := range h.wildcards {
+		if topicMatch(pattern, topic) {
+			sets = append(sets, h.topics[pattern].snapshot())
+		}
+	}
+	waiting := h.sessions.subscribers(topic)
+	h.mu.RUnlock()
+
+	targets := sets[0]
+	if len(sets) > 1 {
+		// Overlapping subscriptions get the message once
+		targets = nil
+		seen := make(map[ConnID]bool)
+		for _, set := range sets {
+			for _, hc := range set {
+				if !seen[hc.ID] {
+					seen[hc.ID] = true
+					targets = append(targets, hc)
+				}
+			}
+		}
+	}
+	n := deliver(ctx, targets, msg)
+	for _, ps := range waiting {
+		if h.sessions.keep(ctx, ps, msg, true) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// deliver queues msg on each connection and counts the successes. Fan-out
+// messages are bulk: SlowConsumerDropBulk may discard them.
+func deliver(ctx context.Context, targets []*HubConn, msg []byte) int {
+	n := 0
+	for _, hc := range targets {
+		if hc.queue(ctx, msg, true) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// enqueue queues a server notice, bound only by the hub's MessageTTL.
+func (hc *HubConn) enqueue(msg []byte) error {
+	return hc.Push(context.Background(), msg)
+}
+
+// Push queues msg for this connection without blocking. The message is
+// dropped instead of written if ctx's deadline - or, without one, the
+// hub's MessageTTL - passes while it waits in the queue. Cancelling ctx
+// after Push returns doesn't withdraw the message.
+// A full queue means the client can't keep up; depending on the overflow
+// policy it is disconnected or messages are dropped, rather than letting
+// memory grow unbounded.
+func (hc *HubConn) Push(ctx context.Context, msg []byte) error {
+	return hc.queue(ctx, msg, false)
+}
+
+// queue implements Push. bulk marks broadcast and topic messages. A
+// message for a connection that closed meanwhile goes to its session, if
+// it left one.
+func (hc *HubConn) queue(ctx context.Context, msg []byte, bulk bool) error {
+	select {
+	case <-hc.done:
+		return hc.hub.sessions.forward(ctx, hc.ID, msg, bulk)
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return err // Already stale - don't queue it at all
+	}
+	if err := hc.charge(int64(len(msg))); err != nil {
+		if errors.Is(err, ErrUnknownConn) {
+			return hc.hub.sessions.forward(ctx, hc.ID, msg, bulk)
+		}
+		return err
+	}
+	m := hc.outgoing(ctx, msg)
+	m.bulk = bulk
+	if err := hc.push(m); err != nil {
+		hc.uncharge(int64(len(msg)))
+		if errors.Is(err, ErrUnknownConn) {
+			return hc.hub.sessions.forward(ctx, hc.ID, msg, bulk)
+		}
+		return err
+	}
+	hc.checkSlow(len(hc.send))
+	return nil
+}
+
+// push puts m on the queue, applying the overflow policy when it is full.
+// Enqueues are serialized - meanwhile only the writer and evictors take
+// the oldest messages off the queue - so each sender's messages are
+// queued in the order it pushed them.
+func (hc *HubConn) push(m outgoing) error {
+	hc.pushMu.Lock()
+	defer hc.pushMu.Unlock()
+	select {
+	case <-hc.done:
+		return ErrUnknownConn // Closed while the caller was charging
+	default:
+	}
+	select {
+	case hc.send <- m:
+		return nil
+	default:
+	}
+
+	switch hc.overflow {
+	case OverflowDropNewest:
+		hc.hub.dropped.Add(1)
+		return ErrQueueFull
+	case OverflowDropOldest:
+		select {
+		case old := <-hc.send: // The writer may have made room meanwhile - then nothing is lost
+			hc.uncharge(int64(len(old.data)))
+			hc.hub.dropped.Add(1)
+		default:
+		}
+		hc.send <- m // Every enqueue holds pushMu, so the room is ours
+		return nil
+	}
+	hc.logger.Warn("Hub: slow consumer, disconnecting", "queue_depth", cap(hc.send))
+	hc.closing(DisconnectSlowConsumer, "")
+	go CloseWith(hc.conn, ClosePolicyViolation, "slow consumer")
+	return ErrSlowConsumer
+}
+
+// replay queues a message of a resumed session, waiting for room instead
+// of applying the overflow policy. It enqueues under pushMu like push, so
+// the room drop_oldest and dropBulk make can't be taken from under them.
+func (hc *HubConn) replay(ctx context.Context, m outgoing) error {
+	if m.stale(time.Now()) {
+		hc.hub.expire(hc, m)
+		return nil
+	}
+	if err := hc.charge(int64(len(m.data))); err != nil {
+		return err
+	}
+	hc.pushMu.Lock()
+	defer hc.pushMu.Unlock()
+	select {
+	case hc.send <- m:
+		return nil
+	case <-hc.stopped:
+	case <-hc.done:
+	case <-ctx.Done():
+	}
+	hc.uncharge(int64(len(m.data)))
+	return ErrUnknownConn
+}
+
+// writeLoop writes queued messages until the connection is unregistered.
+func (hc *HubConn) writeLoop(ctx context.Context) {
+	defer close(hc.stopped)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hc.done:
+			return
+		case m := <-hc.send:
+			if m.stale(time.Now()) {
+				hc.uncharge(int64(len(m.data)))
+				hc.hub.expire(hc, m) // Too late to be useful
+				continue
+			}
+			err := hc.write(ctx, m)
+			hc.uncharge(int64(len(m.data)))
+			hc.caughtUp()
+			if errors.Is(err, errWriteExpired) {
+				hc.hub.expire(hc, m)
+				continue
+			}
+			// Kept until a heartbeat confirms it - a failed write may have
+			// reached the client or not, so it is resent with the session
+			hc.unacked.add(m)
+			hc.sent.Add(1)
+			if err != nil {
+				hc.logger.Warn("Hub: write failed", "error", err)
+				return // The read loop notices the broken connection and unregisters
+			}
+		}
+	}
+}
+
+// charge reserves n bytes for a message about to be queued.
+func (hc *HubConn) charge(n int64) error {
+	hc.accMu.Lock()
+	released := hc.released
+	hc.accMu.Unlock()
+	if released {
+		return ErrUnknownConn
+	}
+	// Reserve may evict from this very queue, so it runs without accMu
+	if !hc.hub.memory.Reserve(n) {
+		return ErrMemoryBudget
+	}
+	hc.accMu.Lock()
+	defer hc.accMu.Unlock()
+	if hc.released {
+		hc.hub.memory.Release(n) // Unregistered meanwhile
+		return ErrUnknownConn
+	}
+	hc.queued += n
+	return nil
+}
+
+// uncharge releases the bytes of a message taken off the queue.
+func (hc *HubConn) uncharge(n int64) {
+	hc.accMu.Lock()
+	defer hc.accMu.Unlock()
+	if hc.released {
+		return // Already returned by releaseQueued
+	}
+	hc.queued -= n
+	hc.hub.memory.Release(n)
+}
+
+// releaseQueued returns the bytes of everything still queued.
+func (hc *HubConn) releaseQueued() {
+	hc.accMu.Lock()
+	defer hc.accMu.Unlock()
+	hc.hub.memory.Release(hc.queued)
+	hc.queued, hc.released = 0, true
+}
+
+// queuedBytes returns the bytes currently queued.
+func (hc *HubConn) queuedBytes() int64 {
+	hc.accMu.Lock()
+	defer hc.accMu.Unlock()
+	return hc.queued
+}
+
+// evictQueued is the hub's Evictor: it drops the oldest messages of the
+// longest queues - those of the slowest clients - until need bytes are
+// freed. Evicted messages count as dropped.
+func (h *Hub) evictQueued(need int64) int64 {
+	h.mu.RLock()
+	conns := slices.Clone(h.conns.snapshot())
+	h.mu.RUnlock()
+	sizes := make(map[*HubConn]int64, len(conns))
+	for _, hc := range conns {
+		sizes[hc] = hc.queuedBytes()
+	}
+	sort.Slice(conns, func(i, j int) bool { return sizes[conns[i]] > sizes[conns[j]] })
+
+	var freed int64
+	for _, hc := range conns {
+	drain:
+		for freed < need {
+			select {
+			case m := <-hc.send:
+				hc.uncharge(int64(len(m.data)))
+				h.dropped.Add(1)
+				freed += int64(len(m.data))
+			default:
+				break drain // Empty - try the next queue
+			}
+		}
+	}
+	if freed > 0 {
+		slog.Debug("Hub: evicted queued messages under memory pressure", "bytes", freed)
+	}
+	return freed
+}
+
+// connKey is the context key for the connection's HubConn.
+type connKey struct{}
+
+// withHubConn returns a context carrying the connection's hub entry.
+func withHubConn(ctx context.Context, hc *HubConn) context.Context {
+	return context.WithValue(ctx, connKey{}, hc)
+}
+
+// LoggerFromContext returns the logger of the connection a handler is
+// serving: the default logger with the connection's conn_id and
+// remote_addr attributes. Outside a connection it returns the default logger.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	return logging.FromContext(ctx)
+}
+
+// ConnFromContext returns the hub entry of the connection a handler is
+// serving, so it can subscribe the caller to topics or learn its ID.
+func ConnFromContext(ctx context.Context) (*HubConn, bool) {
+	hc, ok := ctx.Value(connKey{}).(*HubConn)
+	return hc, ok
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// outgoing is a queued hub message with the deadline it must be written by.
+type outgoing struct {
+	data     []byte
+	deadline time.Time // Zero = no deadline
+	bulk     bool      // Broadcast or topic message (see SlowConsumerDropBulk)
+}
+
+// outgoing wraps msg with ctx's deadline, or the hub's MessageTTL if ctx
+// has none. Only the deadline is kept: senders typically cancel their
+// context on return, long before the writer gets to the message.
+func (hc *HubConn) outgoing(ctx context.Context, msg []byte) outgoing {
+	m := outgoing{data: msg}
+	if d, ok := ctx.Deadline(); ok {
+		m.deadline = d
+	} else if hc.ttl > 0 {
+		m.deadline = time.Now().Add(hc.ttl)
+	}
+	return m
+}
+
+// stale reports whether m's deadline has passed.
+func (m outgoing) stale(now time.Time) bool {
+	return !m.deadline.IsZero() && !now.Before(m.deadline)
+}
+
+// expire counts a message dropped by the writer and keeps it in the
+// dead-letter queue, if enabled.
+func (h *Hub) expire(hc *HubConn, m outgoing) {
+	h.expired.Add(1)
+	hc.logger.Debug("Hub: dropped expired message", "deadline", m.deadline, "bytes", len(m.data))
+	h.dlq.Load().add(DeadLetter{
+		ConnID:    hc.ID,
+		Data:      m.data,
+		Deadline:  m.deadline,
+		DroppedAt: time.Now(),
+	})
+}
+
+// Expired returns how many messages were dropped because their deadline
+// passed before they were written.
+func (h *Hub) Expired() int64 {
+	return h.expired.Load()
+}
+
+// DeadLetters returns the most recently expired messages, oldest first.
+// Empty unless HubSettings.DeadLetters is set.
+func (h *Hub) DeadLetters() []DeadLetter {
+	return h.dlq.Load().List()
+}
+
+// DeadLetter is a message the hub dropped instead of writing it.
+type DeadLetter struct {
+	ConnID    ConnID    `json:"conn_id"`
+	Data      []byte    `json:"data"`
+	Deadline  time.Time `json:"deadline"`
+	DroppedAt time.Time `json:"dropped_at"`
+}
+
+// DeadLetterQueue keeps the last dropped messages in a ring buffer, so
+// memory stays bounded no matter how many expire. Under memory pressure
+// its oldest entries are evicted first. Methods are nil-safe: a nil queue
+// keeps nothing.
+type DeadLetterQueue struct {
+	entries []DeadLetter
+	head    int // Oldest entry
+	n       int // Entries in use
+	mu      sync.Mutex
+
+	budget *MemoryBudget // Accounts the entries' data (nil = unaccounted)
+}
+
+// NewDeadLetterQueue creates a queue keeping the last size entries.
+// Returns nil for size 0.
+func NewDeadLetterQueue(size int) *DeadLetterQueue {
+	if size <= 0 {
+		return nil
+	}
+	return &DeadLetterQueue{entries: make([]DeadLetter, size)}
+}
+
+// Cap returns how many entries the queue keeps.
+func (q *DeadLetterQueue) Cap() int {
+	if q == nil {
+		return 0
+	}
+	return len(q.entries)
+}
+
+// add stores an entry, overwriting the oldest once the queue is full.
+// Entries the memory budget has no room for aren't kept.
+func (q *DeadLetterQueue) add(dl DeadLetter) {
+	if q == nil || !q.budget.Reserve(int64(len(dl.Data))) {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 {
+		q.budget.Release(int64(len(dl.Data))) // Cleared by a resize
+		return
+	}
+	if q.n == len(q.entries) {
+		q.pop()
+	}
+	q.entries[(q.head+q.n)%len(q.entries)] = dl
+	q.n++
+}
+
+// pop removes the oldest entry and returns its size. Callers must hold q.mu.
+func (q *DeadLetterQueue) pop() int64 {
+	size := int64(len(q.entries[q.head].Data))
+	q.entries[q.head] = DeadLetter{}
+	q.head = (q.head + 1) % len(q.entries)
+	q.n--
+	q.budget.Release(size)
+	return size
+}
+
+// evict is the queue's Evictor: it drops the oldest entries until need
+// bytes are freed.
+func (q *DeadLetterQueue) evict(need int64) int64 {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var freed int64
+	for freed < need && q.n > 0 {
+		freed += q.pop()
+	}
+	return freed
+}
+
+// clear drops all entries of a queue that is being replaced.
+func (q *DeadLetterQueue) clear() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.n > 0 {
+		q.pop()
+	}
+	q.entries = nil
+}
+
+// List returns the entries, oldest first.
+func (q *DeadLetterQueue) List() []DeadLetter {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]DeadLetter, 0, q.n)
+	for i := 0; i < q.n; i++ {
+		out = append(out, q.entries[(q.head+i)%len(q.entries)])
+	}
+	return out
+}
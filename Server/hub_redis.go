@@ -0,0 +1,587 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClusterSettings connects the hub to the hubs of other server instances
+// through Redis pub/sub, so a broadcast or topic message reaches the
+// clients of every instance, not only those connected to the one that
+// sent it. Direct messages and sessions stay with their instance.
+type ClusterSettings struct {
+	RedisAddr      string        `yaml:"redis_addr"`      // host:port of the Redis server; empty = single instance (env CLUSTER_REDIS_ADDR)
+	RedisPassword  string        `yaml:"redis_password"`  // AUTH password, if Redis requires one (env CLUSTER_REDIS_PASSWORD)
+	Prefix         string        `yaml:"prefix"`          // Prefix of the channels and keys used; instances sharing it form a cluster (env CLUSTER_PREFIX)
+	Instance       string        `yaml:"instance"`        // Name of this instance; empty = hostname and a random suffix (env CLUSTER_INSTANCE)
+	ReportInterval time.Duration `yaml:"report_interval"` // How often connection counts are shared (env CLUSTER_REPORT_INTERVAL)
+}
+
+// DefaultClusterSettings returns a single instance; once a Redis address
+// is set, instances share the "cysl" prefix and report every 5s.
+func DefaultClusterSettings() ClusterSettings {
+	return ClusterSettings{Prefix: "cysl", ReportInterval: 5 * time.Second}
+}
+
+// Enabled reports whether a Redis server is configured.
+func (cs ClusterSettings) Enabled() bool {
+	return cs.RedisAddr != ""
+}
+
+// validate checks the cluster settings.
+func (cs ClusterSettings) validate() []ValidationError {
+	if !cs.Enabled() {
+		return nil
+	}
+	var errs []ValidationError
+	if _, _, err := net.SplitHostPort(cs.RedisAddr); err != nil {
+		errs = append(errs, ValidationError{"cluster.redis_addr", "must be host:port"})
+	}
+	if cs.Prefix == "" || strings.ContainsAny(cs.Prefix, "*?[] ") {
+		errs = append(errs, ValidationError{"cluster.prefix", "must be set and contain no spaces or glob characters"})
+	}
+	if cs.ReportInterval <= 0 {
+		errs = append(errs, ValidationError{"cluster.report_interval", "must be positive"})
+	}
+	return errs
+}
+
+// clusterEnvelope carries a hub message between instances.
+type clusterEnvelope struct {
+	From     string `json:"from"`               // Instance that sent it, which ignores its own messages
+	Deadline int64  `json:"deadline,omitempty"` // Unix milliseconds; 0 = none
+	TraceID  string `json:"trace_id,omitempty"` // Trace of the publisher's ctx, see WithTraceID
+	Data     []byte `json:"data"`
+}
+
+// ClusterStats is the cluster as seen by the last connection-count report.
+type ClusterStats struct {
+	Instances   int `json:"instances"`   // Instances that reported within three intervals
+	Connections int `json:"connections"` // Hub connections of all of them
+}
+
+// ClusterRelay propagates a hub's broadcasts and topic messages to the
+// other instances of a cluster and delivers theirs locally. Each message
+// is published once to Redis, which fans it out to every instance.
+// Messages published while an instance's subscription is down are lost to
+// it; Redis pub/sub doesn't keep them. Methods are nil-safe: a nil relay
+// keeps everything local.
+type ClusterRelay struct {
+	settings ClusterSettings
+	hub      *Hub
+	logger   *slog.Logger
+
+	// Channels and keys, all under the prefix
+	broadcastChannel string // Broadcasts
+	topicPrefix      string // Topic messages, followed by the topic
+	countKey         string // This instance's connection count
+	countPattern     string // Every instance's
+	certKey          string // This instance's soonest-expiring TLS certificate
+	certPattern      string // Every instance's
+
+	pub      *redisConn // Connection for commands; subscriptions need their own
+	pubRetry time.Time  // No dialing before then, after a failed dial
+	pubMu    sync.Mutex // Protects pub and pubRetry
+
+	stats     atomic.Pointer[ClusterStats]
+	certs     atomic.Pointer[CertMonitor] // Reported along with the count (nil = no TLS)
+	published atomic.Int64                // Messages sent to the other instances
+	received  atomic.Int64                // Messages delivered from the other instances
+	failures  atomic.Int64                // Failed Redis commands and lost subscriptions
+}
+
+// NewClusterRelay creates a relay for h. Run connects it.
+func NewClusterRelay(settings ClusterSettings, h *Hub, logger *slog.Logger) *ClusterRelay {
+	if settings.Instance == "" {
+		settings.Instance = defaultInstanceName()
+	}
+	p := settings.Prefix
+	return &ClusterRelay{
+		settings:         settings,
+		hub:              h,
+		logger:           logger.With("instance", settings.Instance),
+		broadcastChannel: p + ":broadcast",
+		topicPrefix:      p + ":topic:",
+		countKey:         p + ":conns:" + settings.Instance,
+		countPattern:     p + ":conns:*",
+		certKey:          p + ":certs:" + settings.Instance,
+		certPattern:      p + ":certs:*",
+	}
+}
+
+// clusterRelayFromConfig returns nil for a single instance.
+func clusterRelayFromConfig(cs ClusterSettings, h *Hub, logger *slog.Logger) *ClusterRelay {
+	if !cs.Enabled() {
+		return nil
+	}
+	return NewClusterRelay(cs, h, logger)
+}
+
+// defaultInstanceName returns the hostname with a random suffix, so
+// instances on one host or restarts of one instance don't collide.
+func defaultInstanceName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "cysl"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// Run subscribes to the other instances' messages and reports this
+// instance's connection count until ctx is done, reconnecting to Redis
+// with backoff whenever it fails.
+func (cr *ClusterRelay) Run(ctx context.Context) {
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		cr.report(ctx)
+	}()
+	backoff := time.Second
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := cr.subscribe(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		cr.failures.Add(1)
+		if time.Since(start) > time.Minute {
+			backoff = time.Second // It was up for a while - not a persistent failure
+		}
+		cr.logger.Warn("Cluster subscription lost", "error", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+	<-reported // Its last command removes the count
+	cr.pubMu.Lock()
+	defer cr.pubMu.Unlock()
+	cr.pub.Close()
+	cr.pub = nil
+}
+
+// subscribe receives the cluster's messages on a connection of its own
+// until it fails or ctx is done.
+func (cr *ClusterRelay) subscribe(ctx context.Context) error {
+	conn, err := dialRedis(ctx, cr.settings.RedisAddr, cr.settings.RedisPassword)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := conn.send("SUBSCRIBE", cr.broadcastChannel); err != nil {
+		return err
+	}
+	if err := conn.send("PSUBSCRIBE", cr.topicPrefix+"*"); err != nil {
+		return err
+	}
+	cr.logger.Info("Cluster relay connected", "redis", cr.settings.RedisAddr, "prefix", cr.settings.Prefix)
+	for {
+		reply, err := conn.receive(0) // Quiet channels are fine
+		if err != nil {
+			return err
+		}
+		// ["message", channel, payload] or ["pmessage", pattern, channel, payload];
+		// subscription confirmations are skipped
+		fields, _ := reply.([]any)
+		switch {
+		case len(fields) == 3 && fields[0] == "message":
+			cr.deliver(ctx, fields[1], fields[2])
+		case len(fields) == 4 && fields[0] == "pmessage":
+			cr.deliver(ctx, fields[2], fields[3])
+		}
+	}
+}
+
+// deliver hands a message from another instance to the local hub, without
+// relaying it again.
+func (cr *ClusterRelay) deliver(ctx context.Context, channel, payload any) {
+	ch, _ := channel.(string)
+	data, _ := payload.(string)
+	var env clusterEnvelope
+	if err := json.Unmarshal([]byte(data), &env); err != nil {
+		cr.logger.Warn("Ignoring malformed cluster message", "channel", ch, "error", err)
+		return
+	}
+	if env.From == cr.settings.Instance {
+		return // Delivered locally when it was sent
+	}
+	if env.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.UnixMilli(env.Deadline))
+		defer cancel()
+	}
+	if env.TraceID != "" {
+		ctx = WithTraceID(ctx, env.TraceID)
+	}
+	cr.received.Add(1)
+	if ch == cr.broadcastChannel {
+		cr.hub.broadcastLocal(ctx, env.Data)
+	} else if topic, ok := strings.CutPrefix(ch, cr.topicPrefix); ok {
+		cr.hub.publishLocal(ctx, topic, env.Data)
+	}
+}
+
+// broadcast sends a local broadcast to the other instances.
+func (cr *ClusterRelay) broadcast(ctx context.Context, msg []byte) {
+	if cr == nil {
+		return
+	}
+	cr.publish(ctx, cr.broadcastChannel, msg)
+}
+
+// publishTopic sends a local topic message to the other instances.
+func (cr *ClusterRelay) publishTopic(ctx context.Context, topic string, msg []byte) {
+	if cr == nil {
+		return
+	}
+	cr.publish(ctx, cr.topicPrefix+topic, msg)
+}
+
+// publish sends msg on channel, carrying ctx's deadline along. A message
+// that can't be sent is counted and logged; local delivery doesn't depend
+// on it.
+func (cr *ClusterRelay) publish(ctx context.Context, channel string, msg []byte) {
+	env := clusterEnvelope{From: cr.settings.Instance, TraceID: TraceIDFromContext(ctx), Data: msg}
+	if deadline, ok := ctx.Deadline(); ok {
+		env.Deadline = deadline.UnixMilli()
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		return
+	}
+	if _, err := cr.do("PUBLISH", channel, string(data)); err != nil {
+		cr.failures.Add(1)
+		if !errors.Is(err, errRedisUnavailable) { // Already logged when the dial failed
+			cr.logger.Warn("Relaying message to the cluster failed", "channel", channel, "trace_id", env.TraceID, "error", err)
+		}
+		return
+	}
+	cr.published.Add(1)
+}
+
+// errRedisUnavailable fails commands fast while Redis can't be reached,
+// so publishers aren't held up by a dial for every message.
+var errRedisUnavailable = errors.New("redis unavailable")
+
+// do runs a command on the shared connection, dialing it when needed. A
+// connection that failed is dropped, so the next command redials - at
+// most once per second.
+func (cr *ClusterRelay) do(args ...string) (any, error) {
+	cr.pubMu.Lock()
+	defer cr.pubMu.Unlock()
+	if cr.pub == nil {
+		if time.Now().Before(cr.pubRetry) {
+			return nil, errRedisUnavailable
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		conn, err := dialRedis(ctx, cr.settings.RedisAddr, cr.settings.RedisPassword)
+		if err != nil {
+			cr.pubRetry = time.Now().Add(time.Second)
+			return nil, err
+		}
+		cr.pub = conn
+	}
+	reply, err := cr.pub.do(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		cr.pub.Close()
+		cr.pub = nil
+	}
+	return reply, err
+}
+
+// report shares this instance's connection count, and its soonest-expiring
+// certificate, every ReportInterval and sums up the counts of the others. Counts expire after three intervals, so a
+// crashed instance drops out of the total.
+func (cr *ClusterRelay) report(ctx context.Context) {
+	ticker := time.NewTicker(cr.settings.ReportInterval)
+	defer ticker.Stop()
+	for {
+		if err := cr.refresh(); err != nil {
+			cr.failures.Add(1)
+			cr.logger.Warn("Reporting to the cluster failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			cr.do("DEL", cr.countKey, cr.certKey) // Leave the total right away
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh stores this instance's count and certificate and reads
+// everybody's count.
+func (cr *ClusterRelay) refresh() error {
+	ttl := strconv.FormatInt((3 * cr.settings.ReportInterval).Milliseconds(), 10)
+	if _, err := cr.do("SET", cr.countKey, strconv.Itoa(cr.hub.Count()), "PX", ttl); err != nil {
+		return err
+	}
+	if cert, ok := cr.certs.Load().Soonest(); ok {
+		data, _ := json.Marshal(cert)
+		if _, err := cr.do("SET", cr.certKey, string(data), "PX", ttl); err != nil {
+			return err
+		}
+	}
+	reply, err := cr.do("KEYS", cr.countPattern)
+	if err != nil {
+		return err
+	}
+	keys, _ := reply.([]any)
+	if len(keys) == 0 {
+		return nil // Expired between SET and KEYS
+	}
+	args := []string{"MGET"}
+	for _, k := range keys {
+		if s, ok := k.(string); ok {
+			args = append(args, s)
+		}
+	}
+	if reply, err = cr.do(args...); err != nil {
+		return err
+	}
+	var stats ClusterStats
+	counts, _ := reply.([]any)
+	for _, c := range counts {
+		s, ok := c.(string) // nil if it expired meanwhile
+		if n, err := strconv.Atoi(s); ok && err == nil {
+			stats.Instances++
+			stats.Connections += n
+		}
+	}
+	cr.stats.Store(&stats)
+	return nil
+}
+
+// reportCerts makes the relay share the soonest-expiring certificate of
+// cm with the other instances. Nil-safe.
+func (cr *ClusterRelay) reportCerts(cm *CertMonitor) {
+	if cr != nil {
+		cr.certs.Store(cm)
+	}
+}
+
+// Certs returns the soonest-expiring certificate of each instance that
+// serves TLS, the one expiring first first. Reports expire like the
+// connection counts.
+func (cr *ClusterRelay) Certs() ([]CertInfo, error) {
+	if cr == nil {
+		return nil, nil
+	}
+	reply, err := cr.do("KEYS", cr.certPattern)
+	if err != nil {
+		return nil, err
+	}
+	keys, _ := reply.([]any)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	args := []string{"MGET"}
+	for _, k := range keys {
+		if s, ok := k.(string); ok {
+			args = append(args, s)
+		}
+	}
+	if reply, err = cr.do(args...); err != nil {
+		return nil, err
+	}
+	var certs []CertInfo
+	values, _ := reply.([]any)
+	for i, v := range values {
+		s, ok := v.(string) // nil if it expired meanwhile
+		var cert CertInfo
+		if !ok || json.Unmarshal([]byte(s), &cert) != nil {
+			continue
+		}
+		cert.Instance = strings.TrimPrefix(args[i+1], cr.settings.Prefix+":certs:")
+		certs = append(certs, cert)
+	}
+	slices.SortFunc(certs, func(a, b CertInfo) int { return a.NotAfter.Compare(b.NotAfter) })
+	return certs, nil
+}
+
+// Stats returns the cluster's instances and connections as of the last
+// report; zero before the first.
+func (cr *ClusterRelay) Stats() ClusterStats {
+	if cr == nil {
+		return ClusterStats{}
+	}
+	if st := cr.stats.Load(); st != nil {
+		return *st
+	}
+	return ClusterStats{}
+}
+
+// Published returns how many messages were sent to the other instances.
+func (cr *ClusterRelay) Published() int64 {
+	if cr == nil {
+		return 0
+	}
+	return cr.published.Load()
+}
+
+// Received returns how many messages from the other instances were
+// delivered locally.
+func (cr *ClusterRelay) Received() int64 {
+	if cr == nil {
+		return 0
+	}
+	return cr.received.Load()
+}
+
+// Errors returns how many Redis commands failed and subscriptions were
+// lost.
+func (cr *ClusterRelay) Errors() int64 {
+	if cr == nil {
+		return 0
+	}
+	return cr.failures.Load()
+}
+
+// redisTimeout bounds dialing and each command on the shared connection.
+const redisTimeout = 5 * time.Second
+
+// redisConn speaks the subset of the Redis protocol (RESP2) the relay
+// needs: commands as arrays of bulk strings, and the replies to them.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply: the command reached Redis, so the
+// connection is still usable.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// dialRedis connects and authenticates.
+func dialRedis(ctx context.Context, addr, password string) (*redisConn, error) {
+	var d net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	conn, err := d.DialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if password != "" {
+		if _, err := rc.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// Close closes the connection. Nil-safe.
+func (rc *redisConn) Close() error {
+	if rc == nil {
+		return nil
+	}
+	return rc.conn.Close()
+}
+
+// do sends a command and reads its reply.
+func (rc *redisConn) do(args ...string) (any, error) {
+	if err := rc.send(args...); err != nil {
+		return nil, err
+	}
+	reply, err := rc.receive(redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(redisError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// send writes a command.
+func (rc *redisConn) send(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	rc.conn.SetWriteDeadline(time.Now().Add(redisTimeout))
+	_, err := rc.conn.Write([]byte(b.String()))
+	return err
+}
+
+// receive reads one reply, waiting at most timeout (0 = forever). Strings
+// come back as string, integers as int64, arrays as []any, nulls as nil
+// and error replies as redisError.
+func (rc *redisConn) receive(timeout time.Duration) (any, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	rc.conn.SetReadDeadline(deadline)
+	return rc.readReply()
+}
+
+// readReply parses one RESP2 value.
+func (rc *redisConn) readReply() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	kind, rest := line[0], line[1:]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return redisError(rest), nil
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err // $-1 is a null
+		}
+		buf := make([]byte, n+2) // With the trailing \r\n
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err // *-1 is a null
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = rc.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// errWriteExpired is returned by write when a message's deadline passed
+// while its write was being retried. The connection is still fine.
+var errWriteExpired = errors.New("message expired while retrying its write")
+
+// writeRetryBackoff is the pause before the first retry of a timed-out
+// write; it doubles with every further attempt.
+const writeRetryBackoff = 50 * time.Millisecond
+
+// write writes a queued message, retrying up to WriteRetries times when
+// the write timed out on a connection that is still alive.
+//
+// A write times out harmlessly while it waits for the connection's writer
+// lock - held by a reply or heartbeat being written directly - so nothing
+// of the frame was sent yet. A timeout in the middle of a frame closes the
+// connection instead, and the retry fails at once. The client therefore
+// never gets a frame twice from a retry; envelopes carry message IDs so
+// it can drop repeats anyway.
+func (hc *HubConn) write(ctx context.Context, m outgoing) error {
+	for attempt := 0; ; attempt++ {
+		writeCtx, cancel := context.WithTimeout(ctx, hc.writeTimeout)
+		err := hc.conn.Write(writeCtx, websocket.MessageText, m.data)
+		cancel()
+		if err == nil || attempt >= hc.writeRetries || !retryableWrite(ctx, err) {
+			return err
+		}
+
+		hc.hub.writeRetries.Add(1)
+		backoff := writeRetryBackoff << attempt
+		hc.logger.Debug("Hub: write timed out, retrying", "attempt", attempt+1, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-hc.done:
+			return err
+		case <-time.After(backoff):
+		}
+		if m.stale(time.Now()) {
+			return errWriteExpired
+		}
+	}
+}
+
+// retryableWrite reports whether a failed write may be retried: only the
+// per-write timeout expired, not the connection's context.
+func retryableWrite(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+}
+
+// WriteRetries returns how many timed-out writes were retried.
+func (h *Hub) WriteRetries() int64 {
+	return h.writeRetries.Load()
+}
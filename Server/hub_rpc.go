@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// topicParams are the params of the topic.* RPC methods.
+type topicParams struct {
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data,omitempty"` // Payload for topic.publish
+}
+
+// topicMessage is pushed to subscribers as a "topic.message" notification.
+type topicMessage struct {
+	Topic string          `json:"topic"`
+	From  ConnID          `json:"from"`
+	User  UserID          `json:"user,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// registerHubMethods adds the topic fan-out methods to the RPC registry:
+// topic.subscribe, topic.unsubscribe and topic.publish. Subscriptions may use
+// wildcards (see topicMatch), publishing may not. Subscribers receive
+// {"jsonrpc":"2.0","method":"topic.message","params":{topic,from,user,data}}.
+func registerHubMethods(reg *RPCRegistry) {
+	reg.Register("topic.subscribe", func(ctx context.Context, params json.RawMessage) (any, error) {
+		hc, p, err := topicCall(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		if err := hc.hub.Subscribe(hc.ID, p.Topic); err != nil {
+			return nil, err
+		}
+		return map[string]any{"subscribed": p.Topic, "conn_id": hc.ID}, nil
+	})
+	reg.Register("topic.unsubscribe", func(ctx context.Context, params json.RawMessage) (any, error) {
+		hc, p, err := topicCall(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		hc.hub.Unsubscribe(hc.ID, p.Topic)
+		return map[string]any{"unsubscribed": p.Topic}, nil
+	})
+	reg.Register("topic.publish", func(ctx context.Context, params json.RawMessage) (any, error) {
+		hc, p, err := topicCall(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		if p.Data == nil {
+			return nil, &RPCError{Code: RPCInvalidParams, Message: "topic.publish requires data"}
+		}
+		if isTopicPattern(p.Topic) {
+			return nil, &RPCError{Code: RPCInvalidParams, Message: "cannot publish to a wildcard topic"}
+		}
+		msg, err := json.Marshal(rpcNotification{JSONRPC: "2.0", Method: "topic.message", Params: topicMessage{
+			Topic: p.Topic, From: hc.ID, User: hc.User, Data: p.Data,
+		}})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]int{"delivered": hc.hub.Publish(p.Topic, msg)}, nil
+	})
+}
+
+// topicCall decodes topic params and finds the calling connection.
+func topicCall(ctx context.Context, params json.RawMessage) (*HubConn, topicParams, error) {
+	var p topicParams
+	if err := json.Unmarshal(params, &p); err != nil || p.Topic == "" {
+		return nil, p, &RPCError{Code: RPCInvalidParams, Message: "params must be {\"topic\": \"...\"}"}
+	}
+	// Topics are checked like subscribe messages, keeping clients away
+	// from server topics such as health watches
+	if err := validateClientTopic(p.Topic); err != nil {
+		return nil, p, &RPCError{Code: RPCInvalidParams, Message: err.Error()}
+	}
+	hc, ok := ConnFromContext(ctx)
+	if !ok {
+		return nil, p, errors.New("no connection in context")
+	}
+	return hc, p, nil
+}
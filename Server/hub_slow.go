@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Policies for a connection detected as a slow consumer.
+const (
+	SlowConsumerNotify     = "notify"     // Only tell the client and record the event
+	SlowConsumerDropBulk   = "drop_bulk"  // Also discard its queued broadcasts and topic messages
+	SlowConsumerDisconnect = "disconnect" // Close the connection
+)
+
+// SlowConsumerSettings configures detection of connections that lag behind
+// before their queue overflows: a queue that stays at or above Threshold
+// messages for For marks the connection as a slow consumer. The event is
+// counted, audited and sent to the client as a {"type":"slow_consumer",...}
+// notice, then Policy is applied.
+type SlowConsumerSettings struct {
+	Threshold int           `yaml:"threshold"` // Queued messages; 0 = detection off (env HUB_SLOW_THRESHOLD)
+	For       time.Duration `yaml:"for"`       // How long the queue must stay above Threshold (env HUB_SLOW_FOR)
+	Policy    string        `yaml:"policy"`    // SlowConsumerNotify, SlowConsumerDropBulk or SlowConsumerDisconnect (env HUB_SLOW_POLICY)
+}
+
+// DefaultSlowConsumerSettings flags connections whose queue stays three
+// quarters full for 10s and drops their backlog of bulk messages.
+func DefaultSlowConsumerSettings() SlowConsumerSettings {
+	return SlowConsumerSettings{Threshold: 48, For: 10 * time.Second, Policy: SlowConsumerDropBulk}
+}
+
+// validate checks the settings against the queue depth.
+func (sc SlowConsumerSettings) validate(queueDepth int) []ValidationError {
+	var errs []ValidationError
+	if sc.Threshold < 0 || sc.Threshold > queueDepth {
+		errs = append(errs, ValidationError{"hub.slow_consumer.threshold", "must be between 0 and hub.queue_depth"})
+	}
+	if sc.Threshold > 0 && sc.For <= 0 {
+		errs = append(errs, ValidationError{"hub.slow_consumer.for", "must be positive"})
+	}
+	switch sc.Policy {
+	case SlowConsumerNotify, SlowConsumerDropBulk, SlowConsumerDisconnect:
+	default:
+		errs = append(errs, ValidationError{"hub.slow_consumer.policy",
+			fmt.Sprintf("must be %q, %q or %q", SlowConsumerNotify, SlowConsumerDropBulk, SlowConsumerDisconnect)})
+	}
+	return errs
+}
+
+// slowConsumerNotice tells a client it is falling behind. It is sent in
+// band, or as the close reason under SlowConsumerDisconnect (with "error"
+// in place of "type").
+type slowConsumerNotice struct {
+	Type    string `json:"type,omitempty"`  // "slow_consumer" for in-band notices
+	Error   string `json:"error,omitempty"` // "slow_consumer" in close reasons
+	Queued  int    `json:"queued"`          // Messages waiting when detected
+	Policy  string `json:"policy"`
+	Dropped int    `json:"dropped,omitempty"` // Bulk messages discarded
+}
+
+// checkSlow tracks how long the queue has been at or above the threshold.
+// It is called after every queued message, with the queue's new length.
+func (hc *HubConn) checkSlow(depth int) {
+	if hc.slow.Threshold <= 0 {
+		return
+	}
+	if depth < hc.slow.Threshold {
+		hc.slowSince.Store(0)
+		return
+	}
+	now := time.Now().UnixNano()
+	since := hc.slowSince.Load()
+	if since == 0 {
+		hc.slowSince.CompareAndSwap(0, now)
+		return
+	}
+	// since = -1 marks an episode already handled
+	if since < 0 || time.Duration(now-since) < hc.slow.For {
+		return
+	}
+	if hc.slowSince.CompareAndSwap(since, -1) {
+		hc.slowConsumer(depth, time.Duration(now-since))
+	}
+}
+
+// caughtUp ends a slow episode once the writer has drained the queue
+// below the threshold.
+func (hc *HubConn) caughtUp() {
+	if hc.slow.Threshold > 0 && len(hc.send) < hc.slow.Threshold {
+		hc.slowSince.Store(0)
+	}
+}
+
+// slowConsumer records a detected slow consumer and applies the policy.
+func (hc *HubConn) slowConsumer(depth int, lagging time.Duration) {
+	hc.hub.slowConsumers.Add(1)
+	notice := slowConsumerNotice{Queued: depth, Policy: hc.slow.Policy}
+	if hc.slow.Policy == SlowConsumerDropBulk {
+		notice.Dropped = hc.dropBulk()
+	}
+	hc.logger.Warn("Hub: slow consumer", "queued", depth, "for", lagging.Round(time.Millisecond),
+		"policy", hc.slow.Policy, "dropped", notice.Dropped)
+	auditLog.Record(AuditEvent{
+		Type:       "slow_consumer",
+		RemoteAddr: hc.RemoteAddr,
+		Decision:   hc.slow.Policy,
+		Reason:     fmt.Sprintf("%d messages queued for %v", depth, lagging.Round(time.Millisecond)),
+		Fields: map[string]string{
+			"conn_id": string(hc.ID),
+			"user":    string(hc.User),
+			"dropped": fmt.Sprintf("%d", notice.Dropped),
+		},
+	})
+
+	if hc.slow.Policy == SlowConsumerDisconnect {
+		notice.Error = "slow_consumer"
+		reason, _ := json.Marshal(notice)
+		hc.closing(DisconnectSlowConsumer, "")
+		go CloseWith(hc.conn, ClosePolicyViolation, string(reason))
+		return
+	}
+	notice.Type = "slow_consumer"
+	data, _ := json.Marshal(notice)
+	hc.enqueue(data) // Behind the backlog - the client sees it once it catches up
+}
+
+// dropBulk discards the queued broadcasts and topic messages, keeping
+// direct messages and notices in order. Senders wait meanwhile, so no
+// new message overtakes the kept ones. Returns how many were dropped.
+func (hc *HubConn) dropBulk() int {
+	hc.pushMu.Lock()
+	defer hc.pushMu.Unlock()
+	var keep []outgoing
+	dropped := 0
+drain:
+	for {
+		select {
+		case m := <-hc.send:
+			if !m.bulk {
+				keep = append(keep, m)
+				continue
+			}
+			hc.uncharge(int64(len(m.data)))
+			dropped++
+		default:
+			break drain
+		}
+	}
+	for _, m := range keep {
+		hc.send <- m // Fits: the queue held them a moment ago, and every enqueue holds pushMu
+	}
+	hc.hub.dropped.Add(int64(dropped))
+	return dropped
+}
+
+// SlowConsumers returns how many slow consumers were detected.
+func (h *Hub) SlowConsumers() int64 {
+	return h.slowConsumers.Load()
+}
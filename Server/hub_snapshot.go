@@ -0,0 +1,71 @@
+package server
+
+import "sync/atomic"
+
+// connSet is a set of connections that hands out its members as an
+// immutable slice for fan-out. Changes only drop the current slice and the
+// next fan-out builds a new one, so joins and leaves stay cheap and
+// fan-out to a stable set copies nothing. Senders iterate their slice
+// after releasing the owner's lock, while the set keeps changing.
+//
+// Changes need the owner's write lock; snapshot needs at least its read
+// lock. A nil set is empty.
+type connSet struct {
+	members map[ConnID]*HubConn
+	current atomic.Pointer[[]*HubConn] // nil after a change
+}
+
+// newConnSet creates an empty set.
+func newConnSet() *connSet {
+	return &connSet{members: make(map[ConnID]*HubConn)}
+}
+
+// add inserts hc, replacing a member with the same ID.
+func (cs *connSet) add(hc *HubConn) {
+	cs.members[hc.ID] = hc
+	cs.current.Store(nil)
+}
+
+// remove deletes id and reports whether the set is now empty.
+func (cs *connSet) remove(id ConnID) bool {
+	if _, ok := cs.members[id]; ok {
+		delete(cs.members, id)
+		cs.current.Store(nil)
+	}
+	return len(cs.members) == 0
+}
+
+// get returns the member with id.
+func (cs *connSet) get(id ConnID) (*HubConn, bool) {
+	if cs == nil {
+		return nil, false
+	}
+	hc, ok := cs.members[id]
+	return hc, ok
+}
+
+// len returns the number of members.
+func (cs *connSet) len() int {
+	if cs == nil {
+		return 0
+	}
+	return len(cs.members)
+}
+
+// snapshot returns the members. The slice is shared and must not be
+// modified; it stays valid after the lock is released.
+func (cs *connSet) snapshot() []*HubConn {
+	if cs == nil {
+		return nil
+	}
+	if s := cs.current.Load(); s != nil {
+		return *s
+	}
+	// Readers may build it concurrently; they build the same members
+	s := make([]*HubConn, 0, len(cs.members))
+	for _, hc := range cs.members {
+		s = append(s, hc)
+	}
+	cs.current.Store(&s)
+	return s
+}
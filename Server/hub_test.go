@@ -0,0 +1,405 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// testHub returns a hub with settings, slow consumer detection off unless
+// settings turn it on.
+func testHub(settings HubSettings) *Hub {
+	h := NewHub()
+	h.configure(settings, 5*time.Second)
+	return h
+}
+
+// received collects what a client read, in order.
+type received struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (r *received) add(m string) {
+	r.mu.Lock()
+	r.msgs = append(r.msgs, m)
+	r.mu.Unlock()
+}
+
+func (r *received) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.msgs...)
+}
+
+// waitFor waits until r holds n messages.
+func (r *received) waitFor(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if msgs := r.snapshot(); len(msgs) >= n {
+			return msgs
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("received %d of %d messages", len(r.snapshot()), n)
+	return nil
+}
+
+// connect registers a real WebSocket connection with h and returns it,
+// together with what its client reads.
+func connect(t *testing.T, h *Hub, unacked *offlineQueue) (*HubConn, *received) {
+	t.Helper()
+	conns := make(chan *HubConn, 1)
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		conns <- h.register(context.Background(), newConnID(), conn, "", r.RemoteAddr, GeoInfo{}, unacked)
+		<-stop
+	}))
+	t.Cleanup(func() {
+		close(stop)
+		srv.Close()
+	})
+
+	client, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	client.SetReadLimit(-1)
+	t.Cleanup(func() { client.CloseNow() })
+	got := &received{}
+	go func() {
+		for {
+			_, data, err := client.Read(context.Background())
+			if err != nil {
+				return
+			}
+			got.add(string(data))
+		}
+	}()
+	return <-conns, got
+}
+
+// message is what sender sends as its seq-th message.
+func message(sender, seq int) []byte {
+	return []byte(fmt.Sprintf("%d:%d", sender, seq))
+}
+
+// checkOrder fails t if a sender's messages arrived out of order or twice.
+// Gaps are allowed: overflow policies drop messages, they never reorder
+// them. Returns how many messages of each sender arrived.
+func checkOrder(t *testing.T, name string, msgs []string) map[int]int {
+	t.Helper()
+	last := make(map[int]int)
+	counts := make(map[int]int)
+	for _, m := range msgs {
+		var sender, seq int
+		if _, err := fmt.Sscanf(m, "%d:%d", &sender, &seq); err != nil {
+			continue // A notice, not a test message
+		}
+		if prev, ok := last[sender]; ok && seq <= prev {
+			t.Fatalf("%s: sender %d's message %d arrived after %d", name, sender, seq, prev)
+		}
+		last[sender] = seq
+		counts[sender]++
+	}
+	return counts
+}
+
+// publishAll runs senders goroutines at once, each calling send for
+// messages 0 to perSender-1 in order.
+func publishAll(senders, perSender int, send func(sender, seq int)) {
+	var start, wg sync.WaitGroup
+	start.Add(1)
+	for s := range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start.Wait()
+			for seq := range perSender {
+				send(s, seq)
+			}
+		}()
+	}
+	start.Done()
+	wg.Wait()
+}
+
+// TestHubOrderPerSender has thousands of goroutines broadcast, publish and
+// send directly to the same connections at once; every recipient must get
+// each sender's messages complete and in the order they were sent.
+func TestHubOrderPerSender(t *testing.T) {
+	const senders, perSender = 2000, 6
+	h := testHub(HubSettings{QueueDepth: senders * perSender, Overflow: OverflowDisconnect})
+	type conn struct {
+		hc  *HubConn
+		got *received
+	}
+	var conns []conn
+	for range 4 {
+		hc, got := connect(t, h, nil)
+		h.Subscribe(hc.ID, "sensors/+/temp")
+		conns = append(conns, conn{hc, got})
+	}
+
+	publishAll(senders, perSender, func(sender, seq int) {
+		msg := message(sender, seq)
+		switch seq % 3 {
+		case 0:
+			h.Broadcast(msg)
+		case 1:
+			h.Publish("sensors/a/temp", msg)
+		default:
+			for _, c := range conns {
+				h.SendTo(c.hc.ID, msg)
+			}
+		}
+	})
+
+	for i, c := range conns {
+		counts := checkOrder(t, fmt.Sprintf("conn %d", i), c.got.waitFor(t, senders*perSender))
+		for s := range senders {
+			if counts[s] != perSender {
+				t.Fatalf("conn %d got %d of sender %d's %d messages", i, counts[s], s, perSender)
+			}
+		}
+	}
+}
+
+// TestHubOrderDropOldest floods small drop_oldest queues: messages are
+// lost, but those that arrive keep each sender's order.
+func TestHubOrderDropOldest(t *testing.T) {
+	const senders, perSender = 1000, 20
+	h := testHub(HubSettings{QueueDepth: 8, Overflow: OverflowDropOldest})
+	var gots []*received
+	for range 2 {
+		_, got := connect(t, h, nil)
+		gots = append(gots, got)
+	}
+
+	publishAll(senders, perSender, func(sender, seq int) {
+		h.Broadcast(message(sender, seq))
+	})
+	h.Broadcast([]byte("done"))
+
+	for i, got := range gots {
+		deadline := time.Now().Add(30 * time.Second)
+		for !strings.HasSuffix(strings.Join(got.snapshot(), ","), "done") {
+			if time.Now().After(deadline) {
+				t.Fatalf("conn %d never got the last message", i)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		checkOrder(t, fmt.Sprintf("conn %d", i), got.snapshot())
+	}
+	if h.Dropped() == 0 {
+		t.Log("no message was dropped; the queues kept up")
+	}
+}
+
+// TestHubOrderDropBulk lets drop_bulk requeue the direct messages of
+// lagging connections while thousands of senders keep going: broadcasts
+// may be dropped, direct messages must all arrive, and both in order.
+func TestHubOrderDropBulk(t *testing.T) {
+	const senders, perSender = 1000, 10
+	h := testHub(HubSettings{
+		QueueDepth:   senders * perSender,
+		Overflow:     OverflowDisconnect,
+		SlowConsumer: SlowConsumerSettings{Threshold: 16, For: time.Nanosecond, Policy: SlowConsumerDropBulk},
+	})
+	hc, got := connect(t, h, nil)
+
+	publishAll(senders, perSender, func(sender, seq int) {
+		if seq%2 == 0 {
+			h.SendTo(hc.ID, message(sender, seq))
+		} else {
+			h.Broadcast(message(sender, seq))
+		}
+	})
+
+	// Direct messages are never dropped: wait for all of them
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		direct := 0
+		for _, m := range got.snapshot() {
+			var sender, seq int
+			if _, err := fmt.Sscanf(m, "%d:%d", &sender, &seq); err == nil && seq%2 == 0 {
+				direct++
+			}
+		}
+		if direct == senders*perSender/2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d of %d direct messages", direct, senders*perSender/2)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	checkOrder(t, "conn", got.snapshot())
+	t.Logf("slow consumer episodes: %d, dropped: %d", h.SlowConsumers(), h.Dropped())
+}
+
+// TestHubOrderSessionHandover parks a connection's session while
+// thousands of senders publish to its topic and its connection ID, and
+// resumes it on a new connection. Nothing is acknowledged, so the new
+// connection gets everything - what the old one was written again, then
+// what was kept - and each sender's messages must be complete and in
+// order.
+func TestHubOrderSessionHandover(t *testing.T) {
+	const senders, perSender = 1000, 10
+	h := testHub(HubSettings{QueueDepth: senders * perSender, Overflow: OverflowDisconnect})
+	ss := SessionSettings{TTL: time.Minute, MaxMessages: senders * perSender, MaxBytes: 1 << 30}
+	old, _ := connect(t, h, newOfflineQueue(h, ss))
+	h.Subscribe(old.ID, "rooms/+")
+	token, _ := h.sessions.Resume("", "")
+
+	parked := make(chan struct{})
+	resumed := make(chan *HubConn)
+	var gotNew *received
+	go func() {
+		<-parked
+		_, ps := h.sessions.Resume(token, "")
+		if ps == nil {
+			t.Error("session not found")
+			close(resumed)
+			return
+		}
+		hc, got := connect(t, h, newOfflineQueue(h, ss))
+		gotNew = got
+		h.sessions.restore(context.Background(), ps, hc)
+		resumed <- hc
+	}()
+
+	var sent atomic.Int64
+	publishAll(senders, perSender, func(sender, seq int) {
+		if sent.Add(1) == senders*perSender/2 {
+			// Drop the connection halfway, like its read loop would
+			h.sessions.Park(token, old, ss.TTL)
+			close(parked)
+		}
+		if seq%2 == 0 {
+			h.Publish("rooms/lobby", message(sender, seq))
+		} else {
+			h.SendTo(old.ID, message(sender, seq))
+		}
+	})
+	if _, ok := <-resumed; !ok {
+		return
+	}
+
+	counts := checkOrder(t, "resumed conn", gotNew.waitFor(t, senders*perSender))
+	for s := range senders {
+		if counts[s] != perSender {
+			t.Fatalf("resumed conn got %d of sender %d's %d messages", counts[s], s, perSender)
+		}
+	}
+}
+
+// TestHubReplayWaitsForPush replays a session message while drop_oldest
+// is making room on a connection whose writer has stopped, so the queue
+// never drains: the replay must wait for the push instead of taking its
+// room, which would leave the push - and Unregister after it - blocked
+// forever.
+func TestHubReplayWaitsForPush(t *testing.T) {
+	h := testHub(HubSettings{QueueDepth: 1, Overflow: OverflowDropOldest})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // The writer exits right away, as after a failed write
+	hc := h.register(ctx, newConnID(), nil, "", "test", GeoInfo{}, nil)
+	<-hc.stopped
+	if err := hc.push(hc.outgoing(context.Background(), message(0, 0))); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	// Do what push does under drop_oldest, one step at a time
+	hc.pushMu.Lock()
+	<-hc.send // The oldest message makes room
+	replayed := make(chan error, 1)
+	go func() { replayed <- hc.replay(context.Background(), outgoing{data: message(1, 0)}) }()
+	time.Sleep(50 * time.Millisecond)
+	if len(hc.send) != 0 {
+		t.Fatal("replay took the room drop_oldest made for its message")
+	}
+	hc.send <- hc.outgoing(context.Background(), message(0, 1))
+	hc.pushMu.Unlock()
+
+	select {
+	case err := <-replayed:
+		if err != ErrUnknownConn {
+			t.Fatalf("replay on a full queue without a writer = %v, want ErrUnknownConn", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replay blocked on a full queue without a writer")
+	}
+	unregistered := make(chan struct{})
+	go func() {
+		h.Unregister(hc)
+		close(unregistered)
+	}()
+	select {
+	case <-unregistered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unregister blocked")
+	}
+}
+
+// BenchmarkHubFanOut publishes to random topics of a hub with 10k topics
+// and 100k subscribers, ten per topic, from parallel goroutines - the
+// measurement behind keeping a single hub lock instead of sharding the
+// topic maps. "churn" makes one in ten operations subscribe and
+// unsubscribe a connection, which takes the lock exclusively. Queues use
+// drop_oldest without a writer, so every delivery costs a queue operation
+// without the network. Compare lock contention with e.g.
+//
+//	go test -run '^$' -bench HubFanOut -cpu 1,4 -mutexprofile mutex.out ./Server
+func BenchmarkHubFanOut(b *testing.B) {
+	const topics, subscribers = 10_000, 100_000
+	h := testHub(HubSettings{QueueDepth: 4, Overflow: OverflowDropOldest})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // No writers: the queues stay full and drop their oldest message
+	names := make([]string, topics)
+	for i := range names {
+		names[i] = fmt.Sprintf("room/%d", i)
+	}
+	conns := make([]*HubConn, subscribers)
+	for i := range conns {
+		conns[i] = h.register(ctx, newConnID(), nil, "", "bench", GeoInfo{}, nil)
+		h.Subscribe(conns[i].ID, names[i%topics])
+	}
+	msg := []byte(`{"type":"message","payload":"benchmark"}`)
+
+	for _, churn := range []bool{false, true} {
+		name := "publish"
+		if churn {
+			name = "churn"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					topic := names[rand.IntN(topics)]
+					if churn && i%10 == 0 {
+						hc := conns[rand.IntN(subscribers)]
+						h.Subscribe(hc.ID, topic)
+						h.Unsubscribe(hc.ID, topic)
+						continue
+					}
+					h.Publish(topic, msg)
+				}
+			})
+		})
+	}
+}
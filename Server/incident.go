@@ -0,0 +1,433 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Incident states.
+const (
+	IncidentOpen         = "open"         // Outage detected, nobody has picked it up
+	IncidentAcknowledged = "acknowledged" // Someone is working on it
+	IncidentResolved     = "resolved"     // Recovered or closed by hand
+)
+
+// incidentSystem is the actor recorded for automatic timeline entries.
+const incidentSystem = "system"
+
+// IncidentSettings configures incident tracking.
+type IncidentSettings struct {
+	Retain    int    `yaml:"retain"`     // Resolved incidents kept; open ones are never dropped
+	StateFile string `yaml:"state_file"` // Where incidents are persisted across restarts (optional)
+}
+
+// IncidentEntry is one line of an incident's timeline.
+type IncidentEntry struct {
+	At   time.Time `json:"at"`
+	Type string    `json:"type"` // opened, acknowledged, note, resolved, recovered
+	By   string    `json:"by"`
+	Text string    `json:"text,omitempty"`
+}
+
+// Incident is one outage of a device or monitor, created from its offline
+// event and closed by the matching online event or by hand.
+type Incident struct {
+	ID             int64           `json:"id"`
+	Component      string          `json:"component"` // Device ID or monitor name
+	Kind           string          `json:"kind"`      // "device" or "monitor"
+	State          string          `json:"state"`
+	Started        time.Time       `json:"started"` // When the outage began (not when it was detected)
+	AcknowledgedAt *time.Time      `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy string          `json:"acknowledged_by,omitempty"`
+	ResolvedAt     *time.Time      `json:"resolved_at,omitempty"`
+	ResolvedBy     string          `json:"resolved_by,omitempty"`
+	Timeline       []IncidentEntry `json:"timeline"`
+}
+
+// Duration returns how long the incident lasted, or has lasted so far at now.
+func (inc Incident) Duration(now time.Time) time.Duration {
+	end := now
+	if inc.ResolvedAt != nil {
+		end = *inc.ResolvedAt
+	}
+	return end.Sub(inc.Started)
+}
+
+// TimeToAcknowledge returns how long the incident waited for someone to
+// pick it up, and false if it never was.
+func (inc Incident) TimeToAcknowledge() (time.Duration, bool) {
+	if inc.AcknowledgedAt == nil {
+		return 0, false
+	}
+	return inc.AcknowledgedAt.Sub(inc.Started), true
+}
+
+// incidentView adds the computed durations to an Incident for the API.
+type incidentView struct {
+	Incident
+	Duration          string `json:"duration"`
+	TimeToAcknowledge string `json:"time_to_acknowledge,omitempty"`
+}
+
+func newIncidentView(inc Incident, now time.Time) incidentView {
+	v := incidentView{Incident: inc, Duration: inc.Duration(now).Round(time.Second).String()}
+	if d, ok := inc.TimeToAcknowledge(); ok {
+		v.TimeToAcknowledge = d.Round(time.Second).String()
+	}
+	return v
+}
+
+var (
+	errUnknownIncident  = errors.New("unknown incident")
+	errIncidentResolved = errors.New("incident already resolved")
+)
+
+// IncidentStore keeps incidents and their timelines. Safe for concurrent use.
+type IncidentStore struct {
+	cfg       IncidentSettings
+	incidents []*Incident // Oldest first
+	nextID    int64
+	mu        sync.Mutex // Protects incidents and nextID
+}
+
+// incidentState is the persisted form of an IncidentStore.
+type incidentState struct {
+	NextID    int64       `json:"next_id"`
+	Incidents []*Incident `json:"incidents"`
+}
+
+// NewIncidentStore creates a store and loads persisted incidents if a
+// state file is configured. A missing state file is not an error.
+func NewIncidentStore(cfg IncidentSettings) (*IncidentStore, error) {
+	is := &IncidentStore{cfg: cfg, nextID: 1}
+	if cfg.StateFile == "" {
+		return is, nil
+	}
+
+	data, err := os.ReadFile(cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return is, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read incident state: %w", err)
+	}
+	var state incidentState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parse incident state %s: %w", cfg.StateFile, err)
+	}
+	is.incidents = state.Incidents
+	is.nextID = max(state.NextID, 1)
+	return is, nil
+}
+
+// Record applies a downtime event: "offline" opens an incident unless the
+// component already has an unresolved one, "online" resolves it.
+func (is *IncidentStore) Record(kind string, ev DowntimeEvent) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	current := is.unresolved(kind, ev.Device)
+	if ev.State == "online" {
+		if current == nil {
+			return // Closed by hand while the outage lasted
+		}
+		is.resolve(current, ev.At, incidentSystem, "recovered", "")
+		is.save()
+		return
+	}
+	if current != nil {
+		return // Same outage reported again
+	}
+
+	inc := &Incident{
+		ID:        is.nextID,
+		Component: ev.Device,
+		Kind:      kind,
+		State:     IncidentOpen,
+		Started:   ev.Since,
+		Timeline: []IncidentEntry{{
+			At:   ev.At,
+			Type: "opened",
+			By:   incidentSystem,
+			Text: fmt.Sprintf("%s %s went offline", kind, ev.Device),
+		}},
+	}
+	is.nextID++
+	is.incidents = append(is.incidents, inc)
+	is.prune()
+	is.save()
+	is.audit(inc, "opened", incidentSystem)
+}
+
+// Acknowledge marks an incident as being worked on, with an optional note.
+func (is *IncidentStore) Acknowledge(id int64, by, note string, now time.Time) (Incident, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	inc := is.find(id)
+	switch {
+	case inc == nil:
+		return Incident{}, errUnknownIncident
+	case inc.State == IncidentResolved:
+		return Incident{}, errIncidentResolved
+	}
+	if inc.AcknowledgedAt == nil {
+		inc.AcknowledgedAt = &now
+		inc.AcknowledgedBy = by
+	}
+	inc.State = IncidentAcknowledged
+	inc.Timeline = append(inc.Timeline, IncidentEntry{At: now, Type: "acknowledged", By: by, Text: note})
+	is.save()
+	is.audit(inc, "acknowledged", by)
+	return is.copy(inc), nil
+}
+
+// Resolve closes an incident by hand, e.g. when the outage was expected.
+// A later recovery of the component doesn't reopen it.
+func (is *IncidentStore) Resolve(id int64, by, note string, now time.Time) (Incident, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	inc := is.find(id)
+	switch {
+	case inc == nil:
+		return Incident{}, errUnknownIncident
+	case inc.State == IncidentResolved:
+		return Incident{}, errIncidentResolved
+	}
+	is.resolve(inc, now, by, "resolved", note)
+	is.save()
+	return is.copy(inc), nil
+}
+
+// AddNote appends a note to an incident's timeline. Resolved incidents
+// still take notes, for post-mortem findings.
+func (is *IncidentStore) AddNote(id int64, by, text string, now time.Time) (Incident, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	inc := is.find(id)
+	if inc == nil {
+		return Incident{}, errUnknownIncident
+	}
+	inc.Timeline = append(inc.Timeline, IncidentEntry{At: now, Type: "note", By: by, Text: text})
+	is.save()
+	return is.copy(inc), nil
+}
+
+// Get returns one incident.
+func (is *IncidentStore) Get(id int64) (Incident, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	inc := is.find(id)
+	if inc == nil {
+		return Incident{}, errUnknownIncident
+	}
+	return is.copy(inc), nil
+}
+
+// List returns incidents newest first, optionally only those in state.
+func (is *IncidentStore) List(state string) []Incident {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	out := make([]Incident, 0, len(is.incidents))
+	for i := len(is.incidents) - 1; i >= 0; i-- {
+		if inc := is.incidents[i]; state == "" || inc.State == state {
+			out = append(out, is.copy(inc))
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Started.After(out[j].Started) })
+	return out
+}
+
+// resolve closes inc. Callers hold is.mu.
+func (is *IncidentStore) resolve(inc *Incident, at time.Time, by, entryType, note string) {
+	inc.State = IncidentResolved
+	inc.ResolvedAt = &at
+	inc.ResolvedBy = by
+	text := note
+	if text == "" {
+		text = fmt.Sprintf("down for %s", inc.Duration(at).Round(time.Second))
+	}
+	inc.Timeline = append(inc.Timeline, IncidentEntry{At: at, Type: entryType, By: by, Text: text})
+	is.audit(inc, entryType, by)
+}
+
+// unresolved returns the component's open or acknowledged incident.
+// Callers hold is.mu.
+func (is *IncidentStore) unresolved(kind, component string) *Incident {
+	for i := len(is.incidents) - 1; i >= 0; i-- {
+		inc := is.incidents[i]
+		if inc.Kind == kind && inc.Component == component && inc.State != IncidentResolved {
+			return inc
+		}
+	}
+	return nil
+}
+
+// find returns the incident with id. Callers hold is.mu.
+func (is *IncidentStore) find(id int64) *Incident {
+	for _, inc := range is.incidents {
+		if inc.ID == id {
+			return inc
+		}
+	}
+	return nil
+}
+
+// copy returns a snapshot of inc that doesn't share the timeline.
+// Callers hold is.mu.
+func (is *IncidentStore) copy(inc *Incident) Incident {
+	out := *inc
+	out.Timeline = append([]IncidentEntry(nil), inc.Timeline...)
+	return out
+}
+
+// prune drops the oldest resolved incidents beyond Retain.
+// Callers hold is.mu.
+func (is *IncidentStore) prune() {
+	resolved := 0
+	for _, inc := range is.incidents {
+		if inc.State == IncidentResolved {
+			resolved++
+		}
+	}
+	if is.cfg.Retain <= 0 || resolved <= is.cfg.Retain {
+		return
+	}
+	drop := resolved - is.cfg.Retain
+	kept := is.incidents[:0]
+	for _, inc := range is.incidents {
+		if drop > 0 && inc.State == IncidentResolved {
+			drop--
+			continue
+		}
+		kept = append(kept, inc)
+	}
+	is.incidents = kept
+}
+
+// audit records an incident state change. Callers hold is.mu.
+func (is *IncidentStore) audit(inc *Incident, decision, by string) {
+	slog.Info("Incident "+decision, "id", inc.ID, "kind", inc.Kind, "component", inc.Component, "by", by)
+	auditLog.Record(AuditEvent{
+		Type:       "incident",
+		RemoteAddr: inc.Component,
+		Decision:   decision,
+		Reason:     fmt.Sprintf("incident #%d", inc.ID),
+		Fields:     map[string]string{"by": by, "kind": inc.Kind},
+	})
+}
+
+// save writes the incidents to the state file, replacing it atomically.
+// Callers hold is.mu.
+func (is *IncidentStore) save() {
+	if is.cfg.StateFile == "" {
+		return
+	}
+	data, err := json.Marshal(incidentState{NextID: is.nextID, Incidents: is.incidents})
+	if err != nil {
+		slog.Error("Failed to encode incident state", "error", err)
+		return
+	}
+	tmp := is.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		slog.Error("Failed to write incident state", "error", err)
+		return
+	}
+	if err := os.Rename(tmp, is.cfg.StateFile); err != nil {
+		slog.Error("Failed to replace incident state", "error", err)
+	}
+}
+
+// registerAdminRoutes mounts the incident admin API:
+//
+//	GET  /admin/incidents[?state=open]
+//	GET  /admin/incidents/{id}
+//	POST /admin/incidents/{id}/ack      {"by":"alice","note":"looking"}
+//	POST /admin/incidents/{id}/resolve  {"by":"alice","note":"planned"}
+//	POST /admin/incidents/{id}/notes    {"by":"alice","text":"..."}
+func (is *IncidentStore) registerAdminRoutes(mux *http.ServeMux, as AdminSettings) {
+	mux.Handle("GET /admin/incidents", requireAdmin(as, http.HandlerFunc(is.handleList)))
+	mux.Handle("GET /admin/incidents/{id}", requireAdmin(as, is.action(func(id int64, _ incidentAction) (Incident, error) {
+		return is.Get(id)
+	})))
+	mux.Handle("POST /admin/incidents/{id}/ack", requireAdmin(as, is.action(func(id int64, a incidentAction) (Incident, error) {
+		return is.Acknowledge(id, a.By, a.Note, time.Now())
+	})))
+	mux.Handle("POST /admin/incidents/{id}/resolve", requireAdmin(as, is.action(func(id int64, a incidentAction) (Incident, error) {
+		return is.Resolve(id, a.By, a.Note, time.Now())
+	})))
+	mux.Handle("POST /admin/incidents/{id}/notes", requireAdmin(as, is.action(func(id int64, a incidentAction) (Incident, error) {
+		if a.Text == "" {
+			return Incident{}, errors.New("note text must not be empty")
+		}
+		return is.AddNote(id, a.By, a.Text, time.Now())
+	})))
+}
+
+// incidentAction is the request body of the incident admin actions.
+type incidentAction struct {
+	By   string `json:"by"`   // Who acts - defaults to "admin"
+	Note string `json:"note"` // Optional note for ack/resolve
+	Text string `json:"text"` // Note text for /notes
+}
+
+// handleList serves the incident list.
+func (is *IncidentStore) handleList(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	incidents := is.List(r.URL.Query().Get("state"))
+	views := make([]incidentView, len(incidents))
+	for i, inc := range incidents {
+		views[i] = newIncidentView(inc, now)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+// action adapts an incident operation to an HTTP handler: it parses the
+// {id} path value and optional JSON body and maps errors to status codes.
+func (is *IncidentStore) action(op func(id int64, a incidentAction) (Incident, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			httpError(w, r, "invalid incident id", http.StatusBadRequest)
+			return
+		}
+		var a incidentAction
+		if r.Method == http.MethodPost && r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&a); err != nil {
+				httpError(w, r, "invalid JSON body", http.StatusBadRequest)
+				return
+			}
+		}
+		if a.By == "" {
+			a.By = "admin"
+		}
+
+		inc, err := op(id, a)
+		switch {
+		case errors.Is(err, errUnknownIncident):
+			httpError(w, r, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, errIncidentResolved):
+			httpError(w, r, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newIncidentView(inc, time.Now()))
+	})
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/coder/websocket"
+)
+
+// Standard JSON-RPC 2.0 error codes (https://www.jsonrpc.org/specification#error_object)
+const (
+	RPCParseError     = -32700 // Invalid JSON received
+	RPCInvalidRequest = -32600 // JSON is not a valid request object
+	RPCMethodNotFound = -32601 // Method does not exist
+	RPCInvalidParams  = -32602 // Invalid method parameters
+	RPCInternalError  = -32603 // Internal JSON-RPC error
+)
+
+// RPCError is a JSON-RPC 2.0 error object. Method handlers can return one
+// to control the code sent to the client; any other error becomes
+// RPCInternalError.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// Error implements the error interface.
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// RPCMethod handles one JSON-RPC method call. params is the raw "params"
+// member (nil if absent); the result is marshalled into the response.
+type RPCMethod func(ctx context.Context, params json.RawMessage) (any, error)
+
+// rpcRequest is an incoming request or notification.
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"` // Absent for notifications
+}
+
+// rpcResponse is an outgoing response.
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  any             `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcNotification is a server-initiated notification (no id, no reply expected).
+type rpcNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+// RPCRegistry maps method names to handlers. Safe for concurrent use,
+// so methods can be registered while connections are being served.
+type RPCRegistry struct {
+	methods map[string]RPCMethod
+	mu      sync.RWMutex
+}
+
+// NewRPCRegistry creates an empty method registry.
+func NewRPCRegistry() *RPCRegistry {
+	return &RPCRegistry{methods: make(map[string]RPCMethod)}
+}
+
+// Register adds or replaces a method handler.
+func (reg *RPCRegistry) Register(method string, fn RPCMethod) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.methods[method] = fn
+}
+
+// lookup returns the handler for method, if registered.
+func (reg *RPCRegistry) lookup(method string) (RPCMethod, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	fn, ok := reg.methods[method]
+	return fn, ok
+}
+
+// Handle processes one JSON-RPC payload (single request or batch) and
+// returns the encoded response, or nil if nothing must be sent back
+// (notifications only).
+func (reg *RPCRegistry) Handle(ctx context.Context, payload []byte) []byte {
+	payload = bytes.TrimSpace(payload)
+
+	// Batch request: array of request objects
+	if len(payload) > 0 && payload[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(payload, &batch); err != nil {
+			return encodeRPC(rpcErrorResponse(nil, RPCParseError, "parse error"))
+		}
+		if len(batch) == 0 {
+			return encodeRPC(rpcErrorResponse(nil, RPCInvalidRequest, "empty batch"))
+		}
+
+		var responses []rpcResponse
+		for _, raw := range batch {
+			if resp := reg.handleOne(ctx, raw); resp != nil {
+				responses = append(responses, *resp)
+			}
+		}
+		if len(responses) == 0 {
+			return nil // Batch of notifications - no response at all
+		}
+		return encodeRPC(responses)
+	}
+
+	resp := reg.handleOne(ctx, payload)
+	if resp == nil {
+		return nil
+	}
+	return encodeRPC(resp)
+}
+
+// handleOne processes a single request object. Returns nil for notifications.
+func (reg *RPCRegistry) handleOne(ctx context.Context, raw json.RawMessage) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		// Valid JSON that isn't an object is an invalid request, not a parse error
+		if json.Valid(raw) {
+			return rpcErrorResponse(nil, RPCInvalidRequest, "invalid request")
+		}
+		return rpcErrorResponse(nil, RPCParseError, "parse error")
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return rpcErrorResponse(req.ID, RPCInvalidRequest, "invalid request")
+	}
+
+	isNotification := len(req.ID) == 0
+	fn, ok := reg.lookup(req.Method)
+	if !ok {
+		if isNotification {
+			return nil // Errors on notifications are never reported
+		}
+		return rpcErrorResponse(req.ID, RPCMethodNotFound, "method not found")
+	}
+
+	result, err := fn(ctx, req.Params)
+	if isNotification {
+		return nil
+	}
+	if err != nil {
+		var rpcErr *RPCError
+		if errors.As(err, &rpcErr) {
+			return &rpcResponse{JSONRPC: "2.0", Error: rpcErr, ID: req.ID}
+		}
+		return rpcErrorResponse(req.ID, RPCInternalError, err.Error())
+	}
+	if result == nil {
+		result = json.RawMessage("null") // "result" is required on success
+	}
+	return &rpcResponse{JSONRPC: "2.0", Result: result, ID: req.ID}
+}
+
+// rpcErrorResponse builds an error response. A nil id is encoded as null.
+func rpcErrorResponse(id json.RawMessage, code int, msg string) *rpcResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{JSONRPC: "2.0", Error: &RPCError{Code: code, Message: msg}, ID: id}
+}
+
+// encodeRPC marshals a response value; encoding failures become an internal error.
+func encodeRPC(v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(rpcErrorResponse(nil, RPCInternalError, "response encoding failed"))
+	}
+	return data
+}
+
+// RPCNotify sends a server-initiated JSON-RPC notification to a client.
+func RPCNotify(ctx context.Context, conn *websocket.Conn, method string, params any) error {
+	data, err := json.Marshal(rpcNotification{JSONRPC: "2.0", Method: method, Params: params})
+	if err != nil {
+		return fmt.Errorf("encode notification: %w", err)
+	}
+	writeCtx, cancel := context.WithTimeout(ctx, ConfigFromContext(ctx).WriteTimeout)
+	defer cancel()
+	return conn.Write(writeCtx, websocket.MessageText, data)
+}
+
+// rpcMethods is the registry served on /rpc, pre-populated with built-in methods.
+var rpcMethods = newDefaultRPCRegistry()
+
+// newDefaultRPCRegistry registers the built-in methods:
+// "ping" -> "pong", "echo" -> params unchanged, "server.stats" -> connection
+// counts, plus the topic.* methods backed by the Hub.
+func newDefaultRPCRegistry() *RPCRegistry {
+	reg := NewRPCRegistry()
+	reg.Register("ping", func(ctx context.Context, params json.RawMessage) (any, error) {
+		return "pong", nil
+	})
+	reg.Register("echo", func(ctx context.Context, params json.RawMessage) (any, error) {
+		if params == nil {
+			return nil, &RPCError{Code: RPCInvalidParams, Message: "echo requires params"}
+		}
+		return params, nil
+	})
+	reg.Register("server.stats", func(ctx context.Context, params json.RawMessage) (any, error) {
+		s := serverFromContext(ctx)
+		return map[string]int64{
+			"active_connections": s.active.Load(),
+			"oversized_messages": s.metrics.OversizedMessages.Load(),
+			"hub_connections":    int64(s.hub.Count()),
+		}, nil
+	})
+	registerHubMethods(reg)
+	return reg
+}
+
+// RegisterRPCMethod adds a method to the /rpc endpoint.
+func RegisterRPCMethod(method string, fn RPCMethod) {
+	rpcMethods.Register(method, fn)
+}
+
+// rpcHandler serves the /rpc endpoint: the same connection handling as
+// /ws, but every message is answered as a JSON-RPC 2.0 request or batch.
+type rpcHandler struct {
+	BaseHandler
+}
+
+// OnMessage dispatches the request; notifications produce no reply.
+func (rpcHandler) OnMessage(ctx context.Context, hc *HubConn, msgType websocket.MessageType, msg []byte) ([]byte, error) {
+	return rpcMethods.Handle(ctx, msg), nil
+}
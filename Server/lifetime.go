@@ -0,0 +1,90 @@
+package server
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// LifetimeSettings bound how long a connection stays open, whatever its
+// heartbeat says: a maximum age, so clients reconnect with fresh
+// credentials and connections rebalance across instances, and a maximum
+// time without a message, for clients that only keep the socket alive.
+// Either closes the connection with CloseShutdown, which clients answer
+// by reconnecting.
+type LifetimeSettings struct {
+	MaxLifetime time.Duration `yaml:"max_lifetime"` // Max age of a connection; 0 = unlimited (env CONN_MAX_LIFETIME)
+	Jitter      float64       `yaml:"jitter"`       // Random spread of MaxLifetime (0.1 = ±10%), so connections opened together don't all close together
+	IdleTimeout time.Duration `yaml:"idle_timeout"` // Max time without a message from the client; heartbeats don't count. 0 = off (env CONN_IDLE_TIMEOUT)
+}
+
+// DefaultLifetimeSettings returns no limits, with ±10% jitter once a
+// lifetime is set.
+func DefaultLifetimeSettings() LifetimeSettings {
+	return LifetimeSettings{Jitter: 0.1}
+}
+
+// validate checks the settings.
+func (ls LifetimeSettings) validate() []ValidationError {
+	var errs []ValidationError
+	if ls.MaxLifetime < 0 {
+		errs = append(errs, ValidationError{"lifetime.max_lifetime", "must not be negative"})
+	}
+	if ls.Jitter < 0 || ls.Jitter >= 1 {
+		errs = append(errs, ValidationError{"lifetime.jitter", "must be at least 0 and below 1"})
+	}
+	if ls.IdleTimeout < 0 {
+		errs = append(errs, ValidationError{"lifetime.idle_timeout", "must not be negative"})
+	}
+	return errs
+}
+
+// lifetime returns the max age of one connection: MaxLifetime spread by
+// Jitter. 0 = unlimited.
+func (ls LifetimeSettings) lifetime() time.Duration {
+	if ls.MaxLifetime <= 0 || ls.Jitter <= 0 {
+		return ls.MaxLifetime
+	}
+	spread := 1 + ls.Jitter*(2*rand.Float64()-1)
+	return time.Duration(float64(ls.MaxLifetime) * spread)
+}
+
+// Close reasons of connections that reached a limit.
+const (
+	lifetimeReason = "connection lifetime exceeded"
+	idleReason     = "idle timeout"
+)
+
+// limitLifetime closes hc with CloseShutdown once it reaches its max age
+// or goes IdleTimeout without a message. It returns touch, which the read
+// loop calls for every message that counts as activity, and stop, which
+// cancels both limits when the connection ends.
+func limitLifetime(hc *HubConn, ls LifetimeSettings) (touch, stop func()) {
+	closeFor := func(reason DisconnectReason, text string, after time.Duration) func() {
+		return func() {
+			hc.logger.Info("Closing connection", "reason", reason, "after", after)
+			hc.closing(reason, text)
+			CloseWith(hc.conn, CloseShutdown, text)
+		}
+	}
+	var lifetime, idle *time.Timer
+	if d := ls.lifetime(); d > 0 {
+		lifetime = time.AfterFunc(d, closeFor(DisconnectLifetime, lifetimeReason, d))
+	}
+	if ls.IdleTimeout > 0 {
+		idle = time.AfterFunc(ls.IdleTimeout, closeFor(DisconnectIdle, idleReason, ls.IdleTimeout))
+	}
+	touch = func() {
+		if idle != nil {
+			idle.Reset(ls.IdleTimeout)
+		}
+	}
+	stop = func() {
+		if lifetime != nil {
+			lifetime.Stop()
+		}
+		if idle != nil {
+			idle.Stop()
+		}
+	}
+	return touch, stop
+}
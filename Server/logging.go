@@ -0,0 +1,26 @@
+package server
+
+import (
+	"os"
+
+	"github.com/deanbregenzer/cysl/internal/logging"
+)
+
+// LogSettings selects the log level (debug, info, warn, error) and output
+// format of the process logger. Per-message and per-ping lines are logged
+// at debug level.
+type LogSettings = logging.Settings
+
+// Log output formats.
+const (
+	LogFormatText = logging.FormatText // key=value lines (default)
+	LogFormatJSON = logging.FormatJSON // One JSON object per line, for log aggregation
+)
+
+// ConfigureLogging makes log/slog's default logger write to stderr as ls
+// selects. Every connection logs through it with conn_id and remote_addr
+// attributes (see LoggerFromContext). Start doesn't call it, so embedding
+// applications keep their own logger unless they opt in.
+func ConfigureLogging(ls LogSettings) error {
+	return logging.Setup(os.Stderr, ls)
+}
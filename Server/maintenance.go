@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// MaintenanceSettings configures planned maintenance windows.
+type MaintenanceSettings struct {
+	CheckInterval time.Duration       `yaml:"check_interval"` // How often window starts and ends are detected
+	Windows       []MaintenanceWindow `yaml:"windows"`
+}
+
+// MaintenanceWindow is planned work between Start and End. During the
+// window, outages of the covered devices and monitors don't alert, don't
+// open incidents and don't count against uptime, and connected clients are
+// told about it. A window without any selector covers everything.
+type MaintenanceWindow struct {
+	Name     string    `yaml:"name"`     // Shown in notices
+	Message  string    `yaml:"message"`  // Notice text sent to clients (optional)
+	Devices  []string  `yaml:"devices"`  // Device ID patterns
+	Tenants  []string  `yaml:"tenants"`  // Escalation tenants - covers their devices
+	Monitors []string  `yaml:"monitors"` // Monitor name patterns
+	Rooms    []string  `yaml:"rooms"`    // Chat room patterns - only receive the notice
+	Start    time.Time `yaml:"start"`    // RFC 3339
+	End      time.Time `yaml:"end"`      // RFC 3339
+}
+
+// activeAt reports whether now falls inside the window.
+func (w MaintenanceWindow) activeAt(now time.Time) bool {
+	return !now.Before(w.Start) && now.Before(w.End)
+}
+
+// global reports whether the window has no selectors.
+func (w MaintenanceWindow) global() bool {
+	return len(w.Devices)+len(w.Tenants)+len(w.Monitors)+len(w.Rooms) == 0
+}
+
+// MaintenanceNotice is broadcast to clients when a window starts or ends.
+type MaintenanceNotice struct {
+	Type    string    `json:"type"`  // Always "maintenance"
+	State   string    `json:"state"` // "started" or "ended"
+	Name    string    `json:"name,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+}
+
+// MaintenanceSchedule answers whether a component is under maintenance and
+// announces window starts and ends. Methods are nil-safe: a nil schedule
+// never covers anything.
+type MaintenanceSchedule struct {
+	cfg     MaintenanceSettings
+	tenants map[string][]string // Tenant -> device patterns, from escalation policies
+	active  map[int]bool        // Window index -> announced as started
+	mu      sync.Mutex          // Protects active
+	hub     *Hub                // Receives the maintenance notices (DefaultHub unless set)
+}
+
+// maintenanceSchedule is the schedule consulted by downtime detection,
+// monitors, uptime and escalation.
+var maintenanceSchedule *MaintenanceSchedule
+
+// NewMaintenanceSchedule creates a schedule. Tenant selectors resolve to
+// the device patterns of the escalation policies with that tenant name.
+func NewMaintenanceSchedule(cfg MaintenanceSettings, policies []EscalationPolicy) *MaintenanceSchedule {
+	tenants := make(map[string][]string)
+	for _, p := range policies {
+		tenants[p.Tenant] = append(tenants[p.Tenant], p.Devices...)
+	}
+	return &MaintenanceSchedule{cfg: cfg, tenants: tenants, active: make(map[int]bool), hub: hub}
+}
+
+// Covers reports whether a device, monitor or room (kind "device",
+// "monitor" or "room") is under maintenance at now.
+func (ms *MaintenanceSchedule) Covers(kind, id string, now time.Time) bool {
+	if ms == nil {
+		return false
+	}
+	for _, w := range ms.cfg.Windows {
+		if w.activeAt(now) && ms.selects(w, kind, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// selects reports whether the window's selectors include the component.
+func (ms *MaintenanceSchedule) selects(w MaintenanceWindow, kind, id string) bool {
+	if w.global() {
+		return true
+	}
+	switch kind {
+	case "device":
+		if len(w.Devices) > 0 && matchDevice(w.Devices, id) {
+			return true
+		}
+		for _, t := range w.Tenants {
+			if patterns, ok := ms.tenants[t]; ok && matchDevice(patterns, id) {
+				return true
+			}
+		}
+	case "monitor":
+		return len(w.Monitors) > 0 && matchDevice(w.Monitors, id)
+	case "room":
+		return len(w.Rooms) > 0 && matchDevice(w.Rooms, id)
+	}
+	return false
+}
+
+// Run announces window starts and ends every CheckInterval until ctx is cancelled.
+func (ms *MaintenanceSchedule) Run(ctx context.Context) {
+	ms.Check(time.Now())
+	ticker := time.NewTicker(ms.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ms.Check(time.Now())
+	}
+}
+
+// Check announces every window whose state changed since the last check.
+// A window that is already over when first seen is not announced.
+func (ms *MaintenanceSchedule) Check(now time.Time) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for i, w := range ms.cfg.Windows {
+		active := w.activeAt(now)
+		if active == ms.active[i] {
+			continue
+		}
+		ms.active[i] = active
+		state := "started"
+		if !active {
+			state = "ended"
+		}
+		ms.announce(w, state)
+	}
+}
+
+// announce audits a window transition and notifies clients: members of
+// the selected rooms, or every connection for device, tenant and global windows.
+func (ms *MaintenanceSchedule) announce(w MaintenanceWindow, state string) {
+	slog.Info("Maintenance "+state, "name", w.Name, "start", w.Start.Format(time.RFC3339), "end", w.End.Format(time.RFC3339))
+	auditLog.Record(AuditEvent{
+		Type:     "maintenance",
+		Decision: state,
+		Reason:   w.Name,
+		Fields:   map[string]string{"start": w.Start.Format(time.RFC3339), "end": w.End.Format(time.RFC3339)},
+	})
+
+	if len(w.Rooms) > 0 {
+		body := maintenanceText(w, state)
+		for _, rm := range chatRooms.Matching(w.Rooms) {
+			rm.Broadcast(ChatMessage{Type: ChatMessageSystem, Sender: "server", Room: rm.Name, Body: body, Timestamp: time.Now()})
+		}
+		if len(w.Devices)+len(w.Tenants)+len(w.Monitors) == 0 {
+			return // Room-only window
+		}
+	}
+
+	data, err := json.Marshal(MaintenanceNotice{
+		Type:    "maintenance",
+		State:   state,
+		Name:    w.Name,
+		Message: w.Message,
+		Start:   w.Start,
+		End:     w.End,
+	})
+	if err != nil {
+		return
+	}
+	ms.hub.Broadcast(data)
+}
+
+// roomNotice returns the notice for a room that is under maintenance, for
+// members joining mid-window.
+func (ms *MaintenanceSchedule) roomNotice(room string, now time.Time) (string, bool) {
+	if ms == nil {
+		return "", false
+	}
+	for _, w := range ms.cfg.Windows {
+		if w.activeAt(now) && len(w.Rooms) > 0 && matchDevice(w.Rooms, room) {
+			return maintenanceText(w, "started"), true
+		}
+	}
+	return "", false
+}
+
+// maintenanceText is the human-readable notice for a window transition.
+func maintenanceText(w MaintenanceWindow, state string) string {
+	if state == "ended" {
+		return fmt.Sprintf("Maintenance %s has ended.", w.Name)
+	}
+	if w.Message != "" {
+		return w.Message
+	}
+	return fmt.Sprintf("Maintenance %s in progress until %s.", w.Name, w.End.Format(time.RFC3339))
+}
+
+// maintenanceFromConfig creates the schedule when windows are configured.
+// Returns nil otherwise.
+func maintenanceFromConfig(ms MaintenanceSettings, policies []EscalationPolicy, h *Hub) *MaintenanceSchedule {
+	if len(ms.Windows) == 0 {
+		return nil
+	}
+	sched := NewMaintenanceSchedule(ms, policies)
+	sched.hub = h
+	return sched
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// MemorySettings caps the memory held by buffered messages: the hub's
+// per-connection send queues and the dead-letter queue. A broadcast storm
+// to many slow clients otherwise queues a copy for each of them until the
+// process runs out of memory.
+type MemorySettings struct {
+	Budget    int64   `yaml:"budget"`     // Bytes all buffers may hold together; 0 = unlimited (env MEMORY_BUDGET)
+	HighWater float64 `yaml:"high_water"` // Fraction of Budget above which buffers are evicted (env MEMORY_HIGH_WATER)
+}
+
+// DefaultMemorySettings sets no budget; once one is set, eviction starts
+// at 80% of it.
+func DefaultMemorySettings() MemorySettings {
+	return MemorySettings{HighWater: 0.8}
+}
+
+// validate checks the budget.
+func (ms MemorySettings) validate() []ValidationError {
+	var errs []ValidationError
+	if ms.Budget < 0 {
+		errs = append(errs, ValidationError{"memory.budget", "must not be negative"})
+	}
+	if ms.HighWater <= 0 || ms.HighWater > 1 {
+		errs = append(errs, ValidationError{"memory.high_water", "must be in (0, 1]"})
+	}
+	return errs
+}
+
+// ErrMemoryBudget is returned when a message can't be buffered because the
+// memory budget is used up.
+var ErrMemoryBudget = errors.New("memory budget exhausted - message dropped")
+
+// Evictor frees about need bytes from a store, least valuable data first,
+// releasing them from the budget. It returns how many bytes it freed.
+type Evictor func(need int64) int64
+
+// MemoryBudget accounts the bytes held by message buffers against a global
+// limit. Buffers Reserve before keeping a message and Release once it is
+// gone. Above the high-water mark, Reserve first asks the registered
+// evictors for room; past the limit it refuses. Methods are nil-safe: a
+// nil budget allows everything.
+type MemoryBudget struct {
+	limit    atomic.Int64 // 0 = unlimited
+	high     atomic.Int64 // Eviction threshold in bytes
+	used     atomic.Int64
+	peak     atomic.Int64
+	rejected atomic.Int64 // Reservations refused
+	evicted  atomic.Int64 // Bytes freed by evictors
+
+	evictors []Evictor  // Asked in registration order
+	mu       sync.Mutex // Protects evictors
+	evicting sync.Mutex // One eviction run at a time
+}
+
+// NewMemoryBudget creates a budget with settings.
+func NewMemoryBudget(settings MemorySettings) *MemoryBudget {
+	mb := &MemoryBudget{}
+	mb.configure(settings)
+	return mb
+}
+
+// configure changes the limit. Buffers already over a lowered limit are
+// evicted as new messages arrive.
+func (mb *MemoryBudget) configure(settings MemorySettings) {
+	mb.limit.Store(settings.Budget)
+	mb.high.Store(int64(float64(settings.Budget) * settings.HighWater))
+}
+
+// AddEvictor registers a store that gives up memory under pressure.
+// Stores registered first are evicted first.
+func (mb *MemoryBudget) AddEvictor(e Evictor) {
+	if mb == nil {
+		return
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.evictors = append(mb.evictors, e)
+}
+
+// Reserve accounts n bytes. It returns false, reserving nothing, if they
+// don't fit even after eviction. Callers must not hold locks an evictor
+// takes.
+func (mb *MemoryBudget) Reserve(n int64) bool {
+	if mb == nil {
+		return true
+	}
+	used := mb.used.Add(n)
+	if limit := mb.limit.Load(); limit > 0 {
+		if high := mb.high.Load(); used > high {
+			mb.evict(used - high)
+			used = mb.used.Load()
+		}
+		if used > limit {
+			mb.used.Add(-n)
+			mb.rejected.Add(1)
+			return false
+		}
+	}
+	for peak := mb.peak.Load(); used > peak && !mb.peak.CompareAndSwap(peak, used); peak = mb.peak.Load() {
+	}
+	return true
+}
+
+// Release returns n reserved bytes.
+func (mb *MemoryBudget) Release(n int64) {
+	if mb == nil {
+		return
+	}
+	mb.used.Add(-n)
+}
+
+// evict asks the evictors for need bytes. Concurrent callers don't wait
+// for a run in progress - it frees room for them too.
+func (mb *MemoryBudget) evict(need int64) {
+	if !mb.evicting.TryLock() {
+		return
+	}
+	defer mb.evicting.Unlock()
+	mb.mu.Lock()
+	evictors := append([]Evictor(nil), mb.evictors...)
+	mb.mu.Unlock()
+
+	var freed int64
+	for _, e := range evictors {
+		if freed >= need {
+			break
+		}
+		freed += e(need - freed)
+	}
+	mb.evicted.Add(freed)
+}
+
+// MemoryStats is a snapshot of a MemoryBudget.
+type MemoryStats struct {
+	Limit    int64   `json:"limit"`    // Budget in bytes (0 = unlimited)
+	Used     int64   `json:"used"`     // Bytes currently reserved
+	Peak     int64   `json:"peak"`     // Highest Used seen
+	Pressure float64 `json:"pressure"` // Used/Limit (0 without a limit)
+	Rejected int64   `json:"rejected"` // Messages refused for lack of budget
+	Evicted  int64   `json:"evicted"`  // Bytes freed by eviction
+}
+
+// Stats returns the budget's current state.
+func (mb *MemoryBudget) Stats() MemoryStats {
+	if mb == nil {
+		return MemoryStats{}
+	}
+	st := MemoryStats{
+		Limit:    mb.limit.Load(),
+		Used:     mb.used.Load(),
+		Peak:     mb.peak.Load(),
+		Rejected: mb.rejected.Load(),
+		Evicted:  mb.evicted.Load(),
+	}
+	if st.Limit > 0 {
+		st.Pressure = float64(st.Used) / float64(st.Limit)
+	}
+	return st
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServerMetrics counts connection and message events across all connections.
+type ServerMetrics struct {
+	ConnectionsTotal     atomic.Int64 // Accepted WebSocket connections since start
+	MessagesReceived     atomic.Int64 // Messages read from clients
+	MessagesSent         atomic.Int64 // Replies written to clients
+	RateLimitViolations  atomic.Int64 // Messages that arrived faster than a message rate limit allows
+	RateLimitDisconnects atomic.Int64 // Connections closed for exceeding a message rate limit
+	OversizedMessages    atomic.Int64 // Messages rejected for exceeding the read limit
+	HandlerPanics        atomic.Int64 // Connections ended by a panic in a handler or middleware
+
+	// HealthChanges counts the transitions into each health state
+	HealthChanges map[ConnHealth]*atomic.Int64
+
+	// Limiters holds the counters of every rate limiter, exported per
+	// limiter so operators can tell which one is throttling clients
+	Limiters map[string]*RateLimiterStats
+
+	types *messageTypes // Handler outcomes per message type
+}
+
+// NewServerMetrics creates zeroed counters for every limiter.
+func NewServerMetrics() *ServerMetrics {
+	return &ServerMetrics{
+		Limiters: map[string]*RateLimiterStats{
+			LimiterMessageRate:       {},
+			LimiterConnectionsPerIP:  {},
+			LimiterIPMessageRate:     {},
+			LimiterGlobalMessageRate: {},
+		},
+		HealthChanges: map[ConnHealth]*atomic.Int64{
+			HealthHealthy:  {},
+			HealthDegraded: {},
+			HealthUnstable: {},
+			HealthLost:     {},
+		},
+		types: newMessageTypes(),
+	}
+}
+
+// latencyBuckets are the upper bounds (seconds) of the ping latency histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Histogram is a fixed-bucket histogram safe for concurrent use.
+type Histogram struct {
+	bounds []float64      // Upper bounds in seconds, ascending
+	counts []atomic.Int64 // Observations per bucket (not cumulative); last is +Inf
+	sumNs  atomic.Int64   // Sum of observations in nanoseconds
+	count  atomic.Int64
+}
+
+// NewHistogram creates a histogram with the given ascending upper bounds.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+}
+
+// Observe records one duration.
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.bounds, d.Seconds()) // First bound >= d
+	h.counts[i].Add(1)
+	h.sumNs.Add(int64(d))
+	h.count.Add(1)
+}
+
+// HeartbeatStats aggregates HeartbeatMetrics of all heartbeat loops: live
+// connections are summed on every scrape, closed ones are folded into the
+// retired totals so counters never go backwards.
+type HeartbeatStats struct {
+	Latency *Histogram // Ping round-trip times
+
+	live    map[*HeartbeatMetrics]struct{}
+	retired HeartbeatMetrics // Totals of finished heartbeat loops (counters only)
+	mu      sync.Mutex       // Protects live and folding into retired
+}
+
+// heartbeatStats is the process-wide HeartbeatStats instance fed by EnhancedHeartbeat.
+var heartbeatStats = NewHeartbeatStats()
+
+// NewHeartbeatStats creates an empty aggregator.
+func NewHeartbeatStats() *HeartbeatStats {
+	return &HeartbeatStats{
+		Latency: NewHistogram(latencyBuckets),
+		live:    make(map[*HeartbeatMetrics]struct{}),
+	}
+}
+
+// track adds a running heartbeat loop's metrics.
+func (hs *HeartbeatStats) track(m *HeartbeatMetrics) {
+	hs.mu.Lock()
+	hs.live[m] = struct{}{}
+	hs.mu.Unlock()
+}
+
+// retire folds a finished loop's counts into the totals.
+func (hs *HeartbeatStats) retire(m *HeartbeatMetrics) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	delete(hs.live, m)
+	hs.retired.PingsSent.Add(m.PingsSent.Load())
+	hs.retired.PongsReceived.Add(m.PongsReceived.Load())
+	hs.retired.FailedPings.Add(m.FailedPings.Load())
+}
+
+// totals returns pings sent, pongs received and failed pings so far.
+func (hs *HeartbeatStats) totals() (sent, received, failed int64) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	sent, received, failed = hs.retired.PingsSent.Load(), hs.retired.PongsReceived.Load(), hs.retired.FailedPings.Load()
+	for m := range hs.live {
+		sent += m.PingsSent.Load()
+		received += m.PongsReceived.Load()
+		failed += m.FailedPings.Load()
+	}
+	return sent, received, failed
+}
+
+// MetricsWriter renders metric families in the Prometheus text exposition format.
+type MetricsWriter struct {
+	buf bytes.Buffer
+}
+
+// header writes the HELP and TYPE lines of a family.
+func (mw *MetricsWriter) header(name, help, typ string) {
+	fmt.Fprintf(&mw.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labelEscaper escapes label values as the text format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sample writes one sample line; labels are name/value pairs.
+func (mw *MetricsWriter) sample(name string, value float64, labels ...string) {
+	mw.buf.WriteString(name)
+	if len(labels) > 0 {
+		mw.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&mw.buf, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		mw.buf.WriteByte('}')
+	}
+	mw.buf.WriteByte(' ')
+	mw.buf.WriteString(formatMetricValue(value))
+	mw.buf.WriteByte('\n')
+}
+
+// Counter writes a single-sample counter family.
+func (mw *MetricsWriter) Counter(name, help string, value float64) {
+	mw.header(name, help, "counter")
+	mw.sample(name, value)
+}
+
+// Gauge writes a single-sample gauge family.
+func (mw *MetricsWriter) Gauge(name, help string, value float64) {
+	mw.header(name, help, "gauge")
+	mw.sample(name, value)
+}
+
+// GaugeVec writes a gauge family with one sample per label value.
+// Samples are sorted so scrapes are stable.
+func (mw *MetricsWriter) GaugeVec(name, help, label string, values map[string]float64) {
+	mw.header(name, help, "gauge")
+	mw.vec(name, label, values)
+}
+
+// CounterVec writes a counter family with one sample per label value.
+func (mw *MetricsWriter) CounterVec(name, help, label string, values map[string]float64) {
+	mw.header(name, help, "counter")
+	mw.vec(name, label, values)
+}
+
+// vec writes one sample per label value, sorted by label value.
+func (mw *MetricsWriter) vec(name, label string, values map[string]float64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		mw.sample(name, values[k], label, k)
+	}
+}
+
+// Histogram writes a histogram family with cumulative buckets.
+func (mw *MetricsWriter) Histogram(name, help string, h *Histogram) {
+	mw.header(name, help, "histogram")
+	mw.histogram(name, h)
+}
+
+// HistogramVec writes a histogram family with one histogram per label
+// value, sorted by label value.
+func (mw *MetricsWriter) HistogramVec(name, help, label string, hs map[string]*Histogram) {
+	mw.header(name, help, "histogram")
+	keys := make([]string, 0, len(hs))
+	for k := range hs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		mw.histogram(name, hs[k], label, k)
+	}
+}
+
+// histogram writes the samples of h; labels are name/value pairs.
+func (mw *MetricsWriter) histogram(name string, h *Histogram, labels ...string) {
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		mw.sample(name+"_bucket", float64(cumulative), append(labels, "le", formatMetricValue(bound))...)
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	mw.sample(name+"_bucket", float64(cumulative), append(labels, "le", "+Inf")...)
+	mw.sample(name+"_sum", time.Duration(h.sumNs.Load()).Seconds(), labels...)
+	mw.sample(name+"_count", float64(h.count.Load()), labels...)
+}
+
+// formatMetricValue formats a sample value the way Prometheus expects.
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// MetricsCollector contributes metric families to each /metrics scrape.
+type MetricsCollector func(mw *MetricsWriter)
+
+// metricsCollectors are called in registration order on every scrape.
+var (
+	metricsCollectors   = []MetricsCollector{collectHeartbeatMetrics}
+	metricsCollectorsMu sync.Mutex
+)
+
+// RegisterMetricsCollector adds a collector to the /metrics endpoint, e.g.
+// for application metrics next to the built-in ones.
+func RegisterMetricsCollector(c MetricsCollector) {
+	metricsCollectorsMu.Lock()
+	metricsCollectors = append(metricsCollectors, c)
+	metricsCollectorsMu.Unlock()
+}
+
+// collectMetrics exports the server's connection, message and rate limit
+// counters.
+func (s *Server) collectMetrics(mw *MetricsWriter) {
+	m := s.metrics
+	mw.Gauge("cysl_active_connections", "Open WebSocket connections.", float64(s.active.Load()))
+
+	// Per-IP counts stay in /admin/stats: as labels they would grow with
+	// every client and tell anyone scraping who is connected
+	perIP := s.conns.Snapshot()
+	busiest := 0
+	for _, n := range perIP {
+		busiest = max(busiest, n)
+	}
+	mw.Gauge("cysl_client_ips", "Client IPs with open WebSocket connections.", float64(len(perIP)))
+	mw.Gauge("cysl_connections_per_ip_max", "Open WebSocket connections of the busiest client IP.", float64(busiest))
+
+	if s.geoResolver != nil {
+		countries := make(map[string]float64)
+		for c, n := range s.geoStats.Countries() {
+			countries[c] = float64(n)
+		}
+		mw.GaugeVec("cysl_connections_by_country", "Open WebSocket connections by GeoIP country.", "country", countries)
+		asns := make(map[string]float64)
+		for asn, n := range s.geoStats.ASNs() {
+			asns[fmt.Sprintf("%d", asn)] = float64(n)
+		}
+		mw.GaugeVec("cysl_connections_by_asn", "Open WebSocket connections by GeoIP autonomous system number.", "asn", asns)
+	}
+
+	mw.Counter("cysl_connections_total", "WebSocket connections accepted.", float64(m.ConnectionsTotal.Load()))
+	mw.Counter("cysl_messages_received_total", "Messages received from clients.", float64(m.MessagesReceived.Load()))
+	mw.Counter("cysl_messages_sent_total", "Replies sent to clients.", float64(m.MessagesSent.Load()))
+	mw.Counter("cysl_oversized_messages_total", "Messages rejected for exceeding the size limit.", float64(m.OversizedMessages.Load()))
+	mw.Counter("cysl_rate_limit_violations_total", "Messages that arrived faster than the allowed interval.", float64(m.RateLimitViolations.Load()))
+	mw.Counter("cysl_rate_limit_disconnects_total", "Connections closed for repeated rate limit violations.", float64(m.RateLimitDisconnects.Load()))
+	mw.Counter("cysl_handler_panics_total", "Connections closed after a handler or middleware panicked.", float64(m.HandlerPanics.Load()))
+	types := m.types.snapshot()
+	received := make(map[string]float64, len(types))
+	succeeded := make(map[string]float64, len(types))
+	failed := make(map[string]float64, len(types))
+	latency := make(map[string]*Histogram, len(types))
+	for typ, st := range types {
+		received[typ] = float64(st.Received.Load())
+		succeeded[typ] = float64(st.Succeeded.Load())
+		failed[typ] = float64(st.Failed.Load())
+		latency[typ] = st.Latency
+	}
+	mw.CounterVec("cysl_handler_messages_total", "Messages handed to the handler, by message type.", "type", received)
+	mw.CounterVec("cysl_handler_succeeded_total", "Messages the handler processed, by message type.", "type", succeeded)
+	mw.CounterVec("cysl_handler_failed_total", "Messages the handler failed on, returned an error for or answered with an error message, by message type.", "type", failed)
+	mw.HistogramVec("cysl_handler_duration_seconds", "Time the handler took per message, by message type.", "type", latency)
+	mw.Counter("cysl_connections_superseded_total", "Connections closed because a newer one from the same user and device took over.", float64(s.devices.superseded.Load()))
+
+	violations := make(map[string]float64, len(m.Limiters))
+	rejections := make(map[string]float64, len(m.Limiters))
+	for name, st := range m.Limiters {
+		violations[name] = float64(st.Violations.Load())
+		rejections[name] = float64(st.Rejections.Load())
+	}
+	mw.CounterVec("cysl_rate_limiter_violations_total", "Requests over a rate limit, by limiter.", "limiter", violations)
+	mw.CounterVec("cysl_rate_limiter_rejections_total", "Connections refused or closed by a rate limit, by limiter.", "limiter", rejections)
+	mw.Counter("cysl_access_denied_total", "Connections refused by the IP allow and deny lists.", float64(s.access.Denied()))
+	mw.Counter("cysl_half_open_closed_total", "Half-open connections closed by the sweeper.", float64(s.sweeper.Closed()))
+	mw.Gauge("cysl_connection_states", "Per-connection rate limit states tracked.", float64(s.states.Len()))
+	mw.Counter("cysl_connection_states_expired_total", "Connection states dropped by the janitor because their cleanup never ran.", float64(s.states.Expired()))
+	mw.Gauge("cysl_hub_connections", "Connections registered with the hub.", float64(s.hub.Count()))
+	mw.Counter("cysl_hub_dropped_messages_total", "Outgoing messages dropped because a send queue was full or memory ran short.", float64(s.hub.Dropped()))
+	mw.Counter("cysl_hub_expired_messages_total", "Outgoing messages dropped because their deadline passed before they were written.", float64(s.hub.Expired()))
+	mw.Counter("cysl_hub_write_retries_total", "Outgoing message writes retried after timing out on a live connection.", float64(s.hub.WriteRetries()))
+	mw.Counter("cysl_hub_slow_consumers_total", "Connections detected lagging behind their send queue.", float64(s.hub.SlowConsumers()))
+	sessions := s.hub.Sessions()
+	mw.Gauge("cysl_sessions_parked", "Sessions of dropped connections waiting to be resumed.", float64(sessions.Parked()))
+	mw.Counter("cysl_sessions_resumed_total", "Sessions restored on a new connection.", float64(sessions.Resumed()))
+	mw.Counter("cysl_sessions_expired_total", "Sessions dropped because nobody resumed them within their TTL.", float64(sessions.Expired()))
+	mw.Counter("cysl_sessions_buffered_total", "Messages kept for dropped connections while their sessions waited.", float64(sessions.Buffered()))
+	mw.Counter("cysl_sessions_replayed_total", "Kept messages queued on resumed connections.", float64(sessions.Replayed()))
+	if relay := s.hub.Cluster(); relay != nil {
+		cluster := relay.Stats()
+		mw.Gauge("cysl_cluster_instances", "Server instances that reported to the cluster recently.", float64(cluster.Instances))
+		mw.Gauge("cysl_cluster_connections", "Hub connections of all instances of the cluster.", float64(cluster.Connections))
+		mw.Counter("cysl_cluster_published_total", "Broadcasts and topic messages relayed to the other instances.", float64(relay.Published()))
+		mw.Counter("cysl_cluster_received_total", "Broadcasts and topic messages from other instances delivered here.", float64(relay.Received()))
+		mw.Counter("cysl_cluster_errors_total", "Failed Redis commands and lost cluster subscriptions.", float64(relay.Errors()))
+	}
+	s.certs.Load().collectMetrics(mw)
+	mem := s.hub.Memory().Stats()
+	mw.Gauge("cysl_memory_budget_bytes", "Memory budget for queued and stored messages (0 = unlimited).", float64(mem.Limit))
+	mw.Gauge("cysl_memory_used_bytes", "Bytes of queued and stored messages.", float64(mem.Used))
+	mw.Gauge("cysl_memory_peak_bytes", "Highest cysl_memory_used_bytes seen.", float64(mem.Peak))
+	mw.Gauge("cysl_memory_pressure", "Used share of the memory budget (0 without a budget).", mem.Pressure)
+	mw.Counter("cysl_memory_evicted_bytes_total", "Bytes of messages evicted under memory pressure.", float64(mem.Evicted))
+	mw.Counter("cysl_memory_rejected_total", "Messages refused because the memory budget was used up.", float64(mem.Rejected))
+
+	health := make(map[string]float64)
+	for state, n := range s.hub.HealthCounts() {
+		health[state.String()] = float64(n)
+	}
+	mw.GaugeVec("cysl_connection_health", "Connections by derived heartbeat health state.", "state", health)
+	changes := map[string]float64{}
+	for state, n := range s.metrics.HealthChanges {
+		changes[state.String()] = float64(n.Load())
+	}
+	mw.CounterVec("cysl_connection_health_changes_total", "Connection health transitions, by the state entered.", "state", changes)
+
+	if s.moderation != nil {
+		mm := s.moderation.Metrics()
+		mw.Counter("cysl_moderation_checked_total", "Messages submitted to the moderator.", float64(mm.Checked.Load()))
+		mw.Counter("cysl_moderation_approved_total", "Messages approved by moderation, including fail-open fallbacks.", float64(mm.Approved.Load()))
+		mw.Counter("cysl_moderation_rejected_total", "Messages rejected by moderation.", float64(mm.Rejected.Load()))
+		mw.Counter("cysl_moderation_errors_total", "Moderator calls that failed or timed out.", float64(mm.Errors.Load()))
+		mw.Histogram("cysl_moderation_latency_seconds", "Moderator call latency.", mm.Latencies)
+	}
+}
+
+// collectHeartbeatMetrics exports the aggregated heartbeat counters and
+// the ping latency histogram.
+func collectHeartbeatMetrics(mw *MetricsWriter) {
+	sent, received, failed := heartbeatStats.totals()
+	mw.Counter("cysl_heartbeat_pings_sent_total", "Heartbeat pings sent.", float64(sent))
+	mw.Counter("cysl_heartbeat_pongs_received_total", "Heartbeat pongs received.", float64(received))
+	mw.Counter("cysl_heartbeat_pings_failed_total", "Heartbeat pings that failed or timed out.", float64(failed))
+	mw.Histogram("cysl_heartbeat_latency_seconds", "Heartbeat ping round-trip time.", heartbeatStats.Latency)
+}
+
+// metricsHandler serves /metrics, behind the admin token when the admin
+// API is enabled - the metrics describe the server's load and clients.
+func (s *Server) metricsHandler() http.Handler {
+	h := http.Handler(http.HandlerFunc(s.handleMetrics))
+	if as := s.Config().Admin; as.Enabled() {
+		h = requireAdmin(as, h)
+	}
+	return h
+}
+
+// handleMetrics serves the server's metrics and all collectors in the
+// Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsCollectorsMu.Lock()
+	collectors := append([]MetricsCollector{s.collectMetrics}, metricsCollectors...)
+	metricsCollectorsMu.Unlock()
+
+	var mw MetricsWriter
+	for _, collect := range collectors {
+		collect(&mw)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(mw.buf.Bytes())
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ConnHandler serves one accepted WebSocket connection until it ends and
+// returns why. The server's own ConnHandler runs the Handler's OnConnect,
+// the heartbeat and the read loop, and returns a *DisconnectError.
+type ConnHandler func(ctx context.Context, hc *HubConn) error
+
+// Middleware wraps the serving of every connection, so cross-cutting
+// concerns - authorization, limits, logging, metrics, recovery - can be
+// composed instead of being built into the handlers. The server's own
+// checks - access lists, origin, authentication, the per-IP and geo
+// limits - are middleware, too, installed ahead of the upgrade. The
+// application's middleware runs after it, once the connection has joined
+// the hub:
+//
+//	func logConns(next server.ConnHandler) server.ConnHandler {
+//		return func(ctx context.Context, hc *server.HubConn) error {
+//			start := time.Now()
+//			err := next(ctx, hc)
+//			slog.Info("Connection served", "conn_id", hc.ID, "for", time.Since(start), "error", err)
+//			return err
+//		}
+//	}
+//
+// It refuses a connection by returning an error without calling next; the
+// connection is closed like after a failed OnConnect (ClosePolicyViolation,
+// or the code of a CloseError). Returning nil without calling next ends it
+// normally. Values it adds to ctx reach OnConnect and OnMessage. next must
+// be called at most once, on the middleware's goroutine, and its error
+// should be returned.
+type Middleware func(next ConnHandler) ConnHandler
+
+// Chain composes mw into one middleware. The first is the outermost: it
+// sees the connection first and its end last.
+func Chain(mw ...Middleware) Middleware {
+	return func(next ConnHandler) ConnHandler {
+		for i := len(mw) - 1; i >= 0; i-- {
+			next = mw[i](next)
+		}
+		return next
+	}
+}
+
+// WithMiddleware wraps the serving of each of the server's connections,
+// on every endpoint, in mw. Like WithStateChange, each option adds to the
+// chain; the first middleware given is the outermost.
+func WithMiddleware(mw ...Middleware) Option {
+	return func(o *serverOptions) { o.middleware = append(o.middleware, mw...) }
+}
+
+// connChain returns the middleware chain every connection of the server
+// runs through. The server's own checks come first, in the order they
+// must be made: the access lists, the origin, authentication, the per-IP
+// connection limit and the geo policy each answer a refused request with
+// an HTTP status before any work is done for it. upgrade then accepts the
+// connection and joins it to the hub, and the panic recovery and the
+// application's middleware (WithMiddleware) wrap what follows.
+func (s *Server) connChain(wc *wsConn) Middleware {
+	builtin := []Middleware{wc.checkAccess, wc.checkOrigin, wc.checkAuth, wc.limitConns, wc.admitGeo, wc.upgrade, s.recoverPanics}
+	return Chain(append(builtin, s.opts.middleware...)...)
+}
+
+// errRefused is returned by the built-in checks that refused a request;
+// they have answered it already.
+var errRefused = errors.New("connection refused")
+
+// checkAccess refuses addresses the access lists exclude before doing any
+// work for them.
+func (wc *wsConn) checkAccess(next ConnHandler) ConnHandler {
+	return func(ctx context.Context, hc *HubConn) error {
+		ok, reason := wc.s.access.Check(wc.clientIP)
+		if ok {
+			return next(ctx, hc)
+		}
+		http.Error(wc.w, "Forbidden", http.StatusForbidden)
+		hc.logger.Warn("Connection refused by access list", "reason", reason)
+		auditLog.Record(AuditEvent{
+			Type:       "access",
+			RemoteAddr: hc.RemoteAddr,
+			Decision:   "deny",
+			Reason:     reason,
+			Fields: map[string]string{
+				"country": hc.Geo.Country,
+				"asn":     fmt.Sprintf("%d", hc.Geo.ASN),
+			},
+		})
+		return errRefused
+	}
+}
+
+// checkOrigin runs a custom origin check before any work, too; origin
+// patterns are matched by the upgrade.
+func (wc *wsConn) checkOrigin(next ConnHandler) ConnHandler {
+	return func(ctx context.Context, hc *HubConn) error {
+		if wc.settings.Origins.allowed(wc.r) {
+			return next(ctx, hc)
+		}
+		http.Error(wc.w, "Forbidden", http.StatusForbidden)
+		hc.logger.Warn("Connection refused by origin check", "origin", wc.r.Header.Get("Origin"))
+		auditLog.Record(AuditEvent{
+			Type:       "origin",
+			RemoteAddr: hc.RemoteAddr,
+			Decision:   "deny",
+			Reason:     wc.r.Header.Get("Origin"),
+		})
+		return errRefused
+	}
+}
+
+// checkAuth authenticates the request before it can occupy any connection
+// slot; the identity travels on in ctx (see UserFromContext).
+func (wc *wsConn) checkAuth(next ConnHandler) ConnHandler {
+	return func(ctx context.Context, hc *HubConn) error {
+		if wc.s.authenticate == nil {
+			return next(ctx, hc) // Anonymous connections
+		}
+		user, err := wc.s.authenticate(wc.r)
+		if err == nil {
+			return next(withUser(ctx, user), hc)
+		}
+		wc.w.Header().Set("WWW-Authenticate", `Bearer realm="cysl"`)
+		http.Error(wc.w, "Unauthorized", http.StatusUnauthorized)
+		hc.logger.Warn("Authentication failed", "error", err)
+		auditLog.Record(AuditEvent{
+			Type:       "auth",
+			RemoteAddr: hc.RemoteAddr,
+			Decision:   "deny",
+			Reason:     err.Error(),
+			Fields: map[string]string{
+				"country": hc.Geo.Country,
+				"asn":     fmt.Sprintf("%d", hc.Geo.ASN),
+			},
+		})
+		return errRefused
+	}
+}
+
+// limitConns checks the connection limit of the client's IP address, so a
+// single IP can't exhaust the server's resources, and holds a slot until
+// the connection ended.
+func (wc *wsConn) limitConns(next ConnHandler) ConnHandler {
+	return func(ctx context.Context, hc *HubConn) error {
+		s, settings := wc.s, wc.settings
+		if !s.conns.CheckLimit(wc.clientIP) {
+			stats := s.metrics.Limiters[LimiterConnectionsPerIP]
+			stats.Violations.Add(1)
+			stats.Rejections.Add(1)
+			// Tell well-behaved clients when to come back instead of hammering
+			// us, and which limit they hit
+			wc.w.Header().Set("Retry-After", fmt.Sprintf("%d", int(settings.RetryAfterConnLimit.Seconds())))
+			wc.w.Header().Set("X-RateLimit-Limiter", LimiterConnectionsPerIP)
+			wc.w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", settings.MaxConnectionsPerIP))
+			http.Error(wc.w, "Too many connections from your IP", http.StatusTooManyRequests)
+			hc.logger.Warn("Connection limit exceeded", "limit", settings.MaxConnectionsPerIP)
+			auditLog.Record(AuditEvent{
+				Type:       "connection_limit",
+				RemoteAddr: hc.RemoteAddr,
+				Decision:   "deny",
+				Reason:     fmt.Sprintf("per-IP limit (%d) reached", settings.MaxConnectionsPerIP),
+				Fields: map[string]string{
+					"country": hc.Geo.Country,
+					"asn":     fmt.Sprintf("%d", hc.Geo.ASN),
+				},
+			})
+			return errRefused
+		}
+		defer s.conns.Release(wc.clientIP) // Always release the connection slot
+		s.limiter.acquire(wc.clientIP)     // The IP's connections share one message bucket
+		defer s.limiter.release(wc.clientIP)
+		return next(ctx, hc)
+	}
+}
+
+// admitGeo evaluates the country/ASN policy before resources are spent on
+// the upgrade, and dry-runs the shadow policy, auditing where it
+// disagrees. Both decisions' message intervals apply to the connection.
+func (wc *wsConn) admitGeo(next ConnHandler) ConnHandler {
+	return func(ctx context.Context, hc *HubConn) error {
+		s := wc.s
+		wc.geoDecision = s.geoPolicy.Admit(hc.Geo)
+		if s.geoPolicy != nil {
+			decision := "allow"
+			if !wc.geoDecision.Allowed {
+				decision = "deny"
+			}
+			auditLog.Record(AuditEvent{
+				Type:       "geo_policy",
+				RemoteAddr: hc.RemoteAddr,
+				Decision:   decision,
+				Reason:     wc.geoDecision.Reason,
+				Fields: map[string]string{
+					"country": hc.Geo.Country,
+					"asn":     fmt.Sprintf("%d", hc.Geo.ASN),
+				},
+			})
+		}
+
+		wc.shadowDecision = s.geoShadow.Admit(hc.Geo)
+		defer s.geoShadow.Release(wc.shadowDecision)
+		if s.geoShadow != nil && wc.shadowDecision.Allowed != wc.geoDecision.Allowed {
+			decision := "would_allow"
+			if !wc.shadowDecision.Allowed {
+				decision = "would_deny"
+			}
+			auditLog.Record(AuditEvent{
+				Type:       "geo_policy_shadow",
+				RemoteAddr: hc.RemoteAddr,
+				Decision:   decision,
+				Reason:     wc.shadowDecision.Reason,
+				Fields: map[string]string{
+					"country": hc.Geo.Country,
+					"asn":     fmt.Sprintf("%d", hc.Geo.ASN),
+				},
+			})
+		}
+
+		if !wc.geoDecision.Allowed {
+			http.Error(wc.w, "Connections from your network are not allowed", http.StatusForbidden)
+			return errRefused
+		}
+		defer s.geoPolicy.Release(wc.geoDecision)
+		return next(ctx, hc)
+	}
+}
+
+// served returns the *DisconnectError of a connection the chain after the
+// upgrade returned err for. A connection a middleware refused, or ended
+// without calling next, is closed here.
+func served(hc *HubConn, err error) error {
+	var de *DisconnectError
+	if errors.As(err, &de) {
+		return de
+	}
+	if err == nil {
+		CloseWith(hc.conn, CloseNormal, "")
+		return &DisconnectError{Reason: DisconnectHandler}
+	}
+	hc.logger.Warn("Middleware refused connection", "error", err)
+	closeHandlerError(hc.conn, err)
+	return &DisconnectError{Reason: DisconnectHandler, Err: err}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// middlewareServer serves /ws with one connection per IP, a bearer token
+// "ok" for user "alice", and mw after the built-in checks.
+func middlewareServer(t *testing.T, mw Middleware) string {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.MaxConnectionsPerIP = 1
+	auth := func(r *http.Request) (UserID, error) {
+		if r.Header.Get("Authorization") != "Bearer ok" {
+			return "", ErrUnauthenticated
+		}
+		return "alice", nil
+	}
+	s, err := NewServer(cfg, WithAuth(auth), WithMiddleware(mw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		s.Shutdown(context.Background())
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+func dial(ctx context.Context, url, token string) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return websocket.Dial(ctx, url, &websocket.DialOptions{HTTPHeader: header})
+}
+
+// TestBuiltinChecksRefuseBeforeUpgrade checks that the built-in checks of
+// the default chain answer with an HTTP status before the application's
+// middleware sees the connection.
+func TestBuiltinChecksRefuseBeforeUpgrade(t *testing.T) {
+	var calls atomic.Int32
+	url := middlewareServer(t, func(next ConnHandler) ConnHandler {
+		return func(ctx context.Context, hc *HubConn) error {
+			calls.Add(1)
+			return next(ctx, hc)
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, resp, err := dial(ctx, url, "wrong"); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dial with a wrong token = %v, want 401", err)
+	}
+	conn, _, err := dial(ctx, url, "ok")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.CloseNow()
+	_, resp, err := dial(ctx, url, "ok")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second dial from the same IP = %v, want 429", err)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("middleware ran for %d connections, want only the accepted one", n)
+	}
+}
+
+// TestMiddlewareRunsAfterUpgrade checks that the application's middleware
+// sees the authenticated user and the connection's hub entry, and that a
+// refusal closes the connection with ClosePolicyViolation.
+func TestMiddlewareRunsAfterUpgrade(t *testing.T) {
+	seen := make(chan string, 1)
+	url := middlewareServer(t, func(next ConnHandler) ConnHandler {
+		return func(ctx context.Context, hc *HubConn) error {
+			user, _ := UserFromContext(ctx)
+			if registered, ok := hc.hub.Get(hc.ID); !ok || registered != hc {
+				seen <- "not in the hub"
+				return errors.New("not registered")
+			}
+			seen <- string(user)
+			return errors.New("closed for maintenance")
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := dial(ctx, url, "ok")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.CloseNow()
+	if user := <-seen; user != "alice" {
+		t.Fatalf("middleware saw %q, want user alice", user)
+	}
+	_, _, err = conn.Read(ctx)
+	if code := websocket.CloseStatus(err); code != ClosePolicyViolation {
+		t.Fatalf("read after the refusal = %v, want close code %d", err, ClosePolicyViolation)
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// ModerationVerdict is the outcome of a moderation check for a single message.
+type ModerationVerdict int
+
+const (
+	VerdictAllow  ModerationVerdict = iota // Message may be delivered
+	VerdictReject                          // Message must be dropped
+)
+
+// ModerationRequest carries the message under review to the moderation hook.
+// It is serialized as JSON when sent to an external moderation service.
+type ModerationRequest struct {
+	RemoteAddr string    `json:"remote_addr"` // Sender address - lets the service apply per-client rules
+	Body       string    `json:"body"`        // Raw message text
+	ReceivedAt time.Time `json:"received_at"` // When the server read the message
+}
+
+// Moderator is the hook interface for content moderation. Implementations are
+// called while the message is held back, before it is delivered anywhere, and
+// must honor ctx cancellation so a slow backend can't stall the read loop.
+// Any transport (HTTP, gRPC, in-process filter) can sit behind this interface.
+type Moderator interface {
+	Moderate(ctx context.Context, req ModerationRequest) (ModerationVerdict, string, error)
+}
+
+// ModerationMetrics collects moderation outcomes for monitoring.
+// Uses atomics like HeartbeatMetrics so it can be read from any goroutine.
+type ModerationMetrics struct {
+	Checked   atomic.Int64 // Messages submitted to the moderator
+	Approved  atomic.Int64 // Messages allowed (including fail-open fallbacks)
+	Rejected  atomic.Int64 // Messages rejected (including fail-closed fallbacks)
+	Errors    atomic.Int64 // Moderator calls that failed or timed out
+	Latencies *Histogram   // Latency of all moderator calls
+}
+
+// ModerationConfig controls how moderation is applied to incoming messages.
+type ModerationConfig struct {
+	Enabled  bool          // Master switch - when false messages bypass the hook
+	Timeout  time.Duration // Max time a message is held waiting for a verdict
+	FailOpen bool          // Allow messages when the moderator errors (false = reject them)
+	Rooms    []string      // Chat rooms moderated, as path.Match patterns (empty = all messages)
+}
+
+// DefaultModerationConfig returns a disabled configuration with a short timeout
+// and fail-open policy, so enabling moderation never blocks chat by accident.
+func DefaultModerationConfig() ModerationConfig {
+	return ModerationConfig{
+		Enabled:  false,
+		Timeout:  2 * time.Second,
+		FailOpen: true,
+	}
+}
+
+// ModerationGate applies a Moderator to messages according to ModerationConfig
+// and records the results in ModerationMetrics.
+type ModerationGate struct {
+	moderator Moderator
+	cfg       ModerationConfig
+	metrics   *ModerationMetrics
+}
+
+// NewModerationGate creates a gate around the given moderator.
+func NewModerationGate(m Moderator, cfg ModerationConfig) *ModerationGate {
+	return &ModerationGate{
+		moderator: m,
+		cfg:       cfg,
+		metrics:   &ModerationMetrics{Latencies: NewHistogram(latencyBuckets)},
+	}
+}
+
+// Covers reports whether messages sent in room go through the gate.
+// Connections outside a chat room (room "") are covered only when the
+// gate isn't limited to rooms.
+func (g *ModerationGate) Covers(room string) bool {
+	if g == nil || !g.cfg.Enabled || g.moderator == nil {
+		return false
+	}
+	if len(g.cfg.Rooms) == 0 {
+		return true
+	}
+	return room != "" && matchDevice(g.cfg.Rooms, room)
+}
+
+// roomHandler is a Handler serving the members of one chat room, so
+// moderation can be enabled per room.
+type roomHandler interface {
+	roomName() string
+}
+
+// handlerRoom returns the chat room h serves, or "".
+func handlerRoom(h Handler) string {
+	if rh, ok := h.(roomHandler); ok {
+		return rh.roomName()
+	}
+	return ""
+}
+
+// Metrics returns the gate's metrics collector.
+func (g *ModerationGate) Metrics() *ModerationMetrics {
+	return g.metrics
+}
+
+// Check holds the message until the moderator returns a verdict or the
+// configured timeout elapses. On error or timeout the fail-open/closed policy
+// decides the outcome. Returns the verdict and a human-readable reason.
+func (g *ModerationGate) Check(ctx context.Context, req ModerationRequest) (ModerationVerdict, string) {
+	if g == nil || !g.cfg.Enabled || g.moderator == nil {
+		return VerdictAllow, "" // Moderation disabled - pass through
+	}
+
+	g.metrics.Checked.Add(1)
+	modCtx, cancel := context.WithTimeout(ctx, g.cfg.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	verdict, reason, err := g.moderator.Moderate(modCtx, req)
+	g.metrics.Latencies.Observe(time.Since(start))
+
+	if err != nil {
+		// Backend unavailable or too slow - apply configured failure policy
+		g.metrics.Errors.Add(1)
+		if g.cfg.FailOpen {
+			g.metrics.Approved.Add(1)
+			return VerdictAllow, ""
+		}
+		g.metrics.Rejected.Add(1)
+		return VerdictReject, fmt.Sprintf("moderation unavailable: %v", err)
+	}
+
+	if verdict == VerdictReject {
+		g.metrics.Rejected.Add(1)
+		return VerdictReject, reason
+	}
+	g.metrics.Approved.Add(1)
+	return VerdictAllow, ""
+}
+
+// moderationQueue is how many messages of one connection may wait for
+// their verdict. The read loop keeps reading - and answering heartbeats -
+// while they wait, and only blocks once a client sends faster than the
+// moderation backend answers.
+const moderationQueue = 16
+
+// inboundMessage is a message read from a connection, queued for
+// moderation and delivery.
+type inboundMessage struct {
+	msgType websocket.MessageType
+	msg     []byte
+}
+
+// HTTPModerator calls an external moderation service via HTTP POST.
+// The request body is a JSON ModerationRequest; the service must answer with
+// {"allow": bool, "reason": string}. Non-2xx responses are treated as errors.
+type HTTPModerator struct {
+	URL    string       // Moderation endpoint
+	Client *http.Client // HTTP client - timeouts come from the request context
+}
+
+// NewHTTPModerator creates an HTTP moderator for the given endpoint.
+func NewHTTPModerator(url string) *HTTPModerator {
+	return &HTTPModerator{URL: url, Client: &http.Client{}}
+}
+
+// Moderate implements Moderator by posting the message to the external service.
+func (hm *HTTPModerator) Moderate(ctx context.Context, req ModerationRequest) (ModerationVerdict, string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return VerdictReject, "", fmt.Errorf("encode moderation request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, hm.URL, bytes.NewReader(body))
+	if err != nil {
+		return VerdictReject, "", fmt.Errorf("build moderation request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := hm.Client.Do(httpReq)
+	if err != nil {
+		return VerdictReject, "", fmt.Errorf("moderation request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return VerdictReject, "", fmt.Errorf("moderation service returned %s", resp.Status)
+	}
+
+	var result struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return VerdictReject, "", fmt.Errorf("decode moderation response: %w", err)
+	}
+
+	if !result.Allow {
+		return VerdictReject, result.Reason, nil
+	}
+	return VerdictAllow, "", nil
+}
+
+// moderationGateFromConfig builds the moderation gate from the server config.
+// Returns nil when no moderation endpoint is configured.
+func moderationGateFromConfig(ms ModerationSettings) *ModerationGate {
+	if ms.URL == "" {
+		return nil
+	}
+	return NewModerationGate(NewHTTPModerator(ms.URL), ModerationConfig{
+		Enabled:  true,
+		Timeout:  ms.Timeout,
+		FailOpen: ms.FailOpen,
+		Rooms:    ms.Rooms,
+	})
+}
+
+// validate checks the settings of an enabled hook: a message must not be
+// held without a deadline, nor rejected before the service was asked.
+func (ms ModerationSettings) validate() []ValidationError {
+	if ms.URL == "" {
+		return nil
+	}
+	var errs []ValidationError
+	if u, err := url.Parse(ms.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		errs = append(errs, ValidationError{"moderation.url", "must be an http(s) URL"})
+	}
+	if ms.Timeout <= 0 {
+		errs = append(errs, ValidationError{"moderation.timeout", "must be positive"})
+	}
+	for _, p := range ms.Rooms {
+		if _, err := path.Match(p, ""); err != nil {
+			errs = append(errs, ValidationError{"moderation.rooms", fmt.Sprintf("invalid pattern %q", p)})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestModerationTimeoutMustBePositive(t *testing.T) {
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		cfg := DefaultConfig()
+		cfg.Moderation = ModerationSettings{URL: "http://moderator:9000/check", Timeout: timeout}
+		if _, err := NewServer(cfg); err == nil || !strings.Contains(err.Error(), "moderation.timeout") {
+			t.Errorf("NewServer with moderation timeout %v = %v, want a moderation.timeout error", timeout, err)
+		}
+	}
+}
+
+func TestModerationCovers(t *testing.T) {
+	all := NewModerationGate(NewHTTPModerator("http://moderator"), ModerationConfig{Enabled: true, Timeout: time.Second})
+	rooms := NewModerationGate(NewHTTPModerator("http://moderator"), ModerationConfig{Enabled: true, Timeout: time.Second, Rooms: []string{"support-*"}})
+	tests := []struct {
+		gate *ModerationGate
+		room string
+		want bool
+	}{
+		{nil, "", false},
+		{all, "", true},
+		{all, "lobby", true},
+		{rooms, "", false},
+		{rooms, "lobby", false},
+		{rooms, "support-1", true},
+	}
+	for _, tt := range tests {
+		if got := tt.gate.Covers(tt.room); got != tt.want {
+			t.Errorf("Covers(%q) with rooms %v = %v, want %v", tt.room, tt.gate.cfg.Rooms, got, tt.want)
+		}
+	}
+}
+
+// TestModerationPerRoom checks that only the rooms moderation is enabled
+// for wait for the service: it rejects everything, so messages in other
+// rooms are broadcast and those in support rooms are rejected.
+func TestModerationPerRoom(t *testing.T) {
+	var checked atomic.Int32
+	moderator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checked.Add(1)
+		w.Write([]byte(`{"allow":false,"reason":"not today"}`))
+	}))
+	defer moderator.Close()
+	cfg := DefaultConfig()
+	cfg.Moderation = ModerationSettings{URL: moderator.URL, Timeout: time.Second, Rooms: []string{"support-*"}}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	defer func() {
+		srv.Close()
+		s.Shutdown(context.Background())
+	}()
+	base := "ws" + strings.TrimPrefix(srv.URL, "http") + "/chat/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	say := func(room string) string {
+		conn, _, err := websocket.Dial(ctx, base+room, nil)
+		if err != nil {
+			t.Fatalf("dial %s: %v", room, err)
+		}
+		defer conn.CloseNow()
+		if err := conn.Write(ctx, websocket.MessageText, []byte("hello")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		for {
+			_, data, err := conn.Read(ctx)
+			if err != nil {
+				t.Fatalf("read in %s: %v", room, err)
+			}
+			if reply := string(data); !strings.Contains(reply, `"type":"join"`) {
+				return reply
+			}
+		}
+	}
+
+	if reply := say("lobby"); !strings.Contains(reply, `"body":"hello"`) {
+		t.Errorf("lobby reply = %s, want the broadcast", reply)
+	}
+	if n := checked.Load(); n != 0 {
+		t.Errorf("moderation checked %d lobby messages, want none", n)
+	}
+	if reply := say("support-1"); !strings.Contains(reply, "Server rejected message: not today") {
+		t.Errorf("support-1 reply = %s, want the rejection", reply)
+	}
+	if n := checked.Load(); n != 1 {
+		t.Errorf("moderation checked %d messages, want 1", n)
+	}
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Monitor states.
+const (
+	MonitorNew  = "new"  // No check-in yet, first one not yet due
+	MonitorUp   = "up"   // Checked in on schedule
+	MonitorLate = "late" // Past due, within the grace period
+	MonitorDown = "down" // Missed: past due plus grace
+)
+
+// MonitorSpec defines a passive monitor: a job or device expected to check
+// in on a schedule, either every fixed interval or on a cron expression.
+type MonitorSpec struct {
+	Name     string        `yaml:"name"`     // Used in the check-in URL /checkin/{name}
+	Every    time.Duration `yaml:"every"`    // Expected interval between check-ins
+	Schedule string        `yaml:"schedule"` // Cron expression (alternative to Every)
+	Timezone string        `yaml:"timezone"` // Time zone for Schedule, default UTC
+	Grace    time.Duration `yaml:"grace"`    // How late a check-in may be before it counts as missed
+	Token    string        `yaml:"token"`    // Secret required to check in (optional)
+}
+
+// MonitorSettings configures passive check-in monitors.
+type MonitorSettings struct {
+	CheckInterval time.Duration `yaml:"check_interval"` // How often deadlines are evaluated
+	WebhookURL    string        `yaml:"webhook_url"`    // Receives DowntimeEvent JSON on misses and recoveries
+	Monitors      []MonitorSpec `yaml:"monitors"`
+}
+
+// MonitorStatus is the public state of one monitor.
+type MonitorStatus struct {
+	Name        string     `json:"name"`
+	State       string     `json:"state"`
+	LastCheckIn *time.Time `json:"last_check_in,omitempty"`
+	NextDue     time.Time  `json:"next_due"`
+	Missed      int64      `json:"missed"` // Missed deadlines since start
+}
+
+// monitor is the runtime state of a MonitorSpec.
+type monitor struct {
+	spec      MonitorSpec
+	cron      *CronSchedule
+	loc       *time.Location
+	status    MonitorStatus
+	notified  bool      // A "down" event was sent for the current miss
+	downSince time.Time // Deadline that was missed first
+}
+
+// next returns the deadline following t.
+func (m *monitor) next(t time.Time) time.Time {
+	if m.cron != nil {
+		return m.cron.Next(t.In(m.loc))
+	}
+	return t.Add(m.spec.Every)
+}
+
+// MonitorRegistry tracks scheduled check-ins and alerts when they are missed.
+type MonitorRegistry struct {
+	cfg      MonitorSettings
+	monitors map[string]*monitor
+	webhook  *WebhookNotifier
+	mu       sync.Mutex // Protects monitors' state
+
+	// OnEvent, if set, receives miss/recovery events (e.g. for escalation).
+	OnEvent func(DowntimeEvent)
+}
+
+// NewMonitorRegistry creates the registry; deadlines start counting now.
+func NewMonitorRegistry(cfg MonitorSettings) (*MonitorRegistry, error) {
+	mr := &MonitorRegistry{
+		cfg:      cfg,
+		monitors: make(map[string]*monitor),
+		webhook:  NewWebhookNotifier(cfg.WebhookURL),
+	}
+	now := time.Now()
+	for _, spec := range cfg.Monitors {
+		m := &monitor{spec: spec, loc: time.UTC}
+		if spec.Timezone != "" {
+			loc, err := time.LoadLocation(spec.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("monitor %s: %w", spec.Name, err)
+			}
+			m.loc = loc
+		}
+		if spec.Schedule != "" {
+			cron, err := ParseCron(spec.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("monitor %s: %w", spec.Name, err)
+			}
+			m.cron = cron
+		}
+		m.status = MonitorStatus{Name: spec.Name, State: MonitorNew, NextDue: m.next(now)}
+		mr.monitors[spec.Name] = m
+	}
+	return mr, nil
+}
+
+// errUnknownMonitor and errBadToken are returned by CheckIn.
+var (
+	errUnknownMonitor = errors.New("unknown monitor")
+	errBadToken       = errors.New("invalid check-in token")
+)
+
+// CheckIn records a check-in and schedules the next deadline.
+func (mr *MonitorRegistry) CheckIn(name, token string, now time.Time) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	m, ok := mr.monitors[name]
+	if !ok {
+		return errUnknownMonitor
+	}
+	if m.spec.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(m.spec.Token)) != 1 {
+		return errBadToken
+	}
+
+	wasDown := m.status.State == MonitorDown
+	m.status.State = MonitorUp
+	m.status.LastCheckIn = &now
+	m.status.NextDue = m.next(now)
+	if wasDown && m.notified {
+		m.notified = false
+		mr.emit(DowntimeEvent{
+			Device:   name,
+			State:    "online",
+			At:       now,
+			Since:    m.downSince,
+			Duration: now.Sub(m.downSince).Round(time.Second).String(),
+		})
+	}
+	return nil
+}
+
+// Check advances every monitor's state against its deadline.
+func (mr *MonitorRegistry) Check(now time.Time) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for name, m := range mr.monitors {
+		due := m.status.NextDue
+		switch {
+		case now.Before(due):
+			continue
+		case now.Before(due.Add(m.spec.Grace)):
+			if m.status.State != MonitorDown {
+				m.status.State = MonitorLate
+			}
+		case maintenanceSchedule.Covers("monitor", name, now):
+			// Missed during maintenance: expected, so neither counted nor
+			// notified - a miss after the window alerts as usual
+			m.status.State = MonitorDown
+			m.status.NextDue = m.next(due)
+		default:
+			// Missed: count it and move on to the following deadline, so a
+			// job that stays dead is counted once per expected run
+			m.status.Missed++
+			m.status.State = MonitorDown
+			m.status.NextDue = m.next(due)
+			if !m.notified {
+				m.notified = true
+				m.downSince = due
+				mr.emit(DowntimeEvent{Device: name, State: "offline", At: now, Since: due})
+			}
+		}
+	}
+}
+
+// emit sends a monitor event to the audit log, webhook and OnEvent.
+// Callers hold mr.mu.
+func (mr *MonitorRegistry) emit(ev DowntimeEvent) {
+	decision := "missed"
+	if ev.State == "online" {
+		decision = "recovered"
+	}
+	slog.Info("Monitor "+decision+" its check-in", "monitor", ev.Device)
+	auditLog.Record(AuditEvent{
+		Type:       "monitor",
+		RemoteAddr: ev.Device,
+		Decision:   decision,
+		Reason:     fmt.Sprintf("check-in due since %s", ev.Since.Format(time.RFC3339)),
+		Fields:     map[string]string{"monitor": ev.Device},
+	})
+	mr.webhook.Notify(ev)
+	if mr.OnEvent != nil {
+		mr.OnEvent(ev)
+	}
+}
+
+// Run evaluates deadlines every CheckInterval until ctx is cancelled.
+func (mr *MonitorRegistry) Run(ctx context.Context) {
+	ticker := time.NewTicker(mr.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		mr.Check(time.Now())
+	}
+}
+
+// List returns all monitor states sorted by name.
+func (mr *MonitorRegistry) List() []MonitorStatus {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	out := make([]MonitorStatus, 0, len(mr.monitors))
+	for _, m := range mr.monitors {
+		out = append(out, m.status)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// handleCheckIn serves /checkin/{name}. Any method works so cron jobs can
+// use a bare `curl`; the token may be given as ?token= or X-Checkin-Token.
+func (mr *MonitorRegistry) handleCheckIn(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = r.Header.Get("X-Checkin-Token")
+	}
+	switch err := mr.CheckIn(r.PathValue("name"), token, time.Now()); err {
+	case nil:
+		w.Write([]byte("OK\n"))
+	case errUnknownMonitor:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+}
+
+// handleMonitors lists the monitors as JSON.
+func (mr *MonitorRegistry) handleMonitors(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mr.List())
+}
+
+// monitorCheckInMethod lets WebSocket clients check in over /rpc:
+// {"method":"monitor.checkin","params":{"name":"backup","token":"..."}}.
+func (mr *MonitorRegistry) monitorCheckInMethod(ctx context.Context, params json.RawMessage) (any, error) {
+	var p struct {
+		Name  string `json:"name"`
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil || p.Name == "" {
+		return nil, &RPCError{Code: RPCInvalidParams, Message: "params must be {\"name\": \"...\"}"}
+	}
+	if err := mr.CheckIn(p.Name, p.Token, time.Now()); err != nil {
+		return nil, &RPCError{Code: RPCInvalidParams, Message: err.Error()}
+	}
+	return "ok", nil
+}
+
+// monitorsFromConfig creates the registry when monitors are configured.
+func monitorsFromConfig(ms MonitorSettings) (*MonitorRegistry, error) {
+	if len(ms.Monitors) == 0 {
+		return nil, nil
+	}
+	return NewMonitorRegistry(ms)
+}
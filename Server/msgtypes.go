@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// maxMessageTypes caps the message types counted separately. Clients pick
+// the types they send, so past the cap new ones are counted as
+// otherMessageType instead of growing /metrics without bound.
+const maxMessageTypes = 64
+
+// Type labels of messages that don't carry a type of their own.
+const (
+	rawMessageType     = "raw"     // Raw text connections
+	invalidMessageType = "invalid" // Data that isn't an envelope
+	otherMessageType   = "other"   // Types past maxMessageTypes
+)
+
+// handlerBuckets are the upper bounds (seconds) of the handler latency
+// histograms. Handlers are mostly fast, so they start below a millisecond.
+var handlerBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// MessageTypeStats counts the messages of one type the handler got.
+type MessageTypeStats struct {
+	Received  atomic.Int64 // Messages handed to OnMessage
+	Succeeded atomic.Int64 // Handled without an error, answered with anything but MessageTypeError
+	Failed    atomic.Int64 // OnMessage returned an error or panicked, or answered with MessageTypeError
+	Latency   *Histogram   // How long OnMessage took
+}
+
+// messageTypes holds the MessageTypeStats of each type seen.
+type messageTypes struct {
+	types map[string]*MessageTypeStats
+	mu    sync.RWMutex
+}
+
+// newMessageTypes creates an empty set.
+func newMessageTypes() *messageTypes {
+	return &messageTypes{types: make(map[string]*MessageTypeStats)}
+}
+
+// get returns the stats of typ, created on first use.
+func (mt *messageTypes) get(typ string) *MessageTypeStats {
+	mt.mu.RLock()
+	st, ok := mt.types[typ]
+	mt.mu.RUnlock()
+	if ok {
+		return st
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if st, ok := mt.types[typ]; ok {
+		return st
+	}
+	if len(mt.types) >= maxMessageTypes {
+		if st, ok := mt.types[otherMessageType]; ok {
+			return st
+		}
+		typ = otherMessageType // Takes the slot past the cap
+	}
+	st = &MessageTypeStats{Latency: NewHistogram(handlerBuckets)}
+	mt.types[typ] = st
+	return st
+}
+
+// snapshot returns the stats by type.
+func (mt *messageTypes) snapshot() map[string]*MessageTypeStats {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	out := make(map[string]*MessageTypeStats, len(mt.types))
+	for typ, st := range mt.types {
+		out[typ] = st
+	}
+	return out
+}
+
+// isErrorReply reports whether reply is a MessageTypeError envelope - the
+// handler's way of saying it couldn't process a message.
+func isErrorReply(ctx context.Context, msgType websocket.MessageType, reply []byte) bool {
+	if reply == nil || ProtocolVersionFromContext(ctx) == ProtocolRaw {
+		return false
+	}
+	codec := CodecFromContext(ctx)
+	if msgType == websocket.MessageText && codec.Binary() {
+		codec = CodecJSON // Replies to text frames are JSON, see EchoHandler
+	}
+	m, err := codec.Decode(reply)
+	return err == nil && m.Type == MessageTypeError
+}
+
+// handle calls the handler's OnMessage and counts the outcome and latency
+// under typ, the message's type label (see inbound).
+func (wc *wsConn) handle(ctx context.Context, hc *HubConn, typ string, msgType websocket.MessageType, msg []byte) (reply []byte, err error) {
+	st := wc.s.metrics.types.get(typ)
+	st.Received.Add(1)
+	failed := true // Until OnMessage returned: a panic counts as a failure
+	defer func() {
+		if failed {
+			st.Failed.Add(1)
+		} else {
+			st.Succeeded.Add(1)
+		}
+	}()
+	start := time.Now()
+	reply, err = wc.h.OnMessage(ctx, hc, msgType, msg)
+	st.Latency.Observe(time.Since(start))
+	failed = err != nil || isErrorReply(ctx, msgType, reply)
+	return reply, err
+}
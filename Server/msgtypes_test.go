@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// TestHandlerMetricsByType checks that /metrics counts the handler's
+// outcomes per message type: echoed messages succeed, and unsupported
+// types and invalid envelopes, which get error replies, fail.
+func TestHandlerMetricsByType(t *testing.T) {
+	s, url := serveHandler(t, DefaultConfig(), EchoHandler{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	header := http.Header{}
+	header.Set(HeaderProtocolVersion, "1")
+	conn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{HTTPHeader: header})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.CloseNow()
+	for _, msg := range []string{
+		`{"type":"message","id":"1","payload":"hello"}`,
+		`{"type":"message","id":"2","payload":"again"}`,
+		`{"type":"launch","id":"3"}`,
+		`not an envelope`,
+	} {
+		if err := conn.Write(ctx, websocket.MessageText, []byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, _, err := conn.Read(ctx); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics := rec.Body.String()
+	for _, want := range []string{
+		`cysl_handler_messages_total{type="message"} 2`,
+		`cysl_handler_succeeded_total{type="message"} 2`,
+		`cysl_handler_failed_total{type="launch"} 1`,
+		`cysl_handler_failed_total{type="invalid"} 1`,
+		`cysl_handler_duration_seconds_count{type="message"} 2`,
+	} {
+		if !strings.Contains(metrics, want+"\n") {
+			t.Errorf("/metrics lacks %s", want)
+		}
+	}
+}
+
+// TestMessageTypesCapped checks that types past maxMessageTypes share the
+// "other" label.
+func TestMessageTypesCapped(t *testing.T) {
+	mt := newMessageTypes()
+	for i := range maxMessageTypes + 10 {
+		mt.get(fmt.Sprintf("type-%d", i)).Received.Add(1)
+	}
+	types := mt.snapshot()
+	if len(types) != maxMessageTypes+1 {
+		t.Fatalf("%d types tracked, want %d and other", len(types), maxMessageTypes)
+	}
+	if n := types[otherMessageType].Received.Load(); n != 10 {
+		t.Fatalf("other counted %d messages, want 10", n)
+	}
+}
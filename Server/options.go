@@ -0,0 +1,86 @@
+package server
+
+import "log/slog"
+
+// Option customizes a Server beyond its Config, e.g. with values that
+// can't come from a file. Precedence, lowest first:
+//
+//  1. DefaultConfig
+//  2. the config file and environment variables (LoadConfig)
+//  3. changes the caller makes to the Config it passes to NewServer
+//  4. options, in the order given - a later option overrides an earlier one
+//
+// Options that replace config settings (WithHeartbeat, WithOriginCheck)
+// are applied again by UpdateConfig, so a reloaded config can't silently
+// undo them.
+type Option func(*serverOptions)
+
+// serverOptions collects what the options set. Nil fields leave the
+// config's choice in place.
+type serverOptions struct {
+	heartbeat   *HeartbeatConfig
+	originCheck OriginCheckFunc
+	auth        AuthFunc
+	store       *IncidentStore
+	logger      *slog.Logger
+	stateChange []StateChangeFunc
+	middleware  []Middleware
+}
+
+// WithHeartbeat sets the default heartbeat profile, replacing
+// Config.Heartbeat. Clients can still negotiate within Config.Policy.
+func WithHeartbeat(cfg HeartbeatConfig) Option {
+	return func(o *serverOptions) { o.heartbeat = &cfg }
+}
+
+// WithOriginCheck decides with check which browser origins may connect,
+// replacing Config.Origins.Patterns.
+func WithOriginCheck(check OriginCheckFunc) Option {
+	return func(o *serverOptions) { o.originCheck = check }
+}
+
+// WithAuth authenticates connections with provider, taking precedence over
+// Config.Auth (both the JWT settings and Func).
+func WithAuth(provider AuthFunc) Option {
+	return func(o *serverOptions) { o.auth = provider }
+}
+
+// WithStore makes Run record incidents in store instead of creating one
+// from Config.Incidents, e.g. to share it with the rest of the application
+// or to inspect it in tests.
+func WithStore(store *IncidentStore) Option {
+	return func(o *serverOptions) { o.store = store }
+}
+
+// WithLogger makes the server log through l instead of slog.Default().
+// Connection loggers derive from it, adding conn_id and remote_addr.
+// Process-wide services (beacons, monitors, ...) keep the default logger.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *serverOptions) { o.logger = l }
+}
+
+// WithStateChange calls fn whenever a connection's health changes, e.g.
+// to alert on connections turning unstable or to steer traffic away from
+// them. Unlike other options, each one adds a callback; they run in the
+// order given.
+func WithStateChange(fn StateChangeFunc) Option {
+	return func(o *serverOptions) { o.stateChange = append(o.stateChange, fn) }
+}
+
+// applyConfig applies the options that replace config settings to cfg.
+func (o *serverOptions) applyConfig(cfg *Config) {
+	if o.heartbeat != nil {
+		cfg.Heartbeat = *o.heartbeat
+	}
+	if o.originCheck != nil {
+		cfg.Origins.Check = o.originCheck
+	}
+}
+
+// logger returns the server's logger.
+func (s *Server) logger() *slog.Logger {
+	if s.opts.logger != nil {
+		return s.opts.logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/coder/websocket"
+)
+
+// OriginCheckFunc decides whether a browser on origin (the request's Origin
+// header, e.g. "https://app.example.com") may open a WebSocket connection.
+type OriginCheckFunc func(r *http.Request, origin string) bool
+
+// OriginSettings decides which browser origins may connect. Requests
+// without an Origin header (non-browser clients) are always accepted.
+// Otherwise Check decides, if set; without it the origin must be the
+// server's own host or match one of Patterns.
+type OriginSettings struct {
+	// Patterns are path.Match patterns for the origin's host
+	// ("*.example.com", "localhost:*"), or for scheme and host if the
+	// pattern contains "://" ("https://app.example.com")
+	// (env ORIGIN_PATTERNS, comma-separated).
+	Patterns []string `yaml:"patterns"`
+
+	// AllowAll accepts every origin. For development only: any website a
+	// user visits can then connect with the user's cookies
+	// (env ORIGIN_ALLOW_ALL).
+	AllowAll bool `yaml:"allow_all"`
+
+	// Check, when set from code (see WithOriginCheck), replaces Patterns
+	// and decides every request that carries an Origin header.
+	Check OriginCheckFunc `yaml:"-"`
+}
+
+// DefaultOriginSettings accepts local development origins only.
+func DefaultOriginSettings() OriginSettings {
+	return OriginSettings{Patterns: []string{"localhost:*"}}
+}
+
+// validate checks the pattern syntax.
+func (o OriginSettings) validate() []ValidationError {
+	var errs []ValidationError
+	for _, p := range o.Patterns {
+		if _, err := path.Match(strings.ToLower(p), ""); err != nil {
+			errs = append(errs, ValidationError{"origins.patterns", fmt.Sprintf("invalid pattern %q: %v", p, err)})
+		}
+	}
+	return errs
+}
+
+// acceptOptions sets up opts to enforce the settings. Patterns are matched
+// by websocket.Accept, which answers 403 itself; with AllowAll or Check
+// the caller must have called allowed first, so Accept's own check is
+// turned off.
+func (o OriginSettings) acceptOptions(opts *websocket.AcceptOptions) {
+	if o.AllowAll || o.Check != nil {
+		opts.InsecureSkipVerify = true
+		return
+	}
+	opts.OriginPatterns = o.Patterns
+}
+
+// allowed runs Check on requests that carry an Origin header. Without a
+// Check every request passes here and Accept matches the patterns.
+func (o OriginSettings) allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if o.AllowAll || o.Check == nil || origin == "" {
+		return true
+	}
+	return o.Check(r, origin)
+}
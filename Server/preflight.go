@@ -0,0 +1,362 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Preflight checks Run performs before it starts listening.
+const (
+	PreflightTLS    = "tls"    // Certificate files load and aren't expired or about to
+	PreflightBroker = "broker" // The cluster's Redis server answers
+	PreflightStore  = "store"  // State files parse and their directories are writable
+	PreflightGeoIP  = "geoip"  // The GeoIP databases open
+	PreflightPorts  = "ports"  // The listen addresses can be bound
+)
+
+// preflightChecks lists the checks in the order they run.
+var preflightChecks = []struct {
+	name string
+	run  func(ctx context.Context, cfg Config) preflightOutcome
+}{
+	{PreflightPorts, checkPorts},
+	{PreflightTLS, checkTLS},
+	{PreflightStore, checkStore},
+	{PreflightGeoIP, checkGeoIP},
+	{PreflightBroker, checkBroker},
+}
+
+// PreflightSettings configures the startup self-test. A failed check
+// stops the server if it is listed in FailOn; otherwise the server starts
+// degraded, without what failed, and /readyz says so.
+type PreflightSettings struct {
+	FailOn []string `yaml:"fail_on"` // Checks whose failure stops startup (env PREFLIGHT_FAIL_ON, comma-separated)
+}
+
+// DefaultPreflightSettings fails on the checks the server has always
+// stopped for: certificates, listeners and state files.
+func DefaultPreflightSettings() PreflightSettings {
+	return PreflightSettings{FailOn: []string{PreflightTLS, PreflightPorts, PreflightStore}}
+}
+
+// validate checks the settings.
+func (ps PreflightSettings) validate() []ValidationError {
+	var errs []ValidationError
+	for _, name := range ps.FailOn {
+		if !knownPreflightCheck(name) {
+			errs = append(errs, ValidationError{"preflight.fail_on", fmt.Sprintf("unknown check %q", name)})
+		}
+	}
+	return errs
+}
+
+// knownPreflightCheck reports whether name is one of the checks.
+func knownPreflightCheck(name string) bool {
+	for _, c := range preflightChecks {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// PreflightStatus is the outcome of a check.
+type PreflightStatus string
+
+// Check outcomes. Only failures degrade the server or stop it.
+const (
+	PreflightOK      PreflightStatus = "ok"
+	PreflightWarn    PreflightStatus = "warn" // Works for now, e.g. a certificate about to expire
+	PreflightFailed  PreflightStatus = "fail"
+	PreflightSkipped PreflightStatus = "skip" // The feature isn't configured
+)
+
+// PreflightCheck is the result of one check.
+type PreflightCheck struct {
+	Name       string          `json:"name"`
+	Status     PreflightStatus `json:"status"`
+	Detail     string          `json:"detail,omitempty"`
+	Fatal      bool            `json:"fatal,omitempty"` // Failed and listed in fail_on
+	DurationMs int64           `json:"duration_ms"`
+}
+
+// PreflightReport is the result of the startup self-test.
+type PreflightReport struct {
+	CheckedAt time.Time        `json:"checked_at"`
+	Checks    []PreflightCheck `json:"checks"`
+}
+
+// Degraded reports whether a check failed without stopping the server.
+func (r *PreflightReport) Degraded() bool {
+	return r != nil && slices.ContainsFunc(r.Checks, func(c PreflightCheck) bool {
+		return c.Status == PreflightFailed && !c.Fatal
+	})
+}
+
+// Err returns the failures that stop the server, nil if there are none.
+func (r *PreflightReport) Err() error {
+	var errs []error
+	for _, c := range r.Checks {
+		if c.Fatal {
+			errs = append(errs, fmt.Errorf("preflight check %s failed: %s", c.Name, c.Detail))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// preflightOutcome is what a check found.
+type preflightOutcome struct {
+	status   PreflightStatus
+	detail   string
+	fallback string            // How the server runs when it starts anyway
+	degrade  func(cfg *Config) // Makes the server run without what failed (nil = nothing to turn off)
+}
+
+// preflight runs the startup self-test against cfg and logs each result.
+// For failed checks that don't stop startup, cfg is changed to run without
+// what failed: unusable state files aren't loaded or written and a plain
+// listener that can't be bound is left out. The GeoIP databases are
+// already disabled when they don't open, and the cluster relay keeps
+// retrying Redis on its own.
+func (s *Server) preflight(ctx context.Context, cfg *Config) *PreflightReport {
+	report := &PreflightReport{CheckedAt: time.Now()}
+	check := *cfg
+	if s.opts.store != nil {
+		check.Incidents.StateFile = "" // Not used - WithStore replaces it
+	}
+	for _, c := range preflightChecks {
+		start := time.Now()
+		out := c.run(ctx, check)
+		result := PreflightCheck{
+			Name:       c.name,
+			Status:     out.status,
+			Detail:     out.detail,
+			Fatal:      out.status == PreflightFailed && slices.Contains(cfg.Preflight.FailOn, c.name),
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		report.Checks = append(report.Checks, result)
+
+		switch {
+		case result.Fatal:
+			s.logger().Error("Preflight check failed", "check", c.name, "detail", out.detail)
+		case out.status == PreflightFailed:
+			s.logger().Error("Preflight check failed - starting degraded", "check", c.name, "detail", out.detail, "fallback", out.fallback)
+			if out.fallback != "" {
+				report.Checks[len(report.Checks)-1].Detail += " - " + out.fallback
+			}
+			if out.degrade != nil {
+				out.degrade(cfg)
+			}
+		case out.status == PreflightWarn:
+			s.logger().Warn("Preflight check warning", "check", c.name, "detail", out.detail)
+		default:
+			s.logger().Debug("Preflight check", "check", c.name, "status", out.status, "detail", out.detail)
+		}
+	}
+	s.readiness.Store(report)
+	return report
+}
+
+// checkPorts binds the listen addresses and releases them again.
+func checkPorts(_ context.Context, cfg Config) preflightOutcome {
+	if err := tryListen(cfg.Addr); err != nil {
+		return preflightOutcome{status: PreflightFailed, detail: err.Error()}
+	}
+	if cfg.TLS.Enabled() && cfg.TLS.PlainAddr != "" {
+		if err := tryListen(cfg.TLS.PlainAddr); err != nil {
+			return preflightOutcome{
+				status:   PreflightFailed,
+				detail:   err.Error(),
+				fallback: "serving without the plain listener",
+				degrade:  func(cfg *Config) { cfg.TLS.PlainAddr = "" },
+			}
+		}
+	}
+	return preflightOutcome{status: PreflightOK}
+}
+
+// tryListen reports whether addr can be bound.
+func tryListen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+// checkTLS loads the certificates and checks their validity period.
+// Autocert certificates are renewed by the server itself and not checked.
+func checkTLS(_ context.Context, cfg Config) preflightOutcome {
+	ts := cfg.TLS
+	var certs []tls.Certificate
+	switch {
+	case !ts.Enabled():
+		return preflightOutcome{status: PreflightSkipped, detail: "TLS disabled"}
+	case ts.Config != nil:
+		certs = ts.Config.Certificates
+	case len(ts.Autocert.Domains) > 0:
+		return preflightOutcome{status: PreflightSkipped, detail: "certificates managed by autocert"}
+	default:
+		cert, err := tls.LoadX509KeyPair(ts.CertFile, ts.KeyFile)
+		if err != nil {
+			return preflightOutcome{status: PreflightFailed, detail: err.Error()}
+		}
+		certs = []tls.Certificate{cert}
+	}
+	if len(certs) == 0 {
+		return preflightOutcome{status: PreflightSkipped, detail: "certificates supplied at handshake time"}
+	}
+
+	// The certificate expiring first decides
+	out := preflightOutcome{status: PreflightOK}
+	now := time.Now()
+	var first *x509.Certificate
+	for _, cert := range certs {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return preflightOutcome{status: PreflightFailed, detail: err.Error()}
+		}
+		if now.Before(leaf.NotBefore) {
+			return preflightOutcome{status: PreflightFailed,
+				detail:   fmt.Sprintf("certificate for %s not valid before %s", leaf.Subject.CommonName, leaf.NotBefore.Format(time.RFC3339)),
+				fallback: "serving it anyway"}
+		}
+		if first == nil || leaf.NotAfter.Before(first.NotAfter) {
+			first = leaf
+		}
+	}
+	left := first.NotAfter.Sub(now)
+	out.detail = fmt.Sprintf("certificate for %s expires %s", first.Subject.CommonName, first.NotAfter.Format(time.RFC3339))
+	switch {
+	case left <= 0:
+		out.status = PreflightFailed
+		out.detail = fmt.Sprintf("certificate for %s expired %s", first.Subject.CommonName, first.NotAfter.Format(time.RFC3339))
+		out.fallback = "serving it anyway"
+	case left < ts.ExpiryWarning:
+		out.status = PreflightWarn
+		out.detail += fmt.Sprintf(" (in %v)", left.Round(time.Hour))
+	}
+	return out
+}
+
+// checkStore loads the state files the server will use, as it will load
+// them, and makes sure their directories take the files it writes. The
+// files carry no version: a file that parses is one this version reads.
+func checkStore(_ context.Context, cfg Config) preflightOutcome {
+	var problems []string
+	var disable []func(*Config)
+	fail := func(err error, off func(*Config)) {
+		problems = append(problems, err.Error())
+		disable = append(disable, off)
+	}
+
+	if path := cfg.Incidents.StateFile; path != "" {
+		if _, err := NewIncidentStore(cfg.Incidents); err != nil {
+			fail(err, func(c *Config) { c.Incidents.StateFile = "" })
+		} else if err := checkWritable(path); err != nil {
+			fail(err, func(c *Config) { c.Incidents.StateFile = "" })
+		}
+	}
+	if path := cfg.History.StateFile; path != "" {
+		if _, err := NewMetricsHistory(cfg.History); err != nil {
+			fail(err, func(c *Config) { c.History.StateFile = "" })
+		} else if err := checkWritable(path); err != nil {
+			fail(err, func(c *Config) { c.History.StateFile = "" })
+		}
+	}
+	// Uptime history is only kept when beacons or probes feed the registry
+	if path := cfg.Uptime.StateFile; path != "" && (cfg.Beacon.Addr != "" || len(cfg.Probes.Targets) > 0) {
+		if _, err := NewUptimeTracker(cfg.Uptime, nil); err != nil {
+			fail(err, func(c *Config) { c.Uptime.StateFile = "" })
+		} else if err := checkWritable(path); err != nil {
+			fail(err, func(c *Config) { c.Uptime.StateFile = "" })
+		}
+	}
+
+	if len(problems) == 0 {
+		if cfg.Incidents.StateFile == "" && cfg.History.StateFile == "" && cfg.Uptime.StateFile == "" {
+			return preflightOutcome{status: PreflightSkipped, detail: "no state files"}
+		}
+		return preflightOutcome{status: PreflightOK}
+	}
+	return preflightOutcome{
+		status:   PreflightFailed,
+		detail:   strings.Join(problems, "; "),
+		fallback: "not loading or saving those state files",
+		degrade: func(c *Config) {
+			for _, off := range disable {
+				off(c)
+			}
+		},
+	}
+}
+
+// checkWritable creates and removes a file next to path, the way state
+// files are saved (a temporary file renamed over the old one).
+func checkWritable(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".preflight-*")
+	if err != nil {
+		return fmt.Errorf("state file %s not writable: %w", path, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkGeoIP opens the GeoIP databases.
+func checkGeoIP(_ context.Context, cfg Config) preflightOutcome {
+	if cfg.GeoIP.CountryDB == "" && cfg.GeoIP.ASNDB == "" {
+		return preflightOutcome{status: PreflightSkipped, detail: "no GeoIP databases"}
+	}
+	gr, err := NewGeoResolver(cfg.GeoIP.CountryDB, cfg.GeoIP.ASNDB)
+	if err != nil {
+		return preflightOutcome{status: PreflightFailed, detail: err.Error(), fallback: "GeoIP lookups disabled"}
+	}
+	gr.Close()
+	return preflightOutcome{status: PreflightOK}
+}
+
+// checkBroker connects to the cluster's Redis server and pings it.
+func checkBroker(ctx context.Context, cfg Config) preflightOutcome {
+	if !cfg.Cluster.Enabled() {
+		return preflightOutcome{status: PreflightSkipped, detail: "single instance"}
+	}
+	rc, err := dialRedis(ctx, cfg.Cluster.RedisAddr, cfg.Cluster.RedisPassword)
+	if err == nil {
+		_, err = rc.do("PING")
+		rc.Close()
+	}
+	if err != nil {
+		return preflightOutcome{status: PreflightFailed, detail: fmt.Sprintf("redis %s: %v", cfg.Cluster.RedisAddr, err),
+			fallback: "running alone until Redis is reachable"}
+	}
+	return preflightOutcome{status: PreflightOK, detail: "redis " + cfg.Cluster.RedisAddr}
+}
+
+// handleReadyz reports whether the server is ready: "ready", or "degraded"
+// when a preflight check failed without stopping it, with the check
+// results. Both answer 200 - a degraded server still serves. Servers
+// mounted through Handler have no preflight results and are always ready.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := s.readiness.Load()
+	body := struct {
+		Status string           `json:"status"`
+		Checks []PreflightCheck `json:"checks,omitempty"`
+	}{Status: "ready"}
+	if report != nil {
+		body.Checks = report.Checks
+		if report.Degraded() {
+			body.Status = "degraded"
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, body)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ProbeTarget is a device endpoint the server checks actively. URL is either
+// tcp://host:port (connect check) or http(s)://... (GET, 2xx/3xx = reachable).
+type ProbeTarget struct {
+	Device string `yaml:"device"` // Device ID the result is recorded under
+	URL    string `yaml:"url"`    // Endpoint to probe
+}
+
+// ProbeSettings configures the active reachability prober.
+type ProbeSettings struct {
+	Interval time.Duration `yaml:"interval"` // Time between probe rounds
+	Timeout  time.Duration `yaml:"timeout"`  // Max time per probe
+	Targets  []ProbeTarget `yaml:"targets"`  // Endpoints to probe - empty disables probing
+}
+
+// ProbeResult is the outcome of the most recent probe of a device.
+type ProbeResult struct {
+	URL       string    `json:"url"`
+	Reachable bool      `json:"reachable"`
+	LatencyMs int64     `json:"latency_ms"`      // Round trip of the last probe
+	CheckedAt time.Time `json:"checked_at"`      // When the last probe finished
+	Failures  int       `json:"failures"`        // Consecutive failed probes
+	Error     string    `json:"error,omitempty"` // Why the last probe failed
+}
+
+// Prober periodically checks registered device endpoints from the server
+// side and records the results in the DeviceRegistry, so /devices shows
+// beacon liveness and active reachability side by side. Useful for devices
+// that expose a callback endpoint but can't be trusted to report themselves.
+type Prober struct {
+	cfg      ProbeSettings
+	registry *DeviceRegistry
+	client   *http.Client
+	dialer   net.Dialer
+
+	targets []ProbeTarget // Registered endpoints
+	mu      sync.Mutex    // Protects targets
+}
+
+// NewProber creates a prober for the configured targets. Call Run to start probing.
+func NewProber(cfg ProbeSettings, registry *DeviceRegistry) *Prober {
+	return &Prober{
+		cfg:      cfg,
+		registry: registry,
+		// Don't follow redirects: a 3xx already proves the endpoint is up
+		client: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}},
+		targets: append([]ProbeTarget(nil), cfg.Targets...),
+	}
+}
+
+// Add registers another endpoint; it is probed from the next round on.
+func (p *Prober) Add(t ProbeTarget) {
+	p.mu.Lock()
+	p.targets = append(p.targets, t)
+	p.mu.Unlock()
+}
+
+// Run probes all targets every Interval until ctx is cancelled.
+func (p *Prober) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.round(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// round probes every target concurrently and waits for all of them, so a
+// slow endpoint delays only its own result, never a whole round.
+func (p *Prober) round(ctx context.Context) {
+	p.mu.Lock()
+	targets := append([]ProbeTarget(nil), p.targets...)
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t ProbeTarget) {
+			defer wg.Done()
+			start := time.Now()
+			err := p.check(ctx, t.URL)
+			if ctx.Err() != nil {
+				return // Shutting down - don't record a bogus failure
+			}
+			p.record(t, time.Since(start), err)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// check performs one probe. Returns nil if the endpoint is reachable.
+func (p *Prober) check(ctx context.Context, rawURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		conn, err := p.dialer.DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("endpoint returned %s", resp.Status)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported probe scheme %q", u.Scheme)
+	}
+}
+
+// record stores a probe outcome and audits reachability changes.
+func (p *Prober) record(t ProbeTarget, latency time.Duration, err error) {
+	result := ProbeResult{
+		URL:       t.URL,
+		Reachable: err == nil,
+		LatencyMs: latency.Milliseconds(),
+		CheckedAt: time.Now(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	prev, changed := p.registry.RecordProbe(t.Device, result)
+	if !changed {
+		return
+	}
+
+	decision := "up"
+	if err != nil {
+		decision = "down"
+	}
+	if prev != nil || err != nil { // First successful probe isn't news
+		slog.Info("Device probe result", "device", t.Device, "state", decision, "url", t.URL, "error", result.Error)
+		auditLog.Record(AuditEvent{
+			Type:       "probe",
+			RemoteAddr: t.URL,
+			Decision:   decision,
+			Reason:     result.Error,
+			Fields:     map[string]string{"device": t.Device},
+		})
+	}
+}
+
+// proberFromConfig creates the prober when targets are configured.
+func proberFromConfig(ps ProbeSettings, registry *DeviceRegistry) *Prober {
+	if len(ps.Targets) == 0 {
+		return nil
+	}
+	return NewProber(ps, registry)
+}
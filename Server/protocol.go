@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// Message is the envelope of application messages on connections that
+// negotiated protocol version 1 or later (see internal/protocol).
+type Message = protocol.Message
+
+// MessageError is the payload of a MessageTypeError message.
+type MessageError = protocol.ErrorPayload
+
+// Protocol versions and the header that negotiates them during the upgrade.
+const (
+	ProtocolRaw     = protocol.VersionRaw // Plain text messages (clients that don't negotiate)
+	ProtocolV1      = protocol.Version1   // JSON Message envelopes
+	ProtocolCurrent = protocol.Current
+
+	HeaderProtocolVersion = protocol.HeaderVersion
+)
+
+// Built-in message types and error codes.
+const (
+	MessageTypeMessage = protocol.TypeMessage
+	MessageTypeEcho    = protocol.TypeEcho
+	MessageTypeError   = protocol.TypeError
+
+	ErrorCodeInvalidMessage  = protocol.CodeInvalidMessage
+	ErrorCodeUnsupportedType = protocol.CodeUnsupportedType
+)
+
+// Codec encodes envelopes for the wire; it is negotiated as the WebSocket
+// subprotocol. Connections without one use CodecJSON.
+type Codec = protocol.Codec
+
+// Built-in codecs, offered to clients in this order of preference.
+var (
+	CodecProtobuf = protocol.Protobuf // Subprotocol "cysl.protobuf", binary frames
+	CodecMsgPack  = protocol.MsgPack  // Subprotocol "cysl.msgpack", binary frames
+	CodecJSON     = protocol.JSON     // Subprotocol "cysl.json" or none, text frames
+)
+
+// NewMessage encodes a message of type typ with payload in the codec of
+// the connection ctx belongs to, ready to return from OnMessage. It
+// travels on the stream of ctx, see WithStream, and carries its trace ID,
+// see WithTraceID.
+func NewMessage(ctx context.Context, typ string, payload any) ([]byte, error) {
+	m, err := protocol.New(typ, payload)
+	if err != nil {
+		return nil, err
+	}
+	m.Stream, m.TraceID = StreamFromContext(ctx), TraceIDFromContext(ctx)
+	return CodecFromContext(ctx).Encode(m)
+}
+
+// NewReply encodes a message of type typ answering req, in the codec of
+// the connection ctx belongs to. Its ReplyTo is req's ID, so the client
+// can match it with the request - client.Client's Call waits for it - it
+// travels on req's stream and carries the trace ID of ctx (or of req
+// outside a handler).
+// Handlers answering requests reply with it instead of NewMessage.
+func NewReply(ctx context.Context, req Message, typ string, payload any) ([]byte, error) {
+	m, err := protocol.NewReply(req, typ, payload)
+	if err != nil {
+		return nil, err
+	}
+	if id := TraceIDFromContext(ctx); id != "" {
+		m.TraceID = id
+	}
+	return CodecFromContext(ctx).Encode(m)
+}
+
+// DecodeMessage parses an envelope in the codec of the connection ctx
+// belongs to.
+func DecodeMessage(ctx context.Context, data []byte) (Message, error) {
+	return CodecFromContext(ctx).Decode(data)
+}
+
+// errorMessage encodes a MessageTypeError reply. Encoding a string payload
+// can't fail, so errors are not returned.
+func errorMessage(ctx context.Context, code, msg string) []byte {
+	data, _ := NewMessage(ctx, protocol.TypeError, MessageError{Code: code, Message: msg})
+	return data
+}
+
+// errorReply is errorMessage answering req.
+func errorReply(ctx context.Context, req Message, code, msg string) []byte {
+	data, _ := NewReply(ctx, req, protocol.TypeError, MessageError{Code: code, Message: msg})
+	return data
+}
+
+// protocolKey and codecKey are the context keys for the connection's
+// protocol version and codec.
+type (
+	protocolKey struct{}
+	codecKey    struct{}
+)
+
+// withProtocolVersion returns a copy of ctx carrying the negotiated version.
+func withProtocolVersion(ctx context.Context, version int) context.Context {
+	return context.WithValue(ctx, protocolKey{}, version)
+}
+
+// withCodec returns a copy of ctx carrying the negotiated codec.
+func withCodec(ctx context.Context, c Codec) context.Context {
+	return context.WithValue(ctx, codecKey{}, c)
+}
+
+// CodecFromContext returns the codec the connection negotiated as its
+// subprotocol; CodecJSON if none was.
+func CodecFromContext(ctx context.Context) Codec {
+	if c, ok := ctx.Value(codecKey{}).(Codec); ok {
+		return c
+	}
+	return CodecJSON
+}
+
+// codecSubprotocols lists the codecs' subprotocols in order of preference;
+// Accept picks the first one the client offers.
+var codecSubprotocols = protocol.Subprotocols(protocol.Codecs()...)
+
+// ProtocolVersionFromContext returns the protocol version the connection
+// negotiated during the upgrade. Handlers use it to decide between
+// envelopes and raw text; ProtocolRaw if none was negotiated.
+func ProtocolVersionFromContext(ctx context.Context) int {
+	v, _ := ctx.Value(protocolKey{}).(int)
+	return v
+}
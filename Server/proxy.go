@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxySettings describes the reverse proxies in front of the server.
+// Behind a proxy every connection arrives from the proxy's address, so
+// without this the per-IP limit throttles all clients together and logs
+// and audit events show the proxy instead of the client.
+type ProxySettings struct {
+	// TrustedProxies lists proxy addresses or CIDRs (env TRUSTED_PROXIES,
+	// comma-separated). Only requests arriving from them may set the client
+	// address via X-Forwarded-For or X-Real-IP - anyone else could forge it.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// ProxyProtocol expects a PROXY protocol header (v1 or v2) on every
+	// connection from a trusted proxy, e.g. from HAProxy or an AWS NLB
+	// (env PROXY_PROTOCOL). Connections from other addresses are served
+	// as they are.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+}
+
+// validate checks the proxy list.
+func (ps ProxySettings) validate() []ValidationError {
+	var errs []ValidationError
+	if _, err := ParseTrustedProxies(ps.TrustedProxies); err != nil {
+		errs = append(errs, ValidationError{"proxy.trusted_proxies", err.Error()})
+	}
+	if ps.ProxyProtocol && len(ps.TrustedProxies) == 0 {
+		errs = append(errs, ValidationError{"proxy.proxy_protocol", "requires trusted_proxies - any client could claim any address"})
+	}
+	return errs
+}
+
+// TrustedProxies decides which peers may report the client's address and
+// derives that address. Methods are nil-safe: a nil list trusts nobody.
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// ParseTrustedProxies parses addresses ("10.0.0.1") and CIDRs
+// ("10.0.0.0/8"). Returns nil for an empty list.
+func ParseTrustedProxies(list []string) (*TrustedProxies, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	nets, err := parseCIDRs(list)
+	if err != nil {
+		return nil, err
+	}
+	return &TrustedProxies{nets: nets}, nil
+}
+
+// trustedProxiesFromConfig returns the configured proxies, or nil when
+// none are (or the list is invalid - validation reports that).
+func trustedProxiesFromConfig(ps ProxySettings) *TrustedProxies {
+	tp, _ := ParseTrustedProxies(ps.TrustedProxies)
+	return tp
+}
+
+// Contains reports whether ip belongs to a trusted proxy.
+func (tp *TrustedProxies) Contains(ip net.IP) bool {
+	if tp == nil || ip == nil {
+		return false
+	}
+	return netsContain(tp.nets, ip)
+}
+
+// ClientAddr returns the address of the client behind r as "ip:port".
+// For requests from a trusted proxy the IP comes from X-Forwarded-For -
+// the rightmost entry that isn't itself a trusted proxy, since everything
+// left of it was written by the client and can be forged - or else from
+// X-Real-IP. The port stays the one of the proxy's connection, so
+// concurrent connections keep distinct addresses. Other requests keep
+// RemoteAddr.
+func (tp *TrustedProxies) ClientAddr(r *http.Request) string {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !tp.Contains(net.ParseIP(host)) {
+		return r.RemoteAddr
+	}
+	if ip := tp.forwardedFor(r.Header.Values("X-Forwarded-For")); ip != nil {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	return r.RemoteAddr
+}
+
+// forwardedFor walks the X-Forwarded-For chain from the nearest hop and
+// returns the first address that isn't a trusted proxy. A malformed entry
+// ends the walk: nothing beyond it can be trusted.
+func (tp *TrustedProxies) forwardedFor(values []string) net.IP {
+	var hops []string
+	for _, v := range values {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	var last net.IP // Leftmost valid hop - used when every hop is a proxy
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.Trim(hostFromAddr(strings.TrimSpace(hops[i])), "[]"))
+		if ip == nil {
+			return last
+		}
+		if !tp.Contains(ip) {
+			return ip
+		}
+		last = ip
+	}
+	return last
+}
+
+// proxyHeaderTimeout bounds the wait for a PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyListener reads PROXY protocol headers from connections accepted
+// from trusted proxies.
+type proxyListener struct {
+	net.Listener
+	trusted *TrustedProxies
+}
+
+// proxyListenerFromConfig wraps ln when the PROXY protocol is enabled.
+// Returns ln unchanged otherwise.
+func proxyListenerFromConfig(ln net.Listener, ps ProxySettings, tp *TrustedProxies) net.Listener {
+	if !ps.ProxyProtocol || tp == nil {
+		return ln
+	}
+	return &proxyListener{Listener: ln, trusted: tp}
+}
+
+// Accept wraps connections from trusted proxies. The header is read on
+// first use - from the connection's own goroutine, so a slow proxy can't
+// stall the accept loop.
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	c, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !pl.trusted.Contains(tcp.IP) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn is a connection whose first bytes are a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr // Client address from the header (nil = keep the proxy's)
+	err    error    // Header parse error - fails every Read
+}
+
+// init reads the header once.
+func (pc *proxyConn) init() {
+	pc.once.Do(func() {
+		pc.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		pc.remote, pc.err = readProxyHeader(pc.r)
+		pc.Conn.SetReadDeadline(time.Time{})
+		if pc.err != nil {
+			slog.Warn("Invalid PROXY protocol header", "proxy", pc.Conn.RemoteAddr().String(), "error", pc.err)
+		}
+	})
+}
+
+// Read returns the data after the header.
+func (pc *proxyConn) Read(p []byte) (int, error) {
+	pc.init()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	return pc.r.Read(p)
+}
+
+// RemoteAddr returns the client's address from the header.
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.init()
+	if pc.remote != nil {
+		return pc.remote
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errNoProxyHeader is returned when a trusted proxy sent no header.
+var errNoProxyHeader = errors.New("missing PROXY protocol header")
+
+// readProxyHeader parses a v1 or v2 header. It returns a nil address for
+// headers that carry none (v1 UNKNOWN, v2 LOCAL health checks).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(5)
+	if err != nil {
+		return nil, errNoProxyHeader
+	}
+	if string(start) == "PROXY" {
+		return readProxyV1(r)
+	}
+	if sig, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	return nil, errNoProxyHeader
+}
+
+// readProxyV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("malformed PROXY v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 parses the binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, errors.New("truncated PROXY v2 header")
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.New("truncated PROXY v2 header")
+	}
+	if hdr[12]&0x0f == 0 {
+		return nil, nil // LOCAL: the proxy's own connection, e.g. a health check
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET: src, dst, sport, dport
+		if len(body) >= 12 {
+			return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+		}
+	case 2: // AF_INET6
+		if len(body) >= 36 {
+			return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+		}
+	default:
+		return nil, nil // AF_UNSPEC or AF_UNIX: no usable address
+	}
+	return nil, errors.New("truncated PROXY v2 address")
+}
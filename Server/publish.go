@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// PublishSettings configure POST /publish, which lets systems without a
+// WebSocket connection - cron jobs, other services - inject messages into
+// chat rooms, hub topics or single connections. Without a token the
+// endpoint is not mounted. Its token is separate from the admin token, so
+// publishers get no admin rights.
+type PublishSettings struct {
+	Token string       `yaml:"token"` // Bearer token for POST /publish (env PUBLISH_TOKEN)
+	Rate  RateSettings `yaml:"rate"`  // Publish requests per second, shared by all publishers (env PUBLISH_RATE, PUBLISH_BURST)
+}
+
+// DefaultPublishSettings returns the endpoint off, limited to 10 requests
+// per second with bursts of 20 once it has a token.
+func DefaultPublishSettings() PublishSettings {
+	return PublishSettings{Rate: RateSettings{Rate: 10, Burst: 20}}
+}
+
+// Enabled reports whether POST /publish should be served.
+func (ps PublishSettings) Enabled() bool {
+	return ps.Token != ""
+}
+
+// validate checks the token and the rate limit.
+func (ps PublishSettings) validate() []ValidationError {
+	var errs []ValidationError
+	if ps.Token != "" && len(ps.Token) < 16 {
+		errs = append(errs, ValidationError{"publish.token", "must be at least 16 bytes"})
+	}
+	if ps.Rate.Rate < 0 {
+		errs = append(errs, ValidationError{"publish.rate.rate", "must not be negative"})
+	}
+	if ps.Rate.enabled() && ps.Rate.Burst < 1 {
+		errs = append(errs, ValidationError{"publish.rate.burst", "must be at least 1"})
+	}
+	return errs
+}
+
+// maxPublishBody bounds the body of a publish request.
+const maxPublishBody = 1 << 20
+
+// publishRequest is the body of POST /publish. Exactly one target is set:
+//
+//	{"room":"lobby","message":{"type":"system","payload":"Back at 3pm"}}
+//	{"topic":"sensors/kitchen","message":{"type":"reading","payload":{"temp":21.5}}}
+//	{"conn_id":"3f2a...","message":{"type":"notice","payload":"Your export is ready"}}
+type publishRequest struct {
+	Room    string  `json:"room,omitempty"`    // Chat room (/chat/{room})
+	Topic   string  `json:"topic,omitempty"`   // Hub topic, relayed to the other instances of a cluster
+	ConnID  ConnID  `json:"conn_id,omitempty"` // One connection, or its parked session
+	Message Message `json:"message"`           // Envelope to deliver
+}
+
+// publishResponse answers an accepted publish request.
+type publishResponse struct {
+	ID        string `json:"id"`        // The message's ID
+	TraceID   string `json:"trace_id"`  // The message's trace ID, see WithTraceID
+	Delivered int    `json:"delivered"` // Connections on this instance that queued it
+}
+
+// target names the request's target for logs and the audit trail, or
+// returns an error unless exactly one is set.
+func (pr publishRequest) target() (string, error) {
+	var targets []string
+	if pr.Room != "" {
+		targets = append(targets, "room "+pr.Room)
+	}
+	if pr.Topic != "" {
+		targets = append(targets, "topic "+pr.Topic)
+	}
+	if pr.ConnID != "" {
+		targets = append(targets, "connection "+string(pr.ConnID))
+	}
+	if len(targets) != 1 {
+		return "", errors.New("exactly one of room, topic and conn_id must be set")
+	}
+	return targets[0], nil
+}
+
+// publisher serves POST /publish.
+type publisher struct {
+	s          *Server
+	limit      *TokenBucket // nil = unlimited
+	retryAfter int          // Seconds one token takes to refill, at least one
+}
+
+// registerPublishRoute mounts POST /publish behind ps's token.
+func (s *Server) registerPublishRoute(mux *http.ServeMux, ps PublishSettings) {
+	p := &publisher{s: s, limit: NewTokenBucket(ps.Rate.Rate, ps.Rate.Burst), retryAfter: 1}
+	if ps.Rate.enabled() {
+		p.retryAfter = max(1, int(math.Ceil(1/ps.Rate.Rate)))
+	}
+	mux.Handle("POST /publish", requireToken("publish", ps.Token, p))
+}
+
+// ServeHTTP delivers the message of a publish request. Room and topic
+// messages are answered with how many local connections queued them, a
+// message for one connection with 1 once it was queued (or handed to the
+// connection's session). Every request, accepted or not, is audited.
+func (p *publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fields := map[string]string{"request_id": RequestIDFromContext(r.Context())}
+	reject := func(status int, msg string) {
+		auditLog.Record(AuditEvent{Type: "publish", RemoteAddr: r.RemoteAddr, Decision: "reject", Reason: msg, Fields: fields})
+		httpError(w, r, msg, status)
+	}
+	if !p.limit.Allow() {
+		w.Header().Set("Retry-After", strconv.Itoa(p.retryAfter))
+		reject(http.StatusTooManyRequests, "publish rate limit exceeded")
+		return
+	}
+	var req publishRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBody)).Decode(&req); err != nil {
+		reject(http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	target, err := req.target()
+	if err != nil {
+		reject(http.StatusBadRequest, err.Error())
+		return
+	}
+	fields["target"] = target
+	if err := req.check(); err != nil {
+		reject(http.StatusBadRequest, err.Error())
+		return
+	}
+	m := req.Message
+	if m.Type == "" {
+		reject(http.StatusBadRequest, "message.type must be set")
+		return
+	}
+	if m.ID == "" {
+		m.ID = protocol.NewID()
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now().UTC()
+	}
+	if !validRequestID(m.TraceID) {
+		m.TraceID = NewTraceID()
+	}
+	fields["type"], fields["id"], fields["trace_id"] = m.Type, m.ID, m.TraceID
+	// Queued messages outlive the request, so only its values are kept
+	ctx := WithTraceID(context.WithoutCancel(r.Context()), m.TraceID)
+
+	n, err := p.deliver(ctx, req, m)
+	switch {
+	case errors.Is(err, ErrRoomNotFound), errors.Is(err, ErrUnknownConn):
+		reject(http.StatusNotFound, err.Error())
+		return
+	case err != nil: // e.g. a full queue or the memory budget
+		reject(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	fields["delivered"] = strconv.Itoa(n)
+	auditLog.Record(AuditEvent{Type: "publish", RemoteAddr: r.RemoteAddr, Decision: "accept", Fields: fields})
+	LoggerFromContext(ctx).Info("Published message", "target", target, "type", m.Type, "delivered", n)
+	writeAdminJSON(w, http.StatusAccepted, publishResponse{ID: m.ID, TraceID: m.TraceID, Delivered: n})
+}
+
+// check validates what the target needs: room messages a string payload,
+// which becomes the chat message's body, and topics a name clients could
+// subscribe to.
+func (pr publishRequest) check() error {
+	if pr.Room != "" {
+		var body string
+		if json.Unmarshal(pr.Message.Payload, &body) != nil {
+			return errors.New("room messages need a string payload")
+		}
+	}
+	if pr.Topic != "" {
+		if err := validateClientTopic(pr.Topic); err != nil {
+			return fmt.Errorf("topic: %w", err)
+		}
+	}
+	return nil
+}
+
+// deliver hands m to the request's target. Chat rooms get it as a
+// ChatMessage from "server"; topics and connections get the JSON envelope.
+func (p *publisher) deliver(ctx context.Context, req publishRequest, m Message) (int, error) {
+	if req.Room != "" {
+		var body string
+		json.Unmarshal(m.Payload, &body) // Checked by check
+		return BroadcastToRoom(req.Room, ChatMessage{
+			Type:      m.Type,
+			Sender:    "server",
+			Body:      body,
+			TraceID:   m.TraceID,
+			Timestamp: m.Timestamp,
+		})
+	}
+	data, err := protocol.Encode(m)
+	if err != nil {
+		return 0, err
+	}
+	if req.Topic != "" {
+		return p.s.hub.PublishContext(ctx, req.Topic, data), nil
+	}
+	if err := p.s.hub.SendToContext(ctx, req.ConnID, data); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const publishToken = "publish-token-0123456789"
+
+// publishServer serves the server's full mux with POST /publish behind
+// publishToken, limited to rate requests per second.
+func publishServer(t *testing.T, rate RateSettings) (*Server, *httptest.Server) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.CrashDump.Dir = t.TempDir()
+	cfg.Publish = PublishSettings{Token: publishToken, Rate: rate}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		s.Shutdown(context.Background())
+	})
+	return s, srv
+}
+
+// publish posts body to /publish with token and returns the response.
+func publish(t *testing.T, srv *httptest.Server, token, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/publish", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// TestPublishDelivers checks that POST /publish reaches chat rooms and
+// single connections, refuses bad requests and audits what it accepts.
+func TestPublishDelivers(t *testing.T) {
+	prev := auditLog
+	auditLog, _ = NewAuditLogger("") // Embedded servers don't set one up
+	t.Cleanup(func() { auditLog = prev })
+	s, srv := publishServer(t, RateSettings{Rate: 100, Burst: 100})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/chat/publish-room", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.CloseNow()
+	read := func() []byte {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return data
+	}
+	read() // Our own join
+
+	resp := publish(t, srv, publishToken, `{"room":"publish-room","message":{"type":"system","trace_id":"cron-7","payload":"Back at 3pm"}}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("room publish = %s, want 202", resp.Status)
+	}
+	var chat ChatMessage
+	if err := json.Unmarshal(read(), &chat); err != nil || chat.Type != ChatMessageSystem || chat.Body != "Back at 3pm" || chat.TraceID != "cron-7" {
+		t.Fatalf("room got %+v (%v), want the system message with trace cron-7", chat, err)
+	}
+
+	id := s.hub.Conns()[0].ID
+	resp = publish(t, srv, publishToken, `{"conn_id":"`+string(id)+`","message":{"type":"notice","payload":"Your export is ready"}}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("connection publish = %s, want 202", resp.Status)
+	}
+	m, err := CodecJSON.Decode(read())
+	if err != nil || m.Type != "notice" || m.ID == "" || m.TraceID == "" || string(m.Payload) != `"Your export is ready"` {
+		t.Fatalf("connection got %+v (%v), want the notice with an ID and trace ID", m, err)
+	}
+	var audited bool
+	for _, ev := range auditLog.Recent() {
+		audited = audited || (ev.Type == "publish" && ev.Decision == "accept" && ev.Fields["id"] == m.ID && ev.Fields["target"] == "connection "+string(id))
+	}
+	if !audited {
+		t.Error("accepted publish not in the audit log")
+	}
+
+	for _, tt := range []struct {
+		name, token, body string
+		status            int
+	}{
+		{"no token", "", `{"topic":"news","message":{"type":"notice"}}`, http.StatusUnauthorized},
+		{"wrong token", "admin-token-0123456789", `{"topic":"news","message":{"type":"notice"}}`, http.StatusUnauthorized},
+		{"two targets", publishToken, `{"topic":"news","room":"publish-room","message":{"type":"notice"}}`, http.StatusBadRequest},
+		{"no type", publishToken, `{"topic":"news","message":{"payload":1}}`, http.StatusBadRequest},
+		{"server topic", publishToken, `{"topic":"$health","message":{"type":"notice"}}`, http.StatusBadRequest},
+		{"room payload not a string", publishToken, `{"room":"publish-room","message":{"type":"system","payload":{}}}`, http.StatusBadRequest},
+		{"unknown room", publishToken, `{"room":"nobody-here","message":{"type":"system","payload":"hi"}}`, http.StatusNotFound},
+		{"unknown connection", publishToken, `{"conn_id":"gone","message":{"type":"notice"}}`, http.StatusNotFound},
+	} {
+		if resp := publish(t, srv, tt.token, tt.body); resp.StatusCode != tt.status {
+			t.Errorf("%s: %s, want %d", tt.name, resp.Status, tt.status)
+		}
+	}
+}
+
+// TestPublishRateLimited checks that publishers share the rate limit and
+// are told when to retry.
+func TestPublishRateLimited(t *testing.T) {
+	_, srv := publishServer(t, RateSettings{Rate: 0.5, Burst: 1})
+	body := `{"topic":"news","message":{"type":"notice"}}`
+	if resp := publish(t, srv, publishToken, body); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("first publish = %s, want 202", resp.Status)
+	}
+	resp := publish(t, srv, publishToken, body)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" {
+		t.Fatalf("second publish = %s with Retry-After %q, want 429 and 2", resp.Status, resp.Header.Get("Retry-After"))
+	}
+}
+
+// TestPublishDisabledWithoutToken checks that POST /publish is only
+// mounted with a token, and that short tokens are refused.
+func TestPublishDisabledWithoutToken(t *testing.T) {
+	s, err := NewServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/publish", strings.NewReader("{}")))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("POST /publish without a token = %d, want 404", rec.Code)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Publish.Token = "short"
+	if _, err := NewServer(cfg); err == nil || !strings.Contains(err.Error(), "publish.token") {
+		t.Fatalf("NewServer with a short token = %v, want a publish.token error", err)
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coder/websocket"
+)
+
+// PubSubSettings configures topic subscriptions by clients. When enabled,
+// a connection subscribes itself with a control message and from then on
+// receives what is published to the topic (Hub.Publish, or topic.publish
+// over /rpc). Without it, subscribe messages reach the handler like any
+// other.
+type PubSubSettings struct {
+	Enabled          bool `yaml:"enabled"`           // Answer subscribe/unsubscribe messages (env PUBSUB_ENABLED)
+	MaxSubscriptions int  `yaml:"max_subscriptions"` // Topics one connection may be subscribed to (env PUBSUB_MAX_SUBSCRIPTIONS)
+}
+
+// DefaultPubSubSettings returns the defaults: off, and 100 topics per
+// connection once enabled.
+func DefaultPubSubSettings() PubSubSettings {
+	return PubSubSettings{MaxSubscriptions: 100}
+}
+
+// validate checks the subscription limit.
+func (ps PubSubSettings) validate() []ValidationError {
+	if ps.Enabled && ps.MaxSubscriptions <= 0 {
+		return []ValidationError{{"pubsub.max_subscriptions", "must be positive"}}
+	}
+	return nil
+}
+
+// Topic wildcards, MQTT style: levels are separated by "/", "+" stands for
+// exactly one level and a trailing "#" for any number of remaining levels,
+// including none. "sensors/+/temp" matches "sensors/kitchen/temp";
+// "sensors/#" matches "sensors" and everything below it. Topics starting
+// with "$" belong to the server (e.g. health watches) and are only reached
+// by their exact name.
+const (
+	topicSeparator   = "/"
+	topicWildcardOne = "+"
+	topicWildcardAll = "#"
+	maxTopicLength   = 256
+)
+
+// isTopicPattern reports whether topic contains wildcards.
+func isTopicPattern(topic string) bool {
+	return strings.ContainsAny(topic, topicWildcardOne+topicWildcardAll)
+}
+
+// topicMatch reports whether topic is matched by pattern, which may
+// contain wildcards.
+func topicMatch(pattern, topic string) bool {
+	if !isTopicPattern(pattern) {
+		return pattern == topic
+	}
+	if strings.HasPrefix(topic, "$") {
+		return false // Server topics are only reached by name
+	}
+	levels := strings.Split(topic, topicSeparator)
+	for i, p := range strings.Split(pattern, topicSeparator) {
+		switch {
+		case p == topicWildcardAll:
+			return true
+		case i >= len(levels):
+			return false
+		case p != topicWildcardOne && p != levels[i]:
+			return false
+		}
+	}
+	return len(strings.Split(pattern, topicSeparator)) == len(levels)
+}
+
+// ErrTooManySubscriptions is returned when a client subscribes to more
+// topics than PubSubSettings.MaxSubscriptions allows.
+var ErrTooManySubscriptions = errors.New("too many subscriptions")
+
+// errTopicReserved refuses client subscriptions to server topics.
+var errTopicReserved = errors.New(`topics starting with "$" are reserved`)
+
+// validateClientTopic checks a topic or pattern a client asked for.
+func validateClientTopic(topic string) error {
+	switch {
+	case topic == "":
+		return errors.New("topic must not be empty")
+	case len(topic) > maxTopicLength:
+		return fmt.Errorf("topic is longer than %d bytes", maxTopicLength)
+	case strings.HasPrefix(topic, "$"):
+		return errTopicReserved
+	}
+	levels := strings.Split(topic, topicSeparator)
+	for i, level := range levels {
+		if level == topicWildcardAll && i != len(levels)-1 {
+			return errors.New(`"#" must be the last level`)
+		}
+		if level != topicWildcardOne && level != topicWildcardAll && isTopicPattern(level) {
+			return errors.New(`wildcards must stand for a whole level`)
+		}
+	}
+	return nil
+}
+
+// subscribeRequest is a subscription control message from a client:
+//
+//	{"type":"subscribe","topic":"sensors/+/temp"}
+//	{"type":"unsubscribe","topic":"sensors/+/temp"}
+type subscribeRequest struct {
+	Type  string `json:"type"`
+	Topic string `json:"topic"`
+}
+
+// subscribeReply answers a subscription request.
+type subscribeReply struct {
+	Type  string `json:"type"` // "subscribed", "unsubscribed" or "subscribe_error"
+	Topic string `json:"topic"`
+	Error string `json:"error,omitempty"`
+}
+
+// handle consumes subscribe and unsubscribe messages from the read loop
+// and replies on the connection. Returns false for every other message,
+// and for every message when subscriptions are disabled.
+func (ps PubSubSettings) handle(hc *HubConn, msgType websocket.MessageType, data []byte) bool {
+	if !ps.Enabled || msgType != websocket.MessageText || len(data) == 0 || data[0] != '{' {
+		return false
+	}
+	var req subscribeRequest
+	if json.Unmarshal(data, &req) != nil || (req.Type != "subscribe" && req.Type != "unsubscribe") {
+		return false
+	}
+
+	reply := subscribeReply{Topic: req.Topic}
+	if err := validateClientTopic(req.Topic); err != nil {
+		reply.Type, reply.Error = "subscribe_error", err.Error()
+	} else if req.Type == "unsubscribe" {
+		hc.hub.Unsubscribe(hc.ID, req.Topic)
+		reply.Type = "unsubscribed"
+	} else if err := hc.hub.subscribeLimited(hc.ID, req.Topic, ps.MaxSubscriptions); err != nil {
+		reply.Type, reply.Error = "subscribe_error", err.Error()
+	} else {
+		reply.Type = "subscribed"
+		hc.logger.Debug("Subscribed", "topic", req.Topic)
+	}
+
+	if msg, err := json.Marshal(reply); err == nil {
+		hc.enqueue(msg)
+	}
+	return true
+}
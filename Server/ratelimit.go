@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// Rate limiters, as named in RateLimitError and the per-limiter metrics.
+const (
+	LimiterMessageRate       = "message_rate"        // Minimum interval between a connection's messages
+	LimiterConnectionsPerIP  = "connections_per_ip"  // Concurrent connections per client IP
+	LimiterIPMessageRate     = "ip_message_rate"     // Token bucket shared by a client IP's connections
+	LimiterGlobalMessageRate = "global_message_rate" // Token bucket shared by all connections
+)
+
+// RateLimiterStats counts one limiter's decisions.
+type RateLimiterStats struct {
+	Violations atomic.Int64 // Requests over the limit (throttled messages, refused connections)
+	Rejections atomic.Int64 // Requests refused or connections closed because of it
+}
+
+// RateLimitError describes a limit a client ran into and where it stands,
+// so clients can back off precisely instead of guessing. It is sent to the
+// client as JSON: in the close frame when the connection is closed for
+// violations, and as a {"type":"rate_limited",...} message when a message
+// was throttled but let through.
+type RateLimitError struct {
+	Limiter       string        // One of the Limiter* names
+	RemoteAddr    string        // Client the limit applies to
+	Violations    int           // Consecutive violations so far
+	MaxViolations int           // Violations tolerated before disconnecting
+	MinInterval   time.Duration // Required spacing of messages
+
+	// Token bucket limits (LimiterIPMessageRate, LimiterGlobalMessageRate)
+	Rate  float64 // Messages per second
+	Burst int     // Messages allowed at once
+}
+
+// Error implements the error interface.
+func (e *RateLimitError) Error() string {
+	if e.Rate > 0 {
+		return fmt.Sprintf("%s limit exceeded for %s (%g messages/s, burst %d)",
+			e.Limiter, e.RemoteAddr, e.Rate, e.Burst)
+	}
+	return fmt.Sprintf("message rate limit exceeded for %s (violations: %d/%d, min interval %v)",
+		e.RemoteAddr, e.Violations, e.MaxViolations, e.MinInterval)
+}
+
+// Is makes every RateLimitError match ErrRateLimited.
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// rateLimitInfo is the machine-readable form of a RateLimitError. It has
+// to fit a close frame's 123-byte reason, so fields a limiter doesn't use
+// are left out.
+type rateLimitInfo struct {
+	Type          string  `json:"type,omitempty"`  // "rate_limited" for in-band notices
+	Error         string  `json:"error,omitempty"` // "rate_limited" in close reasons
+	Limiter       string  `json:"limiter"`
+	Violations    int     `json:"violations,omitempty"`
+	MaxViolations int     `json:"max_violations,omitempty"`
+	MinIntervalMs int64   `json:"min_interval_ms,omitempty"`
+	Rate          float64 `json:"rate,omitempty"`
+	Burst         int     `json:"burst,omitempty"`
+}
+
+// info converts e for the wire.
+func (e *RateLimitError) info() rateLimitInfo {
+	return rateLimitInfo{
+		Limiter:       e.Limiter,
+		Violations:    e.Violations,
+		MaxViolations: e.MaxViolations,
+		MinIntervalMs: e.MinInterval.Milliseconds(),
+		Rate:          e.Rate,
+		Burst:         e.Burst,
+	}
+}
+
+// Notice returns the in-band message telling a client its message was
+// throttled, e.g.
+// {"type":"rate_limited","limiter":"message_rate","violations":2,"max_violations":3,"min_interval_ms":10000}.
+func (e *RateLimitError) Notice() []byte {
+	info := e.info()
+	info.Type = "rate_limited"
+	data, _ := json.Marshal(info)
+	return data
+}
+
+// closeRateLimited closes the connection with CloseRateLimited and a
+// machine-readable reason, e.g.
+// {"error":"rate_limited","limiter":"message_rate","violations":4,"max_violations":3,"min_interval_ms":10000}
+// or {"error":"rate_limited","limiter":"ip_message_rate","rate":20,"burst":50}.
+func closeRateLimited(conn *websocket.Conn, e *RateLimitError) error {
+	info := e.info()
+	info.Error = "rate_limited"
+	reason, _ := json.Marshal(info)
+	return CloseWith(conn, CloseRateLimited, string(reason))
+}
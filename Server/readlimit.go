@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/coder/websocket"
+)
+
+// MessageTooBigError is returned when a client message exceeds the read limit.
+// It wraps websocket.ErrMessageTooBig so errors.Is keeps working.
+type MessageTooBigError struct {
+	Limit int64 // Maximum allowed message size in bytes
+}
+
+// Error implements the error interface.
+func (e *MessageTooBigError) Error() string {
+	return fmt.Sprintf("message exceeds read limit of %d bytes", e.Limit)
+}
+
+// Unwrap returns websocket.ErrMessageTooBig.
+func (e *MessageTooBigError) Unwrap() error {
+	return websocket.ErrMessageTooBig
+}
+
+// readLimited reads one message, enforcing limit itself instead of relying on
+// conn.SetReadLimit. The library closes the connection on its own when its
+// limit is hit, leaving no chance to tell the client what went wrong; reading
+// through a LimitReader lets the caller send a structured close frame instead.
+// The connection's own read limit must be disabled (SetReadLimit(-1)).
+func readLimited(ctx context.Context, conn *websocket.Conn, limit int64) (websocket.MessageType, []byte, error) {
+	typ, r, err := conn.Reader(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Read one byte past the limit to detect oversized messages
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if int64(len(data)) > limit {
+		return typ, nil, &MessageTooBigError{Limit: limit}
+	}
+	return typ, data, nil
+}
+
+// closeMessageTooBig closes the connection with CloseMessageTooBig and a
+// machine-readable reason, e.g. {"error":"payload_too_large","max":1048576}.
+func closeMessageTooBig(conn *websocket.Conn, limit int64) error {
+	reason, _ := json.Marshal(struct {
+		Error string `json:"error"`
+		Max   int64  `json:"max"`
+	}{"payload_too_large", limit})
+	return CloseWith(conn, CloseMessageTooBig, string(reason))
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// recoverPanics is the first middleware after the upgrade: a panic in a
+// handler or a middleware ends only the connection it happened on (see
+// recoverConn). Other connections and the process carry on.
+func (s *Server) recoverPanics(next ConnHandler) ConnHandler {
+	return func(ctx context.Context, hc *HubConn) (err error) {
+		defer s.recoverConn(hc, func(de *DisconnectError) { err = de })
+		return next(ctx, hc)
+	}
+}
+
+// recoverConn is deferred on every goroutine that runs application code
+// for hc: the middleware chain, the heartbeat with its health callbacks,
+// the moderation worker and OnClose. It recovers a panic and ends hc with
+// DisconnectPanic: the stack is logged with the connection's ID, the
+// client gets CloseInternalError and the panic is counted in
+// cysl_handler_panics_total, and a crash dump is written (see
+// dumpConnPanic). end, if set, learns the cause - e.g. to cancel the
+// connection's context.
+func (s *Server) recoverConn(hc *HubConn, end func(*DisconnectError)) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	s.metrics.HandlerPanics.Add(1)
+	stack := debug.Stack()
+	hc.logger.Error("Connection handler panicked", "panic", v, "stack", string(stack))
+	s.dumpConnPanic(hc, fmt.Sprintf("panic: %v", v), stack)
+	perr, ok := v.(error)
+	if !ok {
+		perr = fmt.Errorf("%v", v)
+	}
+	hc.closing(DisconnectPanic, perr.Error()) // The read loop reports the panic, not the close
+	CloseWith(hc.conn, CloseInternalError, "internal error")
+	if end != nil {
+		end(&DisconnectError{Reason: DisconnectPanic, Err: perr})
+	}
+}
+
+// crashDumpInterval is how often connection panics write a crash dump. A
+// handler bug tends to hit every connection; the first dump tells the
+// story, and the rest would only fill the disk.
+const crashDumpInterval = time.Minute
+
+// dumpConnPanic writes a crash dump for a recovered connection panic,
+// unless another one did within crashDumpInterval.
+func (s *Server) dumpConnPanic(hc *HubConn, reason string, stack []byte) {
+	now := time.Now().UnixNano()
+	last := s.lastDump.Load()
+	if (last != 0 && now-last < int64(crashDumpInterval)) || !s.lastDump.CompareAndSwap(last, now) {
+		hc.logger.Debug("Crash dump skipped - one was written recently", "reason", reason)
+		return
+	}
+	if path, err := s.writeCrashDump(reason, stack); err != nil {
+		hc.logger.Error("Crash dump failed", "reason", reason, "error", err)
+	} else {
+		hc.logger.Error("Crash dump written", "reason", reason, "path", path)
+	}
+}
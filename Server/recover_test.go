@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// panicHandler panics in the callbacks it is told to and reports how its
+// connections ended.
+type panicHandler struct {
+	BaseHandler
+	onMessage, onClose bool
+	closed             chan error
+}
+
+func (h *panicHandler) OnMessage(ctx context.Context, hc *HubConn, msgType websocket.MessageType, msg []byte) ([]byte, error) {
+	if h.onMessage {
+		panic("boom in OnMessage")
+	}
+	return msg, nil
+}
+
+func (h *panicHandler) OnClose(ctx context.Context, hc *HubConn, err error) {
+	h.closed <- err
+	if h.onClose {
+		panic("boom in OnClose")
+	}
+}
+
+// approveAll is a moderation service that allows every message.
+func approveAll(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"allow":true}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// serveHandler serves h on a new server with cfg and returns the server
+// and the WebSocket URL. Crash dumps go to a test directory unless cfg
+// names one.
+func serveHandler(t *testing.T, cfg Config, h Handler) (*Server, string) {
+	t.Helper()
+	if cfg.CrashDump.Dir == "" {
+		cfg.CrashDump.Dir = t.TempDir()
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.WebSocketHandler(h))
+	t.Cleanup(func() {
+		srv.Close()
+		s.Shutdown(context.Background())
+	})
+	return s, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// sendAndRead sends one message and returns the error the next read ends with.
+func sendAndRead(t *testing.T, url string) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.CloseNow()
+	if err := conn.Write(ctx, websocket.MessageText, []byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for {
+		if _, _, err := conn.Read(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// TestPanicInModeratedOnMessage checks that a panic in OnMessage, which
+// runs on the moderation worker, ends only its connection.
+func TestPanicInModeratedOnMessage(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Moderation = ModerationSettings{URL: approveAll(t), Timeout: time.Second, FailOpen: true}
+	h := &panicHandler{onMessage: true, closed: make(chan error, 1)}
+	s, url := serveHandler(t, cfg, h)
+
+	if err := sendAndRead(t, url); websocket.CloseStatus(err) != CloseInternalError {
+		t.Fatalf("read after the panic = %v, want close code %d", err, CloseInternalError)
+	}
+	if reason := disconnectReason(<-h.closed); reason != DisconnectPanic {
+		t.Fatalf("OnClose reason = %q, want %q", reason, DisconnectPanic)
+	}
+	if n := s.metrics.HandlerPanics.Load(); n != 1 {
+		t.Fatalf("cysl_handler_panics_total = %d, want 1", n)
+	}
+}
+
+// TestPanicInOnClose checks that a panic in OnClose is recovered and
+// counted.
+func TestPanicInOnClose(t *testing.T) {
+	h := &panicHandler{onClose: true, closed: make(chan error, 1)}
+	s, url := serveHandler(t, DefaultConfig(), h)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+	<-h.closed
+	deadline := time.Now().Add(5 * time.Second)
+	for s.metrics.HandlerPanics.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("panic in OnClose not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestPanicWritesCrashDump checks that a panic on a connection writes a
+// crash dump with the panicking stack, and only one for a burst of them.
+func TestPanicWritesCrashDump(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CrashDump.Dir = t.TempDir()
+	h := &panicHandler{onMessage: true, closed: make(chan error, 2)}
+	_, url := serveHandler(t, cfg, h)
+
+	for range 2 {
+		if err := sendAndRead(t, url); websocket.CloseStatus(err) != CloseInternalError {
+			t.Fatalf("read after the panic = %v, want close code %d", err, CloseInternalError)
+		}
+		<-h.closed
+	}
+	dumps, _ := filepath.Glob(filepath.Join(cfg.CrashDump.Dir, "cysl-crash-*.txt"))
+	if len(dumps) != 1 {
+		t.Fatalf("%d crash dumps written, want 1", len(dumps))
+	}
+	data, err := os.ReadFile(dumps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump := string(data); !strings.Contains(dump, "reason: panic: boom in OnMessage") || !strings.Contains(dump, "== Panicking goroutine ==") {
+		t.Fatalf("crash dump lacks the panic:\n%s", dump)
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ReplayConfig holds the candidate settings an audit log is replayed against.
+type ReplayConfig struct {
+	MaxConnectionsPerIP int        // Candidate per-IP connection limit
+	MaxViolations       int        // Candidate violation threshold before disconnect
+	Policy              *GeoPolicy // Candidate country/ASN policy (nil = allow all)
+}
+
+// ReplayOutcome is the decision for one connection attempt.
+type ReplayOutcome string
+
+const (
+	OutcomeAccepted ReplayOutcome = "accepted" // Connection admitted
+	OutcomeLimited  ReplayOutcome = "limited"  // Rejected by the per-IP connection limit
+	OutcomeDenied   ReplayOutcome = "denied"   // Rejected by the geo policy
+	OutcomeKicked   ReplayOutcome = "kicked"   // Admitted, then disconnected for rate-limit violations
+)
+
+// ReplayChange records an attempt whose outcome differs under the candidate config.
+type ReplayChange struct {
+	Event    AuditEvent    // Audit event that started the attempt
+	Original ReplayOutcome // What the server actually did
+	Replayed ReplayOutcome // What the candidate config would have done
+	Reason   string        // Why the candidate decided differently
+}
+
+// ReplayReport summarizes a replay run.
+type ReplayReport struct {
+	Original map[ReplayOutcome]int // Outcome counts as recorded
+	Replayed map[ReplayOutcome]int // Outcome counts under the candidate config
+	Changes  []ReplayChange        // Attempts with different outcomes
+	Skipped  int                   // Lines that could not be parsed
+}
+
+// replayConn tracks one connection while replaying.
+type replayConn struct {
+	event   AuditEvent  // Open event - reported as the attempt
+	holding bool        // Whether the connection occupies a simulated per-IP slot
+	geo     GeoDecision // Candidate geo decision to release on close
+}
+
+// Replay reads an audit log (JSON lines, as written by AuditLogger) and
+// re-evaluates every connection attempt under cfg. It uses the recorded
+// connection lifecycle (open/close) to simulate concurrent connections per
+// IP and the recorded peak violations to judge candidate thresholds.
+//
+// Attempts that were originally rejected have no recorded lifetime, so if
+// the candidate config would accept them they are counted as accepted but
+// don't hold a connection slot.
+func Replay(r io.Reader, cfg ReplayConfig) (ReplayReport, error) {
+	report := ReplayReport{
+		Original: make(map[ReplayOutcome]int),
+		Replayed: make(map[ReplayOutcome]int),
+	}
+	perIP := make(map[string]int)        // Simulated concurrent connections per IP
+	live := make(map[string]*replayConn) // Remote address -> open connection
+
+	// admit evaluates an attempt under the candidate config
+	admit := func(ev AuditEvent) (ReplayOutcome, string, GeoDecision) {
+		geo := geoInfoFromFields(ev.Fields)
+		decision := cfg.Policy.Admit(geo)
+		if !decision.Allowed {
+			return OutcomeDenied, decision.Reason, decision
+		}
+		ip := hostFromAddr(ev.RemoteAddr)
+		if cfg.MaxConnectionsPerIP > 0 && perIP[ip] >= cfg.MaxConnectionsPerIP {
+			cfg.Policy.Release(decision)
+			return OutcomeLimited, fmt.Sprintf("per-IP limit (%d) reached", cfg.MaxConnectionsPerIP), decision
+		}
+		return OutcomeAccepted, "", decision
+	}
+
+	record := func(ev AuditEvent, original, replayed ReplayOutcome, reason string) {
+		report.Original[original]++
+		report.Replayed[replayed]++
+		if original != replayed {
+			report.Changes = append(report.Changes, ReplayChange{
+				Event: ev, Original: original, Replayed: replayed, Reason: reason,
+			})
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var ev AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			report.Skipped++
+			continue
+		}
+
+		switch {
+		case ev.Type == "connection_limit" && ev.Decision == "deny",
+			ev.Type == "geo_policy" && ev.Decision == "deny":
+			// Originally rejected attempt
+			original := OutcomeLimited
+			if ev.Type == "geo_policy" {
+				original = OutcomeDenied
+			}
+			replayed, reason, decision := admit(ev)
+			if replayed == OutcomeAccepted {
+				cfg.Policy.Release(decision) // No recorded lifetime - don't hold a slot
+			}
+			record(ev, original, replayed, reason)
+
+		case ev.Type == "connection" && ev.Decision == "open":
+			replayed, reason, decision := admit(ev)
+			rc := &replayConn{event: ev, geo: decision}
+			if replayed == OutcomeAccepted {
+				perIP[hostFromAddr(ev.RemoteAddr)]++
+				rc.holding = true
+			}
+			if replayed != OutcomeAccepted {
+				record(ev, OutcomeAccepted, replayed, reason)
+			} else {
+				live[ev.RemoteAddr] = rc // Final outcome decided on close
+			}
+
+		case ev.Type == "connection" && ev.Decision == "close":
+			rc, ok := live[ev.RemoteAddr]
+			if !ok {
+				continue // Open event outside the log window or already rejected
+			}
+			delete(live, ev.RemoteAddr)
+			if rc.holding {
+				ip := hostFromAddr(ev.RemoteAddr)
+				if perIP[ip]--; perIP[ip] <= 0 {
+					delete(perIP, ip)
+				}
+				cfg.Policy.Release(rc.geo)
+			}
+
+			original, replayed, reason := OutcomeAccepted, OutcomeAccepted, ""
+			peak, _ := strconv.Atoi(ev.Fields["peak_violations"])
+			limit, err := strconv.Atoi(ev.Fields["max_violations"])
+			if err != nil {
+				limit = maxViolations // Logged before the limit was configurable
+			}
+			if peak > limit {
+				original = OutcomeKicked
+			}
+			if cfg.MaxViolations > 0 && peak > cfg.MaxViolations {
+				replayed = OutcomeKicked
+				reason = fmt.Sprintf("peak violations %d > %d", peak, cfg.MaxViolations)
+			}
+			record(rc.event, original, replayed, reason)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return report, fmt.Errorf("read audit log: %w", err)
+	}
+
+	// Connections still open at the end of the log were accepted in both runs
+	for _, rc := range live {
+		record(rc.event, OutcomeAccepted, OutcomeAccepted, "")
+	}
+	return report, nil
+}
+
+// geoInfoFromFields rebuilds GeoInfo from audit event fields.
+func geoInfoFromFields(fields map[string]string) GeoInfo {
+	asn, _ := strconv.ParseUint(fields["asn"], 10, 32)
+	return GeoInfo{Country: fields["country"], ASN: uint(asn)}
+}
+
+// DefaultReplayConfig returns the limits of the given server config, so a
+// replay without overrides reproduces the server's own decisions.
+func DefaultReplayConfig(cfg Config) ReplayConfig {
+	return ReplayConfig{
+		MaxConnectionsPerIP: cfg.MaxConnectionsPerIP,
+		MaxViolations:       cfg.RateLimit.MaxViolations,
+	}
+}
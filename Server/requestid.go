@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/deanbregenzer/cysl/internal/logging"
+)
+
+// HeaderRequestID carries the ID of an HTTP request. The server accepts
+// one set by a proxy in front of it, or makes one up, and answers with it,
+// so an admin action can be traced from the API call through the logs and
+// the audit trail.
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestID bounds the IDs accepted from clients - anything longer, or
+// with characters that don't belong in a log line, is replaced.
+const maxRequestID = 128
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the ID of the HTTP request ctx belongs to,
+// or "" outside of a request.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID gives every request an ID: it's echoed in the
+// X-Request-ID response header, stored in the request's context and added
+// to the context's logger (see logging.FromContext). Admin requests are
+// logged with their ID and status once they finish; /health and /readyz,
+// which probes poll, only at debug level.
+func (s *Server) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if !validRequestID(id) {
+			id = string(newConnID())
+		}
+		w.Header().Set(HeaderRequestID, id)
+		logger := s.logger().With("request_id", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		r = r.WithContext(logging.WithLogger(ctx, logger))
+
+		level := slog.LevelDebug
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/admin/"):
+			level = slog.LevelInfo
+		case r.URL.Path != "/health" && r.URL.Path != "/readyz":
+			// WebSocket upgrades hijack the connection, so their writer
+			// is passed through untouched; the connection logs itself
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		logger.Log(r.Context(), level, "HTTP request",
+			"method", r.Method, "path", r.URL.Path, "status", sw.status,
+			"remote_addr", r.RemoteAddr, "duration", time.Since(start))
+	})
+}
+
+// validRequestID reports whether a client's request ID can be used as is:
+// not empty, not too long and printable ASCII without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// statusWriter remembers the status code written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// httpError replies like http.Error, with the request's ID appended so a
+// client reporting the error hands support what it needs to find the
+// request in the logs, e.g. "invalid JSON body (request_id=3f2a...)".
+func httpError(w http.ResponseWriter, r *http.Request, msg string, status int) {
+	if id := RequestIDFromContext(r.Context()); id != "" {
+		msg = fmt.Sprintf("%s (request_id=%s)", msg, id)
+	}
+	http.Error(w, msg, status)
+}
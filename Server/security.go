@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
@@ -13,18 +14,30 @@ import (
 // This prevents clients from flooding the server with excessive ping frames,
 // which could be used for DoS attacks or resource exhaustion.
 type ConnectionState struct {
-	lastPing         time.Time  // Timestamp of last ping - used to calculate interval
-	pingCount        int        // Number of pings in current window - for burst detection
-	violations       int        // Counter for rate-limit violations - triggers disconnect
-	lastClientPing   time.Time  // Timestamp of last CLIENT ping received
-	clientViolations int        // Violations from client's incoming pings
-	mu               sync.Mutex // Protects state updates
+	lastPing         time.Time     // Timestamp of last ping - used to calculate interval
+	pingCount        int           // Number of pings in current window - for burst detection
+	violations       int           // Counter for rate-limit violations - triggers disconnect
+	lastClientPing   time.Time     // Timestamp of last CLIENT ping received
+	clientViolations int           // Violations from client's incoming pings
+	baseInterval     time.Duration // Minimum interval between client messages (0 = not enforced)
+	minInterval      time.Duration // Stricter interval from the geo policy (0 = none)
+	maxViolations    int           // Violations in a row before disconnect (0 = maxViolations)
+	shadowInterval   time.Duration // Dry-run interval - only counted, never enforced (0 = off)
+	shadowViolations int           // Messages that would have violated shadowInterval
+	peakViolations   int           // Highest clientViolations seen - recorded for replay tooling
+	mu               sync.Mutex    // Protects state updates
+	touched          atomic.Int64  // UnixNano of the last message or ping, see ConnectionStateManager.Expire
+}
+
+// touch records that the connection is in use.
+func (cs *ConnectionState) touch() {
+	cs.touched.Store(time.Now().UnixNano())
 }
 
 // Rate limiting constants
 const (
 	minPingInterval = 10 * time.Second // Minimum interval between pings - prevents flooding
-	maxViolations   = 3                // Max allowed violations before disconnect - prevents abuse
+	maxViolations   = 3                // Default max violations before disconnect - prevents abuse
 )
 
 // RateLimitPing checks if the ping frequency is acceptable and enforces rate limits.
@@ -34,6 +47,7 @@ const (
 // - Count violations (pings that arrive too quickly)
 // - Disconnect after too many violations
 func (cs *ConnectionState) RateLimitPing() bool {
+	cs.touch()
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
@@ -57,6 +71,7 @@ func (cs *ConnectionState) RateLimitPing() bool {
 // This is called whenever the server detects the client has sent a ping frame.
 // Returns false if connection should be closed due to excessive ping flooding.
 func (cs *ConnectionState) RateLimitClientPing() bool {
+	cs.touch()
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
@@ -68,13 +83,21 @@ func (cs *ConnectionState) RateLimitClientPing() bool {
 		return true
 	}
 
+	// Dry-run evaluation: count what a candidate limit would have flagged
+	if cs.shadowInterval > 0 && now.Sub(cs.lastClientPing) < cs.shadowInterval {
+		cs.shadowViolations++
+	}
+
 	// Check if client's ping arrives too quickly
-	if now.Sub(cs.lastClientPing) < minPingInterval {
+	if now.Sub(cs.lastClientPing) < cs.interval() {
 		cs.clientViolations++
+		if cs.clientViolations > cs.peakViolations {
+			cs.peakViolations = cs.clientViolations
+		}
 		cs.lastClientPing = now
 
 		// Client has exceeded the violation threshold - disconnect
-		if cs.clientViolations > maxViolations {
+		if cs.clientViolations > cs.violationLimit() {
 			return false // Signal to close connection
 		}
 		return true // Allow but count violation
@@ -86,6 +109,46 @@ func (cs *ConnectionState) RateLimitClientPing() bool {
 	return true
 }
 
+// interval returns the enforced minimum interval between client messages;
+// 0 lets every message through. Callers must hold cs.mu.
+func (cs *ConnectionState) interval() time.Duration {
+	if cs.minInterval > cs.baseInterval {
+		return cs.minInterval // Stricter limit from access policy
+	}
+	return cs.baseInterval
+}
+
+// violationLimit returns how many violations in a row are let through.
+// It doesn't change after the state was set up.
+func (cs *ConnectionState) violationLimit() int {
+	if cs.maxViolations > 0 {
+		return cs.maxViolations
+	}
+	return maxViolations
+}
+
+// effectiveInterval returns the enforced minimum interval (thread-safe)
+func (cs *ConnectionState) effectiveInterval() time.Duration {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.interval()
+}
+
+// GetPeakViolations returns the highest consecutive violation count seen (thread-safe)
+func (cs *ConnectionState) GetPeakViolations() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.peakViolations
+}
+
+// GetShadowViolations returns how many messages would have been flagged by
+// the dry-run interval (thread-safe)
+func (cs *ConnectionState) GetShadowViolations() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.shadowViolations
+}
+
 // GetClientViolations returns the current number of client ping violations (thread-safe)
 func (cs *ConnectionState) GetClientViolations() int {
 	cs.mu.Lock()
@@ -99,6 +162,22 @@ type RateLimitedConn struct {
 	*websocket.Conn
 	connState  *ConnectionState
 	remoteAddr string
+	readLimit  int64 // Max message size enforced by Read (0 = library default handling)
+
+	// exempt, if set, marks messages that don't count against the rate
+	// limit (e.g. JSON heartbeats, which arrive on the server's schedule)
+	exempt func(websocket.MessageType, []byte) bool
+
+	// onThrottle, if set, is told about messages that violated the rate
+	// limit but were still let through (e.g. to warn the client)
+	onThrottle func(*RateLimitError)
+
+	metrics *ServerMetrics // Where violations are counted
+
+	// limiter, if set, holds the token buckets shared with the client IP's
+	// other connections and all connections
+	limiter *MessageLimiter
+	ip      string // Bucket key: the client IP without port
 }
 
 // NewRateLimitedConn creates a new rate-limited connection wrapper
@@ -107,9 +186,18 @@ func NewRateLimitedConn(conn *websocket.Conn, connState *ConnectionState, remote
 		Conn:       conn,
 		connState:  connState,
 		remoteAddr: remoteAddr,
+		metrics:    NewServerMetrics(), // The server replaces it with its own
 	}
 }
 
+// SetReadLimit makes Read enforce the message size limit itself and return
+// a *MessageTooBigError, instead of the library closing the connection
+// silently. Disables the underlying connection's own limit.
+func (rlc *RateLimitedConn) SetReadLimit(n int64) {
+	rlc.Conn.SetReadLimit(-1)
+	rlc.readLimit = n
+}
+
 // Ping wraps the original Ping method to track outgoing pings
 // Note: This tracks server->client pings, not client->server
 func (rlc *RateLimitedConn) Ping(ctx context.Context) error {
@@ -121,17 +209,84 @@ func (rlc *RateLimitedConn) Ping(ctx context.Context) error {
 // While we cannot directly intercept ping frames (handled internally by coder/websocket),
 // we enforce a general message rate limit that indirectly protects against ping flooding
 func (rlc *RateLimitedConn) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
-	// Check rate limit before processing message
-	// This provides protection against all types of message flooding, including pings
-	if !rlc.connState.RateLimitClientPing() {
-		// Client exceeded rate limit - return error to trigger disconnect
-		return 0, nil, fmt.Errorf("message rate limit exceeded for %s (violations: %d)",
-			rlc.remoteAddr, rlc.connState.GetClientViolations())
+	// Exempt messages are only known once read; everything else is checked
+	// before it is read, as before
+	if rlc.exempt == nil {
+		if e := rlc.allow(); e != nil {
+			return 0, nil, e
+		}
 	}
 
-	msgType, data, err := rlc.Conn.Read(ctx)
-	return msgType, data, err
-} // CheckClientPingRate should be called periodically to enforce client ping rate limits
+	var (
+		msgType websocket.MessageType
+		data    []byte
+		err     error
+	)
+	if rlc.readLimit > 0 {
+		msgType, data, err = readLimited(ctx, rlc.Conn, rlc.readLimit)
+	} else {
+		msgType, data, err = rlc.Conn.Read(ctx)
+	}
+	if err == nil {
+		rlc.connState.touch() // Exempt messages keep the state alive too
+	}
+	if err != nil || rlc.exempt == nil || rlc.exempt(msgType, data) {
+		return msgType, data, err
+	}
+	if e := rlc.allow(); e != nil {
+		return 0, nil, e
+	}
+	return msgType, data, nil
+}
+
+// allow applies the rate limits to one message and returns the one that
+// closes the connection, or nil.
+// This provides protection against all types of message flooding, including pings
+func (rlc *RateLimitedConn) allow() *RateLimitError {
+	// Token buckets first: an empty one disconnects right away
+	if rlc.limiter != nil {
+		if e := rlc.limiter.allow(rlc.ip); e != nil {
+			stats := rlc.metrics.Limiters[e.Limiter]
+			rlc.metrics.RateLimitViolations.Add(1)
+			rlc.metrics.RateLimitDisconnects.Add(1)
+			stats.Violations.Add(1)
+			stats.Rejections.Add(1)
+			e.RemoteAddr = rlc.remoteAddr
+			return e
+		}
+	}
+
+	stats := rlc.metrics.Limiters[LimiterMessageRate]
+	if rlc.connState.RateLimitClientPing() {
+		// Compliant messages reset the count, so any violations mean this one was too fast
+		if rlc.connState.GetClientViolations() > 0 {
+			rlc.metrics.RateLimitViolations.Add(1)
+			stats.Violations.Add(1)
+			if rlc.onThrottle != nil {
+				rlc.onThrottle(rlc.limitError())
+			}
+		}
+		return nil
+	}
+	rlc.metrics.RateLimitViolations.Add(1)
+	rlc.metrics.RateLimitDisconnects.Add(1)
+	stats.Violations.Add(1)
+	stats.Rejections.Add(1)
+	return rlc.limitError()
+}
+
+// limitError describes the connection's standing against the message rate limit.
+func (rlc *RateLimitedConn) limitError() *RateLimitError {
+	return &RateLimitError{
+		Limiter:       LimiterMessageRate,
+		RemoteAddr:    rlc.remoteAddr,
+		Violations:    rlc.connState.GetClientViolations(),
+		MaxViolations: rlc.connState.violationLimit(),
+		MinInterval:   rlc.connState.effectiveInterval(),
+	}
+}
+
+// CheckClientPingRate should be called periodically to enforce client ping rate limits
 // Returns error if client should be disconnected due to excessive pings
 func (rlc *RateLimitedConn) CheckClientPingRate() error {
 	if !rlc.connState.RateLimitClientPing() {
@@ -178,6 +333,14 @@ func (cm *ConnectionManager) CheckLimit(ip string) bool {
 	return true // Allow connection
 }
 
+// SetLimit changes the per-IP limit for new connections. Open connections
+// above a lowered limit stay open.
+func (cm *ConnectionManager) SetLimit(maxPerIP int) {
+	cm.mu.Lock()
+	cm.maxPerIP = maxPerIP
+	cm.mu.Unlock()
+}
+
 // Release atomically decrements the connection count for an IP when a
 // connection is closed. This must be called in a defer statement to ensure
 // the count is always decremented even if connection handler panics.
@@ -205,11 +368,25 @@ func (cm *ConnectionManager) GetConnectionCount(ip string) int {
 	return cm.connections[ip]
 }
 
+// Snapshot returns a copy of the per-IP connection counts.
+func (cm *ConnectionManager) Snapshot() map[string]int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	out := make(map[string]int, len(cm.connections))
+	for ip, n := range cm.connections {
+		out[ip] = n
+	}
+	return out
+}
+
 // ConnectionStateManager manages rate-limiting state for each connection.
 // Tracks ping frequency per connection ID to prevent ping-flooding attacks.
+// States stay until Remove; Run expires those a forgotten cleanup path left
+// behind.
 type ConnectionStateManager struct {
-	states map[string]*ConnectionState // Connection ID -> state
-	mu     sync.RWMutex                // Protects states map
+	states  map[string]*ConnectionState // Connection ID -> state
+	mu      sync.RWMutex                // Protects states map
+	expired atomic.Int64                // States dropped by Expire
 }
 
 // NewConnectionStateManager creates a new connection state manager.
@@ -226,17 +403,28 @@ func (csm *ConnectionStateManager) GetOrCreate(connID string) *ConnectionState {
 	defer csm.mu.Unlock()
 
 	if state, exists := csm.states[connID]; exists {
+		state.touch()
 		return state
 	}
 
 	// Create new state for this connection
 	state := &ConnectionState{
-		lastPing: time.Now(), // Initialize to now to allow first ping immediately
+		lastPing:     time.Now(), // Initialize to now to allow first ping immediately
+		baseInterval: minPingInterval,
 	}
+	state.touch()
 	csm.states[connID] = state
 	return state
 }
 
+// add tracks a state the caller configured, replacing any under connID.
+func (csm *ConnectionStateManager) add(connID string, state *ConnectionState) {
+	state.touch()
+	csm.mu.Lock()
+	defer csm.mu.Unlock()
+	csm.states[connID] = state
+}
+
 // Remove deletes the ConnectionState when a connection is closed.
 // Prevents memory leaks from accumulating old connection states.
 func (csm *ConnectionStateManager) Remove(connID string) {
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// echoURL serves the echo handler on /ws with cfg.
+func echoURL(t *testing.T, cfg Config) string {
+	t.Helper()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		s.Shutdown(context.Background())
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// sendEvery sends n messages spaced by every and returns the replies.
+func sendEvery(t *testing.T, url string, n int, every time.Duration) ([]string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.CloseNow()
+	var replies []string
+	for i := range n {
+		if err := conn.Write(ctx, websocket.MessageText, []byte("hello")); err != nil {
+			return replies, err
+		}
+		for {
+			_, reply, err := conn.Read(ctx)
+			if err != nil {
+				return replies, err
+			}
+			replies = append(replies, string(reply))
+			if strings.HasPrefix(string(reply), "Server echoes") {
+				break // Notices come before the echo of the message they are about
+			}
+		}
+		if i < n-1 {
+			time.Sleep(every)
+		}
+	}
+	return replies, nil
+}
+
+// TestDefaultConfigOnlyUsesTokenBuckets checks that by default only the
+// token buckets limit messages: a client well within them is neither
+// throttled nor closed.
+func TestDefaultConfigOnlyUsesTokenBuckets(t *testing.T) {
+	replies, err := sendEvery(t, echoURL(t, DefaultConfig()), 10, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("after %d replies: %v", len(replies), err)
+	}
+	for _, r := range replies {
+		if strings.Contains(r, "rate_limited") {
+			t.Fatalf("throttled by default: %s", r)
+		}
+	}
+}
+
+// TestMinIntervalIsOptIn checks that a configured minimum interval throttles
+// and, after max_violations, closes a connection sending too fast.
+func TestMinIntervalIsOptIn(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RateLimit.MinInterval = time.Second
+	cfg.RateLimit.MaxViolations = 2
+	replies, err := sendEvery(t, echoURL(t, cfg), 10, 10*time.Millisecond)
+	if websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Fatalf("after %d replies: %v, want a policy violation close", len(replies), err)
+	}
+	notice := `"max_violations":2,"min_interval_ms":1000`
+	if !strings.Contains(strings.Join(replies, "\n"), notice) {
+		t.Fatalf("replies %q lack a notice with %s", replies, notice)
+	}
+}
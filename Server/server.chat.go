@@ -2,38 +2,247 @@ package server
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"regexp"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/coder/websocket"
-	"github.com/coder/websocket/wsjson"
 )
 
-func main() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", handleConnection)
+// Chat message types.
+const (
+	ChatMessageText   = "message" // A user's message
+	ChatMessageJoin   = "join"    // Someone entered the room
+	ChatMessageLeave  = "leave"   // Someone left the room
+	ChatMessageSystem = "system"  // Notice from the server (e.g. maintenance)
+)
+
+// validRoomName restricts room names to something safe in URLs and logs.
+var validRoomName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ChatMessage is the JSON envelope for everything sent in a room.
+type ChatMessage struct {
+	Type      string    `json:"type"`               // message, join, leave or system
+	Sender    string    `json:"sender"`             // Display name of the author
+	Room      string    `json:"room"`               // Room the message belongs to
+	Body      string    `json:"body,omitempty"`     // Text (empty for join/leave)
+	TraceID   string    `json:"trace_id,omitempty"` // Trace of the message it was sent for, see WithTraceID
+	Timestamp time.Time `json:"timestamp"`          // When the server accepted it
+}
+
+// Room is a chat room. Members are hub connections, so delivery reuses the
+// hub's per-connection queues: a member that can't keep up is disconnected
+// instead of slowing the room down for everyone.
+type Room struct {
+	Name    string
+	members *connSet
+	mu      sync.RWMutex
+}
+
+// Join adds a connection to the room.
+func (rm *Room) Join(hc *HubConn) {
+	rm.mu.Lock()
+	rm.members.add(hc)
+	rm.mu.Unlock()
+}
+
+// Leave removes a connection and reports whether the room is now empty.
+func (rm *Room) Leave(hc *HubConn) bool {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.members.remove(hc.ID)
+}
 
+// Size returns the number of members.
+func (rm *Room) Size() int {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return rm.members.len()
 }
 
-func handleConnection(w http.ResponseWriter, r *http.Request) {
-	c, err := websocket.Accept(w, r, nil)
+// Broadcast sends a message to every member. Returns how many accepted it.
+func (rm *Room) Broadcast(msg ChatMessage) int {
+	data, err := json.Marshal(msg)
 	if err != nil {
-		// add error handling
+		return 0
 	}
-	defer c.CloseNow()
 
-	// Set the context as needed. Use of r.Context() is not recommended
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
+	rm.mu.RLock()
+	targets := rm.members.snapshot()
+	rm.mu.RUnlock()
+	return deliver(context.Background(), targets, data)
+}
 
-	var v any
-	err = wsjson.Read(ctx, c, &v)
+// ChatRooms holds the active rooms. Rooms are created on first join and
+// removed when the last member leaves.
+type ChatRooms struct {
+	rooms map[string]*Room
+	mu    sync.Mutex
+}
+
+// NewChatRooms creates an empty room registry.
+func NewChatRooms() *ChatRooms {
+	return &ChatRooms{rooms: make(map[string]*Room)}
+}
+
+// chatRooms holds the rooms served on /chat/{room}.
+var chatRooms = NewChatRooms()
+
+// Join adds hc to the named room, creating it if needed.
+func (cr *ChatRooms) Join(name string, hc *HubConn) *Room {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	rm, ok := cr.rooms[name]
+	if !ok {
+		rm = &Room{Name: name, members: newConnSet()}
+		cr.rooms[name] = rm
+	}
+	rm.Join(hc) // Under cr.mu so an emptying room can't be deleted meanwhile
+	return rm
+}
+
+// Get returns the named room, or ErrRoomNotFound if it has no members.
+func (cr *ChatRooms) Get(name string) (*Room, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	rm, ok := cr.rooms[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrRoomNotFound, name)
+	}
+	return rm, nil
+}
+
+// BroadcastToRoom sends msg to every member of a /chat/{room} room and
+// returns how many it reached. Returns ErrRoomNotFound for rooms nobody
+// has joined.
+func BroadcastToRoom(name string, msg ChatMessage) (int, error) {
+	rm, err := chatRooms.Get(name)
 	if err != nil {
-		// add error handling
+		return 0, err
+	}
+	if msg.Room == "" {
+		msg.Room = name
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	return rm.Broadcast(msg), nil
+}
+
+// Leave removes hc from the room and deletes the room once it is empty.
+func (cr *ChatRooms) Leave(rm *Room, hc *HubConn) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if rm.Leave(hc) && cr.rooms[rm.Name] == rm {
+		delete(cr.rooms, rm.Name)
+	}
+}
+
+// Matching returns the active rooms whose names match any of the patterns.
+func (cr *ChatRooms) Matching(patterns []string) []*Room {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	var out []*Room
+	for name, rm := range cr.rooms {
+		if matchDevice(patterns, name) {
+			out = append(out, rm)
+		}
+	}
+	return out
+}
+
+// List returns the active rooms and their member counts, sorted by name.
+func (cr *ChatRooms) List() []map[string]any {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	out := make([]map[string]any, 0, len(cr.rooms))
+	for name, rm := range cr.rooms {
+		out = append(out, map[string]any{"room": name, "members": rm.Size()})
 	}
+	sort.Slice(out, func(i, j int) bool { return out[i]["room"].(string) < out[j]["room"].(string) })
+	return out
+}
+
+// chatSender picks the display name: the authenticated user, else the
+// ?name= query parameter, else the connection ID.
+func chatSender(r *http.Request, hc *HubConn) string {
+	if hc.User != "" {
+		return string(hc.User)
+	}
+	if name := r.URL.Query().Get("name"); name != "" && len(name) <= 64 {
+		return name
+	}
+	return string(hc.ID)
+}
 
-	log.Printf("received: %v", v)
+// handleChat serves /chat/{room}. Every text message a member sends is
+// wrapped in a ChatMessage and broadcast to the room, the sender included,
+// so all members see the same order.
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("room")
+	if !validRoomName.MatchString(name) {
+		http.Error(w, "Invalid room name", http.StatusBadRequest)
+		return
+	}
+	s.serveWebSocket(w, r, &chatHandler{name: name, r: r})
+}
+
+// chatHandler is the Handler of one chat connection.
+type chatHandler struct {
+	name   string
+	r      *http.Request
+	room   *Room
+	sender string
+}
+
+// roomName makes moderation.rooms apply to the connection.
+func (ch *chatHandler) roomName() string { return ch.name }
+
+// OnConnect joins the room and announces the new member.
+func (ch *chatHandler) OnConnect(ctx context.Context, hc *HubConn) error {
+	ch.sender = chatSender(ch.r, hc)
+	ch.room = chatRooms.Join(ch.name, hc)
+	hc.logger.Info("Chat: joined room", "sender", ch.sender, "room", ch.name, "members", ch.room.Size())
+	ch.room.Broadcast(ChatMessage{Type: ChatMessageJoin, Sender: ch.sender, Room: ch.name, Timestamp: time.Now()})
+	if notice, ok := maintenanceSchedule.roomNotice(ch.name, time.Now()); ok {
+		data, _ := json.Marshal(ChatMessage{Type: ChatMessageSystem, Sender: "server", Room: ch.name, Body: notice, Timestamp: time.Now()})
+		hc.enqueue(data) // Only the newcomer missed the announcement
+	}
+	return nil
+}
+
+// OnMessage broadcasts a text message to the room.
+func (ch *chatHandler) OnMessage(ctx context.Context, hc *HubConn, msgType websocket.MessageType, msg []byte) ([]byte, error) {
+	if msgType != websocket.MessageText {
+		return nil, nil // Chat is text only
+	}
+	ch.room.Broadcast(ChatMessage{
+		Type:      ChatMessageText,
+		Sender:    ch.sender,
+		Room:      ch.name,
+		Body:      string(msg),
+		TraceID:   TraceIDFromContext(ctx),
+		Timestamp: time.Now(),
+	})
+	return nil, nil // The sender receives the broadcast like everyone else
+}
+
+// OnClose leaves the room and tells the remaining members.
+func (ch *chatHandler) OnClose(ctx context.Context, hc *HubConn, err error) {
+	chatRooms.Leave(ch.room, hc)
+	ch.room.Broadcast(ChatMessage{Type: ChatMessageLeave, Sender: ch.sender, Room: ch.name, Timestamp: time.Now()})
+	hc.logger.Info("Chat: left room", "sender", ch.sender, "room", ch.name)
+}
 
-	c.Close(websocket.StatusNormalClosure, "")
+// handleChatRooms lists the active rooms as JSON.
+func handleChatRooms(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chatRooms.List())
 }
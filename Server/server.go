@@ -4,172 +4,981 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
+	"github.com/deanbregenzer/cysl/internal/heartbeat"
+	"github.com/deanbregenzer/cysl/internal/logging"
+	"github.com/deanbregenzer/cysl/internal/protocol"
 )
 
-// Server configuration constants
-const (
-	ServerAddr          = ":8080"          // Server listen address
-	maxMessageSize      = 1024 * 1024      // 1 MB - Maximum allowed message size
-	maxConnectionsPerIP = 50               // Max concurrent connections per IP address
-	readTimeout         = 10 * time.Second // Timeout for reading messages
-	writeTimeout        = 10 * time.Second // Timeout for writing messages
-)
+// ServerAddr is the default listen address; override it with Config.Addr.
+const ServerAddr = ":8080"
 
-// Global connection tracking and management
+// Process-wide state shared by every Server
 var (
-	activeConnections atomic.Int64                                // Thread-safe active connection counter
-	connManager       = NewConnectionManager(maxConnectionsPerIP) // IP-based connection limiter
+	deviceRegistry = NewDeviceRegistry()  // Device liveness from UDP beacons
+	auditLog       *AuditLogger           // Audit trail of security decisions, configured in Run (nil = disabled)
+	defaultServer  atomic.Pointer[Server] // Serves WebSocketHandler and Start; replaced by Start
 )
 
-// Start initializes and starts the WebSocket server
-func Start(ctx context.Context) error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", handleWebSocket)
-	mux.HandleFunc("/health", healthCheck)
+func init() {
+	s, _ := newServer(DefaultConfig(), hub) // The defaults load no files, so this can't fail
+	defaultServer.Store(s)
+}
+
+// Server is one WebSocket server: its settings and everything that tracks
+// its connections. Several servers can run in one process (e.g. in tests
+// or when embedding); each has its own hub, limits and counters.
+//
+// The audit log, device registry, maintenance schedule and heartbeat
+// aggregates are shared by the process, and Run starts the background
+// services configured for them - let only one server configure those.
+type Server struct {
+	config atomic.Pointer[Config] // Current settings - replaced whole, never modified
+
+	conns    *ConnectionManager      // IP-based connection limiter
+	limiter  *MessageLimiter         // Per-IP and global message token buckets
+	access   *AccessControl          // IP allow and deny lists
+	active   atomic.Int64            // Open WebSocket connections
+	metrics  *ServerMetrics          // Connection, message and rate limit counters
+	hub      *Hub                    // Every connection of this server
+	sweeper  *HalfOpenSweeper        // Write-probes long-idle connections
+	states   *ConnectionStateManager // Rate limit state of each open connection
+	geoStats *GeoStats               // Active connections per country/ASN
+	devices  *deviceConns            // Open connection of each user's device, for takeover
+
+	// Optional features loaded from the config
+	moderation   *ModerationGate // Content moderation hook (nil = disabled)
+	geoResolver  *GeoResolver    // GeoIP enrichment (nil = disabled)
+	geoPolicy    *GeoPolicy      // Country/ASN access policy (nil = allow all)
+	geoShadow    *GeoPolicy      // Dry-run policy - audited, never enforced (nil = off)
+	authenticate AuthFunc        // Connection authentication (nil = anonymous)
+	proxies      *TrustedProxies // Reverse proxies whose forwarding headers are believed (nil = none)
+	healthWatch  *HealthWatch    // Routes health changes to watching connections (nil = disabled)
+
+	readiness atomic.Pointer[PreflightReport] // Run's preflight results, served by /readyz (nil = not run)
+	certs     atomic.Pointer[CertMonitor]     // Certificates of Run's TLS listener (nil = no TLS)
+	lastDump  atomic.Int64                    // When a connection panic last wrote a crash dump (UnixNano)
+
+	opts serverOptions // What NewServer's options set, see Option
+
+	// Background loops of the server itself (the sweeper), started by the
+	// first Handler or Run call and stopped by Shutdown
+	background     context.Context
+	stopBackground context.CancelFunc
+	startOnce      sync.Once
+}
+
+// NewServer validates cfg and loads the optional features it enables
+// (policies, GeoIP databases, moderation, auth). Options override cfg,
+// see Option for the precedence. Call Run to serve.
+func NewServer(cfg Config, opts ...Option) (*Server, error) {
+	return newServer(cfg, NewHub(), opts...)
+}
+
+// newServer creates a server whose connections join h.
+func newServer(cfg Config, h *Hub, opts ...Option) (*Server, error) {
+	var o serverOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.applyConfig(&cfg)
+	if problems := cfg.validateSettings(); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration: %s", problems[0])
+	}
+	s := &Server{
+		conns:    NewConnectionManager(cfg.MaxConnectionsPerIP),
+		limiter:  NewMessageLimiter(cfg.RateLimit),
+		metrics:  NewServerMetrics(),
+		hub:      h,
+		sweeper:  NewHalfOpenSweeper(cfg.Sweeper),
+		states:   NewConnectionStateManager(),
+		geoStats: NewGeoStats(),
+		devices:  newDeviceConns(),
+		opts:     o,
+	}
+	s.background, s.stopBackground = context.WithCancel(context.Background())
+	s.config.Store(&cfg)
+	h.configure(cfg.Hub, cfg.WriteTimeout)
+	h.memory.configure(cfg.Memory)
 
-	server := &http.Server{
-		Addr:         ServerAddr,
-		Handler:      mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	// Load optional features before accepting connections
+	var err error
+	if s.geoPolicy, err = loadOptionalGeoPolicy(cfg.GeoIP.PolicyFile); err != nil {
+		return nil, fmt.Errorf("invalid geo policy: %w", err)
+	}
+	// The shadow policy is evaluated next to the enforced one; its decisions
+	// are only audited, letting operators see what a rule change would block
+	if s.geoShadow, err = loadOptionalGeoPolicy(cfg.GeoIP.ShadowPolicyFile); err != nil {
+		return nil, fmt.Errorf("invalid shadow geo policy: %w", err)
+	}
+	s.moderation = moderationGateFromConfig(cfg.Moderation)
+	if s.geoResolver, err = geoResolverFromConfig(cfg.GeoIP); err != nil {
+		return nil, err
+	}
+	s.authenticate = authFromConfig(cfg.Auth)
+	if o.auth != nil {
+		s.authenticate = o.auth
 	}
+	s.healthWatch = healthWatchFromConfig(cfg.Watch, h)
+	s.proxies = trustedProxiesFromConfig(cfg.Proxy)
+	if s.access, err = NewAccessControl(cfg.Access); err != nil {
+		return nil, fmt.Errorf("invalid access list: %w", err)
+	}
+	return s, nil
+}
 
-	errChan := make(chan error, 1)
-	go func() {
-		log.Printf("Starting WebSocket server on %s", ServerAddr)
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			errChan <- err
+// Config returns the current settings. The snapshot is shared and must not
+// be modified; connections keep the snapshot they started with.
+func (s *Server) Config() *Config {
+	return s.config.Load()
+}
+
+// UpdateConfig validates cfg and makes it the snapshot new connections
+// use: limits, timeouts, the heartbeat profile and policy, the hub queues,
+// the memory budget, the access lists, allowed origins and the session
+// TTL. Open connections keep their settings, except for the message rate
+// limits, whose shared buckets change for everyone. Features loaded by
+// NewServer (auth, GeoIP, moderation, the sweeper) and the listeners
+// aren't reloaded. Options given to NewServer still take precedence.
+func (s *Server) UpdateConfig(cfg Config) error {
+	s.opts.applyConfig(&cfg)
+	if problems := cfg.validateSettings(); len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", problems[0])
+	}
+	if err := s.access.configure(cfg.Access); err != nil {
+		return fmt.Errorf("invalid access list: %w", err)
+	}
+	s.conns.SetLimit(cfg.MaxConnectionsPerIP)
+	s.limiter.configure(cfg.RateLimit)
+	s.hub.configure(cfg.Hub, cfg.WriteTimeout)
+	s.hub.memory.configure(cfg.Memory)
+	s.config.Store(&cfg)
+	return nil
+}
+
+// Hub returns the hub all of the server's connections join.
+func (s *Server) Hub() *Hub {
+	return s.hub
+}
+
+// WebSocketHandler wraps h in an http.Handler with the server's full
+// connection handling.
+func (s *Server) WebSocketHandler(h Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveWebSocket(w, r, h)
+	})
+}
+
+// configKey and serverKey are the context keys of a connection's settings
+// snapshot and server.
+type (
+	configKey struct{}
+	serverKey struct{}
+)
+
+// ConfigFromContext returns the settings snapshot a connection runs with.
+// Outside a connection it returns the default server's current settings.
+// The snapshot must not be modified.
+func ConfigFromContext(ctx context.Context) *Config {
+	if cfg, ok := ctx.Value(configKey{}).(*Config); ok {
+		return cfg
+	}
+	return defaultServer.Load().Config()
+}
+
+// serverFromContext returns the server handling the connection, or the
+// default server outside a connection.
+func serverFromContext(ctx context.Context) *Server {
+	if s, ok := ctx.Value(serverKey{}).(*Server); ok {
+		return s
+	}
+	return defaultServer.Load()
+}
+
+// Start initializes and starts the WebSocket server with the given settings
+// and options. Use LoadConfig to build cfg from a file and the environment.
+// The server becomes the default server; its connections join DefaultHub.
+func Start(ctx context.Context, cfg Config, opts ...Option) error {
+	s, err := newServer(cfg, hub, opts...)
+	if err != nil {
+		return err
+	}
+	defaultServer.Store(s)
+	return s.Run(ctx)
+}
+
+// Run serves the configured listeners until ctx is cancelled, then drains
+// the open connections. It also runs the process-wide services the config
+// enables: the audit log, beacons, probes, monitors, escalation,
+// maintenance, incidents, history and the status page.
+func (s *Server) Run(ctx context.Context) error {
+	cfg := *s.Config()
+	// Check the dependencies before anything starts: failures either stop
+	// the server here or turn off what failed in cfg
+	if err := s.preflight(ctx, &cfg).Err(); err != nil {
+		return err
+	}
+	var err error
+	auditLog = auditLoggerFromConfig(cfg.AuditLogFile)
+	defer s.geoResolver.Close()
+	defer auditLog.Close()
+
+	// The WebSocket stack, extended below by the optional services
+	s.start()
+	mux := s.newMux()
+
+	// Optional UDP beacon listener for devices without a duplex channel
+	beacons := beaconListenerFromConfig(cfg.Beacon, deviceRegistry)
+	if beacons != nil {
+		go func() {
+			if err := beacons.Run(ctx); err != nil {
+				slog.Error("Beacon listener stopped", "error", err)
+			}
+		}()
+	}
+
+	// Optional active reachability probes of device endpoints
+	prober := proberFromConfig(cfg.Probes, deviceRegistry)
+	if prober != nil {
+		go prober.Run(ctx)
+	}
+
+	// Outages of devices and monitors escalate through the same policies
+	var onOutage func(DowntimeEvent)
+	if escalator := escalatorFromConfig(cfg.Escalation); escalator != nil {
+		onOutage = escalator.Handle
+		go escalator.Run(ctx)
+	}
+
+	// Planned maintenance silences outages of the covered components
+	maintenanceSchedule = maintenanceFromConfig(cfg.Maintenance, cfg.Escalation.Policies, s.hub)
+	if maintenanceSchedule != nil {
+		go maintenanceSchedule.Run(ctx)
+	}
+
+	// Every outage becomes an incident the team can acknowledge and resolve
+	incidents := s.opts.store
+	if incidents == nil {
+		if incidents, err = NewIncidentStore(cfg.Incidents); err != nil {
+			return err
 		}
-	}()
+	}
+	notify := func(kind string) func(DowntimeEvent) {
+		return func(ev DowntimeEvent) {
+			incidents.Record(kind, ev)
+			if onOutage != nil {
+				onOutage(ev)
+			}
+		}
+	}
+
+	// Loops that write a state file on shutdown; Start waits for them so the
+	// final save isn't cut off by the process exiting
+	var persisting sync.WaitGroup
+	persist := func(run func(context.Context)) {
+		persisting.Add(1)
+		go func() {
+			defer persisting.Done()
+			run(ctx)
+		}()
+	}
+
+	// Device views only make sense when some source feeds the registry
+	var uptime *UptimeTracker
+	if beacons != nil || prober != nil {
+		if uptime, err = NewUptimeTracker(cfg.Uptime, deviceRegistry); err != nil {
+			return err
+		}
+		persist(uptime.Run)
+		downtime := NewDowntimeDetector(cfg.Downtime, deviceRegistry)
+		downtime.OnEvent = notify("device")
+		go downtime.Run(ctx)
+		mux.HandleFunc("/devices", handleDevices)
+		mux.Handle("/devices/uptime", uptime) // Rolling 24h/7d/30d availability (JSON or ?format=csv)
+	}
+
+	// Optional passive monitors for jobs expected to check in on a schedule
+	monitors, err := monitorsFromConfig(cfg.Monitors)
+	if err != nil {
+		return err
+	}
+	if monitors != nil {
+		monitors.OnEvent = notify("monitor")
+		go monitors.Run(ctx)
+		mux.HandleFunc("/checkin/{name}", monitors.handleCheckIn)
+		mux.HandleFunc("/monitors", monitors.handleMonitors)
+		RegisterRPCMethod("monitor.checkin", monitors.monitorCheckInMethod)
+	}
+
+	// Optional long-term history of latency and connection counts for charts
+	history, err := historyFromConfig(cfg.History)
+	if err != nil {
+		return err
+	}
+	if history != nil {
+		history.connections = &s.active
+		persist(history.Run)
+		mux.Handle("/metrics/history", history)
+	}
+
+	if cfg.Admin.Enabled() {
+		s.access.registerAdminRoutes(mux, cfg.Admin)
+		s.registerAdminRoutes(mux, cfg.Admin)
+		incidents.registerAdminRoutes(mux, cfg.Admin)
+		s.registerCertRoutes(mux, cfg.Admin)
+		NewExporter(history, uptime, auditLog).registerAdminRoutes(mux, cfg.Admin)
+	}
+
+	// Optional public status page
+	status, err := statusPageFromConfig(cfg.Status, deviceRegistry, cfg.Uptime.OfflineAfter)
+	if err != nil {
+		return err
+	}
+	if status != nil {
+		status.Attach(uptime, monitors, incidents)
+		mux.Handle("/status", status)
+		mux.HandleFunc("/status.json", status.handleJSON)
+	}
+
+	// Optional TLS: with certificates configured the main listener serves
+	// https/wss only; plain traffic can go to a separate listener
+	tlsCfg, err := buildTLS(cfg.TLS, cfg.Addr)
+	if err != nil {
+		return err
+	}
+
+	servers := []*http.Server{{
+		Addr:         cfg.Addr,
+		Handler:      s.withRequestID(mux),
+		ReadTimeout:  cfg.HTTP.ReadTimeout,
+		WriteTimeout: cfg.HTTP.WriteTimeout,
+		IdleTimeout:  cfg.HTTP.IdleTimeout,
+	}}
+	if tlsCfg != nil {
+		// Track the certificates served, including those autocert renews,
+		// and share the soonest expiry with the cluster
+		certs := certMonitorFromConfig(cfg.TLS, s.logger())
+		certs.Watch(tlsCfg.config)
+		s.certs.Store(certs)
+		s.hub.Cluster().reportCerts(certs)
+		go certs.Run(ctx)
+		servers[0].TLSConfig = tlsCfg.config
+		if cfg.TLS.PlainAddr != "" {
+			servers = append(servers, &http.Server{
+				Addr:         cfg.TLS.PlainAddr,
+				Handler:      tlsCfg.plainHandler,
+				ReadTimeout:  cfg.HTTP.ReadTimeout,
+				WriteTimeout: cfg.HTTP.WriteTimeout,
+				IdleTimeout:  cfg.HTTP.IdleTimeout,
+			})
+		}
+	}
+
+	if cfg.Origins.AllowAll {
+		s.logger().Warn("Accepting WebSocket connections from any origin - for development only")
+	}
+
+	errChan := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			ln, err := net.Listen("tcp", srv.Addr)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			// Proxies speaking the PROXY protocol announce the client's
+			// address before the TLS handshake or HTTP request
+			ln = proxyListenerFromConfig(ln, cfg.Proxy, s.proxies)
+			if srv.TLSConfig != nil {
+				s.logger().Info("Starting WebSocket server", "addr", srv.Addr, "tls", true, "proxy_protocol", cfg.Proxy.ProxyProtocol)
+				err = srv.ServeTLS(ln, "", "") // Certificates come from TLSConfig
+			} else {
+				s.logger().Info("Starting WebSocket server", "addr", srv.Addr, "tls", false, "proxy_protocol", cfg.Proxy.ProxyProtocol)
+				err = srv.Serve(ln)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errChan <- err
+			}
+		}(srv)
+	}
 
 	// Wait for context cancellation or server error
 	select {
 	case err := <-errChan:
+		shutdownAll(servers, cfg.ShutdownTimeout)
 		return fmt.Errorf("server failed to start: %w", err)
 	case <-ctx.Done():
-		log.Println("Shutting down server...")
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-
-		if err := server.Shutdown(shutdownCtx); err != nil {
+		s.logger().Info("Shutting down server")
+		err := shutdownAll(servers, cfg.ShutdownTimeout)
+		// The listeners are closed, so no new connections arrive while the
+		// open ones are told to go away
+		s.drainConnections(cfg.DrainTimeout)
+		if err != nil {
 			return fmt.Errorf("server shutdown error: %w", err)
 		}
-		log.Println("Server stopped")
+		persisting.Wait()
+		s.logger().Info("Server stopped")
 	}
 
 	return nil
 }
 
-// handleWebSocket handles incoming WebSocket connections with comprehensive
+// shutdownAll gracefully stops every listener within one shared timeout.
+func shutdownAll(servers []*http.Server, timeout time.Duration) error {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	for _, srv := range servers {
+		errs = append(errs, srv.Shutdown(shutdownCtx))
+	}
+	return errors.Join(errs...)
+}
+
+// serveWebSocket handles incoming WebSocket connections with comprehensive
 // security checks including IP-based rate limiting and connection counting.
-// Each connection runs in its own goroutine with automatic heartbeat monitoring.
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Step 1: Check connection limit for this IP address
-	// Prevents a single IP from exhausting server resources
-	clientIP := r.RemoteAddr
-	if !connManager.CheckLimit(clientIP) {
-		http.Error(w, "Too many connections from your IP", http.StatusTooManyRequests)
-		log.Printf("Connection limit exceeded for %s", clientIP)
-		return
-	}
-	defer connManager.Release(clientIP) // Always release the connection slot
-
-	// Step 2: Upgrade HTTP connection to WebSocket with security options
-	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		OriginPatterns:  []string{"localhost:*"},       // Only allow local connections
-		CompressionMode: websocket.CompressionDisabled, // Disabled for security
-	})
-	if err != nil {
-		log.Printf("Failed to accept WebSocket connection: %v", err)
-		return
+// Each connection runs in its own goroutine with automatic heartbeat monitoring;
+// the connection and every message that passes all checks go to h. The
+// checks, the upgrade and the application's middleware form one chain
+// around wsConn.serve (see connChain).
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request, h Handler) {
+	// Behind trusted reverse proxies the client's address comes from the
+	// forwarding headers. Per-IP limits count the address without its port
+	remoteAddr := s.proxies.ClientAddr(r)
+	wc := &wsConn{
+		s:        s,
+		h:        h,
+		w:        w,
+		r:        r,
+		settings: s.Config(), // One snapshot for the whole connection
+		clientIP: hostFromAddr(remoteAddr),
 	}
 
-	// Step 3: Configure connection limits and tracking
-	conn.SetReadLimit(maxMessageSize) // Prevent oversized message attacks
-	activeConnections.Add(1)
-	defer activeConnections.Add(-1) // Decrement counter on disconnect
+	// Every line logged for the connection carries its ID, from the
+	// authentication check to the close, so one connection's lifecycle can
+	// be followed in aggregated logs. Until the upgrade registers it with
+	// the hub under the same ID, a stand-in carries its identity; the
+	// origin is resolved up front so every audit event carries it
+	connID := newConnID()
+	logger := s.logger().With("conn_id", connID, "remote_addr", remoteAddr)
+	pending := &HubConn{
+		ID:         connID,
+		RemoteAddr: remoteAddr,
+		Geo:        s.geoResolver.Lookup(remoteAddr),
+		logger:     logger,
+	}
+	ctx := logging.WithLogger(context.Background(), logger)
+	s.connChain(wc)(wc.serve)(ctx, pending) // Refusals and closes are answered along the chain
+}
 
-	log.Printf("New WebSocket connection from %s (active: %d, ip_conns: %d)",
-		r.RemoteAddr, activeConnections.Load(), connManager.GetConnectionCount(clientIP))
+// wsConn is what the steps serving one WebSocket connection share: the
+// request the checks look at, what they decided, and the accepted
+// connection the read loop serves.
+type wsConn struct {
+	s        *Server
+	h        Handler
+	w        http.ResponseWriter
+	r        *http.Request
+	settings *Config
+	clientIP string // Remote address without its port, the key of per-IP limits
 
-	// Step 3.5: Wrap connection with rate-limiting to protect against client ping flooding
-	connState := &ConnectionState{}
-	rateLimitedConn := NewRateLimitedConn(conn, connState, r.RemoteAddr)
+	geoDecision    GeoDecision // Set by admitGeo
+	shadowDecision GeoDecision
 
-	// Step 4: Set up context for graceful shutdown and cleanup
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	defer conn.Close(websocket.StatusInternalError, "") // Ensure connection closure
+	// Set by upgrade
+	conn    *websocket.Conn
+	cfg     HeartbeatConfig // Heartbeat timing negotiated with the client
+	limited *RateLimitedConn
+	state   *ConnectionState
+	sweep   *SweepTarget
+	cancel  context.CancelCauseFunc // Ends the connection; the cause says why
+
+	moderated bool // Messages wait for the moderation hook, set by serve
+}
+
+// upgrade is the built-in middleware that turns the checked request into a
+// WebSocket connection: it negotiates the heartbeat, protocol, capabilities
+// and session, accepts the connection and calls next with its hub entry.
+// Once next returned, OnClose learns why the connection ended.
+func (wc *wsConn) upgrade(next ConnHandler) ConnHandler {
+	return func(ctx context.Context, pending *HubConn) (closeErr error) {
+		s, settings, w, r := wc.s, wc.settings, wc.w, wc.r
+		logger, remoteAddr, geo := pending.logger, pending.RemoteAddr, pending.Geo
+		user, _ := UserFromContext(ctx)
+
+		// Step 1.8: Negotiate heartbeat timing with the client; the accepted
+		// values travel back in the upgrade response headers
+		wc.cfg = NegotiateHeartbeat(r, settings.Heartbeat, settings.Policy)
+		SetHeartbeatHeaders(w.Header(), wc.cfg)
+
+		// Step 1.9: Agree on the message protocol version; clients that don't
+		// propose one keep exchanging raw text
+		version := protocol.Negotiate(r.Header, w.Header())
+
+		// Step 1.92: Agree on the capabilities the handler serves besides its
+		// own messages; clients that propose none never get stream messages
+		var caps []string
+		if ch, ok := wc.h.(CapabilityHandler); ok && version > ProtocolRaw {
+			caps = protocol.NegotiateCapabilities(r.Header, w.Header(), ch.Capabilities())
+		}
+
+		// Step 1.94: A new connection from a device that has one open takes
+		// over: the old one is closed, and its session is resumed below
+		requested := r.Header.Get(HeaderSessionToken)
+		device := wc.deviceKey(user)
+		if old := s.devices.get(device); old != nil {
+			if token := s.devices.supersede(old, settings.Takeover.Wait); token != "" {
+				requested = token
+			}
+		}
+
+		// Step 1.95: Take over the session a reconnecting client presents, or
+		// issue a new one; either token travels back in the upgrade response
+		var sessionToken string
+		var session *parkedSession
+		if settings.Sessions.TTL > 0 {
+			sessionToken, session = s.hub.sessions.Resume(requested, user)
+			w.Header().Set(HeaderSessionToken, sessionToken)
+			if session != nil {
+				w.Header().Set(HeaderSessionResumed, "true")
+			}
+		}
+
+		// Step 2: Upgrade HTTP connection to WebSocket with security options;
+		// envelope connections also pick their codec from the subprotocols
+		// the client offers
+		acceptOpts := &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionDisabled, // Disabled for security
+		}
+		settings.Origins.acceptOptions(acceptOpts) // Browser origins allowed by the config
+		if version > ProtocolRaw {
+			acceptOpts.Subprotocols = codecSubprotocols
+		}
+		conn, err := websocket.Accept(w, r, acceptOpts)
+		if err != nil {
+			logger.Error("Failed to accept WebSocket connection", "error", err)
+			s.hub.sessions.park(sessionToken, session, settings.Sessions.TTL) // The client can try again
+			return err
+		}
+		wc.conn = conn
+		codec, err := protocol.CodecByName(conn.Subprotocol())
+		if err != nil {
+			codec = CodecJSON // Accept only picks from codecSubprotocols
+		}
+
+		// Step 3: Configure connection limits and tracking
+		conn.SetReadLimit(settings.MaxMessageSize) // Prevent oversized message attacks (enforced by the wrapper below)
+		s.active.Add(1)
+		defer s.active.Add(-1) // Decrement counter on disconnect
+		s.metrics.ConnectionsTotal.Add(1)
+
+		// Step 3.2: Track connection metadata by GeoIP origin (country/ASN)
+		s.geoStats.Add(geo)
+		defer s.geoStats.Remove(geo)
+
+		logger.Info("New WebSocket connection", "geo", geo.String(), "user", user,
+			"active", s.active.Load(), "ip_conns", s.conns.GetConnectionCount(wc.clientIP),
+			"heartbeat_interval", wc.cfg.Interval, "heartbeat_timeout", wc.cfg.Timeout, "heartbeat_mode", wc.cfg.Mode,
+			"protocol", version, "codec", codec.Name(), "capabilities", strings.Join(caps, ","))
+		auditLog.Record(AuditEvent{
+			Type:       "connection",
+			RemoteAddr: remoteAddr,
+			Decision:   "open",
+			Fields: map[string]string{
+				"country": geo.Country,
+				"asn":     fmt.Sprintf("%d", geo.ASN),
+				"user":    string(user),
+			},
+		})
+
+		// Step 3.5: Wrap connection with rate-limiting to protect against client ping flooding
+		wc.state = &ConnectionState{
+			baseInterval:   settings.RateLimit.MinInterval,
+			minInterval:    wc.geoDecision.MinInterval,
+			maxViolations:  settings.RateLimit.MaxViolations,
+			shadowInterval: wc.shadowDecision.MinInterval,
+		}
+		s.states.add(string(pending.ID), wc.state)
+		defer s.states.Remove(string(pending.ID))
+		wc.limited = NewRateLimitedConn(conn, wc.state, remoteAddr)
+		wc.limited.metrics = s.metrics
+		wc.limited.limiter, wc.limited.ip = s.limiter, wc.clientIP
+		wc.limited.SetReadLimit(settings.MaxMessageSize) // Oversized messages get a structured close
+
+		// Step 3.6: Let the sweeper probe this connection when it goes idle
+		wc.sweep = s.sweeper.register(conn, remoteAddr, logger)
+		defer s.sweeper.Unregister(wc.sweep)
+
+		// Step 4: Set up context for graceful shutdown and cleanup; handlers
+		// read the authenticated identity from it via UserFromContext and the
+		// settings snapshot via ConfigFromContext, the message protocol via
+		// ProtocolVersionFromContext, CodecFromContext and CapabilitiesFromContext
+		ctx = context.WithValue(ctx, serverKey{}, s)
+		ctx = context.WithValue(ctx, configKey{}, settings)
+		ctx = withCapabilities(withCodec(withProtocolVersion(ctx, version), codec), caps)
+		// Once the connection ended, its context's cause says why - for the
+		// goroutines handlers started (see DisconnectError)
+		ctx, wc.cancel = context.WithCancelCause(ctx)
+		defer func() { wc.cancel(closeErr) }()
+		defer CloseWith(conn, CloseInternalError, "") // Ensure closure; a no-op after a deliberate close
+
+		// Step 4.5: Join the hub so the connection can receive broadcasts,
+		// direct messages and topic fan-out; handlers find it via ConnFromContext
+		var unacked *offlineQueue
+		if sessionToken != "" {
+			unacked = newOfflineQueue(s.hub, settings.Sessions)
+		}
+		hubConn := s.hub.register(ctx, pending.ID, conn, user, remoteAddr, geo, unacked)
+		claim := &deviceConn{hc: hubConn, session: sessionToken, ended: make(chan struct{})}
+		if prev := s.devices.claim(device, claim); prev != nil {
+			s.devices.supersede(prev, 0) // Connected while this one waited for its predecessor
+		}
+		defer func() {
+			// Once the session is parked, a connection taking over can resume it
+			defer s.devices.release(device, claim)
+			// Clients that said goodbye don't come back
+			if sessionToken != "" && websocket.CloseStatus(closeErr) != CloseNormal {
+				s.hub.sessions.Park(sessionToken, hubConn, settings.Sessions.TTL) // Unregisters too
+				return
+			}
+			s.hub.Unregister(hubConn)
+			if unacked != nil {
+				<-hubConn.stopped // Nothing is added after this
+				unacked.clear()
+			}
+		}()
+		defer s.healthWatch.Closed(hubConn) // Runs before Unregister
+		ctx = withHubConn(ctx, hubConn)
+		if session != nil {
+			// Step 4.55: Restore the subscriptions and replay the messages the
+			// client's previous connection didn't receive
+			replayed := s.hub.sessions.restore(ctx, session, hubConn)
+			logger.Info("Session resumed", "topics", len(session.topics), "pending", replayed)
+		}
+		// Throttled messages still reach the handler, but the client learns it
+		// is close to being disconnected
+		wc.limited.onThrottle = func(e *RateLimitError) { hubConn.enqueue(e.Notice()) }
+
+		// Step 4.6: Serve the connection through the rest of the chain - the
+		// panic recovery, the application's middleware and wc.serve
+		defer func() {
+			defer s.recoverConn(hubConn, nil) // The connection is over already
+			wc.h.OnClose(ctx, hubConn, closeErr)
+		}()
+		closeErr = served(hubConn, next(ctx, hubConn))
+
+		// Report what the dry-run rate limit would have flagged on this connection
+		if n := wc.state.GetShadowViolations(); n > 0 {
+			auditLog.Record(AuditEvent{
+				Type:       "rate_limit_shadow",
+				RemoteAddr: remoteAddr,
+				Decision:   "would_limit",
+				Reason:     fmt.Sprintf("%d message(s) faster than %v", n, wc.shadowDecision.MinInterval),
+			})
+		}
+
+		// Record the connection lifecycle so decisions can be replayed offline
+		auditLog.Record(AuditEvent{
+			Type:       "connection",
+			RemoteAddr: remoteAddr,
+			Decision:   "close",
+			Fields: map[string]string{
+				"country":         geo.Country,
+				"asn":             fmt.Sprintf("%d", geo.ASN),
+				"peak_violations": fmt.Sprintf("%d", wc.state.GetPeakViolations()),
+				"max_violations":  fmt.Sprintf("%d", wc.state.violationLimit()),
+				"reason":          string(disconnectReason(closeErr)),
+			},
+		})
+
+		// Clean shutdown with normal closure status, unless the connection was
+		// already closed with a more specific one
+		CloseWith(conn, CloseNormal, "")
+		logger.Info("Connection closed", "reason", disconnectReason(closeErr), "active", s.active.Load())
+		return closeErr
+	}
+}
+
+// deviceKey returns the key takeover tracks the connection under: the
+// user and the device the client named. The zero key, which is never
+// taken over, when takeover is off, the connection is anonymous or the
+// client sent no device ID.
+func (wc *wsConn) deviceKey(user UserID) deviceKey {
+	device := wc.r.Header.Get(HeaderDeviceID)
+	if !wc.settings.Takeover.Enabled || user == "" || device == "" {
+		return deviceKey{}
+	}
+	return deviceKey{user: user, device: device}
+}
+
+// serve is the ConnHandler the middleware chain wraps: it lets the
+// endpoint's handler set up per-connection state, runs the heartbeat and
+// the read loop, and returns the *DisconnectError saying why the
+// connection ended. ctx and hc are the ones the chain called it with.
+func (wc *wsConn) serve(ctx context.Context, hc *HubConn) error {
+	s, settings, conn, cfg, logger := wc.s, wc.settings, wc.conn, wc.cfg, hc.logger
+	if err := wc.h.OnConnect(ctx, hc); err != nil {
+		logger.Warn("Handler refused connection", "error", err)
+		closeHandlerError(conn, err)
+		return &DisconnectError{Reason: DisconnectHandler, Err: err}
+	}
 
 	// Step 5: Start enhanced heartbeat monitoring in background goroutine
 	// This continuously checks connection health via ping/pong frames
-	cfg := DefaultHeartbeatConfig()
+	// using the negotiated interval and timeout
+	// In JSON mode the heartbeat travels as text messages that the read
+	// loop hands over instead of passing them to the handler
+	appHeartbeat := NewAppHeartbeat(conn, cfg)
+	hc.heartbeat.Store(appHeartbeat)
+	if unacked := hc.unacked; unacked != nil {
+		// An answered ping acknowledges every message written before it
+		var mark uint64
+		observe := appHeartbeat.OnPong
+		appHeartbeat.OnPing = func() { mark = unacked.mark() }
+		appHeartbeat.OnPong = func(rtt time.Duration) {
+			observe(rtt)
+			unacked.ack(mark)
+		}
+	}
+	if cfg.Mode == HeartbeatModeJSON {
+		wc.limited.exempt = heartbeat.IsMessage
+	}
+	// Health changes update the hub entry, reach the application's
+	// callbacks and connections watching this identity and, if the client
+	// asked for them, are pushed to it as {"type":"health",...} notices
+	appHeartbeat.OnHealth = func(st heartbeat.HealthStatus) {
+		prev := hc.setHealth(st.State)
+		s.metrics.HealthChanges[st.State].Add(1)
+		change := HealthChange{From: prev, To: st.State, Latency: st.Latency, Jitter: st.Jitter, Missed: st.Missed, At: time.Now()}
+		for _, fn := range s.opts.stateChange {
+			fn(hc, change)
+		}
+		s.healthWatch.Publish(hc, st)
+		logger.Info("Connection health changed", "state", st.State,
+			"latency", st.Latency.Round(time.Millisecond), "jitter", st.Jitter.Round(time.Millisecond), "missed", st.Missed)
+		if !cfg.NotifyHealth {
+			return
+		}
+		if notice, err := json.Marshal(heartbeat.NewHealthNotice(st)); err == nil {
+			hc.enqueue(notice)
+		}
+	}
 	go func() {
-		metrics, err := EnhancedHeartbeat(ctx, conn, cfg)
+		// OnHealth runs the application's callbacks on this goroutine
+		defer s.recoverConn(hc, func(de *DisconnectError) { wc.cancel(de) })
+		metrics, err := appHeartbeat.Run(ctx)
 		if err != nil {
-			// Log detailed metrics on heartbeat failure
-			log.Printf("Heartbeat failed for %s: %v | Pings=%d Pongs=%d Failed=%d Latency=%dms",
-				r.RemoteAddr, err,
-				metrics.PingsSent.Load(),
-				metrics.PongsReceived.Load(),
-				metrics.FailedPings.Load(),
-				metrics.AvgLatency.Load())
-		}
-		// Cancel main context to trigger cleanup on heartbeat failure
-		cancel()
+			// Log detailed metrics on heartbeat failure; a heartbeat stopped
+			// by the connection closing is routine
+			level := slog.LevelWarn
+			if ctx.Err() != nil {
+				level = slog.LevelDebug
+			}
+			snap := metrics.Snapshot()
+			logger.Log(ctx, level, "Heartbeat stopped", "error", err,
+				"pings", snap.PingsSent,
+				"pongs", snap.PongsReceived,
+				"failed", snap.FailedPings,
+				"latency_avg", snap.AvgLatency.Round(time.Millisecond),
+				"latency_p95", snap.P95Latency.Round(time.Millisecond),
+				"latency_max", snap.MaxLatency.Round(time.Millisecond))
+		}
+		// Cancel main context to trigger cleanup on heartbeat failure; the
+		// read loop finds the cause (a no-op if the connection ended first)
+		wc.cancel(&DisconnectError{Reason: DisconnectHeartbeat, Err: err})
 	}()
 
-	// Step 6: Main message handling loop - reads and echoes messages
+	// Step 5.5: Enforce the max lifetime and idle timeout, independent
+	// of the heartbeat
+	touch, stopLimits := limitLifetime(hc, settings.Lifetime)
+	defer stopLimits()
+
+	// Step 5.6: With moderation enabled for the connection's room (or
+	// all connections), messages are delivered by a worker goroutine fed
+	// by the read loop, which keeps OnMessage calls in order and never
+	// concurrent
+	var moderated chan inboundMessage // nil = deliver on the read loop
+	var stopModeration context.CancelFunc
+	moderationDone := make(chan struct{})
+	wc.moderated = s.moderation.Covers(handlerRoom(wc.h))
+	if wc.moderated {
+		moderated = make(chan inboundMessage, moderationQueue)
+		var modCtx context.Context
+		modCtx, stopModeration = context.WithCancel(ctx)
+		go func() {
+			defer close(moderationDone)
+			defer s.recoverConn(hc, func(de *DisconnectError) {
+				wc.cancel(de) // Ends the read loop with this cause
+				stopModeration()
+			})
+			for m := range moderated {
+				if modCtx.Err() != nil {
+					continue // The connection is gone; drop what it still sent
+				}
+				if de := wc.deliver(modCtx, hc, m.msgType, m.msg); de != nil {
+					wc.cancel(de) // Ends the read loop with this cause
+					stopModeration()
+				}
+			}
+		}()
+	}
+
+	// Step 6: Main message handling loop - reads and answers messages
+	var closeErr error
 	for {
 		// Read message with timeout to prevent blocking indefinitely
 		// Uses rate-limited connection wrapper to protect against flooding
-		readCtx, readCancel := context.WithTimeout(ctx, readTimeout)
-		msgType, msg, err := rateLimitedConn.Read(readCtx)
+		readCtx, readCancel := context.WithTimeout(ctx, settings.ReadTimeout)
+		msgType, msg, err := wc.limited.Read(readCtx)
 		readCancel()
 
+		var tooBig *MessageTooBigError
+		if errors.As(err, &tooBig) {
+			// Tell the client why instead of dropping the connection silently
+			s.metrics.OversizedMessages.Add(1)
+			logger.Warn("Message too large, closing connection", "limit", tooBig.Limit)
+			auditLog.Record(AuditEvent{
+				Type:       "read_limit",
+				RemoteAddr: hc.RemoteAddr,
+				Decision:   "close",
+				Reason:     tooBig.Error(),
+			})
+			closeMessageTooBig(conn, tooBig.Limit)
+			closeErr = &DisconnectError{Reason: DisconnectMessageTooBig, Err: err}
+			break
+		}
+		var limited *RateLimitError
+		if errors.As(err, &limited) {
+			// Tell the client which limit it hit and how to stay within it
+			logger.Warn("Closing rate-limited connection", "limiter", limited.Limiter, "violations", limited.Violations)
+			closeRateLimited(conn, limited)
+			closeErr = &DisconnectError{Reason: DisconnectRateLimited, Detail: limited.Limiter, Err: err}
+			break
+		}
 		if err != nil {
-			log.Printf("Read error from %s: %v", r.RemoteAddr, err)
+			// Say why - heartbeat, drain, kick, peer close - not just which
+			// read failed
+			cause := disconnectCause(ctx, hc, wc.sweep, err)
+			logger.Info("Read loop ended", "reason", cause.Reason, "detail", cause.Detail, "error", cause.Err)
 			// Log rate limit violations for monitoring
-			if connState.GetClientViolations() > 0 {
-				log.Printf("Client %s had %d rate limit violations before disconnect",
-					r.RemoteAddr, connState.GetClientViolations())
+			if wc.state.GetClientViolations() > 0 {
+				logger.Info("Rate limit violations before disconnect", "violations", wc.state.GetClientViolations())
 			}
+			closeErr = cause
 			break // Exit loop on any read error
 		}
 
-		log.Printf("Server received from %s: %s", r.RemoteAddr, string(msg))
+		wc.sweep.Touch() // Connection is demonstrably alive
+		if appHeartbeat.Handle(ctx, msgType, msg) {
+			continue // Heartbeat traffic never reaches moderation or the handler
+		}
+		touch() // Everything else counts as activity
+		if s.healthWatch.Handle(hc, msgType, msg) {
+			continue // Watch requests are answered here, not by the handler
+		}
+		if settings.PubSub.handle(hc, msgType, msg) {
+			continue // So are subscriptions
+		}
+		s.metrics.MessagesReceived.Add(1)
+		hc.received.Add(1)
+		logger.Debug("Message received", "message", string(msg))
 
-		// Echo the received message back to the client
-		writeCtx, writeCancel := context.WithTimeout(ctx, writeTimeout)
-		err = conn.Write(writeCtx, msgType, []byte(fmt.Sprintf("Server echoes: %s", msg)))
-		writeCancel()
+		if moderated == nil {
+			if de := wc.deliver(ctx, hc, msgType, msg); de != nil {
+				closeErr = de
+				break
+			}
+			continue
+		}
+		// Moderated messages wait for their verdict in the queue, so a
+		// slow moderation backend doesn't hold up the reads that keep
+		// the heartbeat going
+		select {
+		case moderated <- inboundMessage{msgType, msg}:
+		case <-ctx.Done(): // The worker ended the connection; the next read says why
+		}
+	}
+	if moderated != nil {
+		close(moderated)
+		stopModeration()
+		<-moderationDone // OnClose must not overlap the last OnMessage
+	}
+	return closeErr
+}
 
+// deliver holds a message until the moderation hook approves it, hands it
+// to the endpoint's handler and sends its reply. It returns why the
+// connection must end, if it must.
+func (wc *wsConn) deliver(ctx context.Context, hc *HubConn, msgType websocket.MessageType, msg []byte) *DisconnectError {
+	typ, traceID := inbound(ctx, msg)
+	ctx = WithTraceID(ctx, traceID)
+	s, conn, logger := wc.s, wc.conn, LoggerFromContext(ctx)
+	verdict, reason := VerdictAllow, ""
+	if wc.moderated {
+		verdict, reason = s.moderation.Check(ctx, ModerationRequest{
+			RemoteAddr: hc.RemoteAddr,
+			Body:       string(msg),
+			ReceivedAt: time.Now(),
+		})
+	}
+	if verdict == VerdictReject {
+		logger.Info("Message rejected by moderation", "reason", reason)
+		writeCtx, writeCancel := context.WithTimeout(ctx, wc.settings.WriteTimeout)
+		err := conn.Write(writeCtx, websocket.MessageText, []byte(fmt.Sprintf("Server rejected message: %s", reason)))
+		writeCancel()
 		if err != nil {
-			log.Printf("Write error to %s: %v", r.RemoteAddr, err)
-			break // Exit loop on write failure
+			logger.Warn("Write failed", "error", err)
+			return &DisconnectError{Reason: DisconnectWriteError, Err: err}
 		}
+		s.metrics.MessagesSent.Add(1)
+		hc.sent.Add(1)
+		return nil // Rejected messages are never echoed
 	}
 
-	// Clean shutdown with normal closure status
-	conn.Close(websocket.StatusNormalClosure, "")
-	log.Printf("Connection closed for %s (active: %d)",
-		r.RemoteAddr, activeConnections.Load())
+	// Hand the message to the endpoint's handler and send its reply
+	reply, err := wc.handle(ctx, hc, typ, msgType, msg)
+	if err != nil {
+		logger.Info("Handler closed connection", "error", err)
+		closeHandlerError(conn, err)
+		return &DisconnectError{Reason: DisconnectHandler, Err: err}
+	}
+	if reply == nil {
+		return nil // Nothing to answer (e.g. a notification)
+	}
+	writeCtx, writeCancel := context.WithTimeout(ctx, wc.settings.WriteTimeout)
+	err = conn.Write(writeCtx, msgType, reply)
+	writeCancel()
+	if err != nil {
+		logger.Warn("Write failed", "error", err)
+		return &DisconnectError{Reason: DisconnectWriteError, Err: err}
+	}
+	s.metrics.MessagesSent.Add(1)
+	hc.sent.Add(1)
+	return nil
 }
 
 // healthCheck provides a simple HTTP health check endpoint for monitoring
 // Returns JSON with server status and current active connection count
-func healthCheck(w http.ResponseWriter, r *http.Request) {
+func (s *Server) healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	// In a cluster, the connections of all instances are added up
+	cluster := ""
+	if relay := s.hub.Cluster(); relay != nil {
+		st := relay.Stats()
+		cluster = fmt.Sprintf(`,"cluster":{"instances":%d,"connections":%d}`, st.Instances, st.Connections)
+	}
 	w.Write([]byte(`{"status":"healthy","active_connections":` +
-		fmt.Sprintf("%d", activeConnections.Load()) + `}`))
+		fmt.Sprintf("%d", s.active.Load()) + cluster + `}`))
 }
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// Session resumption headers, see SessionSettings.
+const (
+	HeaderSessionToken   = protocol.HeaderSession
+	HeaderSessionResumed = protocol.HeaderSessionResumed
+)
+
+// SessionSettings configures session resumption. Each connection gets a
+// session token in its upgrade response. When the connection drops, its
+// topic subscriptions are kept for TTL, together with the messages it
+// hadn't received: those still in its send queue, those written but not
+// acknowledged by a heartbeat yet, and those published to its topics or
+// sent to its connection ID while it is away. A client that reconnects
+// with the token in time gets them back, in order, on the new connection.
+// State kept by the endpoint's handler isn't part of the session.
+type SessionSettings struct {
+	TTL         time.Duration `yaml:"ttl"`          // How long a dropped connection's session is kept; 0 = off (env SESSION_TTL)
+	MaxMessages int           `yaml:"max_messages"` // Messages kept per session, oldest dropped first; 0 = none (env SESSION_MAX_MESSAGES)
+	MaxBytes    int64         `yaml:"max_bytes"`    // Bytes kept per session (env SESSION_MAX_BYTES)
+}
+
+// DefaultSessionSettings returns the defaults: sessions off, and up to 256
+// messages or 1 MB kept per session once they are turned on.
+func DefaultSessionSettings() SessionSettings {
+	return SessionSettings{MaxMessages: 256, MaxBytes: 1 << 20}
+}
+
+// validate checks the TTL and the limits.
+func (ss SessionSettings) validate() []ValidationError {
+	var errs []ValidationError
+	if ss.TTL < 0 {
+		errs = append(errs, ValidationError{"sessions.ttl", "must not be negative"})
+	}
+	if ss.MaxMessages < 0 {
+		errs = append(errs, ValidationError{"sessions.max_messages", "must not be negative"})
+	}
+	if ss.MaxBytes < 0 {
+		errs = append(errs, ValidationError{"sessions.max_bytes", "must not be negative"})
+	}
+	return errs
+}
+
+// parkedSession is the state of a session whose connection dropped.
+type parkedSession struct {
+	user   UserID
+	conn   ConnID // The dropped connection, which direct messages still name
+	topics map[string]struct{}
+	queue  *offlineQueue // Messages the client hasn't received, oldest first
+	timer  *time.Timer
+
+	mu sync.Mutex // Protects hc
+	hc *HubConn   // Connection the session was replayed on (nil until then)
+}
+
+// SessionStore keeps the sessions of a hub's dropped connections until
+// they are resumed or their TTL passes. While a session waits, messages
+// for its topics and its connection ID are kept in its queue. Queued
+// messages count against the hub's memory budget; under pressure they
+// are evicted after dead letters but before any live connection's queue.
+type SessionStore struct {
+	hub    *Hub
+	parked map[string]*parkedSession // Token -> session waiting to be resumed
+	open   map[ConnID]*parkedSession // Dropped connection -> session still taking messages
+	mu     sync.Mutex
+
+	resumed  atomic.Int64 // Sessions restored on a new connection
+	expired  atomic.Int64 // Sessions dropped after their TTL
+	buffered atomic.Int64 // Messages kept for dropped connections
+	replayed atomic.Int64 // Kept messages queued on a resumed connection
+}
+
+// newSessionStore creates an empty store for the connections of h. The
+// hub registers its evictor.
+func newSessionStore(h *Hub) *SessionStore {
+	return &SessionStore{
+		hub:    h,
+		parked: make(map[string]*parkedSession),
+		open:   make(map[ConnID]*parkedSession),
+	}
+}
+
+// newSessionToken generates a random session token. Tokens are as good as
+// credentials for the session, so they are long enough not to be guessed.
+func newSessionToken() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Resume takes the parked session token names, if it belongs to user.
+// Otherwise it returns a new token and a nil session. A token presented by
+// another user stays parked for its owner. The session keeps taking
+// messages until it is restored on the new connection.
+func (st *SessionStore) Resume(token string, user UserID) (string, *parkedSession) {
+	if token == "" {
+		return newSessionToken(), nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ps, ok := st.parked[token]
+	if !ok || ps.user != user {
+		return newSessionToken(), nil
+	}
+	delete(st.parked, token)
+	return token, ps
+}
+
+// Park unregisters hc from the hub and keeps its subscriptions and the
+// messages it didn't receive under token for ttl. Both happen in one step,
+// so messages for hc that arrive meanwhile are kept too - behind the ones
+// it left. Messages past their deadline, or that the session's limits or
+// the memory budget have no room for, are dropped.
+func (st *SessionStore) Park(token string, hc *HubConn, ttl time.Duration) {
+	ps := &parkedSession{user: hc.User, conn: hc.ID, topics: make(map[string]struct{}), queue: hc.unacked}
+	// Nobody knows ps yet, so holding its lock ahead of the others is safe.
+	// Senders that find it wait until the messages hc left are in
+	ps.mu.Lock()
+	st.hub.mu.Lock()
+	st.mu.Lock()
+	for topic := range hc.topics {
+		ps.topics[topic] = struct{}{}
+	}
+	st.hub.unregister(hc)
+	st.open[ps.conn] = ps
+	st.mu.Unlock()
+	st.hub.mu.Unlock()
+	hc.close() // Late senders that still found hc are forwarded to ps
+
+	// Unacknowledged messages were written first, so the unsent ones
+	// follow them
+	<-hc.stopped // The writer may still be finishing a message
+	now := time.Now()
+	for len(hc.send) > 0 {
+		m := <-hc.send
+		if m.stale(now) {
+			hc.hub.expire(hc, m)
+			continue
+		}
+		discarded, ok := ps.queue.add(m)
+		if !ok {
+			discarded++
+		}
+		st.hub.dropped.Add(int64(discarded))
+	}
+	ps.mu.Unlock()
+	st.park(token, ps, ttl)
+	hc.logger.Debug("Session parked", "topics", len(ps.topics), "pending", ps.queue.len(), "ttl", ttl)
+}
+
+// park stores ps under token and (re)starts its TTL. Also used to put back
+// a session whose resuming upgrade failed.
+func (st *SessionStore) park(token string, ps *parkedSession, ttl time.Duration) {
+	if ps == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.parked[token] = ps
+	if ps.timer != nil {
+		ps.timer.Stop()
+	}
+	ps.timer = time.AfterFunc(ttl, func() { st.expire(token, ps) })
+}
+
+// expire drops a session nobody resumed in time.
+func (st *SessionStore) expire(token string, ps *parkedSession) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.open[ps.conn] != ps {
+		return // Restored meanwhile
+	}
+	delete(st.open, ps.conn)
+	if st.parked[token] == ps {
+		delete(st.parked, token)
+	}
+	st.hub.dropped.Add(int64(ps.queue.len()))
+	ps.queue.clear()
+	st.expired.Add(1)
+}
+
+// subscribers returns the sessions taking messages for topic, directly or
+// through a pattern. Callers must
+// hold hub.mu, so a session restored meanwhile is either listed here or
+// already subscribed.
+func (st *SessionStore) subscribers(topic string) []*parkedSession {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var out []*parkedSession
+	for _, ps := range st.open {
+		for pattern := range ps.topics {
+			if topicMatch(pattern, topic) {
+				out = append(out, ps)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// session returns the session taking messages for the dropped connection id.
+func (st *SessionStore) session(id ConnID) (*parkedSession, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ps, ok := st.open[id]
+	return ps, ok
+}
+
+// forward keeps msg for the session of the dropped connection id. Returns
+// ErrUnknownConn if the connection left none.
+func (st *SessionStore) forward(ctx context.Context, id ConnID, msg []byte, bulk bool) error {
+	ps, ok := st.session(id)
+	if !ok {
+		return ErrUnknownConn
+	}
+	return st.keep(ctx, ps, msg, bulk)
+}
+
+// keep queues msg for the session: in its queue while it waits, on its new
+// connection once it was replayed there. The message gets ctx's deadline,
+// or the hub's MessageTTL, like a live connection's.
+func (st *SessionStore) keep(ctx context.Context, ps *parkedSession, msg []byte, bulk bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Reserved before taking ps.mu: restore holds it together with the
+	// locks evictors take
+	size := int64(len(msg))
+	if ps.queue == nil || !st.hub.memory.Reserve(size) {
+		st.hub.dropped.Add(1)
+		return ErrMemoryBudget
+	}
+	ps.mu.Lock()
+	if hc := ps.hc; hc != nil {
+		ps.mu.Unlock()
+		st.hub.memory.Release(size)
+		return hc.queue(ctx, msg, bulk)
+	}
+	defer ps.mu.Unlock()
+	m := outgoing{data: msg, bulk: bulk}
+	if d, ok := ctx.Deadline(); ok {
+		m.deadline = d
+	} else if ttl := st.hub.opts.Load().MessageTTL; ttl > 0 {
+		m.deadline = time.Now().Add(ttl)
+	}
+	discarded, ok := ps.queue.insert(m)
+	st.hub.dropped.Add(int64(discarded))
+	if !ok {
+		st.hub.dropped.Add(1)
+		return ErrQueueFull
+	}
+	st.buffered.Add(1)
+	return nil
+}
+
+// restore replays the session's queued messages on hc in order, waiting
+// for room in hc's queue rather than applying its overflow policy, then
+// subscribes hc to the session's topics. Messages arriving for the session
+// meanwhile are replayed too, so none overtakes an older one. Returns how
+// many messages were queued.
+func (st *SessionStore) restore(ctx context.Context, ps *parkedSession, hc *HubConn) int {
+	queued := 0
+	for {
+		if m, ok := ps.queue.pop(); ok {
+			if hc.replay(ctx, m) == nil {
+				queued++
+			} else {
+				st.hub.dropped.Add(1)
+			}
+			continue
+		}
+		// Empty: hand the session over to hc, unless a message slipped in
+		st.hub.mu.Lock()
+		st.mu.Lock()
+		ps.mu.Lock()
+		empty := ps.queue.len() == 0
+		if empty {
+			for topic := range ps.topics {
+				st.hub.subscribe(hc, topic)
+			}
+			delete(st.open, ps.conn)
+			ps.timer.Stop()
+			ps.hc = hc // Publishers that found the session before go to hc
+		}
+		ps.mu.Unlock()
+		st.mu.Unlock()
+		st.hub.mu.Unlock()
+		if empty {
+			break
+		}
+	}
+	st.resumed.Add(1)
+	st.replayed.Add(int64(queued))
+	return queued
+}
+
+// evict is the store's Evictor: it drops the oldest queued messages of
+// waiting sessions until need bytes are freed, then forgets the oldest
+// unacknowledged messages of live connections. Evicted messages of
+// waiting sessions count as dropped.
+func (st *SessionStore) evict(need int64) int64 {
+	st.mu.Lock()
+	waiting := make([]*parkedSession, 0, len(st.open))
+	for _, ps := range st.open {
+		waiting = append(waiting, ps)
+	}
+	st.mu.Unlock()
+
+	var freed int64
+	for _, ps := range waiting {
+		if freed >= need {
+			return freed
+		}
+		n, dropped := ps.queue.evict(need - freed)
+		freed += n
+		st.hub.dropped.Add(int64(dropped))
+	}
+	for _, hc := range st.hub.Conns() {
+		if freed >= need {
+			break
+		}
+		n, _ := hc.unacked.evict(need - freed)
+		freed += n
+	}
+	return freed
+}
+
+// Parked returns how many sessions are waiting to be resumed.
+func (st *SessionStore) Parked() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.parked)
+}
+
+// Resumed returns how many sessions were restored on a new connection.
+func (st *SessionStore) Resumed() int64 {
+	return st.resumed.Load()
+}
+
+// Expired returns how many sessions were dropped after their TTL.
+func (st *SessionStore) Expired() int64 {
+	return st.expired.Load()
+}
+
+// Buffered returns how many messages were kept for dropped connections.
+func (st *SessionStore) Buffered() int64 {
+	return st.buffered.Load()
+}
+
+// Replayed returns how many kept messages were queued on resumed
+// connections.
+func (st *SessionStore) Replayed() int64 {
+	return st.replayed.Load()
+}
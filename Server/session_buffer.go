@@ -0,0 +1,161 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+)
+
+// offlineQueue holds a session's messages in order: while the connection
+// is up, those written to the client but not yet acknowledged; once it
+// dropped, also those still queued and those sent to it since. It is
+// bounded by SessionSettings.MaxMessages and MaxBytes - when full, the
+// oldest messages make room - and its entries are reserved from the hub's
+// memory budget. Methods are nil-safe: a nil queue keeps nothing.
+//
+// A message counts as acknowledged once the client answered a heartbeat
+// ping sent after it: the client reads in order, so it has read every
+// frame before the ping.
+type offlineQueue struct {
+	entries  *list.List // Of offlineEntry, oldest first
+	bytes    int64      // Data of all entries, reserved from hub.memory
+	seq      uint64     // Sequence number of the last message added
+	max      int
+	maxBytes int64
+	hub      *Hub
+	mu       sync.Mutex
+}
+
+// offlineEntry is a message in an offlineQueue.
+type offlineEntry struct {
+	m   outgoing
+	seq uint64
+}
+
+// newOfflineQueue creates an empty queue with the limits of ss. Returns
+// nil if ss keeps no messages.
+func newOfflineQueue(h *Hub, ss SessionSettings) *offlineQueue {
+	if ss.MaxMessages <= 0 || ss.MaxBytes <= 0 {
+		return nil
+	}
+	return &offlineQueue{entries: list.New(), max: ss.MaxMessages, maxBytes: ss.MaxBytes, hub: h}
+}
+
+// add appends m, discarding the oldest messages if the queue is full.
+// Returns how many were discarded, and false if m itself wasn't kept
+// because it is larger than the queue or the memory budget has no room.
+func (q *offlineQueue) add(m outgoing) (int, bool) {
+	// Reserve may evict from this very queue, so it runs without q.mu
+	if q == nil || !q.hub.memory.Reserve(int64(len(m.data))) {
+		return 0, false
+	}
+	return q.insert(m)
+}
+
+// insert is add for a message whose bytes the caller already reserved;
+// they are released if it isn't kept. q must not be nil.
+func (q *offlineQueue) insert(m outgoing) (int, bool) {
+	size := int64(len(m.data))
+	if size > q.maxBytes {
+		q.hub.memory.Release(size)
+		return 0, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	discarded := 0
+	for q.entries.Len() > 0 && (q.entries.Len() >= q.max || q.bytes+size > q.maxBytes) {
+		q.remove(q.entries.Front())
+		discarded++
+	}
+	q.seq++
+	q.entries.PushBack(offlineEntry{m: m, seq: q.seq})
+	q.bytes += size
+	return discarded, true
+}
+
+// remove takes e off the queue and releases its bytes. Callers must hold
+// q.mu.
+func (q *offlineQueue) remove(e *list.Element) int64 {
+	size := int64(len(q.entries.Remove(e).(offlineEntry).m.data))
+	q.bytes -= size
+	q.hub.memory.Release(size)
+	return size
+}
+
+// mark returns the sequence number of the last message added, to be
+// acknowledged once the client proved it read that far.
+func (q *offlineQueue) mark() uint64 {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.seq
+}
+
+// ack drops the messages up to and including seq.
+func (q *offlineQueue) ack(seq uint64) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for e := q.entries.Front(); e != nil && e.Value.(offlineEntry).seq <= seq; e = q.entries.Front() {
+		q.remove(e)
+	}
+}
+
+// pop takes the oldest message off the queue. Its bytes are released; the
+// caller charges them wherever the message goes next.
+func (q *offlineQueue) pop() (outgoing, bool) {
+	if q == nil {
+		return outgoing{}, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e := q.entries.Front()
+	if e == nil {
+		return outgoing{}, false
+	}
+	m := e.Value.(offlineEntry).m
+	q.remove(e)
+	return m, true
+}
+
+// len returns how many messages the queue holds.
+func (q *offlineQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.entries.Len()
+}
+
+// evict drops the oldest messages until need bytes are freed. Returns the
+// bytes freed and how many messages were dropped.
+func (q *offlineQueue) evict(need int64) (int64, int) {
+	if q == nil {
+		return 0, 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var freed int64
+	n := 0
+	for freed < need && q.entries.Len() > 0 {
+		freed += q.remove(q.entries.Front())
+		n++
+	}
+	return freed, n
+}
+
+// clear drops all messages.
+func (q *offlineQueue) clear() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.entries.Len() > 0 {
+		q.remove(q.entries.Front())
+	}
+}
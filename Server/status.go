@@ -0,0 +1,287 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// statusTemplates holds the HTML rendering of the public status page.
+//
+//go:embed templates/status.html
+var statusTemplates embed.FS
+
+// Component states shown on the status page.
+const (
+	ComponentUp       = "up"
+	ComponentDegraded = "degraded" // Monitor is late but within its grace period
+	ComponentDown     = "down"
+	ComponentUnknown  = "unknown" // Monitor without a check-in yet
+)
+
+// StatusSettings configures the public status page.
+type StatusSettings struct {
+	Enabled   bool          `yaml:"enabled"`   // Serve /status and /status.json
+	Title     string        `yaml:"title"`     // Page heading
+	Groups    []StatusGroup `yaml:"groups"`    // Components not matched by any group are listed under "Other"
+	Anonymize bool          `yaml:"anonymize"` // Replace device and monitor names with "<group> <n>"
+	History   int           `yaml:"history"`   // Recent incidents shown
+}
+
+// StatusGroup collects devices and monitors under one heading.
+type StatusGroup struct {
+	Name     string   `yaml:"name"`
+	Devices  []string `yaml:"devices"`  // Device ID patterns ("sensor-*")
+	Monitors []string `yaml:"monitors"` // Monitor name patterns
+}
+
+// StatusComponent is one device or monitor on the page.
+type StatusComponent struct {
+	Name   string              `json:"name"`
+	Kind   string              `json:"kind"` // "device" or "monitor"
+	State  string              `json:"state"`
+	Uptime map[string]*float64 `json:"uptime,omitempty"` // Devices only: window -> percent
+}
+
+// StatusGroupView is a rendered group.
+type StatusGroupView struct {
+	Name       string            `json:"name"`
+	State      string            `json:"state"` // Worst component state
+	Components []StatusComponent `json:"components"`
+}
+
+// StatusIncident is an outage of one component, open until Resolved is set.
+type StatusIncident struct {
+	Component string     `json:"component"`
+	Kind      string     `json:"kind"`
+	State     string     `json:"state"` // open, acknowledged or resolved
+	Started   time.Time  `json:"started"`
+	Resolved  *time.Time `json:"resolved,omitempty"`
+	Duration  string     `json:"duration,omitempty"` // Set once resolved
+}
+
+// StatusSummary is the whole page - served as JSON by /status.json.
+type StatusSummary struct {
+	Title     string            `json:"title"`
+	Overall   string            `json:"overall"` // operational, degraded, partial outage or major outage
+	Generated time.Time         `json:"generated"`
+	Groups    []StatusGroupView `json:"groups"`
+	Incidents []StatusIncident  `json:"incidents"` // Newest first
+}
+
+// StatusPage summarizes device and monitor health for people outside the
+// team. It only exposes states, uptime and outage times - never addresses,
+// tokens or probe targets - and can hide component names entirely.
+type StatusPage struct {
+	cfg          StatusSettings
+	registry     *DeviceRegistry
+	offlineAfter time.Duration    // Beacon silence after which a device counts as down
+	uptime       *UptimeTracker   // Optional
+	monitors     *MonitorRegistry // Optional
+	incidents    *IncidentStore   // Optional
+	tmpl         *template.Template
+}
+
+// NewStatusPage creates a status page over the device registry. Attach
+// adds uptime, monitor and incident data when those features are running.
+func NewStatusPage(cfg StatusSettings, registry *DeviceRegistry, offlineAfter time.Duration) (*StatusPage, error) {
+	tmpl, err := template.New("status.html").Funcs(template.FuncMap{
+		"percent": func(p *float64) string {
+			if p == nil {
+				return "-"
+			}
+			return fmt.Sprintf("%.2f%%", *p)
+		},
+	}).ParseFS(statusTemplates, "templates/status.html")
+	if err != nil {
+		return nil, fmt.Errorf("parse status template: %w", err)
+	}
+	return &StatusPage{
+		cfg:          cfg,
+		registry:     registry,
+		offlineAfter: offlineAfter,
+		tmpl:         tmpl,
+	}, nil
+}
+
+// Attach adds the optional data sources. Call before serving.
+func (sp *StatusPage) Attach(uptime *UptimeTracker, monitors *MonitorRegistry, incidents *IncidentStore) {
+	if sp == nil {
+		return
+	}
+	sp.uptime = uptime
+	sp.monitors = monitors
+	sp.incidents = incidents
+}
+
+// Summary builds the page contents at now.
+func (sp *StatusPage) Summary(now time.Time) StatusSummary {
+	// Collect components with their real names first
+	uptime := make(map[string]map[string]*float64)
+	if sp.uptime != nil {
+		for _, r := range sp.uptime.Report(now) {
+			uptime[r.ID] = r.Uptime
+		}
+	}
+	var components []StatusComponent
+	for _, d := range sp.registry.List() {
+		state := ComponentDown
+		if d.Online(now, sp.offlineAfter) {
+			state = ComponentUp
+		}
+		components = append(components, StatusComponent{Name: d.ID, Kind: "device", State: state, Uptime: uptime[d.ID]})
+	}
+	if sp.monitors != nil {
+		for _, m := range sp.monitors.List() {
+			components = append(components, StatusComponent{Name: m.Name, Kind: "monitor", State: monitorComponentState(m.State)})
+		}
+	}
+
+	// Sort them into groups; anonymized names are numbered per group
+	views := make([]StatusGroupView, len(sp.cfg.Groups)+1)
+	for i, g := range sp.cfg.Groups {
+		views[i].Name = g.Name
+	}
+	views[len(views)-1].Name = "Other"
+	labels := make(map[string]string) // kind/name -> public name
+	for _, c := range components {
+		i := sp.groupOf(c)
+		v := &views[i]
+		if sp.cfg.Anonymize {
+			public := fmt.Sprintf("%s %d", v.Name, len(v.Components)+1)
+			labels[c.Kind+"/"+c.Name] = public
+			c.Name = public
+		}
+		v.Components = append(v.Components, c)
+	}
+
+	summary := StatusSummary{Title: sp.cfg.Title, Generated: now, Groups: []StatusGroupView{}}
+	var up, down, total int
+	for _, v := range views {
+		if len(v.Components) == 0 {
+			continue
+		}
+		v.State = ComponentUp
+		for _, c := range v.Components {
+			total++
+			switch c.State {
+			case ComponentUp:
+				up++
+			case ComponentDown:
+				down++
+			}
+			if stateRank(c.State) > stateRank(v.State) {
+				v.State = c.State
+			}
+		}
+		summary.Groups = append(summary.Groups, v)
+	}
+	switch {
+	case total == 0 || up == total:
+		summary.Overall = "operational"
+	case down == total:
+		summary.Overall = "major outage"
+	case down > 0:
+		summary.Overall = "partial outage"
+	default:
+		summary.Overall = "degraded"
+	}
+
+	// Incidents only show their public side - notes and names of the
+	// people handling them stay in the admin API
+	summary.Incidents = []StatusIncident{}
+	if sp.incidents != nil {
+		for _, inc := range sp.incidents.List("") {
+			if len(summary.Incidents) == sp.cfg.History {
+				break
+			}
+			public := StatusIncident{Component: inc.Component, Kind: inc.Kind, State: inc.State, Started: inc.Started}
+			if inc.ResolvedAt != nil {
+				public.Resolved = inc.ResolvedAt
+				public.Duration = inc.Duration(now).Round(time.Second).String()
+			}
+			if sp.cfg.Anonymize {
+				label, ok := labels[inc.Kind+"/"+inc.Component]
+				if !ok {
+					label = "hidden " + inc.Kind // Component no longer listed
+				}
+				public.Component = label
+			}
+			summary.Incidents = append(summary.Incidents, public)
+		}
+	}
+	return summary
+}
+
+// groupOf returns the index of the first group matching c, or the
+// trailing "Other" group. Groups without patterns of c's kind match nothing.
+func (sp *StatusPage) groupOf(c StatusComponent) int {
+	for i, g := range sp.cfg.Groups {
+		patterns := g.Devices
+		if c.Kind == "monitor" {
+			patterns = g.Monitors
+		}
+		if len(patterns) > 0 && matchDevice(patterns, c.Name) {
+			return i
+		}
+	}
+	return len(sp.cfg.Groups)
+}
+
+// monitorComponentState maps a monitor state onto the page's states.
+func monitorComponentState(state string) string {
+	switch state {
+	case MonitorUp:
+		return ComponentUp
+	case MonitorLate:
+		return ComponentDegraded
+	case MonitorDown:
+		return ComponentDown
+	default:
+		return ComponentUnknown
+	}
+}
+
+// stateRank orders states from best to worst.
+func stateRank(state string) int {
+	switch state {
+	case ComponentUp:
+		return 0
+	case ComponentUnknown:
+		return 1
+	case ComponentDegraded:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// ServeHTTP renders the status page as HTML.
+func (sp *StatusPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := sp.tmpl.Execute(w, sp.Summary(time.Now())); err != nil {
+		slog.Error("Status page render failed", "error", err)
+	}
+}
+
+// handleJSON serves the status summary as JSON.
+func (sp *StatusPage) handleJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // Public data - embeddable in other dashboards
+	json.NewEncoder(w).Encode(sp.Summary(time.Now()))
+}
+
+// statusPageFromConfig creates the status page when enabled. Returns nil
+// otherwise; Attach is a no-op on a nil page.
+func statusPageFromConfig(ss StatusSettings, registry *DeviceRegistry, offlineAfter time.Duration) (*StatusPage, error) {
+	if !ss.Enabled {
+		return nil, nil
+	}
+	return NewStatusPage(ss, registry, offlineAfter)
+}
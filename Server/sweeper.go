@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// SweeperConfig controls the half-open connection sweeper.
+type SweeperConfig struct {
+	SweepInterval time.Duration `yaml:"sweep_interval"` // How often idle connections are checked
+	IdleThreshold time.Duration `yaml:"idle_threshold"` // Idle time after which a connection is probed
+	ProbeTimeout  time.Duration `yaml:"probe_timeout"`  // Max time a probe write may stall before the connection is closed
+}
+
+// DefaultSweeperConfig returns sweeper settings that probe connections well
+// before Config.ReadTimeout would drop them.
+func DefaultSweeperConfig() SweeperConfig {
+	return SweeperConfig{
+		SweepInterval: 5 * time.Second,
+		IdleThreshold: 8 * time.Second,
+		ProbeTimeout:  2 * time.Second,
+	}
+}
+
+// SweepTarget is a connection tracked by the sweeper. Handlers call Touch
+// whenever data moves so active connections are never probed.
+type SweepTarget struct {
+	conn         *websocket.Conn
+	remoteAddr   string
+	logger       *slog.Logger
+	lastActivity atomic.Int64 // Unix nanoseconds of last read/write
+	probing      atomic.Bool  // Whether a probe write is in flight
+	closed       atomic.Bool  // The sweeper closed the connection
+}
+
+// Touch records activity on the connection.
+func (t *SweepTarget) Touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// HalfOpenSweeper closes connections stuck in half-open TCP states.
+// Pings alone can't always catch these: some middleboxes answer or swallow
+// control frames on behalf of a peer that is gone. A small data write whose
+// send buffer never drains is a more reliable signal, so long-idle
+// connections get a probe write (an empty binary message) and are closed if
+// it stalls beyond ProbeTimeout.
+type HalfOpenSweeper struct {
+	cfg     SweeperConfig
+	targets map[*SweepTarget]struct{} // Registered connections
+	mu      sync.Mutex                // Protects targets
+	closed  atomic.Int64              // Connections closed by the sweeper
+}
+
+// NewHalfOpenSweeper creates a sweeper. Call Run to start sweeping.
+func NewHalfOpenSweeper(cfg SweeperConfig) *HalfOpenSweeper {
+	return &HalfOpenSweeper{
+		cfg:     cfg,
+		targets: make(map[*SweepTarget]struct{}),
+	}
+}
+
+// Register starts tracking a connection. The returned target must be passed
+// to Unregister when the connection closes.
+func (s *HalfOpenSweeper) Register(conn *websocket.Conn, remoteAddr string) *SweepTarget {
+	return s.register(conn, remoteAddr, slog.Default().With("remote_addr", remoteAddr))
+}
+
+// register tracks a connection that logs with logger.
+func (s *HalfOpenSweeper) register(conn *websocket.Conn, remoteAddr string, logger *slog.Logger) *SweepTarget {
+	t := &SweepTarget{conn: conn, remoteAddr: remoteAddr, logger: logger}
+	t.Touch()
+	s.mu.Lock()
+	s.targets[t] = struct{}{}
+	s.mu.Unlock()
+	return t
+}
+
+// Unregister stops tracking a connection.
+func (s *HalfOpenSweeper) Unregister(t *SweepTarget) {
+	s.mu.Lock()
+	delete(s.targets, t)
+	s.mu.Unlock()
+}
+
+// Closed returns how many connections the sweeper has closed.
+func (s *HalfOpenSweeper) Closed() int64 {
+	return s.closed.Load()
+}
+
+// Run sweeps idle connections every SweepInterval until ctx is cancelled.
+func (s *HalfOpenSweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.sweep(ctx)
+	}
+}
+
+// sweep probes every connection idle longer than IdleThreshold.
+func (s *HalfOpenSweeper) sweep(ctx context.Context) {
+	cutoff := time.Now().Add(-s.cfg.IdleThreshold).UnixNano()
+
+	s.mu.Lock()
+	var idle []*SweepTarget
+	for t := range s.targets {
+		if t.lastActivity.Load() < cutoff {
+			idle = append(idle, t)
+		}
+	}
+	s.mu.Unlock()
+
+	// Probe outside the lock - each write may block up to ProbeTimeout
+	for _, t := range idle {
+		if !t.probing.CompareAndSwap(false, true) {
+			continue // Previous probe still in flight
+		}
+		go s.probe(ctx, t)
+	}
+}
+
+// probe writes an empty binary message and closes the connection if the
+// write fails or stalls.
+func (s *HalfOpenSweeper) probe(ctx context.Context, t *SweepTarget) {
+	defer t.probing.Store(false)
+
+	probeCtx, cancel := context.WithTimeout(ctx, s.cfg.ProbeTimeout)
+	err := t.conn.Write(probeCtx, websocket.MessageBinary, nil)
+	cancel()
+
+	if err == nil {
+		t.Touch() // Write drained - peer's TCP stack is alive
+		return
+	}
+	if ctx.Err() != nil {
+		return // Server shutting down - not a half-open connection
+	}
+
+	s.closed.Add(1)
+	t.logger.Warn("Closing half-open connection: probe write stalled", "error", err)
+	auditLog.Record(AuditEvent{
+		Type:       "half_open",
+		RemoteAddr: t.remoteAddr,
+		Decision:   "close",
+		Reason:     err.Error(),
+	})
+	t.closed.Store(true)
+	t.conn.CloseNow()
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// HeaderDeviceID is the upgrade request header a client names its device
+// in, see TakeoverSettings.
+const HeaderDeviceID = protocol.HeaderDevice
+
+// TakeoverSettings configure duplicate connection takeover. When an
+// authenticated user connects from a device (HeaderDeviceID) that already
+// has a connection open, the new connection wins: the old one is closed
+// with CloseSuperseded, and with sessions on, its session - subscriptions
+// and the messages it didn't receive - is resumed on the new connection.
+// This keeps a half-open connection the client gave up on from holding a
+// connection slot and its session until the heartbeat notices. The device
+// ID is only trusted together with the user, so clients can't close other
+// users' connections; anonymous connections are never taken over.
+type TakeoverSettings struct {
+	Enabled bool          `yaml:"enabled"` // Take over duplicate connections (env CONN_TAKEOVER)
+	Wait    time.Duration `yaml:"wait"`    // Max time a new connection waits for the old one to close and park its session
+}
+
+// DefaultTakeoverSettings returns takeover off, waiting up to 10 seconds
+// once it is on - long enough for the close handshake of a half-open
+// connection to time out.
+func DefaultTakeoverSettings() TakeoverSettings {
+	return TakeoverSettings{Wait: 10 * time.Second}
+}
+
+// validate checks the wait.
+func (ts TakeoverSettings) validate() []ValidationError {
+	if ts.Enabled && ts.Wait <= 0 {
+		return []ValidationError{{"takeover.wait", "must be positive"}}
+	}
+	return nil
+}
+
+// supersededReason is the close reason of a connection taken over.
+const supersededReason = "superseded by a new connection"
+
+// deviceKey identifies a user's device. The zero key stands for
+// connections that can't be taken over.
+type deviceKey struct {
+	user   UserID
+	device string
+}
+
+// deviceConn is the open connection of a device.
+type deviceConn struct {
+	hc      *HubConn
+	session string        // The connection's session token ("" without sessions)
+	ended   chan struct{} // Closed once the connection left the hub and parked its session
+}
+
+// deviceConns tracks the open connection of each device for takeover.
+type deviceConns struct {
+	conns      map[deviceKey]*deviceConn
+	mu         sync.Mutex
+	superseded atomic.Int64 // Connections closed because a new one took over
+}
+
+// newDeviceConns creates an empty table.
+func newDeviceConns() *deviceConns {
+	return &deviceConns{conns: make(map[deviceKey]*deviceConn)}
+}
+
+// get returns the open connection of key, nil if there is none.
+func (dc *deviceConns) get(key deviceKey) *deviceConn {
+	if key == (deviceKey{}) {
+		return nil
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.conns[key]
+}
+
+// claim records c as key's open connection and returns the one it
+// replaces, if any - one that connected while c waited for its
+// predecessor.
+func (dc *deviceConns) claim(key deviceKey, c *deviceConn) *deviceConn {
+	if key == (deviceKey{}) {
+		return nil
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	prev := dc.conns[key]
+	dc.conns[key] = c
+	return prev
+}
+
+// release forgets c once its connection ended, and lets a connection
+// taking it over continue.
+func (dc *deviceConns) release(key deviceKey, c *deviceConn) {
+	if c == nil {
+		return
+	}
+	dc.mu.Lock()
+	if dc.conns[key] == c {
+		delete(dc.conns, key)
+	}
+	dc.mu.Unlock()
+	close(c.ended)
+}
+
+// supersede closes c's connection with CloseSuperseded and waits up to
+// wait for it to end. Returns c's session token if the session was parked
+// in time, so the new connection can resume it; "" otherwise.
+func (dc *deviceConns) supersede(c *deviceConn, wait time.Duration) string {
+	dc.superseded.Add(1)
+	hc := c.hc
+	hc.logger.Info("Connection superseded by a new one from the same device")
+	auditLog.Record(AuditEvent{
+		Type:       "takeover",
+		RemoteAddr: hc.RemoteAddr,
+		Decision:   "superseded",
+		Fields:     map[string]string{"user": string(hc.User), "conn_id": string(hc.ID)},
+	})
+	hc.closing(DisconnectSuperseded, supersededReason)
+	go CloseWith(hc.conn, CloseSuperseded, supersededReason)
+	if wait <= 0 {
+		return ""
+	}
+	select {
+	case <-c.ended:
+		return c.session
+	case <-time.After(wait):
+		hc.logger.Warn("Superseded connection didn't end in time - its session stays parked", "wait", wait)
+		return ""
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// takeoverServer serves /ws with takeover and sessions on. The bearer
+// token is the user's name.
+func takeoverServer(t *testing.T) string {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Takeover.Enabled = true
+	cfg.Sessions.TTL = time.Minute
+	auth := func(r *http.Request) (UserID, error) {
+		return UserID(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")), nil
+	}
+	s, err := NewServer(cfg, WithAuth(auth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		s.Shutdown(context.Background())
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// dialDevice connects as user from device and keeps reading, so closes
+// complete; the read error arrives on the returned channel.
+func dialDevice(ctx context.Context, t *testing.T, url, user, device string) (*http.Response, <-chan error) {
+	t.Helper()
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+user)
+	header.Set(HeaderDeviceID, device)
+	conn, resp, err := websocket.Dial(ctx, url, &websocket.DialOptions{HTTPHeader: header})
+	if err != nil {
+		t.Fatalf("dial as %s from %s: %v", user, device, err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+	ended := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				ended <- err
+				return
+			}
+		}
+	}()
+	return resp, ended
+}
+
+// TestTakeoverSupersedesSameDevice checks that a second connection of a
+// user's device closes the first with CloseSuperseded and resumes its
+// session, while other users and devices keep theirs.
+func TestTakeoverSupersedesSameDevice(t *testing.T) {
+	url := takeoverServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, firstEnded := dialDevice(ctx, t, url, "alice", "phone")
+	_, otherDevice := dialDevice(ctx, t, url, "alice", "laptop")
+	_, otherUser := dialDevice(ctx, t, url, "bob", "phone")
+
+	second, _ := dialDevice(ctx, t, url, "alice", "phone")
+	if err := <-firstEnded; websocket.CloseStatus(err) != CloseSuperseded {
+		t.Fatalf("first connection ended with %v, want close code %d", err, CloseSuperseded)
+	}
+	if second.Header.Get(HeaderSessionResumed) != "true" || second.Header.Get(HeaderSessionToken) != first.Header.Get(HeaderSessionToken) {
+		t.Fatal("the new connection didn't resume the superseded one's session")
+	}
+	select {
+	case err := <-otherDevice:
+		t.Fatalf("alice's other device was closed: %v", err)
+	case err := <-otherUser:
+		t.Fatalf("bob's connection from the same device ID was closed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
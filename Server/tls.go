@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSSettings configures HTTPS/WSS. Certificates come either from files or
+// from Let's Encrypt via autocert - never both. With TLS enabled the server
+// listens on Config.Addr with TLS, and optionally on PlainAddr without it
+// (needed for autocert's HTTP-01 challenge, otherwise redirects to https).
+type TLSSettings struct {
+	CertFile  string           `yaml:"cert_file"`  // PEM certificate chain (env TLS_CERT_FILE)
+	KeyFile   string           `yaml:"key_file"`   // PEM private key (env TLS_KEY_FILE)
+	Autocert  AutocertSettings `yaml:"autocert"`   // Let's Encrypt certificates
+	PlainAddr string           `yaml:"plain_addr"` // Optional plain HTTP listener (e.g. ":80")
+
+	ExpiryWarning time.Duration `yaml:"expiry_warning"` // Warn about certificates expiring within this (env TLS_EXPIRY_WARNING)
+
+	// Config, when set from code, is used as-is and takes precedence over
+	// the file and autocert settings.
+	Config *tls.Config `yaml:"-"`
+}
+
+// AutocertSettings configures automatic certificates from Let's Encrypt.
+type AutocertSettings struct {
+	Domains  []string `yaml:"domains"`   // Host names to obtain certificates for (env TLS_AUTOCERT_DOMAINS, comma-separated)
+	CacheDir string   `yaml:"cache_dir"` // Where certificates are stored between restarts
+	Email    string   `yaml:"email"`     // Contact address for the ACME account (optional)
+}
+
+// Enabled reports whether the server should serve TLS.
+func (ts TLSSettings) Enabled() bool {
+	return ts.Config != nil || ts.CertFile != "" || len(ts.Autocert.Domains) > 0
+}
+
+// tlsListener describes how the TLS listener is set up, plus the handler
+// for the optional plain listener.
+type tlsListener struct {
+	config       *tls.Config
+	plainHandler http.Handler // Serves PlainAddr (ACME challenges or https redirects)
+}
+
+// buildTLS prepares the TLS configuration for the listener on tlsAddr.
+// Returns nil when TLS is disabled.
+func buildTLS(ts TLSSettings, tlsAddr string) (*tlsListener, error) {
+	if !ts.Enabled() {
+		return nil, nil
+	}
+	tl := &tlsListener{plainHandler: redirectToHTTPS(tlsAddr)}
+
+	switch {
+	case ts.Config != nil:
+		tl.config = ts.Config.Clone()
+	case len(ts.Autocert.Domains) > 0:
+		if ts.Autocert.CacheDir == "" {
+			return nil, errors.New("autocert requires a cache_dir - certificates would be re-issued on every restart")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(ts.Autocert.Domains...),
+			Cache:      autocert.DirCache(ts.Autocert.CacheDir),
+			Email:      ts.Autocert.Email,
+		}
+		tl.config = m.TLSConfig()
+		tl.plainHandler = m.HTTPHandler(nil) // Answers HTTP-01 challenges, redirects the rest
+	default:
+		cert, err := tls.LoadX509KeyPair(ts.CertFile, ts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS certificate: %w", err)
+		}
+		tl.config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if tl.config.MinVersion == 0 {
+		tl.config.MinVersion = tls.VersionTLS12
+	}
+	return tl, nil
+}
+
+// redirectToHTTPS sends plain HTTP clients to the same URL over https on
+// the port of tlsAddr.
+func redirectToHTTPS(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := hostFromAddr(r.Host)
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// splitList splits a comma-separated environment value, dropping blanks.
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
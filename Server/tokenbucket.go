@@ -0,0 +1,197 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// RateSettings configures a token bucket: Rate messages per second on
+// average, with bursts of up to Burst messages. Rate 0 disables it.
+type RateSettings struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// enabled reports whether the bucket limits anything.
+func (rs RateSettings) enabled() bool {
+	return rs.Rate > 0
+}
+
+// MessageRateSettings configures the token buckets every incoming message
+// draws from. A message that finds a bucket empty closes its connection
+// with StatusPolicyViolation. A minimum interval between one connection's
+// messages can be enforced besides; it is off unless MinInterval is set
+// (or a geo rule sets one for the connection's origin).
+type MessageRateSettings struct {
+	PerIP  RateSettings `yaml:"per_ip"` // Shared by all connections of a client IP (env RATE_LIMIT_PER_IP, RATE_LIMIT_PER_IP_BURST)
+	Global RateSettings `yaml:"global"` // Shared by all connections (env RATE_LIMIT_GLOBAL, RATE_LIMIT_GLOBAL_BURST)
+
+	MinInterval   time.Duration `yaml:"min_interval"`   // Spacing of a connection's messages; faster ones are throttled (0 = off, env RATE_LIMIT_MIN_INTERVAL)
+	MaxViolations int           `yaml:"max_violations"` // Throttled messages in a row before the connection is closed (0 = 3, env RATE_LIMIT_MAX_VIOLATIONS)
+}
+
+// DefaultMessageRateSettings allows every IP 20 messages/s with bursts of
+// 50; there is no global limit and no minimum interval.
+func DefaultMessageRateSettings() MessageRateSettings {
+	return MessageRateSettings{PerIP: RateSettings{Rate: 20, Burst: 50}, MaxViolations: maxViolations}
+}
+
+// validate checks both buckets.
+func (ms MessageRateSettings) validate() []ValidationError {
+	var errs []ValidationError
+	for _, b := range []struct {
+		field string
+		rs    RateSettings
+	}{{"rate_limit.per_ip", ms.PerIP}, {"rate_limit.global", ms.Global}} {
+		field, rs := b.field, b.rs
+		if rs.Rate < 0 {
+			errs = append(errs, ValidationError{field + ".rate", "must not be negative"})
+		}
+		if rs.enabled() && rs.Burst < 1 {
+			errs = append(errs, ValidationError{field + ".burst", "must be at least 1"})
+		}
+	}
+	if ms.MinInterval < 0 {
+		errs = append(errs, ValidationError{"rate_limit.min_interval", "must not be negative"})
+	}
+	if ms.MaxViolations < 0 {
+		errs = append(errs, ValidationError{"rate_limit.max_violations", "must not be negative"})
+	}
+	return errs
+}
+
+// TokenBucket is a token bucket rate limiter safe for concurrent use. It
+// starts full. A nil bucket allows everything.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64   // Tokens added per second
+	burst  float64   // Bucket capacity
+	tokens float64   // Tokens available at last
+	last   time.Time // Last refill
+}
+
+// NewTokenBucket creates a bucket, or returns nil when rate is not
+// positive.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Allow takes a token if one is available.
+func (tb *TokenBucket) Allow() bool {
+	if tb == nil {
+		return true
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(time.Now())
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// set changes rate and capacity, keeping the tokens already earned.
+func (tb *TokenBucket) set(rate float64, burst int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(time.Now())
+	tb.rate, tb.burst = rate, float64(burst)
+	tb.tokens = min(tb.tokens, tb.burst)
+}
+
+// refill adds the tokens earned since the last call. Callers must hold tb.mu.
+func (tb *TokenBucket) refill(now time.Time) {
+	tb.tokens = min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+}
+
+// MessageLimiter holds the global bucket and one bucket per client IP. An
+// IP's bucket lives as long as the IP has connections, so its connections
+// share it and opening more of them buys no extra messages.
+type MessageLimiter struct {
+	mu     sync.Mutex
+	perIP  RateSettings
+	global *TokenBucket
+	ips    map[string]*ipBucket
+}
+
+// ipBucket is an IP's bucket and the number of connections using it.
+type ipBucket struct {
+	bucket *TokenBucket // nil when per-IP limiting is disabled
+	conns  int
+}
+
+// NewMessageLimiter creates the buckets for settings.
+func NewMessageLimiter(settings MessageRateSettings) *MessageLimiter {
+	ml := &MessageLimiter{ips: make(map[string]*ipBucket)}
+	ml.configure(settings)
+	return ml
+}
+
+// configure applies new settings. Existing buckets keep their tokens.
+func (ml *MessageLimiter) configure(settings MessageRateSettings) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.global = resize(ml.global, settings.Global)
+	ml.perIP = settings.PerIP
+	for _, ib := range ml.ips {
+		ib.bucket = resize(ib.bucket, settings.PerIP)
+	}
+}
+
+// resize returns tb changed to rs, a new bucket if there was none, or nil
+// if rs is disabled.
+func resize(tb *TokenBucket, rs RateSettings) *TokenBucket {
+	switch {
+	case !rs.enabled():
+		return nil
+	case tb == nil:
+		return NewTokenBucket(rs.Rate, rs.Burst)
+	default:
+		tb.set(rs.Rate, rs.Burst)
+		return tb
+	}
+}
+
+// acquire registers a connection from ip, creating its bucket if needed.
+// Every acquire must be paired with a release.
+func (ml *MessageLimiter) acquire(ip string) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ib := ml.ips[ip]
+	if ib == nil {
+		ib = &ipBucket{bucket: NewTokenBucket(ml.perIP.Rate, ml.perIP.Burst)}
+		ml.ips[ip] = ib
+	}
+	ib.conns++
+}
+
+// release unregisters a connection from ip and drops the bucket with the
+// IP's last connection.
+func (ml *MessageLimiter) release(ip string) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if ib := ml.ips[ip]; ib != nil {
+		if ib.conns--; ib.conns <= 0 {
+			delete(ml.ips, ip)
+		}
+	}
+}
+
+// allow takes a token for one message from ip out of its bucket and the
+// global one. It returns the exceeded limit, or nil.
+func (ml *MessageLimiter) allow(ip string) *RateLimitError {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if ib := ml.ips[ip]; ib != nil && !ib.bucket.Allow() {
+		return &RateLimitError{Limiter: LimiterIPMessageRate, Rate: ml.perIP.Rate, Burst: ml.perIP.Burst}
+	}
+	if !ml.global.Allow() {
+		return &RateLimitError{Limiter: LimiterGlobalMessageRate, Rate: ml.global.rate, Burst: int(ml.global.burst)}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+
+	"github.com/deanbregenzer/cysl/internal/logging"
+	"github.com/deanbregenzer/cysl/internal/protocol"
+)
+
+// Trace IDs follow one user action across the fan-out path. Every message
+// a handler gets has one: the envelope's TraceID if the client set a
+// usable one, else a new one from NewTraceID. The handler's ctx carries
+// it, so the lines it logs through LoggerFromContext have a trace_id
+// attribute, the messages it creates with NewMessage and NewReply carry
+// it to their recipients, and hub messages published with ctx take it
+// along to the other instances of a cluster.
+
+// NewTraceID generates a random trace ID: 32 hex digits, the size of a
+// W3C trace-id.
+func NewTraceID() string {
+	return protocol.NewTraceID()
+}
+
+// traceIDKey is the context key of the trace ID.
+type traceIDKey struct{}
+
+// TraceIDFromContext returns the trace ID of the message a handler is
+// processing, or "" outside of one.
+func TraceIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// WithTraceID returns a copy of ctx carrying the trace ID id, with
+// trace_id added to its logger. Work a handler hands off - to a goroutine
+// or another service - keeps the trace when started from the handler's
+// ctx; use WithTraceID to continue a trace on a fresh context.
+func WithTraceID(ctx context.Context, id string) context.Context {
+	if id == TraceIDFromContext(ctx) {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, traceIDKey{}, id)
+	return logging.WithLogger(ctx, logging.FromContext(ctx).With("trace_id", id))
+}
+
+// inbound returns the type label of msg on the connection ctx belongs to -
+// the envelope's type, or rawMessageType or invalidMessageType - and its
+// trace ID: the envelope's, or a new one when it has none or one that
+// doesn't belong in a log line (see validRequestID).
+func inbound(ctx context.Context, msg []byte) (typ, traceID string) {
+	typ = rawMessageType
+	if ProtocolVersionFromContext(ctx) != ProtocolRaw {
+		m, err := DecodeMessage(ctx, msg)
+		typ, traceID = m.Type, m.TraceID
+		if err != nil {
+			typ = invalidMessageType
+		}
+	}
+	if !validRequestID(traceID) {
+		traceID = NewTraceID()
+	}
+	return typ, traceID
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// traceHandler logs every message, pushes a notice and answers it, all
+// from the handler's ctx.
+type traceHandler struct{ BaseHandler }
+
+func (traceHandler) OnMessage(ctx context.Context, hc *HubConn, msgType websocket.MessageType, msg []byte) ([]byte, error) {
+	LoggerFromContext(ctx).Info("Handling message")
+	req, err := DecodeMessage(ctx, msg)
+	if err != nil {
+		return errorMessage(ctx, ErrorCodeInvalidMessage, err.Error()), nil
+	}
+	notice, _ := NewMessage(ctx, "notice", nil)
+	hc.Push(ctx, notice)
+	return NewReply(ctx, req, MessageTypeEcho, req.Payload)
+}
+
+// lockedBuffer is a log destination safe for concurrent writers.
+type lockedBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+// TestTraceIDPropagates checks that the client's trace ID, or a new one
+// when it sent none or an unusable one, reaches the handler's log lines
+// and every message the handler creates.
+func TestTraceIDPropagates(t *testing.T) {
+	logs := &lockedBuffer{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	_, url := serveHandler(t, DefaultConfig(), traceHandler{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	header := http.Header{}
+	header.Set(HeaderProtocolVersion, "1")
+	conn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{HTTPHeader: header})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.CloseNow()
+
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+	tests := []struct {
+		name, msg string
+		want      *regexp.Regexp
+	}{
+		{"client's trace ID", `{"type":"message","id":"1","trace_id":"action-42"}`, regexp.MustCompile(`^action-42$`)},
+		{"no trace ID", `{"type":"message","id":"2"}`, generated},
+		{"unusable trace ID", `{"type":"message","id":"3","trace_id":"two words"}`, generated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := conn.Write(ctx, websocket.MessageText, []byte(tt.msg)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			var traces []string
+			for range 2 { // The notice and the reply
+				_, data, err := conn.Read(ctx)
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				m, err := CodecJSON.Decode(data)
+				if err != nil {
+					t.Fatalf("decode %s: %v", data, err)
+				}
+				traces = append(traces, m.TraceID)
+			}
+			if !tt.want.MatchString(traces[0]) || traces[1] != traces[0] {
+				t.Fatalf("notice and reply carry trace IDs %q, want one matching %s", traces, tt.want)
+			}
+			if !regexp.MustCompile(`"Handling message".* trace_id=` + traces[0] + `\n`).MatchString(logs.String()) {
+				t.Fatalf("handler's log line lacks trace_id=%s:\n%s", traces[0], logs)
+			}
+		})
+	}
+}
+
+// TestCodecsCarryTraceID checks that every codec keeps the trace ID.
+func TestCodecsCarryTraceID(t *testing.T) {
+	for _, codec := range []Codec{CodecJSON, CodecMsgPack, CodecProtobuf} {
+		data, err := codec.Encode(Message{Type: "message", ID: "1", TraceID: "action-42", Timestamp: time.Now()})
+		if err != nil {
+			t.Fatalf("%s: encode: %v", codec.Name(), err)
+		}
+		m, err := codec.Decode(data)
+		if err != nil || m.TraceID != "action-42" {
+			t.Fatalf("%s: decoded trace ID %q (%v), want action-42", codec.Name(), m.TraceID, err)
+		}
+	}
+}
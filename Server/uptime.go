@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// uptimeRetention is how much history is kept - the longest report window.
+const uptimeRetention = 30 * 24 * time.Hour
+
+// uptimeWindows are the rolling windows reported per device.
+var uptimeWindows = []struct {
+	Name   string
+	Length time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// UptimeSettings configures per-device uptime tracking.
+type UptimeSettings struct {
+	SampleInterval time.Duration `yaml:"sample_interval"` // How often device state is sampled
+	OfflineAfter   time.Duration `yaml:"offline_after"`   // Beacon silence after which a device counts as down
+	StateFile      string        `yaml:"state_file"`      // Where history is persisted across restarts (optional)
+}
+
+// uptimeBucket aggregates one hour of samples for a device.
+type uptimeBucket struct {
+	Hour  int64 `json:"hour"`  // Unix time of the hour start
+	Up    int64 `json:"up"`    // Seconds the device was up
+	Total int64 `json:"total"` // Seconds the device was observed
+}
+
+// UptimeReport is one device's availability over the rolling windows.
+// A nil percentage means the device wasn't observed in that window.
+type UptimeReport struct {
+	ID     string              `json:"id"`
+	Uptime map[string]*float64 `json:"uptime"` // Window name ("24h", "7d", "30d") -> percent
+}
+
+// UptimeTracker samples the DeviceRegistry and turns beacon and probe
+// liveness into uptime percentages per device. History is kept in hourly
+// buckets, so 30 days cost at most 720 small entries per device.
+type UptimeTracker struct {
+	cfg      UptimeSettings
+	registry *DeviceRegistry
+	history  map[string][]uptimeBucket // Device ID -> buckets, oldest first
+	mu       sync.Mutex                // Protects history
+}
+
+// NewUptimeTracker creates a tracker and loads persisted history if a
+// state file is configured. A missing state file is not an error.
+func NewUptimeTracker(cfg UptimeSettings, registry *DeviceRegistry) (*UptimeTracker, error) {
+	ut := &UptimeTracker{
+		cfg:      cfg,
+		registry: registry,
+		history:  make(map[string][]uptimeBucket),
+	}
+	if cfg.StateFile == "" {
+		return ut, nil
+	}
+
+	data, err := os.ReadFile(cfg.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return ut, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read uptime state: %w", err)
+	}
+	if err := json.Unmarshal(data, &ut.history); err != nil {
+		return nil, fmt.Errorf("parse uptime state %s: %w", cfg.StateFile, err)
+	}
+	return ut, nil
+}
+
+// Run samples every SampleInterval until ctx is cancelled, persisting the
+// history after each sample and once more on shutdown.
+func (ut *UptimeTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(ut.cfg.SampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			ut.save()
+			return
+		case <-ticker.C:
+		}
+		ut.Sample(time.Now())
+		ut.save()
+	}
+}
+
+// Sample records one SampleInterval of state for every known device.
+func (ut *UptimeTracker) Sample(now time.Time) {
+	devices := ut.registry.List()
+	hour := now.Truncate(time.Hour).Unix()
+	cutoff := now.Add(-uptimeRetention).Unix()
+	seconds := int64(ut.cfg.SampleInterval / time.Second)
+
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	for _, d := range devices {
+		online := d.Online(now, ut.cfg.OfflineAfter)
+		if !online && maintenanceSchedule.Covers("device", d.ID, now) {
+			continue // Planned downtime doesn't count against uptime
+		}
+
+		buckets := ut.history[d.ID]
+		if n := len(buckets); n == 0 || buckets[n-1].Hour != hour {
+			buckets = append(buckets, uptimeBucket{Hour: hour})
+		}
+		last := &buckets[len(buckets)-1]
+		last.Total += seconds
+		if online {
+			last.Up += seconds
+		}
+
+		// Drop buckets that fell out of the longest window
+		for len(buckets) > 0 && buckets[0].Hour < cutoff {
+			buckets = buckets[1:]
+		}
+		ut.history[d.ID] = buckets
+	}
+}
+
+// Report computes uptime for all devices over the rolling windows, sorted by ID.
+func (ut *UptimeTracker) Report(now time.Time) []UptimeReport {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	out := make([]UptimeReport, 0, len(ut.history))
+	for id, buckets := range ut.history {
+		report := UptimeReport{ID: id, Uptime: make(map[string]*float64)}
+		for _, w := range uptimeWindows {
+			since := now.Add(-w.Length).Unix()
+			var up, total int64
+			for _, b := range buckets {
+				if b.Hour >= since {
+					up += b.Up
+					total += b.Total
+				}
+			}
+			if total > 0 {
+				pct := float64(up) / float64(total) * 100
+				report.Uptime[w.Name] = &pct
+			} else {
+				report.Uptime[w.Name] = nil
+			}
+		}
+		out = append(out, report)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// UptimeRow is one device-hour of uptime history, as exported.
+type UptimeRow struct {
+	ID     string    `json:"id"`
+	Hour   time.Time `json:"hour"`
+	Up     int64     `json:"up_seconds"`
+	Total  int64     `json:"observed_seconds"`
+	Uptime float64   `json:"uptime"` // Percent of the observed time
+}
+
+// Rows returns the hourly history of all devices for hours starting within
+// [from, to], ordered by device and hour.
+func (ut *UptimeTracker) Rows(from, to time.Time) []UptimeRow {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	var rows []UptimeRow
+	for id, buckets := range ut.history {
+		for _, b := range buckets {
+			if b.Hour < from.Truncate(time.Hour).Unix() || b.Hour > to.Unix() || b.Total == 0 {
+				continue
+			}
+			rows = append(rows, UptimeRow{ID: id, Hour: time.Unix(b.Hour, 0).UTC(), Up: b.Up, Total: b.Total,
+				Uptime: float64(b.Up) / float64(b.Total) * 100})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].ID != rows[j].ID {
+			return rows[i].ID < rows[j].ID
+		}
+		return rows[i].Hour.Before(rows[j].Hour)
+	})
+	return rows
+}
+
+// save writes the history to the state file. The file is replaced
+// atomically so a crash mid-write never loses the previous state.
+func (ut *UptimeTracker) save() {
+	if ut.cfg.StateFile == "" {
+		return
+	}
+
+	ut.mu.Lock()
+	data, err := json.Marshal(ut.history)
+	ut.mu.Unlock()
+	if err != nil {
+		slog.Error("Failed to encode uptime state", "error", err)
+		return
+	}
+
+	tmp := ut.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		slog.Error("Failed to write uptime state", "error", err)
+		return
+	}
+	if err := os.Rename(tmp, ut.cfg.StateFile); err != nil {
+		slog.Error("Failed to replace uptime state", "error", err)
+	}
+}
+
+// ServeHTTP serves the uptime report as JSON, or as CSV with ?format=csv.
+func (ut *UptimeTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reports := ut.Report(time.Now())
+
+	if r.URL.Query().Get("format") != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reports)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="uptime.csv"`)
+	cw := csv.NewWriter(w)
+	header := []string{"id"}
+	for _, win := range uptimeWindows {
+		header = append(header, "uptime_"+win.Name)
+	}
+	cw.Write(header)
+	for _, rep := range reports {
+		row := []string{rep.ID}
+		for _, win := range uptimeWindows {
+			if pct := rep.Uptime[win.Name]; pct != nil {
+				row = append(row, fmt.Sprintf("%.3f", *pct))
+			} else {
+				row = append(row, "") // Not observed in this window
+			}
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+}
@@ -0,0 +1,438 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/deanbregenzer/cysl/internal/logging"
+)
+
+// ValidationError describes one problem found while validating configuration.
+// Field names the setting at fault, using its config file key.
+type ValidationError struct {
+	Field   string // Setting that failed validation (e.g. "geoip.policy_file")
+	Problem string // What is wrong with it
+}
+
+// Error implements the error interface.
+func (ve ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", ve.Field, ve.Problem)
+}
+
+// Validate checks the configuration without starting the server.
+// It runs every validator and returns all problems found, so a CI/CD job
+// can report the complete list in one run. An empty result means the
+// configuration is valid.
+func (c Config) Validate() []ValidationError {
+	errs := c.validateSettings()
+	errs = append(errs, c.validateResources()...)
+	return errs
+}
+
+// validateSettings checks the values themselves, without touching files.
+// Start runs it so a broken config fails fast instead of misbehaving.
+func (c Config) validateSettings() []ValidationError {
+	var errs []ValidationError
+	errs = append(errs, validateHeartbeat("heartbeat", c.Heartbeat)...)
+	errs = append(errs, c.validateTimeouts()...)
+	return errs
+}
+
+// validateHeartbeat checks that a heartbeat profile is internally consistent.
+func validateHeartbeat(field string, cfg HeartbeatConfig) []ValidationError {
+	var errs []ValidationError
+	if cfg.Interval <= 0 {
+		errs = append(errs, ValidationError{field + ".interval", "must be positive"})
+	}
+	if cfg.Timeout <= 0 {
+		errs = append(errs, ValidationError{field + ".timeout", "must be positive"})
+	}
+	if cfg.Timeout >= cfg.Interval {
+		errs = append(errs, ValidationError{field + ".timeout",
+			fmt.Sprintf("must be shorter than interval (%v >= %v)", cfg.Timeout, cfg.Interval)})
+	}
+	if cfg.MaxMissedPings < 1 {
+		errs = append(errs, ValidationError{field + ".max_missed_pings", "must be at least 1"})
+	}
+	switch cfg.Mode {
+	case "", HeartbeatModeFrames, HeartbeatModeJSON:
+	default:
+		errs = append(errs, ValidationError{field + ".mode", fmt.Sprintf("must be %q or %q", HeartbeatModeFrames, HeartbeatModeJSON)})
+	}
+	h := cfg.Health
+	if h.DegradedLatency > h.UnstableLatency || h.DegradedJitter > h.UnstableJitter {
+		errs = append(errs, ValidationError{field + ".health", "degraded thresholds must not exceed unstable thresholds"})
+	}
+	if h.UnstableMisses > h.LostMisses {
+		errs = append(errs, ValidationError{field + ".health.unstable_misses", "must not exceed lost_misses"})
+	}
+	if h.Hysteresis < 0 || h.Hysteresis >= 1 {
+		errs = append(errs, ValidationError{field + ".health.hysteresis", "must be in [0, 1)"})
+	}
+	if h.RecoverAfter < 1 {
+		errs = append(errs, ValidationError{field + ".health.recover_after", "must be at least 1"})
+	}
+	if a := cfg.Adaptive; a.Enabled {
+		if a.MinInterval <= cfg.Timeout {
+			errs = append(errs, ValidationError{field + ".adaptive.min_interval",
+				fmt.Sprintf("must be longer than timeout (%v <= %v)", a.MinInterval, cfg.Timeout)})
+		}
+		if a.MaxInterval < a.MinInterval {
+			errs = append(errs, ValidationError{field + ".adaptive.max_interval", "must not be shorter than min_interval"})
+		}
+		if a.StableAfter < 1 {
+			errs = append(errs, ValidationError{field + ".adaptive.stable_after", "must be at least 1"})
+		}
+		if a.Factor <= 1 {
+			errs = append(errs, ValidationError{field + ".adaptive.factor", "must be greater than 1"})
+		}
+	}
+	return errs
+}
+
+// validateTimeouts checks connection limits, timeouts and the sweeper.
+func (c Config) validateTimeouts() []ValidationError {
+	var errs []ValidationError
+	if c.Addr == "" {
+		errs = append(errs, ValidationError{"addr", "must not be empty"})
+	}
+	if c.MaxMessageSize < 1 {
+		errs = append(errs, ValidationError{"max_message_size", "must be at least 1"})
+	}
+	if c.MaxConnectionsPerIP < 1 {
+		errs = append(errs, ValidationError{"max_connections_per_ip", "must be at least 1"})
+	}
+	if c.ReadTimeout <= 0 || c.WriteTimeout <= 0 {
+		errs = append(errs, ValidationError{"read_timeout/write_timeout", "must be positive"})
+	}
+	if c.DrainTimeout <= 0 {
+		errs = append(errs, ValidationError{"drain_timeout", "must be positive"})
+	}
+	if c.Policy.MinInterval > c.Policy.MaxInterval || c.Policy.MinTimeout > c.Policy.MaxTimeout {
+		errs = append(errs, ValidationError{"heartbeat_policy", "minimums must not exceed maximums"})
+	}
+	if c.Uptime.SampleInterval < time.Second || c.Uptime.OfflineAfter <= 0 {
+		errs = append(errs, ValidationError{"uptime", "sample_interval must be at least 1s and offline_after positive"})
+	}
+	if c.Downtime.CheckInterval <= 0 || c.Downtime.OfflineAfter <= 0 || c.Downtime.OnlineAfter < 1 {
+		errs = append(errs, ValidationError{"downtime", "check_interval and offline_after must be positive, online_after at least 1"})
+	}
+	if c.Hub.QueueDepth < 1 {
+		errs = append(errs, ValidationError{"hub.queue_depth", "must be at least 1"})
+	}
+	if c.Hub.MessageTTL < 0 || c.Hub.DeadLetters < 0 || c.Hub.WriteRetries < 0 {
+		errs = append(errs, ValidationError{"hub", "message_ttl, dead_letters and write_retries must not be negative"})
+	}
+	switch c.Hub.Overflow {
+	case OverflowDisconnect, OverflowDropOldest, OverflowDropNewest:
+	default:
+		errs = append(errs, ValidationError{"hub.overflow",
+			fmt.Sprintf("must be %q, %q or %q", OverflowDisconnect, OverflowDropOldest, OverflowDropNewest)})
+	}
+	errs = append(errs, c.Hub.SlowConsumer.validate(c.Hub.QueueDepth)...)
+	errs = append(errs, c.RateLimit.validate()...)
+	errs = append(errs, c.Memory.validate()...)
+	errs = append(errs, c.Sessions.validate()...)
+	errs = append(errs, c.PubSub.validate()...)
+	errs = append(errs, c.Cluster.validate()...)
+	errs = append(errs, c.Proxy.validate()...)
+	errs = append(errs, c.Access.validate()...)
+	errs = append(errs, c.Origins.validate()...)
+	errs = append(errs, c.ConnStates.validate()...)
+	errs = append(errs, c.Preflight.validate()...)
+	errs = append(errs, c.CrashDump.validate()...)
+	errs = append(errs, c.Lifetime.validate()...)
+	errs = append(errs, c.Takeover.validate()...)
+	errs = append(errs, c.Publish.validate()...)
+	errs = append(errs, c.Moderation.validate()...)
+	if c.ConnStates.MaxIdle > 0 && c.ConnStates.MaxIdle <= c.ReadTimeout {
+		errs = append(errs, ValidationError{"conn_states.max_idle",
+			fmt.Sprintf("must be longer than read_timeout (%v <= %v), or open connections lose their state", c.ConnStates.MaxIdle, c.ReadTimeout)})
+	}
+	if c.Sweeper.SweepInterval <= 0 || c.Sweeper.ProbeTimeout <= 0 {
+		errs = append(errs, ValidationError{"sweeper", "sweep_interval and probe_timeout must be positive"})
+	}
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, ValidationError{"log.level", "must be debug, info, warn or error"})
+	}
+	switch c.Log.Format {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		errs = append(errs, ValidationError{"log.format", fmt.Sprintf("must be %q or %q", LogFormatText, LogFormatJSON)})
+	}
+	return errs
+}
+
+// validateResources checks the optional features: files must be readable
+// and parseable, URLs and durations well-formed.
+func (c Config) validateResources() []ValidationError {
+	var errs []ValidationError
+
+	countryDB, asnDB := c.GeoIP.CountryDB, c.GeoIP.ASNDB
+	if countryDB != "" || asnDB != "" {
+		gr, err := NewGeoResolver(countryDB, asnDB)
+		if err != nil {
+			errs = append(errs, ValidationError{"geoip.country_db/geoip.asn_db", err.Error()})
+		} else {
+			gr.Close()
+		}
+	}
+
+	if v := c.GeoIP.PolicyFile; v != "" {
+		if _, err := LoadGeoPolicy(v); err != nil {
+			errs = append(errs, ValidationError{"geoip.policy_file", err.Error()})
+		}
+		if countryDB == "" && asnDB == "" {
+			errs = append(errs, ValidationError{"geoip.policy_file", "has no effect without a GeoIP database"})
+		}
+	}
+
+	if v := c.GeoIP.ShadowPolicyFile; v != "" {
+		if _, err := LoadGeoPolicy(v); err != nil {
+			errs = append(errs, ValidationError{"geoip.shadow_policy_file", err.Error()})
+		}
+		if countryDB == "" && asnDB == "" {
+			errs = append(errs, ValidationError{"geoip.shadow_policy_file", "has no effect without a GeoIP database"})
+		}
+	}
+
+	if c.Access.File != "" {
+		if _, err := loadAccessList(c.Access); err != nil {
+			errs = append(errs, ValidationError{"access.file", err.Error()})
+		}
+	}
+
+	if v := c.AuditLogFile; v != "" {
+		f, err := os.OpenFile(v, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+		if err != nil {
+			errs = append(errs, ValidationError{"audit_log_file", err.Error()})
+		} else {
+			f.Close()
+		}
+	}
+
+	if c.Beacon.Addr != "" && c.Beacon.Key == "" {
+		errs = append(errs, ValidationError{"beacon.key", "required when beacon.addr is set"})
+	}
+
+	if v := c.Downtime.WebhookURL; v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, ValidationError{"downtime.webhook_url", "must be an http(s) URL"})
+		}
+	}
+
+	if c.Auth.Func == nil && c.Auth.JWTSecret != "" && len(c.Auth.JWTSecret) < 32 {
+		errs = append(errs, ValidationError{"auth.jwt_secret", "must be at least 32 bytes"})
+	}
+	// Only authenticated users can watch, so watching without auth does nothing
+	if len(c.Watch.AllowedUsers) > 0 && c.Auth.Func == nil && c.Auth.JWTSecret == "" {
+		errs = append(errs, ValidationError{"watch.allowed_users", "requires auth (no connection has a user to match)"})
+	}
+	for _, u := range c.Watch.AllowedUsers {
+		if strings.TrimSpace(u) == "" {
+			errs = append(errs, ValidationError{"watch.allowed_users", "must not contain empty entries"})
+			break
+		}
+	}
+
+	if c.Admin.Token != "" && len(c.Admin.Token) < 16 {
+		errs = append(errs, ValidationError{"admin.token", "must be at least 16 bytes"})
+	}
+	if c.Incidents.Retain < 0 {
+		errs = append(errs, ValidationError{"incidents.retain", "must not be negative"})
+	}
+
+	errs = append(errs, c.Escalation.validate()...)
+	errs = append(errs, c.Monitors.validate()...)
+	errs = append(errs, c.Status.validate()...)
+	errs = append(errs, c.Maintenance.validate(c.Escalation.Policies)...)
+	errs = append(errs, c.TLS.validate()...)
+
+	if len(c.Probes.Targets) > 0 && (c.Probes.Interval <= 0 || c.Probes.Timeout <= 0) {
+		errs = append(errs, ValidationError{"probes", "interval and timeout must be positive"})
+	}
+	for i, t := range c.Probes.Targets {
+		field := fmt.Sprintf("probes.targets[%d]", i)
+		if t.Device == "" {
+			errs = append(errs, ValidationError{field + ".device", "must not be empty"})
+		}
+		u, err := url.Parse(t.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "tcp" && u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, ValidationError{field + ".url", "must be a tcp://, http:// or https:// URL"})
+		}
+	}
+	return errs
+}
+
+// validate checks that exactly one certificate source is configured and
+// that certificate files actually load.
+func (ts TLSSettings) validate() []ValidationError {
+	var errs []ValidationError
+	if ts.Config != nil {
+		return nil // Supplied from code - nothing to check here
+	}
+	if (ts.CertFile == "") != (ts.KeyFile == "") {
+		errs = append(errs, ValidationError{"tls.cert_file/tls.key_file", "must be set together"})
+	}
+	if ts.CertFile != "" && len(ts.Autocert.Domains) > 0 {
+		errs = append(errs, ValidationError{"tls.autocert", "can't be combined with cert_file/key_file"})
+	}
+	if len(ts.Autocert.Domains) > 0 && ts.Autocert.CacheDir == "" {
+		errs = append(errs, ValidationError{"tls.autocert.cache_dir", "required with autocert"})
+	}
+	if ts.ExpiryWarning < 0 {
+		errs = append(errs, ValidationError{"tls.expiry_warning", "must not be negative"})
+	}
+	if ts.PlainAddr != "" && !ts.Enabled() {
+		errs = append(errs, ValidationError{"tls.plain_addr", "has no effect without TLS"})
+	}
+	if ts.CertFile != "" && ts.KeyFile != "" {
+		if _, err := tls.LoadX509KeyPair(ts.CertFile, ts.KeyFile); err != nil {
+			errs = append(errs, ValidationError{"tls.cert_file", err.Error()})
+		}
+	}
+	return errs
+}
+
+// validate checks escalation policies, quiet hours and maintenance windows.
+func (es EscalationSettings) validate() []ValidationError {
+	var errs []ValidationError
+	if len(es.Policies) > 0 && es.CheckInterval <= 0 {
+		errs = append(errs, ValidationError{"escalation.check_interval", "must be positive"})
+	}
+	for i, p := range es.Policies {
+		field := fmt.Sprintf("escalation.policies[%d]", i)
+		for _, pattern := range p.Devices {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, ValidationError{field + ".devices", fmt.Sprintf("bad pattern %q", pattern)})
+			}
+		}
+		for j, step := range p.Steps {
+			sf := fmt.Sprintf("%s.steps[%d]", field, j)
+			if step.Webhook == "" && len(step.Email) == 0 && step.PagerDutyKey == "" {
+				errs = append(errs, ValidationError{sf, "needs a webhook, email or pagerduty_key"})
+			}
+			if len(step.Email) > 0 && (es.SMTP.Addr == "" || es.SMTP.From == "") {
+				errs = append(errs, ValidationError{sf + ".email", "requires escalation.smtp addr and from"})
+			}
+		}
+		if q := p.QuietHours; q != nil {
+			if _, err := parseClock(q.Start); err != nil {
+				errs = append(errs, ValidationError{field + ".quiet_hours.start", err.Error()})
+			}
+			if _, err := parseClock(q.End); err != nil {
+				errs = append(errs, ValidationError{field + ".quiet_hours.end", err.Error()})
+			}
+			if q.Timezone != "" {
+				if _, err := time.LoadLocation(q.Timezone); err != nil {
+					errs = append(errs, ValidationError{field + ".quiet_hours.timezone", err.Error()})
+				}
+			}
+		}
+	}
+	for i, w := range es.Maintenance {
+		if !w.End.After(w.Start) {
+			errs = append(errs, ValidationError{fmt.Sprintf("escalation.maintenance[%d]", i), "end must be after start"})
+		}
+	}
+	return errs
+}
+
+// validate checks monitor definitions: unique names and exactly one of
+// every/schedule.
+func (ms MonitorSettings) validate() []ValidationError {
+	var errs []ValidationError
+	if len(ms.Monitors) > 0 && ms.CheckInterval <= 0 {
+		errs = append(errs, ValidationError{"monitors.check_interval", "must be positive"})
+	}
+	if v := ms.WebhookURL; v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, ValidationError{"monitors.webhook_url", "must be an http(s) URL"})
+		}
+	}
+	seen := make(map[string]bool)
+	for i, m := range ms.Monitors {
+		field := fmt.Sprintf("monitors.monitors[%d]", i)
+		if m.Name == "" || strings.ContainsAny(m.Name, "/?#") {
+			errs = append(errs, ValidationError{field + ".name", "must be non-empty and URL-path safe"})
+		} else if seen[m.Name] {
+			errs = append(errs, ValidationError{field + ".name", fmt.Sprintf("duplicate monitor %q", m.Name)})
+		}
+		seen[m.Name] = true
+
+		if (m.Every > 0) == (m.Schedule != "") {
+			errs = append(errs, ValidationError{field, "set exactly one of every or schedule"})
+		}
+		if m.Schedule != "" {
+			if cron, err := ParseCron(m.Schedule); err != nil {
+				errs = append(errs, ValidationError{field + ".schedule", err.Error()})
+			} else if cron.Next(time.Now()).IsZero() {
+				errs = append(errs, ValidationError{field + ".schedule", "never fires"})
+			}
+		}
+		if m.Timezone != "" {
+			if _, err := time.LoadLocation(m.Timezone); err != nil {
+				errs = append(errs, ValidationError{field + ".timezone", err.Error()})
+			}
+		}
+		if m.Grace < 0 {
+			errs = append(errs, ValidationError{field + ".grace", "must not be negative"})
+		}
+	}
+	return errs
+}
+
+// validate checks status page groups: named, with well-formed patterns.
+func (ss StatusSettings) validate() []ValidationError {
+	var errs []ValidationError
+	if ss.History < 0 {
+		errs = append(errs, ValidationError{"status.history", "must not be negative"})
+	}
+	for i, g := range ss.Groups {
+		field := fmt.Sprintf("status.groups[%d]", i)
+		if g.Name == "" {
+			errs = append(errs, ValidationError{field + ".name", "must not be empty"})
+		}
+		for _, p := range append(append([]string(nil), g.Devices...), g.Monitors...) {
+			if _, err := path.Match(p, ""); err != nil {
+				errs = append(errs, ValidationError{field, fmt.Sprintf("bad pattern %q", p)})
+			}
+		}
+	}
+	return errs
+}
+
+// validate checks maintenance windows: a time range, well-formed patterns
+// and tenants that exist in the escalation policies.
+func (ms MaintenanceSettings) validate(policies []EscalationPolicy) []ValidationError {
+	var errs []ValidationError
+	if len(ms.Windows) > 0 && ms.CheckInterval <= 0 {
+		errs = append(errs, ValidationError{"maintenance.check_interval", "must be positive"})
+	}
+	tenants := make(map[string]bool)
+	for _, p := range policies {
+		tenants[p.Tenant] = true
+	}
+	for i, w := range ms.Windows {
+		field := fmt.Sprintf("maintenance.windows[%d]", i)
+		if !w.End.After(w.Start) {
+			errs = append(errs, ValidationError{field, "end must be after start"})
+		}
+		for _, t := range w.Tenants {
+			if !tenants[t] {
+				errs = append(errs, ValidationError{field + ".tenants", fmt.Sprintf("no escalation policy for tenant %q", t)})
+			}
+		}
+		for _, p := range append(append(append([]string(nil), w.Devices...), w.Monitors...), w.Rooms...) {
+			if _, err := path.Match(p, ""); err != nil {
+				errs = append(errs, ValidationError{field, fmt.Sprintf("bad pattern %q", p)})
+			}
+		}
+	}
+	return errs
+}
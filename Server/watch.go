@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/deanbregenzer/cysl/internal/heartbeat"
+)
+
+// watchAll is the target that watches every identity.
+const watchAll = "*"
+
+// WatchSettings configures health watching: which users may subscribe to
+// the health events of other connections. Without allowed users the
+// feature is off and watch messages reach the handler like any other.
+type WatchSettings struct {
+	AllowedUsers []string `yaml:"allowed_users"` // Users (JWT sub) allowed to watch; "*" allows every authenticated user
+}
+
+// watchRequest is a watch control message from a client:
+//
+//	{"type":"watch","target":"sensor-17"}
+//	{"type":"unwatch","target":"sensor-17"}
+//
+// target is an identity (the user ID its connections authenticated as),
+// or "*" for all identities.
+type watchRequest struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+}
+
+// WatchedConn is the state of one connection of a watched identity.
+type WatchedConn struct {
+	ConnID ConnID     `json:"conn_id"`
+	State  ConnHealth `json:"state"`
+}
+
+// watchReply answers a watch request.
+type watchReply struct {
+	Type   string        `json:"type"` // "watching", "unwatched" or "watch_error"
+	Target string        `json:"target"`
+	Conns  []WatchedConn `json:"conns,omitempty"` // Current state of the target's connections
+	Error  string        `json:"error,omitempty"`
+}
+
+// HealthEvent is pushed to watchers when a watched connection's health
+// changes or it disconnects:
+//
+//	{"type":"health_event","target":"sensor-17","conn_id":"9f..","state":"degraded","latency_ms":310,"jitter_ms":42,"missed":0,"time":"..."}
+type HealthEvent struct {
+	Type      string     `json:"type"` // Always "health_event"
+	Target    UserID     `json:"target"`
+	ConnID    ConnID     `json:"conn_id"`
+	State     ConnHealth `json:"state"`
+	LatencyMs int64      `json:"latency_ms"`
+	JitterMs  int64      `json:"jitter_ms"`
+	Missed    int        `json:"missed"`
+	Closed    bool       `json:"closed,omitempty"` // The connection ended
+	Time      time.Time  `json:"time"`
+}
+
+// HealthWatch routes health events from the heartbeat subsystem to the
+// connections watching them. Watches are hub topics ("$health:<user>"),
+// so fan-out, slow-consumer handling and cleanup on disconnect come from
+// the Hub. Being server topics, they are out of reach of client wildcards.
+type HealthWatch struct {
+	hub     *Hub
+	allowed []string
+}
+
+// NewHealthWatch creates a watch service on hub for the allowed users.
+func NewHealthWatch(hub *Hub, allowed []string) *HealthWatch {
+	return &HealthWatch{hub: hub, allowed: allowed}
+}
+
+// healthTopic is the hub topic carrying target's health events.
+func healthTopic(target string) string {
+	return "$health:" + target
+}
+
+// mayWatch reports whether user is allowed to watch other connections.
+// Anonymous connections never are.
+func (hw *HealthWatch) mayWatch(user UserID) bool {
+	if user == "" {
+		return false
+	}
+	return slices.Contains(hw.allowed, watchAll) || slices.Contains(hw.allowed, string(user))
+}
+
+// Handle consumes watch and unwatch messages from the read loop and
+// replies on the connection. Returns false for every other message, and
+// for every message when watching is disabled.
+func (hw *HealthWatch) Handle(hc *HubConn, msgType websocket.MessageType, data []byte) bool {
+	if hw == nil || msgType != websocket.MessageText || len(data) == 0 || data[0] != '{' {
+		return false
+	}
+	var req watchRequest
+	if json.Unmarshal(data, &req) != nil || (req.Type != "watch" && req.Type != "unwatch") {
+		return false
+	}
+
+	reply := watchReply{Target: req.Target}
+	switch {
+	case !hw.mayWatch(hc.User):
+		reply.Type, reply.Error = "watch_error", "not authorized to watch"
+		auditLog.Record(AuditEvent{
+			Type:       "watch",
+			RemoteAddr: hc.RemoteAddr,
+			Decision:   "reject",
+			Reason:     "user not allowed to watch",
+			Fields:     map[string]string{"user": string(hc.User), "target": req.Target},
+		})
+	case req.Target == "":
+		reply.Type, reply.Error = "watch_error", "target must not be empty"
+	case req.Type == "unwatch":
+		hw.hub.Unsubscribe(hc.ID, healthTopic(req.Target))
+		reply.Type = "unwatched"
+	default:
+		if err := hw.hub.Subscribe(hc.ID, healthTopic(req.Target)); err != nil {
+			reply.Type, reply.Error = "watch_error", err.Error()
+			break
+		}
+		reply.Type = "watching"
+		reply.Conns = hw.current(req.Target)
+		hc.logger.Info("Watching health", "user", hc.User, "target", req.Target)
+	}
+
+	if msg, err := json.Marshal(reply); err == nil {
+		hc.enqueue(msg)
+	}
+	return true
+}
+
+// current returns the health of target's open connections.
+func (hw *HealthWatch) current(target string) []WatchedConn {
+	hw.hub.mu.RLock()
+	defer hw.hub.mu.RUnlock()
+	out := []WatchedConn{}
+	for _, hc := range hw.hub.conns.snapshot() {
+		if hc.User != "" && (target == watchAll || string(hc.User) == target) {
+			out = append(out, WatchedConn{ConnID: hc.ID, State: hc.Health()})
+		}
+	}
+	slices.SortFunc(out, func(a, b WatchedConn) int { return strings.Compare(string(a.ConnID), string(b.ConnID)) })
+	return out
+}
+
+// Publish sends a health change of hc to its identity's watchers.
+// Anonymous connections have no identity and can't be watched.
+func (hw *HealthWatch) Publish(hc *HubConn, st heartbeat.HealthStatus) {
+	hw.publish(hc, HealthEvent{
+		State:     st.State,
+		LatencyMs: st.Latency.Milliseconds(),
+		JitterMs:  st.Jitter.Milliseconds(),
+		Missed:    st.Missed,
+	})
+}
+
+// Closed tells hc's watchers that the connection ended.
+func (hw *HealthWatch) Closed(hc *HubConn) {
+	hw.publish(hc, HealthEvent{State: hc.Health(), Closed: true})
+}
+
+// publish fills in the event's identity and fans it out.
+func (hw *HealthWatch) publish(hc *HubConn, ev HealthEvent) {
+	if hw == nil || hc.User == "" {
+		return
+	}
+	ev.Type = "health_event"
+	ev.Target = hc.User
+	ev.ConnID = hc.ID
+	ev.Time = time.Now()
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	hw.hub.Publish(healthTopic(string(hc.User)), msg)
+	hw.hub.Publish(healthTopic(watchAll), msg)
+}
+
+// healthWatchFromConfig enables watching when any user is allowed to.
+func healthWatchFromConfig(ws WatchSettings, hub *Hub) *HealthWatch {
+	if len(ws.AllowedUsers) == 0 {
+		return nil
+	}
+	return NewHealthWatch(hub, ws.AllowedUsers)
+}
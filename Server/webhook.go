@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout bounds a single webhook delivery.
+const webhookTimeout = 5 * time.Second
+
+// WebhookNotifier POSTs JSON events to an external URL. Deliveries run in
+// the background so a slow receiver never stalls detection; failures are
+// logged, not retried.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookNotifier creates a notifier for url. Returns nil for an empty
+// url; a nil notifier silently drops events.
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	if url == "" {
+		return nil
+	}
+	return &WebhookNotifier{URL: url, Client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// Notify delivers event asynchronously.
+func (wn *WebhookNotifier) Notify(event any) {
+	if wn == nil {
+		return
+	}
+	go func() {
+		if err := wn.post(context.Background(), event); err != nil {
+			slog.Error("Webhook delivery failed", "url", wn.URL, "error", err)
+		}
+	}()
+}
+
+// post sends one event and checks for a 2xx answer.
+func (wn *WebhookNotifier) post(ctx context.Context, event any) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encode webhook event: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wn.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver returned %s", resp.Status)
+	}
+	return nil
+}
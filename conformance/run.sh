@@ -0,0 +1,26 @@
+#!/bin/sh
+# Runs the Autobahn fuzzing client against the server in conformance mode.
+# Requires Docker. Reports are written to conformance/reports/.
+set -e
+
+cd "$(dirname "$0")/.."
+go build -o cysl .
+
+./cysl -mode=conformance &
+SERVER_PID=$!
+trap 'kill $SERVER_PID 2>/dev/null' EXIT
+sleep 1
+
+docker run --rm \
+  --add-host=host.docker.internal:host-gateway \
+  -v "$PWD/conformance:/config" \
+  -v "$PWD/conformance/reports:/reports" \
+  crossbario/autobahn-testsuite \
+  wstest -m fuzzingclient -s /config/fuzzingclient.json
+
+# Fail if any case did not pass (OK and INFORMATIONAL/NON-STRICT are accepted)
+if grep -q '"behavior": "FAILED"' conformance/reports/index.json; then
+  echo "Autobahn conformance failures - see conformance/reports/index.html"
+  exit 1
+fi
+echo "Autobahn conformance passed"
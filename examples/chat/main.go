@@ -0,0 +1,124 @@
+// Command chat is a terminal chat client for the server's /chat/{room}
+// endpoint. Lines typed on stdin are sent to the room; everything the room
+// broadcasts - including your own messages - is printed as it arrives. The
+// connection survives server restarts: lines typed while reconnecting are
+// sent once the client is back.
+//
+//	READ_TIMEOUT=5m ./cysl -mode=server
+//	go run ./examples/chat -room lobby -name alice
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/coder/websocket"
+	client "github.com/deanbregenzer/cysl/Client"
+)
+
+// chatMessage is what the room broadcasts, see server.ChatMessage.
+type chatMessage struct {
+	Type      string    `json:"type"` // message, join, leave or system
+	Sender    string    `json:"sender"`
+	Body      string    `json:"body"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func main() {
+	server := flag.String("url", "ws://localhost:8080", "Server base URL")
+	room := flag.String("room", "lobby", "Room to join")
+	name := flag.String("name", os.Getenv("USER"), "Name shown to the room")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Lines are read once for the whole run, so none are lost when a
+	// session ends while the user is typing
+	lines := make(chan string)
+	go func() {
+		defer stop() // End of input ends the chat
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	u := fmt.Sprintf("%s/chat/%s?name=%s", *server, url.PathEscape(*room), url.QueryEscape(*name))
+	rc := client.NewClient(u, func(ctx context.Context, conn *websocket.Conn) error {
+		return chat(ctx, conn, lines)
+	},
+		client.WithProtocol(client.ProtocolRaw), // Chat rooms speak plain text
+		client.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+
+	// Connection state goes to stderr, the conversation to stdout
+	events := rc.Events()
+	go func() {
+		for ev := range events {
+			switch ev := ev.(type) {
+			case client.Connected:
+				fmt.Fprintf(os.Stderr, "* joined #%s\n", *room)
+			case client.Reconnecting:
+				fmt.Fprintf(os.Stderr, "* connection lost (%v), retrying in %s\n", ev.Err, ev.Delay.Round(time.Millisecond))
+			case client.MessageDropped:
+				fmt.Fprintf(os.Stderr, "* %d message(s) not delivered (%s)\n", ev.Count, ev.Reason)
+			}
+		}
+	}()
+
+	if err := rc.Run(ctx); err != nil && ctx.Err() == nil {
+		fmt.Fprintln(os.Stderr, "chat:", err)
+		os.Exit(1)
+	}
+}
+
+// chat runs one session: it prints the room's messages and sends the
+// user's lines until the connection breaks or the user leaves.
+func chat(ctx context.Context, conn *websocket.Conn, lines <-chan string) error {
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			_, data, err := conn.Read(ctx)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			var m chatMessage
+			if json.Unmarshal(data, &m) != nil {
+				continue // Notices such as rate limit warnings
+			}
+			switch m.Type {
+			case "message":
+				fmt.Printf("%s <%s> %s\n", m.Timestamp.Local().Format("15:04"), m.Sender, m.Body)
+			case "join", "leave":
+				fmt.Printf("%s -- %s %sed\n", m.Timestamp.Local().Format("15:04"), m.Sender, m.Type)
+			case "system":
+				fmt.Printf("%s !! %s\n", m.Timestamp.Local().Format("15:04"), m.Body)
+			}
+		}
+	}()
+
+	breaker := client.NewCircuitBreaker(client.DefaultCircuitBreakerConfig())
+	for {
+		select {
+		case <-ctx.Done():
+			return nil // Leave the room cleanly
+		case err := <-readErr:
+			return err // Reconnect
+		case line := <-lines:
+			if err := client.Send(ctx, conn, breaker, []byte(line)); err != nil {
+				return err
+			}
+		}
+	}
+}
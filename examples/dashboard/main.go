@@ -0,0 +1,168 @@
+// Command dashboard embeds the WebSocket server in an application of its
+// own: next to the server's endpoints it serves a page showing every live
+// connection with its heartbeat health, latency and traffic, updated every
+// second over a WebSocket of its own. Start it, open http://localhost:8081
+// and connect clients, e.g. the chat and device-agent examples:
+//
+//	go run ./examples/dashboard
+//	go run ./examples/device-agent -url ws://localhost:8081/ws
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	server "github.com/deanbregenzer/cysl/Server"
+)
+
+// topic is the hub topic dashboard pages subscribe to.
+const topic = "dashboard"
+
+// snapshot is what a dashboard page receives every second.
+type snapshot struct {
+	Time        time.Time          `json:"time"`
+	Stats       server.ServerStats `json:"stats"`
+	Connections []server.ConnInfo  `json:"connections"`
+}
+
+// viewer is the Handler of dashboard page connections: it subscribes them
+// to the snapshots and ignores what they send.
+type viewer struct {
+	server.BaseHandler
+	hub *server.Hub
+}
+
+// OnConnect subscribes the page to the snapshots.
+func (v viewer) OnConnect(ctx context.Context, hc *server.HubConn) error {
+	return v.hub.Subscribe(hc.ID, topic)
+}
+
+func main() {
+	addr := flag.String("addr", ":8081", "Listen address")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cfg := server.DefaultConfig()
+	cfg.Heartbeat.NotifyHealth = true // Clients hear about their own health, too
+	// Dashboard pages and chat users may stay quiet for long; heartbeats
+	// still catch dead connections
+	cfg.ReadTimeout = 5 * time.Minute
+	s, err := server.NewServer(cfg)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	server.RegisterHandler("/dashboard/ws", viewer{hub: s.Hub()})
+
+	// The page on "/", the server's endpoints (/ws, /chat/..., /metrics,
+	// /dashboard/ws, ...) on everything else
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(page))
+	})
+	mux.Handle("/", s.Handler())
+
+	go publish(ctx, s)
+
+	srv := &http.Server{Addr: *addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+		s.Shutdown(shutdownCtx) // Close the WebSockets, which http.Server doesn't track
+	}()
+	slog.Info("Dashboard listening", "addr", *addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Server failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// publish sends a snapshot of the server to the dashboard pages every
+// second.
+func publish(ctx context.Context, s *server.Server) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			snap := snapshot{Time: now, Stats: s.Stats(), Connections: []server.ConnInfo{}}
+			for _, hc := range s.Hub().Conns() {
+				snap.Connections = append(snap.Connections, hc.Info())
+			}
+			data, err := json.Marshal(snap)
+			if err != nil {
+				slog.Error("Encoding snapshot failed", "error", err)
+				continue
+			}
+			s.Hub().Publish(topic, data)
+		}
+	}
+}
+
+// page renders the snapshots as a table.
+const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Connections</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+.healthy { color: green; } .degraded { color: orange; } .unstable, .lost { color: red; }
+</style>
+</head>
+<body>
+<h1>Connections</h1>
+<p id="summary">Connecting...</p>
+<table>
+<thead><tr><th>ID</th><th>Address</th><th>User</th><th>Up</th><th>Health</th><th>Latency</th><th>In</th><th>Out</th><th>Queued</th><th>Topics</th></tr></thead>
+<tbody id="rows"></tbody>
+</table>
+<script>
+function connect() {
+  const ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/dashboard/ws");
+  ws.onmessage = (e) => {
+    const snap = JSON.parse(e.data);
+    if (!snap.stats) return; // Health notices and the like
+    document.getElementById("summary").textContent =
+      snap.stats.active_connections + " active, " + snap.stats.connections_total + " total, " +
+      snap.stats.messages_received + " messages in, " + snap.stats.messages_sent + " out";
+    const rows = document.getElementById("rows");
+    rows.replaceChildren(...snap.connections.map((c) => {
+      const tr = document.createElement("tr");
+      const cells = [c.id, c.remote_addr, c.user || "-", Math.round(c.uptime_s) + "s", c.health,
+        c.latency_ms.toFixed(1) + " ms", c.messages_in, c.messages_out, c.queued, (c.topics || []).join(", ")];
+      for (const v of cells) {
+        const td = document.createElement("td");
+        td.textContent = v;
+        tr.appendChild(td);
+      }
+      tr.children[4].className = c.health;
+      return tr;
+    }));
+  };
+  ws.onclose = () => {
+    document.getElementById("summary").textContent = "Disconnected - retrying...";
+    setTimeout(connect, 2000);
+  };
+}
+connect();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,156 @@
+// Command device-agent reports sensor readings to the server's /ws
+// endpoint the way an embedded device would: each reading is sent as a
+// message envelope and counts as delivered once the server's echo
+// acknowledges it. Readings that aren't acknowledged stay in a small
+// backlog and are sent again after a reconnect. Heartbeat round trips and
+// reconnects are reported through a MetricsSink.
+//
+//	READ_TIMEOUT=5m ./cysl -mode=server
+//	go run ./examples/device-agent -id sensor-17 -interval 15s
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	client "github.com/deanbregenzer/cysl/Client"
+)
+
+// reading is one measurement, the payload of a message envelope.
+type reading struct {
+	Device string    `json:"device"`
+	Seq    int       `json:"seq"`
+	Temp   float64   `json:"temp_c"`
+	At     time.Time `json:"at"`
+}
+
+// ackTimeout is how long a reading may wait for its acknowledgment.
+const ackTimeout = 5 * time.Second
+
+// backlogSize is how many unacknowledged readings are kept.
+const backlogSize = 100
+
+// sink keeps the agent's health figures; a real device would forward them
+// to its telemetry instead.
+type sink struct {
+	lastRTT    atomic.Int64
+	reconnects atomic.Int64
+	sendErrors atomic.Int64
+}
+
+func (s *sink) OnLatencySample(rtt time.Duration) { s.lastRTT.Store(int64(rtt)) }
+func (s *sink) OnSendError(err error)             { s.sendErrors.Add(1) }
+func (s *sink) OnReconnect(attempt int, delay time.Duration, cause error) {
+	s.reconnects.Add(1)
+	slog.Warn("Connection lost", "cause", cause, "retry_in", delay.Round(time.Millisecond))
+}
+
+func main() {
+	serverURL := flag.String("url", "ws://localhost:8080/ws", "Server WebSocket URL")
+	id := flag.String("id", "sensor-1", "Device ID")
+	// The server allows one message per 10s on a connection by default;
+	// the margin absorbs scheduling jitter. Run the server with a
+	// READ_TIMEOUT above the interval.
+	interval := flag.Duration("interval", 12*time.Second, "Time between readings")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	health := &sink{}
+	var backlog []reading // Not yet acknowledged, oldest first
+	seq := 0
+
+	rc := client.NewClient(*serverURL, func(ctx context.Context, conn *websocket.Conn) error {
+		acks := make(chan reading)
+		readErr := make(chan error, 1)
+		go readAcks(ctx, conn, acks, readErr)
+
+		breaker := client.NewCircuitBreaker(client.DefaultCircuitBreakerConfig())
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case err := <-readErr:
+				return err
+			case <-ticker.C:
+			}
+
+			seq++
+			backlog = append(backlog, reading{Device: *id, Seq: seq, Temp: 20 + 5*rand.Float64(), At: time.Now()})
+			if len(backlog) > backlogSize {
+				backlog = backlog[1:] // Oldest readings are the least useful
+			}
+			// One message per tick keeps within the server's rate limit, so
+			// a backlog drains one reading at a time
+			r := backlog[0]
+			data, err := client.NewMessage(ctx, client.MessageTypeMessage, r)
+			if err != nil {
+				return err
+			}
+			if err := client.SendFrame(ctx, conn, breaker, client.MessageFrameType(ctx), data); err != nil {
+				return fmt.Errorf("send reading %d: %w", r.Seq, err)
+			}
+
+			select {
+			case ack := <-acks:
+				if ack.Seq == r.Seq {
+					backlog = backlog[1:]
+				}
+				slog.Info("Reading acknowledged", "seq", ack.Seq, "backlog", len(backlog),
+					"rtt", time.Duration(health.lastRTT.Load()).Round(time.Microsecond))
+			case <-time.After(ackTimeout):
+				breaker.RecordFailure()
+				slog.Warn("Reading not acknowledged", "seq", r.Seq, "backlog", len(backlog))
+			case err := <-readErr:
+				return err
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}, client.WithMetricsSink(health))
+
+	if err := rc.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		slog.Error("Agent stopped", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Agent stopped", "readings", seq, "unacknowledged", len(backlog),
+		"reconnects", health.reconnects.Load(), "send_errors", health.sendErrors.Load())
+}
+
+// readAcks reads the server's echoes and passes the readings they carry to
+// acks until the connection fails. Reading also keeps the heartbeat's pongs
+// flowing.
+func readAcks(ctx context.Context, conn *websocket.Conn, acks chan<- reading, readErr chan<- error) {
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			readErr <- err
+			return
+		}
+		m, err := client.DecodeMessage(ctx, data)
+		if err != nil || m.Type != client.MessageTypeEcho {
+			continue // Notices, or replies to other messages
+		}
+		var r reading
+		if m.DecodePayload(&r) != nil {
+			continue
+		}
+		select {
+		case acks <- r:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
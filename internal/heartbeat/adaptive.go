@@ -0,0 +1,58 @@
+package heartbeat
+
+import "time"
+
+// AdaptiveConfig lets the ping interval follow the connection's quality
+// instead of staying at Config.Interval: it grows while the connection is
+// healthy, saving bandwidth and battery on idle links, and shrinks as soon
+// as latency or jitter rise, so a failing link is noticed quickly. The
+// interval starts at Config.Interval, kept within the bounds.
+type AdaptiveConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	MinInterval time.Duration `yaml:"min_interval"` // Shortest interval, used right after a missed ping
+	MaxInterval time.Duration `yaml:"max_interval"` // Longest interval of a stable connection
+	StableAfter int           `yaml:"stable_after"` // Healthy pongs in a row before the interval grows
+	Factor      float64       `yaml:"factor"`       // Growth per step; a pong that isn't healthy shrinks it by the same factor
+}
+
+// DefaultAdaptiveConfig returns the defaults: off, and once enabled an
+// interval between 2s and 60s that grows by half after 5 healthy pongs.
+func DefaultAdaptiveConfig() AdaptiveConfig {
+	return AdaptiveConfig{MinInterval: 2 * time.Second, MaxInterval: 60 * time.Second, StableAfter: 5, Factor: 1.5}
+}
+
+// adaptiveInterval is the interval controller of one heartbeat. Only Run's
+// goroutine uses it.
+type adaptiveInterval struct {
+	cfg     AdaptiveConfig
+	current time.Duration
+	stable  int // Healthy pongs since the interval last changed
+}
+
+// newAdaptiveInterval starts at interval, within cfg's bounds.
+func newAdaptiveInterval(cfg AdaptiveConfig, interval time.Duration) *adaptiveInterval {
+	return &adaptiveInterval{cfg: cfg, current: max(cfg.MinInterval, min(interval, cfg.MaxInterval))}
+}
+
+// pong adjusts the interval to a pong that left the connection in state.
+func (a *adaptiveInterval) pong(state Health) time.Duration {
+	if state != HealthHealthy {
+		a.stable = 0
+		a.current = max(a.cfg.MinInterval, time.Duration(float64(a.current)/a.cfg.Factor))
+		return a.current
+	}
+	a.stable++
+	if a.stable >= a.cfg.StableAfter {
+		a.stable = 0
+		a.current = min(a.cfg.MaxInterval, time.Duration(float64(a.current)*a.cfg.Factor))
+	}
+	return a.current
+}
+
+// miss drops the interval to the minimum: the next pings decide quickly
+// whether the peer is gone.
+func (a *adaptiveInterval) miss() time.Duration {
+	a.stable = 0
+	a.current = a.cfg.MinInterval
+	return a.current
+}
@@ -0,0 +1,212 @@
+package heartbeat
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Health is the derived quality of a connection, from best to worst.
+type Health int32
+
+const (
+	HealthHealthy  Health = iota // Pongs arrive quickly and evenly
+	HealthDegraded               // Usable, but latency or jitter is elevated
+	HealthUnstable               // Pings are being missed or latency is very high
+	HealthLost                   // Several consecutive pings went unanswered
+)
+
+// healthNames are the wire and label names of the states.
+var healthNames = [...]string{"healthy", "degraded", "unstable", "lost"}
+
+// String returns the state's name, e.g. "degraded".
+func (h Health) String() string {
+	if h < 0 || int(h) >= len(healthNames) {
+		return fmt.Sprintf("Health(%d)", int32(h))
+	}
+	return healthNames[h]
+}
+
+// MarshalText encodes the state by name.
+func (h Health) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// UnmarshalText decodes a state name.
+func (h *Health) UnmarshalText(text []byte) error {
+	for i, name := range healthNames {
+		if string(text) == name {
+			*h = Health(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown health state %q", text)
+}
+
+// HealthThresholds configures the health classifier. A connection gets
+// worse as soon as one threshold is crossed, but only gets better once its
+// numbers are Hysteresis below the thresholds for RecoverAfter consecutive
+// pongs - so a connection hovering around a threshold doesn't flap.
+type HealthThresholds struct {
+	DegradedLatency time.Duration `yaml:"degraded_latency"` // Smoothed RTT above which the connection is degraded
+	UnstableLatency time.Duration `yaml:"unstable_latency"` // Smoothed RTT above which it is unstable
+	DegradedJitter  time.Duration `yaml:"degraded_jitter"`  // Jitter above which it is degraded
+	UnstableJitter  time.Duration `yaml:"unstable_jitter"`  // Jitter above which it is unstable
+	UnstableMisses  int           `yaml:"unstable_misses"`  // Consecutive missed pings that make it unstable
+	LostMisses      int           `yaml:"lost_misses"`      // Consecutive missed pings that make it lost
+	Hysteresis      float64       `yaml:"hysteresis"`       // Fraction below a threshold needed to recover (0.2 = 20%)
+	RecoverAfter    int           `yaml:"recover_after"`    // Consecutive better pongs needed to recover
+}
+
+// DefaultHealthThresholds returns thresholds suited to internet clients.
+func DefaultHealthThresholds() HealthThresholds {
+	return HealthThresholds{
+		DegradedLatency: 250 * time.Millisecond,
+		UnstableLatency: time.Second,
+		DegradedJitter:  50 * time.Millisecond,
+		UnstableJitter:  250 * time.Millisecond,
+		UnstableMisses:  1,
+		LostMisses:      2,
+		Hysteresis:      0.2,
+		RecoverAfter:    3,
+	}
+}
+
+// HealthStatus is a classifier's current state and the numbers behind it.
+type HealthStatus struct {
+	State   Health
+	Latency time.Duration // Smoothed RTT
+	Jitter  time.Duration // Smoothed RTT variation
+	Missed  int           // Consecutive missed pings
+}
+
+// HealthClassifier derives a Health from pong RTTs and missed pings.
+// Latency and jitter are exponentially smoothed (jitter as in RFC 3550,
+// but with a faster 1/4 gain since heartbeats are infrequent). Safe for
+// concurrent use.
+type HealthClassifier struct {
+	cfg HealthThresholds
+
+	mu       sync.Mutex
+	state    Health
+	latency  time.Duration
+	jitter   time.Duration
+	last     time.Duration // Previous RTT, for jitter
+	samples  int
+	missed   int // Consecutive missed pings
+	recovery int // Consecutive pongs that qualified for a better state
+}
+
+// NewHealthClassifier creates a classifier starting out healthy.
+func NewHealthClassifier(cfg HealthThresholds) *HealthClassifier {
+	return &HealthClassifier{cfg: cfg}
+}
+
+// Observe records a pong. Returns the status and whether the state changed.
+func (c *HealthClassifier) Observe(rtt time.Duration) (HealthStatus, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.samples == 0 {
+		c.latency = rtt
+	} else {
+		c.latency += (rtt - c.latency) / 4
+		d := rtt - c.last
+		if d < 0 {
+			d = -d
+		}
+		c.jitter += (d - c.jitter) / 4
+	}
+	c.last = rtt
+	c.samples++
+	c.missed = 0
+	return c.update()
+}
+
+// Miss records an unanswered ping. Returns the status and whether the
+// state changed.
+func (c *HealthClassifier) Miss() (HealthStatus, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.missed++
+	return c.update()
+}
+
+// Status returns the current status.
+func (c *HealthClassifier) Status() HealthStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status()
+}
+
+// status snapshots the classifier. Callers must hold c.mu.
+func (c *HealthClassifier) status() HealthStatus {
+	return HealthStatus{State: c.state, Latency: c.latency, Jitter: c.jitter, Missed: c.missed}
+}
+
+// update applies the hysteresis rules. Callers must hold c.mu.
+func (c *HealthClassifier) update() (HealthStatus, bool) {
+	raw := c.classify(1)
+	if raw >= c.state {
+		c.recovery = 0
+		changed := raw > c.state
+		c.state = raw // Getting worse is reported immediately
+		return c.status(), changed
+	}
+
+	// Better numbers must also clear the lowered thresholds, and keep doing
+	// so for RecoverAfter pongs in a row
+	target := c.classify(1 - c.cfg.Hysteresis)
+	if target >= c.state {
+		c.recovery = 0
+		return c.status(), false
+	}
+	c.recovery++
+	if c.recovery < c.cfg.RecoverAfter {
+		return c.status(), false
+	}
+	c.recovery = 0
+	c.state = target
+	return c.status(), true
+}
+
+// classify returns the state the current numbers indicate, with the
+// latency and jitter thresholds scaled by factor. Callers must hold c.mu.
+func (c *HealthClassifier) classify(factor float64) Health {
+	scaled := func(d time.Duration) time.Duration { return time.Duration(float64(d) * factor) }
+	switch {
+	case c.cfg.LostMisses > 0 && c.missed >= c.cfg.LostMisses:
+		return HealthLost
+	case c.cfg.UnstableMisses > 0 && c.missed >= c.cfg.UnstableMisses,
+		c.samples > 0 && c.latency > scaled(c.cfg.UnstableLatency),
+		c.samples > 1 && c.jitter > scaled(c.cfg.UnstableJitter):
+		return HealthUnstable
+	case c.samples > 0 && c.latency > scaled(c.cfg.DegradedLatency),
+		c.samples > 1 && c.jitter > scaled(c.cfg.DegradedJitter):
+		return HealthDegraded
+	}
+	return HealthHealthy
+}
+
+// HealthNotice is the in-protocol notification a server sends when a
+// connection's health changes, if the client asked for it:
+//
+//	{"type":"health","state":"degraded","latency_ms":310,"jitter_ms":42,"missed":0}
+type HealthNotice struct {
+	Type      string `json:"type"` // Always "health"
+	State     Health `json:"state"`
+	LatencyMs int64  `json:"latency_ms"`
+	JitterMs  int64  `json:"jitter_ms"`
+	Missed    int    `json:"missed"`
+}
+
+// NewHealthNotice builds the notification for st.
+func NewHealthNotice(st HealthStatus) HealthNotice {
+	return HealthNotice{
+		Type:      "health",
+		State:     st.State,
+		LatencyMs: st.Latency.Milliseconds(),
+		JitterMs:  st.Jitter.Milliseconds(),
+		Missed:    st.Missed,
+	}
+}
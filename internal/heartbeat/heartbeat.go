@@ -0,0 +1,306 @@
+// Package heartbeat implements the connection heartbeat shared by the server
+// and the client: the configuration and metrics types, the ping loop for
+// both WebSocket ping frames and application-level JSON messages, and the
+// upgrade headers used to negotiate them. The two sides differ only in their
+// Role and the hooks they attach.
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// Role identifies which side of the connection runs a heartbeat.
+type Role string
+
+const (
+	RoleServer Role = "server" // Quiet - the server aggregates metrics instead of logging each ping
+	RoleClient Role = "client" // Logs ping results (successes at debug level)
+)
+
+// Heartbeat modes selectable via Config.Mode.
+const (
+	ModeFrames = "ws"   // RFC 6455 ping/pong control frames (default)
+	ModeJSON   = "json" // Application-level JSON ping/pong messages
+)
+
+// Negotiation headers exchanged during the WebSocket upgrade. The client
+// proposes values in the request; the server answers with the values it
+// accepted in the 101 response. Durations are integer milliseconds so
+// non-Go clients can parse them easily.
+const (
+	HeaderInterval = "X-Heartbeat-Interval-Ms"
+	HeaderTimeout  = "X-Heartbeat-Timeout-Ms"
+	HeaderMode     = "X-Heartbeat-Mode"   // "ws" or "json"
+	HeaderHealth   = "X-Heartbeat-Health" // "notify" asks for HealthNotice messages
+)
+
+// ErrLost is returned by Run once MaxMissedPings consecutive pings went
+// unanswered: the peer is considered gone.
+var ErrLost = errors.New("heartbeat lost")
+
+// Config contains all configurable heartbeat parameters.
+// This allows fine-tuning of heartbeat behavior for different network conditions
+// and application requirements without code changes.
+type Config struct {
+	Interval       time.Duration `yaml:"interval"`         // Time between pings (e.g. 30s) - lower for faster detection
+	Timeout        time.Duration `yaml:"timeout"`          // Max wait time for pong (e.g. 20s) - should be < Interval
+	MaxMissedPings int           `yaml:"max_missed_pings"` // Max failed pings before giving up (e.g. 2) - prevents false positives
+	EnableMetrics  bool          `yaml:"enable_metrics"`   // Enable metrics collection - overhead negligible with atomics
+	Mode           string        `yaml:"mode"`             // ModeFrames (default) or ModeJSON
+
+	Adaptive     AdaptiveConfig   `yaml:"adaptive"`      // Interval that follows the connection's health (local to each side)
+	Health       HealthThresholds `yaml:"health"`        // How latency, jitter and misses map to a Health
+	NotifyHealth bool             `yaml:"notify_health"` // Send HealthNotice messages on changes (negotiated per connection)
+}
+
+// DefaultConfig returns the defaults for role.
+// Interval: 5s - shorter for testing/demo purposes (use 30s in production)
+// Timeout: 3s - allows for network jitter and processing delays
+// MaxMissedPings: 2 - prevents false positives from transient issues
+// Clients ask for health notifications by default; the server only sends
+// them to clients that asked, since others would take them for replies.
+func DefaultConfig(role Role) Config {
+	return Config{
+		Interval:       5 * time.Second,
+		Timeout:        3 * time.Second,
+		MaxMissedPings: 2,
+		EnableMetrics:  true,
+		Mode:           ModeFrames,
+		Adaptive:       DefaultAdaptiveConfig(),
+		Health:         DefaultHealthThresholds(),
+		NotifyHealth:   role == RoleClient,
+	}
+}
+
+// Heartbeat pings one connection and tracks the results. In ModeJSON the
+// pongs arrive as data messages, so the connection's read loop must pass
+// every message to Handle; in ModeFrames the websocket library answers
+// pings itself and Handle consumes nothing.
+type Heartbeat struct {
+	conn *websocket.Conn
+	cfg  Config
+	role Role
+
+	// Optional hooks, set before Run
+	OnStart  func(m *Metrics)            // Run started - e.g. register m with an aggregator
+	OnStop   func(m *Metrics)            // Run returned
+	OnPing   func()                      // A ping is about to be sent
+	OnPong   func(rtt time.Duration)     // A ping was answered
+	OnMiss   func(missed int, err error) // A ping went unanswered; missed counts consecutive misses
+	OnHealth func(st HealthStatus)       // The derived health state changed
+	Logger   *slog.Logger                // Receives the client role's ping results (nil = slog.Default())
+
+	metrics  Metrics
+	health   *HealthClassifier
+	interval atomic.Int64                 // Current ping interval, see AdaptiveConfig
+	pongs    chan Message                 // JSON pongs from Handle to Run
+	reported atomic.Pointer[HealthNotice] // Last HealthNotice from the server (client role)
+
+	StalePongs atomic.Int64 // JSON pongs for pings that already timed out (or were never sent)
+	PeerPings  atomic.Int64 // JSON pings from the peer answered by Handle
+}
+
+// New creates a heartbeat for conn. Call Run to start pinging.
+func New(conn *websocket.Conn, cfg Config, role Role) *Heartbeat {
+	h := &Heartbeat{
+		conn:   conn,
+		cfg:    cfg,
+		role:   role,
+		health: NewHealthClassifier(cfg.Health),
+		pongs:  make(chan Message, 4),
+	}
+	h.interval.Store(int64(cfg.Interval))
+	return h
+}
+
+// Interval returns the current time between pings: Config.Interval, or
+// wherever adaptive mode moved it.
+func (h *Heartbeat) Interval() time.Duration {
+	return time.Duration(h.interval.Load())
+}
+
+// Health returns the connection's current derived health.
+func (h *Heartbeat) Health() HealthStatus {
+	return h.health.Status()
+}
+
+// Reported returns the last health the server reported to this client,
+// if it sent any.
+func (h *Heartbeat) Reported() (HealthNotice, bool) {
+	if n := h.reported.Load(); n != nil {
+		return *n, true
+	}
+	return HealthNotice{}, false
+}
+
+// logger returns the logger for ping results.
+func (h *Heartbeat) logger() *slog.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return slog.Default()
+}
+
+// healthChanged reports a state change to the hook, logging it for clients.
+func (h *Heartbeat) healthChanged(st HealthStatus, changed bool) {
+	if !changed {
+		return
+	}
+	if h.role == RoleClient {
+		h.logger().Info("Connection health changed", "state", st.State,
+			"latency", st.Latency.Round(time.Millisecond), "jitter", st.Jitter.Round(time.Millisecond), "missed", st.Missed)
+	}
+	if h.OnHealth != nil {
+		h.OnHealth(st)
+	}
+}
+
+// Run pings every Interval and waits up to Timeout for each answer.
+// Returns the metrics and an error wrapping ErrLost once MaxMissedPings
+// consecutive pings went unanswered, or ctx's error when it is cancelled
+// (e.g. connection closed).
+func (h *Heartbeat) Run(ctx context.Context) (*Metrics, error) {
+	metrics := &h.metrics
+	if h.OnStart != nil {
+		h.OnStart(metrics)
+	}
+	if h.OnStop != nil {
+		defer h.OnStop(metrics)
+	}
+
+	var adaptive *adaptiveInterval
+	if h.cfg.Adaptive.Enabled {
+		adaptive = newAdaptiveInterval(h.cfg.Adaptive, h.cfg.Interval)
+		h.interval.Store(int64(adaptive.current))
+	}
+	timer := time.NewTimer(h.Interval())
+	defer timer.Stop()
+	var seq uint64
+	missedPings := 0 // Counter for consecutive failures - resets on successful pong
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Context cancelled (e.g., connection closed) - exit gracefully with metrics
+			return metrics, ctx.Err()
+		case <-timer.C:
+			// Timer expired - time to send next ping
+		}
+
+		seq++
+		if h.OnPing != nil {
+			h.OnPing()
+		}
+		start := time.Now() // Start latency measurement
+		err := h.ping(ctx, seq, start)
+		metrics.PingsSent.Add(1) // Atomic increment - thread-safe
+
+		if err != nil {
+			// Ping failed - could be network issue, peer crashed, or timeout
+			metrics.FailedPings.Add(1)
+			missedPings++
+			if h.role == RoleClient {
+				h.logger().Warn("Client ping failed", "error", err, "missed", missedPings, "max_missed", h.cfg.MaxMissedPings)
+			}
+			if h.OnMiss != nil {
+				h.OnMiss(missedPings, err)
+			}
+			h.healthChanged(h.health.Miss())
+			if adaptive != nil {
+				h.setInterval(adaptive.miss())
+			}
+
+			// Multiple failures indicate persistent connection problem
+			if missedPings >= h.cfg.MaxMissedPings {
+				return metrics, fmt.Errorf("%w: max missed pings (%d) exceeded: %w", ErrLost, h.cfg.MaxMissedPings, err)
+			}
+		} else {
+			// Pong received within timeout - connection is healthy
+			rtt := time.Since(start)
+			metrics.ObserveLatency(rtt)
+			metrics.PongsReceived.Add(1)
+			missedPings = 0
+			if h.role == RoleClient {
+				h.logger().Debug("Client ping successful", "latency_ms", rtt.Milliseconds())
+			}
+			if h.OnPong != nil {
+				h.OnPong(rtt)
+			}
+			st, changed := h.health.Observe(rtt)
+			h.healthChanged(st, changed)
+			if adaptive != nil {
+				h.setInterval(adaptive.pong(st.State))
+			}
+		}
+
+		// Reset timer for next ping interval
+		// This creates consistent ping intervals regardless of processing time
+		timer.Reset(h.Interval())
+	}
+}
+
+// setInterval records an adaptive interval change.
+func (h *Heartbeat) setInterval(d time.Duration) {
+	if old := time.Duration(h.interval.Swap(int64(d))); old != d && h.role == RoleClient {
+		h.logger().Debug("Heartbeat interval adapted", "from", old, "to", d)
+	}
+}
+
+// ping sends one ping and waits for its answer within Timeout.
+func (h *Heartbeat) ping(ctx context.Context, seq uint64, now time.Time) error {
+	if h.cfg.Mode != ModeJSON {
+		// Send WebSocket ping frame (opcode 0x9) per RFC 6455; the peer's
+		// library answers with a pong frame (opcode 0xA)
+		pingCtx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+		defer cancel()
+		return h.conn.Ping(pingCtx)
+	}
+	if err := h.send(ctx, Message{Type: "ping", Seq: seq, TS: now.UnixMilli()}); err != nil {
+		return err
+	}
+	return h.awaitPong(ctx, seq)
+}
+
+// WriteHeaders writes cfg's interval, timeout and mode to upgrade headers:
+// the client's proposal or the server's answer.
+func WriteHeaders(h http.Header, cfg Config) {
+	h.Set(HeaderInterval, strconv.FormatInt(cfg.Interval.Milliseconds(), 10))
+	h.Set(HeaderTimeout, strconv.FormatInt(cfg.Timeout.Milliseconds(), 10))
+	if cfg.Mode != "" {
+		h.Set(HeaderMode, cfg.Mode)
+	}
+	if cfg.NotifyHealth {
+		h.Set(HeaderHealth, "notify")
+	}
+}
+
+// ParseMillis parses a positive integer millisecond header value.
+func ParseMillis(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// ParseMode returns the mode named by a header value, and false for unknown
+// or missing values.
+func ParseMode(v string) (string, bool) {
+	switch v {
+	case ModeFrames, ModeJSON:
+		return v, true
+	}
+	return "", false
+}
@@ -0,0 +1,124 @@
+package heartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// Message is the application-level heartbeat used in ModeJSON:
+//
+//	{"type":"ping","seq":7,"ts":1700000000000}
+//	{"type":"pong","seq":7,"ts":1700000000000}
+//
+// A pong echoes the ping's seq and ts (sender's clock, Unix ms) so either
+// side can measure RTT without synchronized clocks. Proxies and browser
+// clients can't always see protocol-level pings; these are plain text
+// messages, so they pass everything that carries data.
+type Message struct {
+	Type string `json:"type"` // "ping" or "pong"
+	Seq  uint64 `json:"seq"`
+	TS   int64  `json:"ts"`
+}
+
+// ParseMessage recognizes heartbeat messages among text messages.
+// Anything else - including JSON with other types - is left to the caller.
+func ParseMessage(msgType websocket.MessageType, data []byte) (Message, bool) {
+	var m Message
+	if msgType != websocket.MessageText || len(data) == 0 || data[0] != '{' {
+		return m, false
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, false
+	}
+	return m, m.Type == "ping" || m.Type == "pong"
+}
+
+// IsMessage reports whether a message is a JSON heartbeat.
+func IsMessage(msgType websocket.MessageType, data []byte) bool {
+	_, ok := ParseMessage(msgType, data)
+	return ok
+}
+
+// Handle consumes heartbeat messages from the read loop: in ModeJSON pings
+// are answered with a pong and pongs are passed to Run; clients also
+// consume the server's HealthNotice messages. Returns false for every
+// other message, which the caller processes as usual. A nil Heartbeat
+// consumes nothing.
+func (h *Heartbeat) Handle(ctx context.Context, msgType websocket.MessageType, data []byte) bool {
+	if h == nil {
+		return false
+	}
+	if h.role == RoleClient {
+		if notice, ok := parseHealthNotice(msgType, data); ok {
+			h.reported.Store(&notice)
+			h.logger().Info("Server reports connection health", "state", notice.State,
+				"latency_ms", notice.LatencyMs, "jitter_ms", notice.JitterMs)
+			return true
+		}
+	}
+	if h.cfg.Mode != ModeJSON {
+		return false
+	}
+	m, ok := ParseMessage(msgType, data)
+	if !ok {
+		return false
+	}
+	if m.Type == "ping" {
+		h.PeerPings.Add(1)
+		h.send(ctx, Message{Type: "pong", Seq: m.Seq, TS: m.TS})
+		return true
+	}
+	select {
+	case h.pongs <- m:
+	default:
+		h.StalePongs.Add(1) // Run isn't keeping up - nobody is waiting for it
+	}
+	return true
+}
+
+// parseHealthNotice recognizes a server's HealthNotice.
+func parseHealthNotice(msgType websocket.MessageType, data []byte) (HealthNotice, bool) {
+	var n HealthNotice
+	if msgType != websocket.MessageText || len(data) == 0 || data[0] != '{' {
+		return n, false
+	}
+	if err := json.Unmarshal(data, &n); err != nil {
+		return n, false
+	}
+	return n, n.Type == "health"
+}
+
+// awaitPong waits for the pong to seq. Pongs to earlier pings that arrive
+// late are counted and skipped.
+func (h *Heartbeat) awaitPong(ctx context.Context, seq uint64) error {
+	timeout := time.NewTimer(h.cfg.Timeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return fmt.Errorf("no pong for seq %d within %v", seq, h.cfg.Timeout)
+		case pong := <-h.pongs:
+			if pong.Seq == seq {
+				return nil
+			}
+			h.StalePongs.Add(1)
+		}
+	}
+}
+
+// send writes one heartbeat message within the heartbeat timeout.
+func (h *Heartbeat) send(ctx context.Context, m Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	writeCtx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+	defer cancel()
+	return h.conn.Write(writeCtx, websocket.MessageText, data)
+}
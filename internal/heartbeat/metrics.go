@@ -0,0 +1,99 @@
+package heartbeat
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyWindow is how many recent RTTs the percentiles are computed from.
+const latencyWindow = 128
+
+// latencyEWMAGain is the weight of a new RTT in the moving average. With
+// 0.2 a sample's influence halves after about three pongs.
+const latencyEWMAGain = 0.2
+
+// Metrics collects performance and health metrics for monitoring.
+// The counters are atomics and can be read directly from any goroutine;
+// latency statistics need a consistent view and are read through Snapshot.
+type Metrics struct {
+	PingsSent     atomic.Int64 // Total pings sent - incremented before each ping
+	PongsReceived atomic.Int64 // Total pongs received - incremented on successful pong
+	FailedPings   atomic.Int64 // Failed pings - incremented on timeout or error
+
+	mu      sync.Mutex                   // Protects the latency fields below
+	ewma    float64                      // Moving average RTT in nanoseconds
+	min     time.Duration                // Lowest RTT seen
+	max     time.Duration                // Highest RTT seen
+	last    time.Duration                // Most recent RTT
+	window  [latencyWindow]time.Duration // Ring buffer of recent RTTs
+	samples int                          // RTTs observed in total
+}
+
+// MetricsSnapshot is a plain copy of Metrics, safe to pass around and
+// encode. Latency fields are zero until the first pong.
+type MetricsSnapshot struct {
+	PingsSent     int64         `json:"pings_sent"`
+	PongsReceived int64         `json:"pongs_received"`
+	FailedPings   int64         `json:"failed_pings"`
+	LastLatency   time.Duration `json:"last_latency"`
+	AvgLatency    time.Duration `json:"avg_latency"` // Exponentially weighted moving average
+	MinLatency    time.Duration `json:"min_latency"`
+	MaxLatency    time.Duration `json:"max_latency"`
+	P50Latency    time.Duration `json:"p50_latency"` // Percentiles over the last latencyWindow pongs
+	P95Latency    time.Duration `json:"p95_latency"`
+	P99Latency    time.Duration `json:"p99_latency"`
+}
+
+// ObserveLatency records the RTT of one pong.
+func (m *Metrics) ObserveLatency(rtt time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.samples == 0 {
+		m.ewma = float64(rtt)
+		m.min, m.max = rtt, rtt
+	} else {
+		m.ewma += latencyEWMAGain * (float64(rtt) - m.ewma)
+		m.min = min(m.min, rtt)
+		m.max = max(m.max, rtt)
+	}
+	m.last = rtt
+	m.window[m.samples%latencyWindow] = rtt
+	m.samples++
+}
+
+// Snapshot returns the current counters and latency statistics.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	snap := MetricsSnapshot{
+		PingsSent:     m.PingsSent.Load(),
+		PongsReceived: m.PongsReceived.Load(),
+		FailedPings:   m.FailedPings.Load(),
+	}
+
+	m.mu.Lock()
+	n := min(m.samples, latencyWindow)
+	recent := slices.Clone(m.window[:n])
+	snap.LastLatency = m.last
+	snap.AvgLatency = time.Duration(m.ewma)
+	snap.MinLatency, snap.MaxLatency = m.min, m.max
+	m.mu.Unlock()
+
+	if n > 0 {
+		slices.Sort(recent) // Outside the lock - Run keeps observing meanwhile
+		snap.P50Latency = percentile(recent, 50)
+		snap.P95Latency = percentile(recent, 95)
+		snap.P99Latency = percentile(recent, 99)
+	}
+	return snap
+}
+
+// percentile returns the nearest-rank percentile p of sorted samples.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
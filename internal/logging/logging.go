@@ -0,0 +1,102 @@
+// Package logging configures log/slog for the server and the client: the
+// level, text or JSON output, and the per-connection logger that carries a
+// connection's ID into every line logged on its behalf.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Output formats selectable via Settings.Format.
+const (
+	FormatText = "text" // key=value lines for terminals (default)
+	FormatJSON = "json" // One JSON object per line for log aggregation
+)
+
+// Settings selects the level and format of the process logger.
+type Settings struct {
+	Level  string `yaml:"level"`  // debug, info (default), warn or error (env LOG_LEVEL)
+	Format string `yaml:"format"` // FormatText or FormatJSON (env LOG_FORMAT)
+}
+
+// ParseLevel parses a level name. An empty name is info.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", name)
+}
+
+// Validate reports the first invalid setting.
+func (s Settings) Validate() error {
+	if _, err := ParseLevel(s.Level); err != nil {
+		return err
+	}
+	switch s.Format {
+	case "", FormatText, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown log format %q (want %s or %s)", s.Format, FormatText, FormatJSON)
+}
+
+// New creates a logger writing to w as s selects.
+func New(w io.Writer, s Settings) (*slog.Logger, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	level, _ := ParseLevel(s.Level)
+	opts := &slog.HandlerOptions{Level: level}
+	if s.Format == FormatJSON {
+		opts.ReplaceAttr = durationStrings
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return slog.New(slog.NewTextHandler(w, opts)), nil
+}
+
+// durationStrings writes durations as "1.5s" rather than nanoseconds, so
+// JSON lines read like the text ones.
+func durationStrings(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		a.Value = slog.StringValue(a.Value.Duration().String())
+	}
+	return a
+}
+
+// Setup makes a logger writing to w the default for log/slog and, through
+// it, for the standard log package.
+func Setup(w io.Writer, s Settings) error {
+	logger, err := New(w, s)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// loggerKey is the context key of a connection's logger.
+type loggerKey struct{}
+
+// WithLogger returns ctx carrying l, so code serving the connection logs
+// with its attributes.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
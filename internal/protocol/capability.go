@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// HeaderCapabilities carries the capability negotiation: the client lists
+// the sub-protocols it understands ("rpc,stream"), the server answers in
+// the 101 response with those it serves on the endpoint. Messages of a
+// capability carry its name in Message.Stream; a peer only sends them
+// once both sides agreed on it, so clients that list nothing - older ones
+// included - never see a frame kind they don't know.
+const HeaderCapabilities = "X-Capabilities"
+
+// CodeUnsupportedStream is the TypeError code for a message on a stream
+// that wasn't negotiated.
+const CodeUnsupportedStream = "unsupported_stream"
+
+// ProposeCapabilities writes caps to the client's upgrade request.
+func ProposeCapabilities(h http.Header, caps []string) {
+	if len(caps) > 0 {
+		h.Set(HeaderCapabilities, strings.Join(caps, ","))
+	}
+}
+
+// NegotiateCapabilities returns the capabilities both the client's
+// request and supported list, in the client's order, and writes them to
+// the response headers. Writes nothing when there are none in common.
+func NegotiateCapabilities(req, resp http.Header, supported []string) []string {
+	var agreed []string
+	for _, c := range parseCapabilities(req.Get(HeaderCapabilities)) {
+		if slices.Contains(supported, c) && !slices.Contains(agreed, c) {
+			agreed = append(agreed, c)
+		}
+	}
+	if len(agreed) > 0 {
+		resp.Set(HeaderCapabilities, strings.Join(agreed, ","))
+	}
+	return agreed
+}
+
+// AcceptedCapabilities returns the capabilities the server agreed to, from
+// its upgrade response headers. Servers without capabilities send none.
+func AcceptedCapabilities(resp http.Header) []string {
+	return parseCapabilities(resp.Get(HeaderCapabilities))
+}
+
+// parseCapabilities splits a header value, dropping empty names.
+func parseCapabilities(value string) []string {
+	var caps []string
+	for _, field := range strings.Split(value, ",") {
+		if c := strings.TrimSpace(field); c != "" {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
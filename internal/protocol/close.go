@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"unicode/utf8"
+
+	"github.com/coder/websocket"
+)
+
+// Close codes, and what they mean between the server and the client. The
+// reason of a close the server decided is often machine-readable JSON with
+// an "error" field, e.g. {"error":"rate_limited",...}, so several causes
+// can share the standard policy violation code older clients know.
+const (
+	CloseNormal          = websocket.StatusNormalClosure   // 1000: the peer is done; sessions aren't kept for resumption
+	CloseShutdown        = websocket.StatusGoingAway       // 1001: the server shuts down, or the client's process exits
+	ClosePolicyViolation = websocket.StatusPolicyViolation // 1008: refused by a handler, kicked, slow consumer
+	CloseRateLimited     = websocket.StatusPolicyViolation // 1008 with {"error":"rate_limited",...}: too many violations or an empty token bucket
+	CloseMessageTooBig   = websocket.StatusMessageTooBig   // 1009 with {"error":"payload_too_large",...}: a message exceeded the limit
+	CloseInternalError   = websocket.StatusInternalError   // 1011: the connection ended without a deliberate close
+	CloseAuthFailed      = websocket.StatusCode(4401)      // 4401: the credentials stopped being valid, e.g. a revoked token
+	CloseSuperseded      = websocket.StatusCode(4409)      // 4409: a newer connection of the same user and device took over
+)
+
+// closeNames names the close codes in logs.
+var closeNames = map[websocket.StatusCode]string{
+	CloseNormal:          "normal",
+	CloseShutdown:        "shutdown",
+	ClosePolicyViolation: "policy_violation",
+	CloseMessageTooBig:   "message_too_big",
+	CloseInternalError:   "internal_error",
+	CloseAuthFailed:      "auth_failed",
+	CloseSuperseded:      "superseded",
+}
+
+// CloseName returns the name of code for logs, e.g. "shutdown", or its
+// number for codes outside the map.
+func CloseName(code websocket.StatusCode) string {
+	if name, ok := closeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprint(int(code))
+}
+
+// MaxCloseReason is the longest close reason a control frame can carry.
+const MaxCloseReason = 123
+
+// TruncateCloseReason shortens reason to fit a close frame, without
+// cutting a UTF-8 sequence in half - peers reject invalid close reasons.
+func TruncateCloseReason(reason string) string {
+	if len(reason) <= MaxCloseReason {
+		return reason
+	}
+	n := MaxCloseReason
+	for n > 0 && !utf8.RuneStart(reason[n]) {
+		n--
+	}
+	return reason[:n]
+}
+
+// CloseWith closes conn with code and reason and waits for the peer's
+// answering close frame (up to five seconds), so both sides see the same
+// status. Closing a connection that is already closing is a no-op: the
+// first close's code is the one the peer sees, and nil is returned. The
+// reason is truncated to fit the frame.
+func CloseWith(conn *websocket.Conn, code websocket.StatusCode, reason string) error {
+	err := conn.Close(code, TruncateCloseReason(reason))
+	if errors.Is(err, net.ErrClosed) {
+		return nil // Someone else closed it first
+	}
+	return err
+}
+
+// PeerClose returns the close frame err ended with - the code and reason
+// the peer closed the connection with.
+func PeerClose(err error) (websocket.CloseError, bool) {
+	var ce websocket.CloseError
+	if !errors.As(err, &ce) {
+		return websocket.CloseError{}, false
+	}
+	return ce, true
+}
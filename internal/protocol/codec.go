@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Codec encodes message envelopes for the wire. The codec is negotiated as
+// the WebSocket subprotocol, see Subprotocols; connections without one use
+// JSON.
+type Codec interface {
+	// Name is the codec's WebSocket subprotocol, e.g. "cysl.msgpack".
+	Name() string
+
+	// Binary reports whether messages travel as binary frames; JSON uses
+	// text frames.
+	Binary() bool
+
+	// Encode returns m's wire form.
+	Encode(m Message) ([]byte, error)
+
+	// Decode parses a message. Data that isn't an envelope is
+	// ErrInvalidMessage; unknown fields are skipped.
+	Decode(data []byte) (Message, error)
+}
+
+// Built-in codecs. The payload is carried as opaque bytes by all of them,
+// so the binary codecs shrink the envelope (field names, timestamp) while
+// the payload keeps whatever encoding New gave it.
+var (
+	JSON     Codec = jsonCodec{}
+	MsgPack  Codec = msgpackCodec{}
+	Protobuf Codec = protobufCodec{}
+)
+
+// codecs lists the built-in codecs in the server's order of preference:
+// the most compact first.
+var codecs = []Codec{Protobuf, MsgPack, JSON}
+
+// Subprotocols returns the subprotocol names of the given codecs, for
+// websocket.AcceptOptions and DialOptions. The order is the preference.
+func Subprotocols(cs ...Codec) []string {
+	names := make([]string, len(cs))
+	for i, c := range cs {
+		names[i] = c.Name()
+	}
+	return names
+}
+
+// Codecs returns the built-in codecs, most compact first.
+func Codecs() []Codec {
+	return append([]Codec(nil), codecs...)
+}
+
+// CodecByName returns the codec for a subprotocol or a short name
+// ("json", "msgpack", "protobuf"). The empty string - no subprotocol
+// negotiated - is JSON.
+func CodecByName(name string) (Codec, error) {
+	if name == "" {
+		return JSON, nil
+	}
+	for _, c := range codecs {
+		if name == c.Name() || "cysl."+name == c.Name() {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+// jsonCodec is the default text codec, the format Encode and Decode use.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                        { return "cysl.json" }
+func (jsonCodec) Binary() bool                        { return false }
+func (jsonCodec) Encode(m Message) ([]byte, error)    { return Encode(m) }
+func (jsonCodec) Decode(data []byte) (Message, error) { return Decode(data) }
+
+// payloadJSON validates a decoded binary payload as JSON so Message keeps
+// its json.RawMessage contract; other bytes are wrapped as a JSON string.
+func payloadJSON(b []byte) json.RawMessage {
+	if len(b) == 0 {
+		return nil
+	}
+	if json.Valid(b) {
+		return json.RawMessage(b)
+	}
+	s, _ := json.Marshal(string(b))
+	return s
+}
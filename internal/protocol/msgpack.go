@@ -0,0 +1,344 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// msgpackCodec encodes a Message as a MessagePack map with the same keys as
+// the JSON form. ts uses the standard timestamp extension (type -1) and the
+// payload is a bin value, so any MessagePack library can read it.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "cysl.msgpack" }
+func (msgpackCodec) Binary() bool { return true }
+
+// Encode returns m as a MessagePack map.
+func (msgpackCodec) Encode(m Message) ([]byte, error) {
+	if m.Type == "" {
+		return nil, fmt.Errorf("%w: missing type", ErrInvalidMessage)
+	}
+	fields := 2 // type, ts
+	if m.ID != "" {
+		fields++
+	}
+	if m.ReplyTo != "" {
+		fields++
+	}
+	if m.Stream != "" {
+		fields++
+	}
+	if m.TraceID != "" {
+		fields++
+	}
+	if len(m.Payload) > 0 {
+		fields++
+	}
+
+	b := make([]byte, 0, 64+len(m.Type)+len(m.ID)+len(m.ReplyTo)+len(m.Stream)+len(m.TraceID)+len(m.Payload))
+	b = append(b, 0x80|byte(fields)) // fixmap
+	b = mpString(mpString(b, "type"), m.Type)
+	if m.ID != "" {
+		b = mpString(mpString(b, "id"), m.ID)
+	}
+	if m.ReplyTo != "" {
+		b = mpString(mpString(b, "reply_to"), m.ReplyTo)
+	}
+	if m.Stream != "" {
+		b = mpString(mpString(b, "stream"), m.Stream)
+	}
+	if m.TraceID != "" {
+		b = mpString(mpString(b, "trace_id"), m.TraceID)
+	}
+	b = mpString(b, "ts")
+	b = append(b, 0xc7, 12, 0xff) // ext 8, timestamp 96
+	b = binary.BigEndian.AppendUint32(b, uint32(m.Timestamp.Nanosecond()))
+	b = binary.BigEndian.AppendUint64(b, uint64(m.Timestamp.Unix()))
+	if len(m.Payload) > 0 {
+		b = mpBin(mpString(b, "payload"), m.Payload)
+	}
+	return b, nil
+}
+
+// Decode parses a MessagePack map, skipping keys it doesn't know.
+func (msgpackCodec) Decode(data []byte) (Message, error) {
+	r := &mpReader{b: data}
+	n, err := r.mapLen()
+	if err != nil {
+		return Message{}, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+
+	var m Message
+	for i := 0; i < n && err == nil; i++ {
+		var key string
+		if key, err = r.str(); err != nil {
+			break
+		}
+		switch key {
+		case "type":
+			m.Type, err = r.str()
+		case "id":
+			m.ID, err = r.str()
+		case "reply_to":
+			m.ReplyTo, err = r.str()
+		case "stream":
+			m.Stream, err = r.str()
+		case "trace_id":
+			m.TraceID, err = r.str()
+		case "ts":
+			m.Timestamp, err = r.timestamp()
+		case "payload":
+			var p []byte
+			p, err = r.bin()
+			m.Payload = payloadJSON(p)
+		default:
+			err = r.skip()
+		}
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if m.Type == "" {
+		return Message{}, fmt.Errorf("%w: missing type", ErrInvalidMessage)
+	}
+	return m, nil
+}
+
+// mpString appends a MessagePack str.
+func mpString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 1<<8:
+		b = append(b, 0xd9, byte(n))
+	case n < 1<<16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+// mpBin appends a MessagePack bin.
+func mpBin(b, p []byte) []byte {
+	switch n := len(p); {
+	case n < 1<<8:
+		b = append(b, 0xc4, byte(n))
+	case n < 1<<16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(n))
+	}
+	return append(b, p...)
+}
+
+// mpReader decodes the subset of MessagePack the envelope uses and skips
+// everything else.
+type mpReader struct {
+	b   []byte
+	off int
+}
+
+// next returns the next n bytes.
+func (r *mpReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.b)-r.off < n {
+		return nil, fmt.Errorf("truncated at byte %d", r.off)
+	}
+	p := r.b[r.off : r.off+n]
+	r.off += n
+	return p, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (r *mpReader) uint(size int) (int, error) {
+	p, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range p {
+		v = v<<8 | uint64(c)
+	}
+	if v > 1<<31 {
+		return 0, fmt.Errorf("length %d too large", v)
+	}
+	return int(v), nil
+}
+
+// mapLen reads a map header.
+func (r *mpReader) mapLen() (int, error) {
+	p, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	switch c := p[0]; {
+	case c&0xf0 == 0x80:
+		return int(c & 0x0f), nil
+	case c == 0xde:
+		return r.uint(2)
+	case c == 0xdf:
+		return r.uint(4)
+	default:
+		return 0, fmt.Errorf("expected map, got 0x%02x", c)
+	}
+}
+
+// str reads a str value.
+func (r *mpReader) str() (string, error) {
+	p, err := r.next(1)
+	if err != nil {
+		return "", err
+	}
+	var n int
+	switch c := p[0]; {
+	case c&0xe0 == 0xa0:
+		n = int(c & 0x1f)
+	case c == 0xd9:
+		n, err = r.uint(1)
+	case c == 0xda:
+		n, err = r.uint(2)
+	case c == 0xdb:
+		n, err = r.uint(4)
+	default:
+		return "", fmt.Errorf("expected string, got 0x%02x", c)
+	}
+	if err != nil {
+		return "", err
+	}
+	s, err := r.next(n)
+	return string(s), err
+}
+
+// bin reads a bin value; str is accepted too, as older MessagePack
+// libraries encode byte slices that way.
+func (r *mpReader) bin() ([]byte, error) {
+	p, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	switch c := p[0]; {
+	case c == 0xc4:
+		n, err = r.uint(1)
+	case c == 0xc5:
+		n, err = r.uint(2)
+	case c == 0xc6:
+		n, err = r.uint(4)
+	case c == 0xc0:
+		return nil, nil // nil
+	default:
+		r.off--
+		s, err := r.str()
+		return []byte(s), err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.next(n)
+}
+
+// timestamp reads a timestamp extension in any of its three sizes.
+func (r *mpReader) timestamp() (time.Time, error) {
+	p, err := r.next(1)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var n int
+	switch p[0] {
+	case 0xd6:
+		n = 4
+	case 0xd7:
+		n = 8
+	case 0xc7:
+		if n, err = r.uint(1); err != nil {
+			return time.Time{}, err
+		}
+	default:
+		return time.Time{}, fmt.Errorf("expected timestamp, got 0x%02x", p[0])
+	}
+	typ, err := r.next(1)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if int8(typ[0]) != -1 {
+		return time.Time{}, fmt.Errorf("expected timestamp, got extension %d", int8(typ[0]))
+	}
+	v, err := r.next(n)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(v)), 0).UTC(), nil
+	case 8:
+		u := binary.BigEndian.Uint64(v)
+		return time.Unix(int64(u&(1<<34-1)), int64(u>>34)).UTC(), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(v[4:])), int64(binary.BigEndian.Uint32(v))).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp length %d", n)
+}
+
+// skip steps over one value of any type.
+func (r *mpReader) skip() error {
+	p, err := r.next(1)
+	if err != nil {
+		return err
+	}
+	c := p[0]
+	n, elems := 0, 0 // Bytes to skip, nested values to skip
+	switch {
+	case c <= 0x7f, c >= 0xe0, c == 0xc0, c == 0xc2, c == 0xc3:
+		// Fixint, nil, bool: nothing follows
+	case c&0xf0 == 0x80:
+		elems = 2 * int(c&0x0f)
+	case c&0xf0 == 0x90:
+		elems = int(c & 0x0f)
+	case c&0xe0 == 0xa0:
+		n = int(c & 0x1f)
+	case c == 0xc4, c == 0xd9:
+		n, err = r.uint(1)
+	case c == 0xc5, c == 0xda:
+		n, err = r.uint(2)
+	case c == 0xc6, c == 0xdb:
+		n, err = r.uint(4)
+	case c == 0xc7, c == 0xc8, c == 0xc9:
+		n, err = r.uint(1 << (c - 0xc7))
+		n++ // Extension type
+	case c == 0xca:
+		n = 4
+	case c == 0xcb:
+		n = 8
+	case c >= 0xcc && c <= 0xcf:
+		n = 1 << (c - 0xcc)
+	case c >= 0xd0 && c <= 0xd3:
+		n = 1 << (c - 0xd0)
+	case c >= 0xd4 && c <= 0xd8:
+		n = 1<<(c-0xd4) + 1
+	case c == 0xdc:
+		elems, err = r.uint(2)
+	case c == 0xdd:
+		elems, err = r.uint(4)
+	case c == 0xde:
+		elems, err = r.uint(2)
+		elems *= 2
+	case c == 0xdf:
+		elems, err = r.uint(4)
+		elems *= 2
+	default:
+		return fmt.Errorf("invalid byte 0x%02x", c)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := r.next(n); err != nil {
+		return err
+	}
+	for i := 0; i < elems; i++ {
+		if err := r.skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
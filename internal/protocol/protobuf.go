@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// protobufCodec encodes a Message in the Protocol Buffers wire format
+// described by message.proto. The encoding is written by hand - the
+// envelope has six fields - so the module needs no code generator.
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string { return "cysl.protobuf" }
+func (protobufCodec) Binary() bool { return true }
+
+// Field numbers of message.proto.
+const (
+	pbType      = 1
+	pbID        = 2
+	pbTimestamp = 3
+	pbPayload   = 4
+	pbReplyTo   = 5
+	pbStream    = 6
+	pbTraceID   = 7
+
+	pbSeconds = 1 // google.protobuf.Timestamp
+	pbNanos   = 2
+)
+
+// Wire types.
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+// Encode returns m in the protobuf wire format. Empty fields are omitted,
+// as proto3 does.
+func (protobufCodec) Encode(m Message) ([]byte, error) {
+	if m.Type == "" {
+		return nil, fmt.Errorf("%w: missing type", ErrInvalidMessage)
+	}
+	var ts []byte
+	if sec := m.Timestamp.Unix(); sec != 0 {
+		ts = pbAppendVarint(ts, pbSeconds, uint64(sec))
+	}
+	if nanos := m.Timestamp.Nanosecond(); nanos != 0 {
+		ts = pbAppendVarint(ts, pbNanos, uint64(nanos))
+	}
+
+	b := make([]byte, 0, 32+len(m.Type)+len(m.ID)+len(m.ReplyTo)+len(m.Stream)+len(m.Payload))
+	b = pbAppendBytes(b, pbType, []byte(m.Type))
+	if m.ID != "" {
+		b = pbAppendBytes(b, pbID, []byte(m.ID))
+	}
+	if !m.Timestamp.IsZero() {
+		b = pbAppendBytes(b, pbTimestamp, ts)
+	}
+	if len(m.Payload) > 0 {
+		b = pbAppendBytes(b, pbPayload, m.Payload)
+	}
+	if m.ReplyTo != "" {
+		b = pbAppendBytes(b, pbReplyTo, []byte(m.ReplyTo))
+	}
+	if m.Stream != "" {
+		b = pbAppendBytes(b, pbStream, []byte(m.Stream))
+	}
+	if m.TraceID != "" {
+		b = pbAppendBytes(b, pbTraceID, []byte(m.TraceID))
+	}
+	return b, nil
+}
+
+// Decode parses the protobuf wire format, skipping unknown fields.
+func (protobufCodec) Decode(data []byte) (Message, error) {
+	var m Message
+	err := pbFields(data, func(field int, value []byte) error {
+		switch field {
+		case pbType:
+			m.Type = string(value)
+		case pbID:
+			m.ID = string(value)
+		case pbTimestamp:
+			var sec, nanos int64
+			err := pbFields(value, func(field int, value []byte) error {
+				v, n := binary.Uvarint(value)
+				if n <= 0 {
+					return errors.New("invalid timestamp")
+				}
+				switch field {
+				case pbSeconds:
+					sec = int64(v)
+				case pbNanos:
+					nanos = int64(int32(v))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			m.Timestamp = time.Unix(sec, nanos).UTC()
+		case pbPayload:
+			m.Payload = payloadJSON(value)
+		case pbReplyTo:
+			m.ReplyTo = string(value)
+		case pbStream:
+			m.Stream = string(value)
+		case pbTraceID:
+			m.TraceID = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return Message{}, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if m.Type == "" {
+		return Message{}, fmt.Errorf("%w: missing type", ErrInvalidMessage)
+	}
+	return m, nil
+}
+
+// pbAppendVarint appends a varint field.
+func pbAppendVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|pbVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+// pbAppendBytes appends a length-delimited field.
+func pbAppendBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|pbBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// pbFields calls fn for every field in data with its raw value: the
+// varint bytes, the fixed bytes or the length-delimited content.
+func pbFields(data []byte, fn func(field int, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid field key")
+		}
+		data = data[n:]
+
+		var size int
+		switch key & 7 {
+		case pbVarint:
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return errors.New("invalid varint")
+			}
+			size = n
+		case pbFixed64:
+			size = 8
+		case pbFixed32:
+			size = 4
+		case pbBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return errors.New("invalid length")
+			}
+			data = data[n:]
+			size = int(l)
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		if size > len(data) {
+			return errors.New("truncated field")
+		}
+		if err := fn(int(key>>3), data[:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
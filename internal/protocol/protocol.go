@@ -0,0 +1,199 @@
+// Package protocol defines the message envelope the server and the client
+// exchange on /ws, and the version negotiation that enables it during the
+// WebSocket upgrade. Peers that don't negotiate keep exchanging raw text,
+// so older clients and servers continue to work unchanged.
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocol versions.
+const (
+	VersionRaw = 0 // No envelope - messages are plain text (peers that don't negotiate)
+	Version1   = 1 // JSON Message envelopes
+	Current    = Version1
+)
+
+// HeaderVersion carries the negotiation: the client lists the versions it
+// speaks ("1" or "1,2"), the server answers with the one it picked in the
+// 101 response. No answer means raw messages.
+const HeaderVersion = "X-Protocol-Version"
+
+// Session resumption: the server issues a token in HeaderSession of the 101
+// response and a reconnecting client presents it in its upgrade request.
+// HeaderSessionResumed is "true" in the response when the server restored
+// the session the token named; otherwise the token is a new one.
+const (
+	HeaderSession        = "X-Session-Token"
+	HeaderSessionResumed = "X-Session-Resumed"
+)
+
+// HeaderDevice carries the ID of the device a client runs on. A server
+// that takes over duplicate connections closes an authenticated user's
+// older connection from the same device when a new one arrives.
+const HeaderDevice = "X-Device-ID"
+
+// Built-in message types. Applications add their own; a peer answers types
+// it doesn't know with TypeError and code CodeUnsupportedType, so new types
+// can be introduced without breaking older peers.
+const (
+	TypeMessage = "message" // Application payload
+	TypeEcho    = "echo"    // The echo handler's reply, carrying the original payload
+	TypeError   = "error"   // An ErrorPayload: the peer couldn't process a message
+)
+
+// Error codes of TypeError messages.
+const (
+	CodeInvalidMessage  = "invalid_message"  // Not a valid envelope
+	CodeUnsupportedType = "unsupported_type" // Valid envelope of a type the peer doesn't handle
+)
+
+// Message is the envelope of every application message in Version1.
+// Unknown fields are ignored when decoding, so later versions can add
+// fields that older peers simply skip.
+type Message struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id,omitempty"`       // Unique per message (set by New)
+	ReplyTo   string          `json:"reply_to,omitempty"` // ID of the message this one answers (set by NewReply)
+	Stream    string          `json:"stream,omitempty"`   // Capability the message belongs to; empty for the endpoint's own messages
+	TraceID   string          `json:"trace_id,omitempty"` // User action the message is part of (see NewTraceID)
+	Timestamp time.Time       `json:"ts"`                 // When the message was created
+	Payload   json.RawMessage `json:"payload,omitempty"`  // Type-specific content
+}
+
+// ErrorPayload is the payload of a TypeError message.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ErrInvalidMessage is returned by Decode for data that isn't an envelope.
+var ErrInvalidMessage = errors.New("invalid message envelope")
+
+// NewID generates a random message ID.
+func NewID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// NewTraceID generates a random trace ID: 32 hex digits, the size of a W3C
+// trace-id, so it can be handed on to a tracing system as is.
+func NewTraceID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// New creates a message of type typ with a fresh ID and timestamp.
+// payload is encoded as JSON; nil leaves the payload empty.
+func New(typ string, payload any) (Message, error) {
+	m := Message{Type: typ, ID: NewID(), Timestamp: time.Now().UTC()}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return Message{}, fmt.Errorf("encode %s payload: %w", typ, err)
+		}
+		m.Payload = data
+	}
+	return m, nil
+}
+
+// NewReply creates a message of type typ answering req: its ReplyTo is
+// req's ID, so the peer can match it with the request it made, and it
+// travels on req's stream and carries req's trace ID. Peers that don't
+// know ReplyTo see an ordinary message.
+func NewReply(req Message, typ string, payload any) (Message, error) {
+	m, err := New(typ, payload)
+	if err != nil {
+		return Message{}, err
+	}
+	m.ReplyTo, m.Stream, m.TraceID = req.ID, req.Stream, req.TraceID
+	return m, nil
+}
+
+// Marshal creates and encodes a message in one step.
+func Marshal(typ string, payload any) ([]byte, error) {
+	m, err := New(typ, payload)
+	if err != nil {
+		return nil, err
+	}
+	return Encode(m)
+}
+
+// Encode returns m's wire form.
+func Encode(m Message) ([]byte, error) {
+	if m.Type == "" {
+		return nil, fmt.Errorf("%w: missing type", ErrInvalidMessage)
+	}
+	return json.Marshal(m)
+}
+
+// Decode parses an envelope. Data that isn't a JSON object with a type is
+// ErrInvalidMessage.
+func Decode(data []byte) (Message, error) {
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Message{}, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if m.Type == "" {
+		return Message{}, fmt.Errorf("%w: missing type", ErrInvalidMessage)
+	}
+	return m, nil
+}
+
+// DecodePayload decodes m's payload into v.
+func (m Message) DecodePayload(v any) error {
+	if len(m.Payload) == 0 {
+		return fmt.Errorf("%s message has no payload", m.Type)
+	}
+	return json.Unmarshal(m.Payload, v)
+}
+
+// Propose writes the versions up to max to the client's upgrade request.
+func Propose(h http.Header, max int) {
+	if max <= VersionRaw {
+		return
+	}
+	versions := make([]string, 0, max)
+	for v := Version1; v <= max; v++ {
+		versions = append(versions, strconv.Itoa(v))
+	}
+	h.Set(HeaderVersion, strings.Join(versions, ","))
+}
+
+// Negotiate picks the highest version both the client's request and this
+// build support, and writes it to the response headers. Returns VersionRaw
+// (writing nothing) when the client proposed none.
+func Negotiate(req, resp http.Header) int {
+	best := VersionRaw
+	for _, field := range strings.Split(req.Get(HeaderVersion), ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err == nil && v > best && v <= Current {
+			best = v
+		}
+	}
+	if best > VersionRaw {
+		resp.Set(HeaderVersion, strconv.Itoa(best))
+	}
+	return best
+}
+
+// Accepted returns the version the server picked, from its upgrade
+// response headers. Servers without versioning send none: VersionRaw.
+func Accepted(resp http.Header) int {
+	v, err := strconv.Atoi(resp.Get(HeaderVersion))
+	if err != nil || v < VersionRaw || v > Current {
+		return VersionRaw
+	}
+	return v
+}
@@ -6,24 +6,44 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	client "github.com/deanbregenzer/cysl/Client"
 	server "github.com/deanbregenzer/cysl/Server"
+	"github.com/deanbregenzer/cysl/internal/logging"
 )
 
 var (
 	// mode determines whether to run as server or client
 	// Set via -mode flag: ./cysl -mode=server or ./cysl -mode=client
 	mode string
+
+	// configPath names an optional YAML/JSON server config file
+	// Set via -config flag: ./cysl -config=server.yaml
+	configPath string
+
+	// interactive makes the client read messages from stdin instead of
+	// sending test messages. Set via -interactive: ./cysl -mode=client -interactive
+	interactive bool
+
+	// loadTest configures -mode=loadtest: ./cysl -mode=loadtest -connections=100 -rate=2
+	loadTest = client.DefaultLoadTestConfig()
 )
 
 // init runs before main() and sets up command-line flags
 func init() {
-	flag.StringVar(&mode, "mode", "server", "Run mode: server or client")
+	flag.StringVar(&mode, "mode", "server", "Run mode: server, client, loadtest or conformance")
+	flag.StringVar(&configPath, "config", "", "Server config file (YAML or JSON); environment variables override it")
+	flag.BoolVar(&interactive, "interactive", false, "Client mode: send lines typed on stdin and print replies as they arrive")
+	flag.IntVar(&loadTest.Connections, "connections", loadTest.Connections, "Loadtest mode: concurrent connections")
+	flag.Float64Var(&loadTest.Rate, "rate", loadTest.Rate, "Loadtest mode: messages per second per connection (0 = connect only)")
+	flag.DurationVar(&loadTest.Duration, "duration", loadTest.Duration, "Loadtest mode: how long to send after the ramp-up")
+	flag.DurationVar(&loadTest.RampUp, "ramp-up", loadTest.RampUp, "Loadtest mode: time over which connections are opened")
 	flag.Parse()
 }
 
@@ -32,6 +52,17 @@ func init() {
 // 2. Starts either server or client based on -mode flag
 // 3. Handles errors and ensures clean shutdown
 func main() {
+	// "config validate" checks the configuration and exits without starting
+	// anything, so CI/CD pipelines can reject bad configs before deploy
+	if flag.NArg() >= 2 && flag.Arg(0) == "config" && flag.Arg(1) == "validate" {
+		os.Exit(validateConfig())
+	}
+
+	// "replay" re-evaluates a recorded audit log against candidate settings
+	if flag.NArg() >= 1 && flag.Arg(0) == "replay" {
+		os.Exit(replayAuditLog(flag.Args()[1:]))
+	}
+
 	// Create context that listens for OS interrupt signals (Ctrl+C, SIGTERM)
 	// This enables graceful shutdown in both Docker and terminal environments
 	ctx, stop := signal.NotifyContext(context.Background(),
@@ -42,20 +73,183 @@ func main() {
 	// Route to appropriate mode based on flag
 	switch mode {
 	case "server":
-		log.Println("Starting in server mode...")
-		err = server.Start(ctx) // Start WebSocket server
+		cfg := loadServerConfig()
+		slog.Info("Starting in server mode")
+		defer server.DumpOnPanic()   // A panic leaves a crash dump behind
+		go reloadOnHangup(ctx)       // SIGHUP re-reads the access list file
+		go dumpOnQuit()              // SIGQUIT writes a crash dump and exits
+		err = server.Start(ctx, cfg) // Start WebSocket server
+	case "conformance":
+		cfg := loadServerConfig()
+		slog.Info("Starting in conformance mode (Autobahn echo endpoint)")
+		err = server.StartConformance(ctx, cfg) // Strict RFC 6455 echo server
 	case "client":
-		log.Println("Starting in client mode...")
-		err = client.Run(ctx) // Start WebSocket client
+		setupClientLogging()
+		slog.Info("Starting in client mode")
+		if interactive {
+			err = client.RunInteractive(ctx, os.Stdin, os.Stdout) // REPL on stdin/stdout
+		} else {
+			err = client.Run(ctx) // Start WebSocket client
+		}
+	case "loadtest":
+		setupClientLogging()
+		slog.Info("Starting in load test mode")
+		err = client.RunLoadTestFromEnv(ctx, loadTest, os.Stdout) // Report on stdout
 	default:
 		// Invalid mode - exit with error
-		log.Fatalf("Invalid mode: %s. Use 'server' or 'client'", mode)
+		fatal("Invalid mode - use 'server', 'client', 'loadtest' or 'conformance'", "mode", mode)
 	}
 
 	// Check for errors during execution
 	if err != nil {
-		log.Fatalf("Error: %v", err)
+		fatal("Error", "error", err)
 	}
 
-	log.Println("Application shutdown complete")
+	slog.Info("Application shutdown complete")
+}
+
+// setupClientLogging configures logging for the client modes. The client
+// has no config file - level and format come from the same variables the
+// server reads.
+func setupClientLogging() {
+	if err := logging.Setup(os.Stderr, logging.Settings{
+		Level:  os.Getenv("LOG_LEVEL"),
+		Format: os.Getenv("LOG_FORMAT"),
+	}); err != nil {
+		fatal("Invalid logging settings", "error", err)
+	}
+}
+
+// fatal logs an error and exits with status 1.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// reloadOnHangup re-reads the server's access list file on every SIGHUP
+// until ctx is cancelled.
+func reloadOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := server.ReloadAccessList(); err != nil {
+				slog.Error("Access list reload failed - keeping previous lists", "error", err)
+				continue
+			}
+			slog.Info("Access list reloaded", "via", "SIGHUP")
+		}
+	}
+}
+
+// dumpOnQuit replaces the runtime's SIGQUIT handling: instead of only
+// printing the goroutines to stderr, it writes a crash dump with the
+// server's state as well, then exits with the same status 2.
+func dumpOnQuit() {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGQUIT)
+	<-quit
+	path, err := server.WriteCrashDump("SIGQUIT")
+	if err != nil {
+		slog.Error("Crash dump failed", "error", err)
+	} else {
+		slog.Error("Crash dump written", "reason", "SIGQUIT", "path", path)
+	}
+	os.Exit(2)
+}
+
+// loadServerConfig loads the server config and sets up logging as it
+// says, or exits if it can't be parsed.
+func loadServerConfig() server.Config {
+	cfg, err := server.LoadConfig(configPath)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if err := server.ConfigureLogging(cfg.Log); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	return cfg
+}
+
+// validateConfig runs all server configuration validators and prints a
+// report. Returns the process exit code: 0 if valid, 1 otherwise.
+func validateConfig() int {
+	cfg, err := server.LoadConfig(configPath)
+	if err != nil {
+		fmt.Printf("Configuration invalid: %v\n", err)
+		return 1
+	}
+
+	errs := cfg.Validate()
+	if len(errs) == 0 {
+		fmt.Println("Configuration OK")
+		return 0
+	}
+
+	fmt.Printf("Configuration invalid (%d problem(s)):\n", len(errs))
+	for _, e := range errs {
+		fmt.Printf("  - %s: %s\n", e.Field, e.Problem)
+	}
+	return 1
+}
+
+// replayAuditLog implements the "replay" subcommand: it replays an audit log
+// against candidate limits and prints which decisions would change.
+// Usage: cysl replay -audit audit.jsonl [-max-conns-per-ip N] [-max-violations N] [-policy file]
+func replayAuditLog(args []string) int {
+	cfg := server.DefaultReplayConfig(loadServerConfig())
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	auditPath := fs.String("audit", "", "Audit log file (JSON lines) to replay")
+	policyPath := fs.String("policy", "", "Candidate geo policy file (optional)")
+	fs.IntVar(&cfg.MaxConnectionsPerIP, "max-conns-per-ip", cfg.MaxConnectionsPerIP, "Candidate per-IP connection limit")
+	fs.IntVar(&cfg.MaxViolations, "max-violations", cfg.MaxViolations, "Candidate rate-limit violation threshold")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *auditPath == "" {
+		fmt.Fprintln(os.Stderr, "replay: -audit is required")
+		return 2
+	}
+
+	if *policyPath != "" {
+		policy, err := server.LoadGeoPolicy(*policyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+			return 1
+		}
+		cfg.Policy = policy
+	}
+
+	f, err := os.Open(*auditPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	report, err := server.Replay(f, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("%-10s %10s %10s\n", "outcome", "recorded", "replayed")
+	for _, o := range []server.ReplayOutcome{server.OutcomeAccepted, server.OutcomeLimited,
+		server.OutcomeDenied, server.OutcomeKicked} {
+		fmt.Printf("%-10s %10d %10d\n", o, report.Original[o], report.Replayed[o])
+	}
+	if report.Skipped > 0 {
+		fmt.Printf("(%d unparseable line(s) skipped)\n", report.Skipped)
+	}
+
+	fmt.Printf("\n%d decision(s) would change:\n", len(report.Changes))
+	for _, c := range report.Changes {
+		fmt.Printf("  %s %s: %s -> %s %s\n", c.Event.Time.Format(time.RFC3339),
+			c.Event.RemoteAddr, c.Original, c.Replayed, c.Reason)
+	}
+	return 0
 }